@@ -0,0 +1,257 @@
+// Command tealis-check validates tealis persistence files offline: it reports where a
+// snapshot or AOF stops being valid, repairs an AOF whose last command was cut short,
+// summarizes the keys of a snapshot by type and compares two snapshots key by key.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"tealis/internal/storage"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `Usage:
+  tealis-check snapshot <file>      validate a snapshot and count its keys by type
+  tealis-check aof [-fix] <file>    validate an AOF; -fix truncates a command cut short at its end
+  tealis-check diff <file> <file>   compare two snapshots key by key
+`
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run runs a subcommand and returns the exit status: 0 when the files are fine or equal, 1
+// when they are not and 2 when the command line is wrong.
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+	fs := flag.NewFlagSet("tealis-check "+args[0], flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fix := fs.Bool("fix", false, "truncate an AOF whose last command was cut short")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	var err error
+	switch {
+	case args[0] == "snapshot" && fs.NArg() == 1 && !*fix:
+		err = checkSnapshot(fs.Arg(0), stdout)
+	case args[0] == "aof" && fs.NArg() == 1:
+		err = checkAOF(fs.Arg(0), *fix, stdout)
+	case args[0] == "diff" && fs.NArg() == 2 && !*fix:
+		err = diffSnapshots(fs.Arg(0), fs.Arg(1), stdout)
+	default:
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+	if err != nil {
+		if err != errFound {
+			fmt.Fprintf(stderr, "%v\n", err)
+		}
+		return 1
+	}
+	return 0
+}
+
+// errFound fails a check whose findings were already printed.
+var errFound = errors.New("")
+
+func inspect(path string) (*storage.SnapshotInfo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := storage.InspectSnapshot(data)
+	var corrupt *storage.CorruptError
+	if errors.As(err, &corrupt) {
+		return nil, fmt.Errorf("%s: corrupt at offset %d: %v", path, corrupt.Offset, corrupt)
+	}
+	return info, err
+}
+
+func checkSnapshot(path string, out io.Writer) error {
+	info, err := inspect(path)
+	if err != nil {
+		return err
+	}
+	format := "binary"
+	if info.Legacy {
+		format = "legacy JSON"
+	}
+	fmt.Fprintf(out, "%s: OK, %s snapshot, %d keys, %d bytes\n", path, format, len(info.Keys), info.Size)
+	if !info.Saved.IsZero() {
+		fmt.Fprintf(out, "saved at %s\n", info.Saved.UTC().Format(time.RFC3339))
+	}
+	if info.AOFBase != "" || info.AOFOffset > 0 {
+		fmt.Fprintf(out, "taken against AOF rewrite %q at %d bytes\n", info.AOFBase, info.AOFOffset)
+	}
+	printDatabases(info.Keys, out)
+	printTypes(info.Keys, out)
+	return nil
+}
+
+// printDatabases prints how many keys each database has, unless they are all in database 0.
+func printDatabases(keys []storage.SnapshotKey, out io.Writer) {
+	if len(keys) == 0 || keys[len(keys)-1].DB == 0 {
+		return
+	}
+	counts := make(map[int]int)
+	var dbs []int
+	for _, key := range keys {
+		if counts[key.DB] == 0 {
+			dbs = append(dbs, key.DB)
+		}
+		counts[key.DB]++
+	}
+	for _, db := range dbs {
+		fmt.Fprintf(out, "db%d: %d keys\n", db, counts[db])
+	}
+}
+
+// printTypes prints how many keys of each type there are, how many bytes they take and how
+// many of them expire.
+func printTypes(keys []storage.SnapshotKey, out io.Writer) {
+	type stats struct{ keys, bytes, expiring int }
+	byType := make(map[string]*stats)
+	var types []string
+	for _, key := range keys {
+		s, ok := byType[key.Type]
+		if !ok {
+			s = &stats{}
+			byType[key.Type] = s
+			types = append(types, key.Type)
+		}
+		s.keys++
+		s.bytes += key.Size
+		if !key.Expiry.IsZero() {
+			s.expiring++
+		}
+	}
+	sort.Strings(types)
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "type\tkeys\tbytes\texpiring\t")
+	for _, t := range types {
+		s := byType[t]
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t\n", t, s.keys, s.bytes, s.expiring)
+	}
+	w.Flush()
+}
+
+func checkAOF(path string, fix bool, out io.Writer) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	info, err := storage.CheckAOF(data)
+	var corrupt *storage.CorruptError
+	if errors.As(err, &corrupt) {
+		// Only a command cut short is safe to cut off; anything after a corruption may matter
+		return fmt.Errorf("%s: corrupt at offset %d: %v", path, corrupt.Offset, corrupt)
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.Preamble != nil {
+		fmt.Fprintf(out, "snapshot preamble: %d keys, %d bytes\n", len(info.Preamble.Keys), info.Preamble.Size)
+	}
+	if info.Base != "" {
+		fmt.Fprintf(out, "rewrite %q\n", info.Base)
+	}
+	if !info.Truncated() {
+		fmt.Fprintf(out, "%s: OK, %d commands, %d bytes\n", path, info.Commands, info.Size)
+		return nil
+	}
+
+	fmt.Fprintf(out, "%s: %d commands, then %d bytes cut short at offset %d\n", path, info.Commands, info.Size-info.ValidSize, info.ValidSize)
+	if !fix {
+		fmt.Fprintf(out, "run with -fix to truncate the AOF at offset %d\n", info.ValidSize)
+		return errFound
+	}
+	if err := os.Truncate(path, info.ValidSize); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%s: truncated to %d bytes\n", path, info.ValidSize)
+	return nil
+}
+
+// diffSnapshots prints the keys only one snapshot has (- and +) and the keys whose type,
+// value (~) or expiry (~ expiry) differ. Keys of databases other than 0 are prefixed with
+// their database.
+func diffSnapshots(pathA, pathB string, out io.Writer) error {
+	a, err := inspect(pathA)
+	if err != nil {
+		return err
+	}
+	b, err := inspect(pathB)
+	if err != nil {
+		return err
+	}
+
+	differ, keys := 0, 0
+	i, j := 0, 0
+	for ; i < len(a.Keys) || j < len(b.Keys); keys++ {
+		switch {
+		case j == len(b.Keys) || i < len(a.Keys) && keyBefore(a.Keys[i], b.Keys[j]):
+			fmt.Fprintf(out, "- %s (%s)\n", keyLabel(a.Keys[i]), a.Keys[i].Type)
+			i++
+			differ++
+		case i == len(a.Keys) || keyBefore(b.Keys[j], a.Keys[i]):
+			fmt.Fprintf(out, "+ %s (%s)\n", keyLabel(b.Keys[j]), b.Keys[j].Type)
+			j++
+			differ++
+		default:
+			ka, kb := a.Keys[i], b.Keys[j]
+			changed := true
+			switch {
+			case ka.Type != kb.Type:
+				fmt.Fprintf(out, "~ %s (%s -> %s)\n", keyLabel(ka), ka.Type, kb.Type)
+			case ka.Digest != kb.Digest:
+				fmt.Fprintf(out, "~ %s (%s)\n", keyLabel(ka), ka.Type)
+			case !ka.Expiry.Equal(kb.Expiry):
+				fmt.Fprintf(out, "~ %s expiry %s -> %s\n", keyLabel(ka), formatExpiry(ka.Expiry), formatExpiry(kb.Expiry))
+			default:
+				changed = false
+			}
+			if changed {
+				differ++
+			}
+			i++
+			j++
+		}
+	}
+	if differ > 0 {
+		fmt.Fprintf(out, "%d of %d keys differ\n", differ, keys)
+		return errFound
+	}
+	fmt.Fprintf(out, "snapshots hold the same %d keys\n", len(a.Keys))
+	return nil
+}
+
+// keyBefore reports whether a comes before b in the order snapshot keys are sorted in.
+func keyBefore(a, b storage.SnapshotKey) bool {
+	return a.DB < b.DB || a.DB == b.DB && a.Name < b.Name
+}
+
+// keyLabel names a key, prefixed with its database unless that is database 0.
+func keyLabel(key storage.SnapshotKey) string {
+	if key.DB == 0 {
+		return key.Name
+	}
+	return fmt.Sprintf("db%d:%s", key.DB, key.Name)
+}
+
+func formatExpiry(t time.Time) string {
+	if t.IsZero() {
+		return "none"
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
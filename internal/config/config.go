@@ -0,0 +1,655 @@
+// Package config holds the server settings. Settings come from, in increasing order of
+// precedence, the defaults, a config file, TEALIS_* environment variables and command line
+// flags, and some of them can be changed at runtime with CONFIG SET.
+package config
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"tealis/internal/logging"
+	"time"
+)
+
+// Config is a complete set of server settings. It is a plain value: copy it, change the
+// copy with Set and swap it in to change settings atomically.
+type Config struct {
+	// Listeners. A port of 0 disables the listener.
+	Bind         string
+	Port         int
+	WSPort       int
+	HTTPPort     int
+	FrontendPort int
+	FrontendDir  string
+
+	// Persistence
+	Dir               string // snapshot directory
+	AppendDir         string // AOF directory
+	AppendOnly        bool
+	AppendFsync       string     // always, everysec or no
+	SaveRules         []SaveRule // a snapshot is saved when any rule matches; none disables automatic saves
+	SnapshotRetention int        // timestamped snapshot generations kept besides the latest snapshot
+	AOFLoadTruncated  bool       // repair an AOF whose last command was cut short instead of refusing to start
+	// The AOF is rewritten once it grew by this percentage since the last rewrite (0 never
+	// rewrites it automatically) and is at least the minimum size
+	AutoAOFRewritePercentage int
+	AutoAOFRewriteMinSize    int64
+	AOFUseSnapshotPreamble   bool // rewrites write the data as a snapshot followed by the new commands
+	ACLFile                  string
+
+	// Keyspace
+	Databases int // number of databases SELECT chooses from
+
+	// Pub/sub
+	NotifyKeyspaceEvents KeyspaceEvents // keyspace notifications published; none by default
+
+	// Limits
+	MaxClients      int
+	Timeout         time.Duration // close idle clients after this long; 0 never does
+	ShutdownTimeout time.Duration // how long shutdown waits for running commands and requests
+
+	// Logging
+	LogLevel string
+	LogFile  string // empty logs to standard error
+
+	file string // the config file the settings were loaded from, for CONFIG REWRITE
+}
+
+// Default returns the settings the server used before it was configurable.
+func Default() Config {
+	return Config{
+		Port:                     6379,
+		WSPort:                   8080,
+		HTTPPort:                 8081,
+		FrontendPort:             8000,
+		FrontendDir:              "./public",
+		Dir:                      "./snapshot",
+		AppendDir:                "./snapshot",
+		AppendOnly:               true,
+		AppendFsync:              "everysec",
+		SaveRules:                []SaveRule{{3600 * time.Second, 1}, {300 * time.Second, 100}, {60 * time.Second, 10000}},
+		SnapshotRetention:        5,
+		AOFLoadTruncated:         true,
+		AutoAOFRewritePercentage: 100,
+		AutoAOFRewriteMinSize:    64 << 20,
+		Databases:                16,
+		ACLFile:                  "./snapshot/users.acl",
+		MaxClients:               10000,
+		ShutdownTimeout:          10 * time.Second,
+		LogLevel:                 "notice",
+	}
+}
+
+// param describes one setting: how to read and write it and whether CONFIG SET may change it.
+type param struct {
+	name    string
+	usage   string
+	mutable bool
+	get     func(c *Config) string
+	set     func(c *Config, value string) error
+
+	// Settings that may be repeated in a config file, like save, add every line after the
+	// first to the value with add, and values returns the lines the file is rewritten with
+	add    func(c *Config, value string) error
+	values func(c *Config) []string
+}
+
+var params = []param{
+	stringParam("bind", "address the listeners bind to (all interfaces when empty)", false, func(c *Config) *string { return &c.Bind }),
+	intParam("port", "RESP (TCP) port", false, 0, 65535, func(c *Config) *int { return &c.Port }),
+	intParam("ws-port", "WebSocket port", false, 0, 65535, func(c *Config) *int { return &c.WSPort }),
+	intParam("http-port", "HTTP command API port", false, 0, 65535, func(c *Config) *int { return &c.HTTPPort }),
+	intParam("frontend-port", "web frontend port", false, 0, 65535, func(c *Config) *int { return &c.FrontendPort }),
+	stringParam("frontend-dir", "directory the web frontend is served from", false, func(c *Config) *string { return &c.FrontendDir }),
+	stringParam("dir", "snapshot directory", false, func(c *Config) *string { return &c.Dir }),
+	stringParam("appenddir", "AOF directory", false, func(c *Config) *string { return &c.AppendDir }),
+	boolParam("appendonly", "log every write to the AOF", true, func(c *Config) *bool { return &c.AppendOnly }),
+	enumParam("appendfsync", "when the AOF is fsynced: always, everysec or no", true, []string{"always", "everysec", "no"}, func(c *Config) *string { return &c.AppendFsync }),
+	{
+		name: "save", usage: "save rules as <seconds> <changes> pairs: save when that many writes happened within that many seconds (empty disables them)", mutable: true,
+		get: func(c *Config) string { return formatSaveRules(c.SaveRules) },
+		set: func(c *Config, value string) error {
+			rules, err := parseSaveRules(value)
+			if err != nil {
+				return err
+			}
+			c.SaveRules = rules
+			return nil
+		},
+		add: func(c *Config, value string) error {
+			rules, err := parseSaveRules(value)
+			if err != nil {
+				return err
+			}
+			if len(rules) == 0 {
+				c.SaveRules = nil // save "" clears the rules of the earlier lines
+				return nil
+			}
+			c.SaveRules = append(c.SaveRules, rules...)
+			return nil
+		},
+		values: func(c *Config) []string {
+			if len(c.SaveRules) == 0 {
+				return []string{""}
+			}
+			values := make([]string, len(c.SaveRules))
+			for i, rule := range c.SaveRules {
+				values[i] = formatSaveRules([]SaveRule{rule})
+			}
+			return values
+		},
+	},
+	intParam("snapshot-retention", "number of timestamped snapshot generations kept for RESTORE (0 keeps none)", true, 0, 1<<20, func(c *Config) *int { return &c.SnapshotRetention }),
+	boolParam("aof-load-truncated", "truncate an AOF whose last command was cut short instead of refusing to start", false, func(c *Config) *bool { return &c.AOFLoadTruncated }),
+	intParam("auto-aof-rewrite-percentage", "AOF growth since the last rewrite, in percent, that triggers a rewrite (0 disables it)", true, 0, 1<<20, func(c *Config) *int { return &c.AutoAOFRewritePercentage }),
+	bytesParam("auto-aof-rewrite-min-size", "smallest AOF size an automatic rewrite happens at, in bytes or with a kb, mb or gb unit", true, func(c *Config) *int64 { return &c.AutoAOFRewriteMinSize }),
+	boolParam("aof-use-snapshot-preamble", "write the data as a binary snapshot at the start of a rewritten AOF, which loads faster", true, func(c *Config) *bool { return &c.AOFUseSnapshotPreamble }),
+	intParam("databases", "number of databases, numbered from 0", false, 1, 1<<16, func(c *Config) *int { return &c.Databases }),
+	{
+		name: "notify-keyspace-events", usage: "keyspace notifications to publish, as flags such as KEA or Egx (empty publishes none)", mutable: true,
+		get: func(c *Config) string { return c.NotifyKeyspaceEvents.String() },
+		set: func(c *Config, value string) error {
+			events, err := ParseKeyspaceEvents(value)
+			if err != nil {
+				return err
+			}
+			c.NotifyKeyspaceEvents = events
+			return nil
+		},
+	},
+	stringParam("aclfile", "ACL users file", false, func(c *Config) *string { return &c.ACLFile }),
+	intParam("maxclients", "maximum number of connected clients", true, 1, 1<<20, func(c *Config) *int { return &c.MaxClients }),
+	secondsParam("timeout", "seconds after which an idle client is closed (0 disables it)", true, func(c *Config) *time.Duration { return &c.Timeout }),
+	secondsParam("shutdown-timeout", "seconds shutdown waits for running commands and requests", true, func(c *Config) *time.Duration { return &c.ShutdownTimeout }),
+	{
+		name: "loglevel", usage: "debug, verbose, notice or warning", mutable: true,
+		get: func(c *Config) string { return c.LogLevel },
+		set: func(c *Config, value string) error {
+			if _, err := logging.ParseLevel(value); err != nil {
+				return err
+			}
+			c.LogLevel = strings.ToLower(value)
+			return nil
+		},
+	},
+	stringParam("logfile", "file the log is written to (standard error when empty)", false, func(c *Config) *string { return &c.LogFile }),
+}
+
+func lookup(name string) (*param, bool) {
+	for i := range params {
+		if strings.EqualFold(params[i].name, name) {
+			return &params[i], true
+		}
+	}
+	return nil, false
+}
+
+func stringParam(name, usage string, mutable bool, field func(*Config) *string) param {
+	return param{
+		name: name, usage: usage, mutable: mutable,
+		get: func(c *Config) string { return *field(c) },
+		set: func(c *Config, value string) error { *field(c) = value; return nil },
+	}
+}
+
+func intParam(name, usage string, mutable bool, min, max int, field func(*Config) *int) param {
+	return param{
+		name: name, usage: usage, mutable: mutable,
+		get: func(c *Config) string { return strconv.Itoa(*field(c)) },
+		set: func(c *Config, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < min || n > max {
+				return fmt.Errorf("argument must be between %d and %d inclusive", min, max)
+			}
+			*field(c) = n
+			return nil
+		},
+	}
+}
+
+func boolParam(name, usage string, mutable bool, field func(*Config) *bool) param {
+	return param{
+		name: name, usage: usage, mutable: mutable,
+		get: func(c *Config) string {
+			if *field(c) {
+				return "yes"
+			}
+			return "no"
+		},
+		set: func(c *Config, value string) error {
+			switch strings.ToLower(value) {
+			case "yes":
+				*field(c) = true
+			case "no":
+				*field(c) = false
+			default:
+				return fmt.Errorf("argument must be 'yes' or 'no'")
+			}
+			return nil
+		},
+	}
+}
+
+func enumParam(name, usage string, mutable bool, values []string, field func(*Config) *string) param {
+	return param{
+		name: name, usage: usage, mutable: mutable,
+		get: func(c *Config) string { return *field(c) },
+		set: func(c *Config, value string) error {
+			for _, v := range values {
+				if strings.EqualFold(v, value) {
+					*field(c) = v
+					return nil
+				}
+			}
+			return fmt.Errorf("argument must be one of %s", strings.Join(values, ", "))
+		},
+	}
+}
+
+func secondsParam(name, usage string, mutable bool, field func(*Config) *time.Duration) param {
+	return param{
+		name: name, usage: usage, mutable: mutable,
+		get: func(c *Config) string { return strconv.FormatInt(int64(*field(c)/time.Second), 10) },
+		set: func(c *Config, value string) error {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 0 {
+				return fmt.Errorf("argument couldn't be parsed into an integer")
+			}
+			*field(c) = time.Duration(n) * time.Second
+			return nil
+		},
+	}
+}
+
+func bytesParam(name, usage string, mutable bool, field func(*Config) *int64) param {
+	return param{
+		name: name, usage: usage, mutable: mutable,
+		get: func(c *Config) string { return strconv.FormatInt(*field(c), 10) },
+		set: func(c *Config, value string) error {
+			n, err := parseBytes(value)
+			if err != nil {
+				return err
+			}
+			*field(c) = n
+			return nil
+		},
+	}
+}
+
+// byteUnits are the memory units Redis accepts: k, m and g are powers of 1000, kb, mb and gb
+// powers of 1024.
+var byteUnits = []struct {
+	suffix string
+	factor int64
+}{
+	{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+	{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+	{"b", 1},
+}
+
+// parseBytes parses a size such as 64mb into bytes.
+func parseBytes(value string) (int64, error) {
+	number, factor := strings.ToLower(value), int64(1)
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(number, unit.suffix) {
+			number, factor = strings.TrimSuffix(number, unit.suffix), unit.factor
+			break
+		}
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("argument must be a memory value")
+	}
+	return n * factor, nil
+}
+
+// SaveRule saves a snapshot once at least Changes writes happened and Period passed since
+// the last save.
+type SaveRule struct {
+	Period  time.Duration
+	Changes int64
+}
+
+// parseSaveRules parses save rules written as "<seconds> <changes>" pairs, such as
+// "3600 1 300 100".
+func parseSaveRules(value string) ([]SaveRule, error) {
+	fields := strings.Fields(value)
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("Invalid save parameters")
+	}
+	rules := make([]SaveRule, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil || seconds < 1 {
+			return nil, fmt.Errorf("Invalid save parameters")
+		}
+		changes, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil || changes < 1 {
+			return nil, fmt.Errorf("Invalid save parameters")
+		}
+		rules = append(rules, SaveRule{time.Duration(seconds) * time.Second, changes})
+	}
+	return rules, nil
+}
+
+func formatSaveRules(rules []SaveRule) string {
+	fields := make([]string, 0, 2*len(rules))
+	for _, rule := range rules {
+		fields = append(fields, strconv.FormatInt(int64(rule.Period/time.Second), 10), strconv.FormatInt(rule.Changes, 10))
+	}
+	return strings.Join(fields, " ")
+}
+
+// KeyspaceEvents selects the keyspace notifications to publish. K and E choose the channels,
+// __keyspace@<db>__:<key> and __keyevent@<db>__:<event>, and the other flags the classes of
+// events published on them.
+type KeyspaceEvents int
+
+const (
+	NotifyKeyspace KeyspaceEvents = 1 << iota // K
+	NotifyKeyevent                            // E
+	NotifyGeneric                             // g: DEL, EXPIRE and other commands on keys of any type
+	NotifyString                              // $
+	NotifyList                                // l
+	NotifySet                                 // s
+	NotifyHash                                // h
+	NotifyZSet                                // z
+	NotifyExpired                             // x: a key expired
+	NotifyEvicted                             // e: a key was evicted
+	NotifyStream                              // t
+	NotifyKeyMiss                             // m: a read found no key
+	NotifyModule                              // d: JSON, time series and vector commands
+	NotifyNew                                 // n: a write created a key
+
+	// NotifyAll is A, every class but the key miss and new key events
+	NotifyAll = NotifyGeneric | NotifyString | NotifyList | NotifySet | NotifyHash | NotifyZSet |
+		NotifyExpired | NotifyEvicted | NotifyStream | NotifyModule
+)
+
+// keyspaceEventFlags are the flags of the classes in the order String writes them.
+var keyspaceEventFlags = []struct {
+	flag  byte
+	event KeyspaceEvents
+}{
+	{'g', NotifyGeneric}, {'$', NotifyString}, {'l', NotifyList}, {'s', NotifySet}, {'h', NotifyHash},
+	{'z', NotifyZSet}, {'x', NotifyExpired}, {'e', NotifyEvicted}, {'t', NotifyStream}, {'d', NotifyModule},
+	{'K', NotifyKeyspace}, {'E', NotifyKeyevent}, {'m', NotifyKeyMiss}, {'n', NotifyNew},
+}
+
+// ParseKeyspaceEvents parses notify-keyspace-events flags such as "KEA". Nothing is
+// published unless the flags select a channel, K or E, and at least one class.
+func ParseKeyspaceEvents(value string) (KeyspaceEvents, error) {
+	var events KeyspaceEvents
+	for i := 0; i < len(value); i++ {
+		if value[i] == 'A' {
+			events |= NotifyAll
+			continue
+		}
+		known := false
+		for _, f := range keyspaceEventFlags {
+			if value[i] == f.flag {
+				events |= f.event
+				known = true
+				break
+			}
+		}
+		if !known {
+			return 0, fmt.Errorf("Invalid event class character. Use 'Ag$lshzxeKEtmdn'.")
+		}
+	}
+	return events, nil
+}
+
+// String returns the flags of events the way CONFIG GET shows them.
+func (events KeyspaceEvents) String() string {
+	var flags []byte
+	for _, f := range keyspaceEventFlags {
+		if f.event&NotifyAll != 0 && events&NotifyAll == NotifyAll {
+			continue
+		}
+		if events&f.event != 0 {
+			flags = append(flags, f.flag)
+		}
+	}
+	if events&NotifyAll == NotifyAll {
+		flags = append([]byte{'A'}, flags...)
+	}
+	return string(flags)
+}
+
+// Names returns the names of all settings, sorted.
+func Names() []string {
+	names := make([]string, len(params))
+	for i, p := range params {
+		names[i] = p.name
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Get returns the value of a setting the way CONFIG GET and the config file write it.
+func (c *Config) Get(name string) (string, bool) {
+	p, ok := lookup(name)
+	if !ok {
+		return "", false
+	}
+	return p.get(c), true
+}
+
+// Set changes a setting, whether or not it can be changed at runtime.
+func (c *Config) Set(name, value string) error {
+	p, ok := lookup(name)
+	if !ok {
+		return fmt.Errorf("unknown option or number of arguments for CONFIG SET - '%s'", name)
+	}
+	return p.set(c, value)
+}
+
+// Mutable reports whether CONFIG SET may change a setting while the server runs.
+func Mutable(name string) bool {
+	p, ok := lookup(name)
+	return ok && p.mutable
+}
+
+// File returns the config file the settings were loaded from, if any.
+func (c *Config) File() string {
+	return c.file
+}
+
+// Load returns the defaults overridden by the settings in a config file.
+func Load(path string) (Config, error) {
+	c := Default()
+	if err := c.loadFile(path); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// loadFile reads "name value" lines. Blank lines and lines starting with # are ignored,
+// and values may be double quoted. A repeated setting replaces the earlier value, except
+// for save, whose lines add up the way they do in redis.conf.
+func (c *Config) loadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		name, value, ok, err := parseLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, lineNo, err)
+		}
+		if !ok {
+			continue
+		}
+		if p, known := lookup(name); known && p.add != nil && seen[p.name] {
+			err = p.add(c, value)
+		} else {
+			err = c.Set(name, value)
+		}
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, lineNo, err)
+		}
+		seen[name] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	c.file = path
+	return nil
+}
+
+// parseLine splits a config file line into a setting and its value. ok is false for blank
+// lines and comments.
+func parseLine(line string) (name, value string, ok bool, err error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", false, nil
+	}
+	name, value, _ = strings.Cut(line, " ")
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, `"`) {
+		if value, err = strconv.Unquote(value); err != nil {
+			return "", "", false, fmt.Errorf("invalid quoted value for '%s'", name)
+		}
+	}
+	return strings.ToLower(name), value, true, nil
+}
+
+// FromArgs builds the settings for a server started with the given command line. The
+// config file is named by -config or the first positional argument. Every setting can be
+// given as a flag (-port 6380) or an environment variable (TEALIS_PORT=6380); flags win
+// over the environment, which wins over the file.
+func FromArgs(args []string, getenv func(string) string, output io.Writer) (Config, error) {
+	fs := flag.NewFlagSet("tealis", flag.ContinueOnError)
+	fs.SetOutput(output)
+	path := fs.String("config", "", "config file")
+	type override struct{ name, value string }
+	var flags []override
+	for _, p := range params {
+		name := p.name
+		fs.Func(name, p.usage, func(value string) error {
+			flags = append(flags, override{name, value})
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+	if *path == "" && fs.NArg() > 0 {
+		*path = fs.Arg(0)
+	}
+
+	c := Default()
+	if *path != "" {
+		if err := c.loadFile(*path); err != nil {
+			return c, err
+		}
+	}
+	for _, p := range params {
+		if value := getenv(EnvName(p.name)); value != "" {
+			if err := c.Set(p.name, value); err != nil {
+				return c, fmt.Errorf("%s: %v", EnvName(p.name), err)
+			}
+		}
+	}
+	for _, f := range flags {
+		if err := c.Set(f.name, f.value); err != nil {
+			return c, fmt.Errorf("-%s: %v", f.name, err)
+		}
+	}
+	return c, nil
+}
+
+// EnvName returns the environment variable that overrides a setting.
+func EnvName(name string) string {
+	return "TEALIS_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// Rewrite writes the current settings back to the config file they were loaded from.
+// Comments and the order of the existing lines are kept: settings already in the file are
+// updated in place and other settings that differ from the defaults are appended.
+func (c *Config) Rewrite() error {
+	if c.file == "" {
+		return fmt.Errorf("The server is running without a config file")
+	}
+	data, err := os.ReadFile(c.file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	written := make(map[string]bool)
+	var lines []string
+	if len(data) > 0 {
+		for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+			name, _, ok, _ := parseLine(line)
+			if !ok {
+				lines = append(lines, line)
+				continue
+			}
+			p, known := lookup(name)
+			if !known {
+				lines = append(lines, line)
+				continue
+			}
+			// Settings repeated in the file are written where they first appear
+			if written[p.name] {
+				continue
+			}
+			written[p.name] = true
+			lines = append(lines, formatLines(p, c)...)
+		}
+	}
+	defaults := Default()
+	for _, p := range params {
+		if !written[p.name] && p.get(c) != p.get(&defaults) {
+			lines = append(lines, formatLines(&p, c)...)
+		}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(c.file), ".tealis-conf-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.file)
+}
+
+// formatLines returns the config file lines of a setting, one per value of a repeatable one.
+func formatLines(p *param, c *Config) []string {
+	if p.values == nil {
+		return []string{formatLine(p.name, p.get(c))}
+	}
+	var lines []string
+	for _, value := range p.values(c) {
+		if value == "" {
+			lines = append(lines, formatLine(p.name, value))
+			continue
+		}
+		lines = append(lines, p.name+" "+value) // save 900 1, unquoted like redis.conf
+	}
+	return lines
+}
+
+func formatLine(name, value string) string {
+	if value == "" || strings.ContainsAny(value, " \t\"#") {
+		value = strconv.Quote(value)
+	}
+	return name + " " + value
+}
@@ -0,0 +1,60 @@
+// Package logging filters the server log by the configured loglevel. Messages at notice
+// level and above go through the standard log package as before.
+package logging
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// Levels, from the most to the least verbose, named as in the loglevel setting.
+const (
+	Debug int32 = iota
+	Verbose
+	Notice
+	Warning
+)
+
+var levelNames = []string{"debug", "verbose", "notice", "warning"}
+
+var level atomic.Int32
+
+func init() {
+	level.Store(Notice)
+}
+
+// ParseLevel converts a loglevel name to its level.
+func ParseLevel(name string) (int32, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(n, name) {
+			return int32(i), nil
+		}
+	}
+	return 0, fmt.Errorf("argument must be one of %s", strings.Join(levelNames, ", "))
+}
+
+// SetLevel changes the minimum level that is logged.
+func SetLevel(l int32) {
+	level.Store(l)
+}
+
+// Enabled reports whether messages at the given level are logged.
+func Enabled(l int32) bool {
+	return l >= level.Load()
+}
+
+// Debugf logs per-request detail, such as every command received.
+func Debugf(format string, args ...interface{}) {
+	if Enabled(Debug) {
+		log.Printf(format, args...)
+	}
+}
+
+// Verbosef logs events that are useful when diagnosing a problem, such as connections.
+func Verbosef(format string, args ...interface{}) {
+	if Enabled(Verbose) {
+		log.Printf(format, args...)
+	}
+}
@@ -1,16 +1,40 @@
 package protocol
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
+const (
+	// MaxBulkLength caps a single bulk argument, matching Redis' proto-max-bulk-len default.
+	MaxBulkLength = 512 * 1024 * 1024
+	// MaxMultiBulkLength caps the number of arguments in one request.
+	MaxMultiBulkLength = 1024 * 1024
+	// MaxInlineLength caps an inline (telnet style) request line.
+	MaxInlineLength = 64 * 1024
+)
+
+// ErrIncomplete is returned by ParseRequest when the buffer does not hold a full request yet.
+var ErrIncomplete = errors.New("incomplete request")
+
+// ProtocolError describes a malformed request. The connection should be closed after it is reported.
+type ProtocolError struct {
+	Msg string
+}
+
+func (e *ProtocolError) Error() string {
+	return "Protocol error: " + e.Msg
+}
+
+var inlineTokens = regexp.MustCompile(`"([^"]*)"|'([^']*)'|[^\s]+`)
+
 func ParseCommand(input string) []string {
 	// Regular expression to match words or quoted strings (single or double quotes)
-	re := regexp.MustCompile(`"([^"]*)"|'([^']*)'|[^\s]+`)
-	fmt.Printf("input %s", input)
-	matches := re.FindAllString(input, -1)
+	matches := inlineTokens.FindAllString(input, -1)
 	var parts []string
 	for _, match := range matches {
 		// Remove the surrounding quotes if present
@@ -19,3 +43,105 @@ func ParseCommand(input string) []string {
 	}
 	return parts
 }
+
+// ParseRequest reads one request from the start of buf and returns its arguments together
+// with the number of bytes consumed. RESP multi-bulk requests ("*<n>\r\n$<len>\r\n...") are
+// binary safe; anything else is treated as an inline command terminated by a newline.
+// An empty inline line yields nil args with a non-zero n so the caller can skip it.
+func ParseRequest(buf []byte) ([]string, int, error) {
+	if len(buf) == 0 {
+		return nil, 0, ErrIncomplete
+	}
+	if buf[0] == '*' {
+		return parseMultiBulk(buf)
+	}
+	return parseInline(buf)
+}
+
+func parseMultiBulk(buf []byte) ([]string, int, error) {
+	count, pos, err := readLength(buf, 0, '*', MaxMultiBulkLength, "invalid multibulk length")
+	if err != nil {
+		return nil, 0, err
+	}
+	if count <= 0 {
+		return nil, pos, nil
+	}
+
+	args := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		if pos >= len(buf) {
+			return nil, 0, ErrIncomplete
+		}
+		if buf[pos] != '$' {
+			return nil, 0, &ProtocolError{Msg: fmt.Sprintf("expected '$', got '%c'", buf[pos])}
+		}
+		size, next, err := readLength(buf, pos, '$', MaxBulkLength, "invalid bulk length")
+		if err != nil {
+			return nil, 0, err
+		}
+		if size < 0 {
+			return nil, 0, &ProtocolError{Msg: "invalid bulk length"}
+		}
+		end := next + size
+		if end+2 > len(buf) {
+			return nil, 0, ErrIncomplete
+		}
+		if buf[end] != '\r' || buf[end+1] != '\n' {
+			return nil, 0, &ProtocolError{Msg: "bulk string is not terminated by CRLF"}
+		}
+		args = append(args, string(buf[next:end]))
+		pos = end + 2
+	}
+	return args, pos, nil
+}
+
+// readLength parses a "<prefix><int>\r\n" header starting at pos and returns the integer
+// and the position right after the CRLF.
+func readLength(buf []byte, pos int, prefix byte, limit int, msg string) (int, int, error) {
+	idx := bytes.IndexByte(buf[pos:], '\n')
+	if idx < 0 {
+		if len(buf)-pos > 32 {
+			return 0, 0, &ProtocolError{Msg: msg}
+		}
+		return 0, 0, ErrIncomplete
+	}
+	line := buf[pos+1 : pos+idx]
+	if len(line) == 0 || line[len(line)-1] != '\r' {
+		return 0, 0, &ProtocolError{Msg: msg}
+	}
+	n, err := strconv.Atoi(string(line[:len(line)-1]))
+	if err != nil || n > limit {
+		return 0, 0, &ProtocolError{Msg: msg}
+	}
+	return n, pos + idx + 1, nil
+}
+
+func parseInline(buf []byte) ([]string, int, error) {
+	idx := bytes.IndexByte(buf, '\n')
+	if idx < 0 {
+		if len(buf) > MaxInlineLength {
+			return nil, 0, &ProtocolError{Msg: "too big inline request"}
+		}
+		return nil, 0, ErrIncomplete
+	}
+	line := strings.TrimSpace(string(cleanBackspaces(buf[:idx])))
+	if line == "" {
+		return nil, idx + 1, nil
+	}
+	return ParseCommand(line), idx + 1, nil
+}
+
+// cleanBackspaces applies backspace characters typed in interactive sessions.
+func cleanBackspaces(data []byte) []byte {
+	var result []byte
+	for _, b := range data {
+		if b == '\b' { // Check for backspace character
+			if len(result) > 0 {
+				result = result[:len(result)-1] // Remove the last byte if present
+			}
+		} else {
+			result = append(result, b) // Append the current byte
+		}
+	}
+	return result
+}
@@ -0,0 +1,106 @@
+package protocol
+
+import "fmt"
+
+// Reply is a typed server reply. Handlers build replies from these types and the
+// connection encodes them for the wire format the client speaks.
+type Reply interface {
+	reply()
+}
+
+// SimpleString is a short, non binary-safe status reply such as OK or QUEUED.
+type SimpleString string
+
+// Error is an error reply. By convention it starts with an upper-case error code,
+// e.g. "ERR syntax error" or "WRONGTYPE Operation against a key holding the wrong kind of value".
+type Error string
+
+// Integer is a signed 64-bit integer reply.
+type Integer int64
+
+// BulkString is a binary-safe string reply.
+type BulkString string
+
+// Null is the absence of a value (a missing key, an empty pop, ...).
+type Null struct{}
+
+// NullArray is the absence of an array, e.g. an EXEC aborted by WATCH.
+type NullArray struct{}
+
+// Array is an ordered collection of replies.
+type Array []Reply
+
+// MapEntry is one key/value pair of a Map reply.
+type MapEntry struct {
+	Key   Reply
+	Value Reply
+}
+
+// Map is an ordered collection of key/value pairs (a hash, a stream entry, ...).
+type Map []MapEntry
+
+// Set is an unordered collection of unique replies.
+type Set []Reply
+
+// Double is a floating point reply (a score, a distance, a sample value, ...).
+type Double float64
+
+// Push is an out-of-band message sent to the client, such as a pub/sub message.
+type Push []Reply
+
+func (SimpleString) reply() {}
+func (Error) reply()        {}
+func (Integer) reply()      {}
+func (BulkString) reply()   {}
+func (Null) reply()         {}
+func (NullArray) reply()    {}
+func (Array) reply()        {}
+func (Map) reply()          {}
+func (Set) reply()          {}
+func (Double) reply()       {}
+func (Push) reply()         {}
+
+// OK is the common "+OK" status reply.
+var OK = SimpleString("OK")
+
+// Errorf builds an "ERR ..." error reply.
+func Errorf(format string, args ...interface{}) Error {
+	return Error("ERR " + fmt.Sprintf(format, args...))
+}
+
+// WrongArgs builds the standard wrong-arity error for a command.
+func WrongArgs(command string) Error {
+	return Errorf("wrong number of arguments for '%s' command", command)
+}
+
+// StringArray converts a slice of strings into an array of bulk strings.
+func StringArray(items []string) Array {
+	arr := make(Array, len(items))
+	for i, item := range items {
+		arr[i] = BulkString(item)
+	}
+	return arr
+}
+
+// StringSet converts a slice of strings into a set of bulk strings.
+func StringSet(items []string) Set {
+	set := make(Set, len(items))
+	for i, item := range items {
+		set[i] = BulkString(item)
+	}
+	return set
+}
+
+// Bool converts a boolean into the 1/0 integer reply Redis uses for predicates.
+func Bool(b bool) Integer {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// IsError reports whether a reply is an error reply.
+func IsError(r Reply) bool {
+	_, ok := r.(Error)
+	return ok
+}
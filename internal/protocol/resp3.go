@@ -0,0 +1,43 @@
+package protocol
+
+import "strconv"
+
+// EncodeRESP3 serializes a reply using RESP3, keeping maps, sets, doubles, nulls and
+// push messages as their native RESP3 types.
+func EncodeRESP3(r Reply) []byte {
+	return AppendRESP3(nil, r)
+}
+
+// AppendRESP3 appends the RESP3 encoding of a reply to dst.
+func AppendRESP3(dst []byte, r Reply) []byte {
+	switch v := r.(type) {
+	case Null, NullArray, nil:
+		return append(dst, "_\r\n"...)
+	case Array:
+		return appendAggregate(dst, '*', v)
+	case Set:
+		return appendAggregate(dst, '~', v)
+	case Push:
+		return appendAggregate(dst, '>', v)
+	case Map:
+		dst = appendLine(dst, '%', strconv.Itoa(len(v)))
+		for _, entry := range v {
+			dst = AppendRESP3(dst, entry.Key)
+			dst = AppendRESP3(dst, entry.Value)
+		}
+		return dst
+	case Double:
+		return appendLine(dst, ',', FormatDouble(float64(v)))
+	default:
+		// Simple strings, errors, integers and bulk strings are identical in both versions
+		return AppendRESP2(dst, r)
+	}
+}
+
+func appendAggregate(dst []byte, prefix byte, items []Reply) []byte {
+	dst = appendLine(dst, prefix, strconv.Itoa(len(items)))
+	for _, item := range items {
+		dst = AppendRESP3(dst, item)
+	}
+	return dst
+}
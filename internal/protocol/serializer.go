@@ -1,5 +1,107 @@
 package protocol
 
-func SerializeResponse(response string) string {
-	return response + "\r\n"
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Protocol versions negotiated with HELLO.
+const (
+	RESP2 = 2
+	RESP3 = 3
+)
+
+// Encode serializes a reply for the given protocol version.
+func Encode(r Reply, version int) []byte {
+	return Append(nil, r, version)
+}
+
+// Append appends the encoding of a reply for the given protocol version to dst.
+func Append(dst []byte, r Reply, version int) []byte {
+	if version == RESP3 {
+		return AppendRESP3(dst, r)
+	}
+	return AppendRESP2(dst, r)
+}
+
+// EncodeRESP2 serializes a reply using RESP2. Types that only exist in RESP3 are
+// downgraded the same way Redis does: maps and sets become flat arrays, doubles
+// become bulk strings and push messages become plain arrays.
+func EncodeRESP2(r Reply) []byte {
+	return AppendRESP2(nil, r)
+}
+
+// AppendRESP2 appends the RESP2 encoding of a reply to dst.
+func AppendRESP2(dst []byte, r Reply) []byte {
+	switch v := r.(type) {
+	case SimpleString:
+		return appendLine(dst, '+', sanitizeLine(string(v)))
+	case Error:
+		return appendLine(dst, '-', sanitizeLine(string(v)))
+	case Integer:
+		return appendLine(dst, ':', strconv.FormatInt(int64(v), 10))
+	case BulkString:
+		return appendBulk(dst, string(v))
+	case Null:
+		return append(dst, "$-1\r\n"...)
+	case NullArray:
+		return append(dst, "*-1\r\n"...)
+	case Array:
+		dst = appendLine(dst, '*', strconv.Itoa(len(v)))
+		for _, item := range v {
+			dst = AppendRESP2(dst, item)
+		}
+		return dst
+	case Set:
+		return AppendRESP2(dst, Array(v))
+	case Push:
+		return AppendRESP2(dst, Array(v))
+	case Map:
+		dst = appendLine(dst, '*', strconv.Itoa(len(v)*2))
+		for _, entry := range v {
+			dst = AppendRESP2(dst, entry.Key)
+			dst = AppendRESP2(dst, entry.Value)
+		}
+		return dst
+	case Double:
+		return appendBulk(dst, FormatDouble(float64(v)))
+	case nil:
+		return append(dst, "$-1\r\n"...)
+	default:
+		return appendLine(dst, '-', "ERR unsupported reply type")
+	}
+}
+
+// FormatDouble renders a float the way Redis prints scores and other doubles.
+func FormatDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func appendLine(dst []byte, prefix byte, line string) []byte {
+	dst = append(dst, prefix)
+	dst = append(dst, line...)
+	return append(dst, '\r', '\n')
+}
+
+func appendBulk(dst []byte, s string) []byte {
+	dst = appendLine(dst, '$', strconv.Itoa(len(s)))
+	dst = append(dst, s...)
+	return append(dst, '\r', '\n')
+}
+
+// sanitizeLine keeps simple strings and errors on a single line, as the protocol requires.
+func sanitizeLine(s string) string {
+	if strings.ContainsAny(s, "\r\n") {
+		return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+	}
+	return s
 }
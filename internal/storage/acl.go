@@ -0,0 +1,616 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"tealis/internal/protocol"
+)
+
+// User is an ACL user: the credentials it authenticates with and what it may run.
+type User struct {
+	Name    string
+	Enabled bool
+	NoPass  bool
+
+	passwords map[string]struct{} // SHA-256 hex digests
+	// commands maps a command name (or "name|subcommand") to whether it is allowed
+	commands     map[string]bool
+	commandRules []string // +/- rules in the order they were applied, for ACL LIST
+	keyPatterns  []string
+	channels     []string
+}
+
+// ACL holds the users known to the server.
+type ACL struct {
+	mu    sync.RWMutex
+	users map[string]*User
+	file  string
+}
+
+func newACL() *ACL {
+	acl := &ACL{users: make(map[string]*User)}
+	acl.users["default"] = defaultUser()
+	return acl
+}
+
+// defaultUser is the user connections start as: no password, every command, every key.
+func defaultUser() *User {
+	u := newUser("default")
+	for _, rule := range []string{"on", "nopass", "~*", "&*", "+@all"} {
+		u.applyRule(rule)
+	}
+	return u
+}
+
+// newUser creates a user that is disabled and cannot run anything, like ACL SETUSER does.
+func newUser(name string) *User {
+	return &User{
+		Name:      name,
+		passwords: make(map[string]struct{}),
+		commands:  make(map[string]bool),
+	}
+}
+
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// applyRule applies one ACL SETUSER rule to the user.
+func (u *User) applyRule(rule string) error {
+	switch lower := strings.ToLower(rule); {
+	case lower == "on":
+		u.Enabled = true
+	case lower == "off":
+		u.Enabled = false
+	case lower == "nopass":
+		u.NoPass = true
+		u.passwords = make(map[string]struct{})
+	case lower == "resetpass":
+		u.NoPass = false
+		u.passwords = make(map[string]struct{})
+	case lower == "allkeys":
+		u.keyPatterns = []string{"*"}
+	case lower == "resetkeys":
+		u.keyPatterns = nil
+	case lower == "allchannels":
+		u.channels = []string{"*"}
+	case lower == "resetchannels":
+		u.channels = nil
+	case lower == "allcommands":
+		return u.applyRule("+@all")
+	case lower == "nocommands":
+		return u.applyRule("-@all")
+	case lower == "reset":
+		for _, r := range []string{"resetpass", "resetkeys", "resetchannels", "off", "-@all"} {
+			u.applyRule(r)
+		}
+	case strings.HasPrefix(rule, ">"):
+		u.passwords[hashPassword(rule[1:])] = struct{}{}
+		u.NoPass = false
+	case strings.HasPrefix(rule, "<"):
+		delete(u.passwords, hashPassword(rule[1:]))
+	case strings.HasPrefix(rule, "#"):
+		if len(rule) != 65 {
+			return fmt.Errorf("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+		}
+		u.passwords[strings.ToLower(rule[1:])] = struct{}{}
+		u.NoPass = false
+	case strings.HasPrefix(rule, "!"):
+		delete(u.passwords, strings.ToLower(rule[1:]))
+	case strings.HasPrefix(rule, "~"):
+		if rule == "~*" {
+			u.keyPatterns = []string{"*"}
+		} else {
+			u.keyPatterns = append(u.keyPatterns, rule[1:])
+		}
+	case strings.HasPrefix(rule, "&"):
+		if rule == "&*" {
+			u.channels = []string{"*"}
+		} else {
+			u.channels = append(u.channels, rule[1:])
+		}
+	case strings.HasPrefix(rule, "+"), strings.HasPrefix(rule, "-"):
+		return u.applyCommandRule(lower)
+	default:
+		return fmt.Errorf("Syntax error")
+	}
+	return nil
+}
+
+// applyCommandRule applies +cmd, -cmd, +cmd|sub, -cmd|sub, +@category and -@category.
+func (u *User) applyCommandRule(rule string) error {
+	allow := rule[0] == '+'
+	target := rule[1:]
+
+	switch {
+	case target == "@all":
+		for _, cmd := range commands {
+			u.setCommand(cmd.Name, allow)
+		}
+		// +@all and -@all override everything before them
+		u.commandRules = nil
+	case strings.HasPrefix(target, "@"):
+		found := false
+		for _, cmd := range commands {
+			for _, category := range cmd.Categories() {
+				if category == target {
+					u.setCommand(cmd.Name, allow)
+					found = true
+				}
+			}
+		}
+		if !found {
+			return fmt.Errorf("Unknown command or category name in ACL")
+		}
+	default:
+		name, sub, isSub := strings.Cut(target, "|")
+		cmd, ok := LookupCommand(name)
+		if !ok || (isSub && !cmd.container) {
+			return fmt.Errorf("Unknown command or category name in ACL")
+		}
+		if isSub {
+			u.commands[cmd.Name+"|"+sub] = allow
+		} else {
+			u.setCommand(cmd.Name, allow)
+		}
+	}
+	u.commandRules = append(u.commandRules, rule)
+	return nil
+}
+
+// setCommand allows or denies a whole command, dropping rules for its subcommands.
+func (u *User) setCommand(name string, allow bool) {
+	for key := range u.commands {
+		if strings.HasPrefix(key, name+"|") {
+			delete(u.commands, key)
+		}
+	}
+	u.commands[name] = allow
+}
+
+// canRun reports whether the user may run the command with the given arguments.
+func (u *User) canRun(cmd *Command, parts []string) bool {
+	if cmd.container && len(parts) > 1 {
+		if allowed, ok := u.commands[cmd.Name+"|"+strings.ToLower(parts[1])]; ok {
+			return allowed
+		}
+	}
+	return u.commands[cmd.Name]
+}
+
+func (u *User) canAccessKey(key string) bool {
+	for _, pattern := range u.keyPatterns {
+		if pattern == "*" || globMatch(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) canAccessChannel(channel string) bool {
+	for _, pattern := range u.channels {
+		if pattern == "*" || globMatch(pattern, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// canAccessPattern reports whether a PSUBSCRIBE pattern is allowed. As in Redis it must be
+// one of the user's channel patterns: matching it against them would let news.? grant news.*.
+func (u *User) canAccessPattern(pattern string) bool {
+	for _, allowed := range u.channels {
+		if allowed == "*" || allowed == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) checkPassword(password string) bool {
+	if u.NoPass {
+		return true
+	}
+	_, ok := u.passwords[hashPassword(password)]
+	return ok
+}
+
+// describe renders the user as ACL rules, the format of ACL LIST and the ACL file.
+func (u *User) describe() string {
+	rules := []string{"user", u.Name}
+	if u.Enabled {
+		rules = append(rules, "on")
+	} else {
+		rules = append(rules, "off")
+	}
+	if u.NoPass {
+		rules = append(rules, "nopass")
+	}
+	for _, hash := range u.sortedPasswords() {
+		rules = append(rules, "#"+hash)
+	}
+	if len(u.keyPatterns) == 0 {
+		rules = append(rules, "resetkeys")
+	}
+	for _, pattern := range u.keyPatterns {
+		rules = append(rules, "~"+pattern)
+	}
+	if len(u.channels) == 0 {
+		rules = append(rules, "resetchannels")
+	}
+	for _, pattern := range u.channels {
+		rules = append(rules, "&"+pattern)
+	}
+	rules = append(rules, u.commandDescription())
+	return strings.Join(rules, " ")
+}
+
+func (u *User) commandDescription() string {
+	if len(u.commandRules) == 0 {
+		return "-@all"
+	}
+	if u.commandRules[0] == "+@all" || u.commandRules[0] == "-@all" {
+		return strings.Join(u.commandRules, " ")
+	}
+	return "-@all " + strings.Join(u.commandRules, " ")
+}
+
+func (u *User) sortedPasswords() []string {
+	hashes := make([]string, 0, len(u.passwords))
+	for hash := range u.passwords {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	return hashes
+}
+
+// clone copies a user so rules can be applied without affecting it until they all succeed.
+func (u *User) clone() *User {
+	c := *u
+	c.passwords = make(map[string]struct{}, len(u.passwords))
+	for hash := range u.passwords {
+		c.passwords[hash] = struct{}{}
+	}
+	c.commands = make(map[string]bool, len(u.commands))
+	for name, allowed := range u.commands {
+		c.commands[name] = allowed
+	}
+	c.commandRules = append([]string(nil), u.commandRules...)
+	c.keyPatterns = append([]string(nil), u.keyPatterns...)
+	c.channels = append([]string(nil), u.channels...)
+	return &c
+}
+
+// SetUser creates or updates a user by applying rules in order. Nothing changes if a rule
+// is invalid.
+func (r *Tealis) SetUser(name string, rules ...string) error {
+	r.acl.mu.Lock()
+	defer r.acl.mu.Unlock()
+
+	var u *User
+	if existing, ok := r.acl.users[name]; ok {
+		u = existing.clone()
+	} else {
+		u = newUser(name)
+	}
+	for _, rule := range rules {
+		if err := u.applyRule(rule); err != nil {
+			return fmt.Errorf("Error in ACL SETUSER modifier '%s': %v", rule, err)
+		}
+	}
+	r.acl.users[name] = u
+	return nil
+}
+
+// Authenticate switches the session to a user if the password matches.
+func (r *Tealis) Authenticate(s *Session, username, password string) bool {
+	r.acl.mu.RLock()
+	u, ok := r.acl.users[username]
+	valid := ok && u.Enabled && u.checkPassword(password)
+	r.acl.mu.RUnlock()
+	if !valid {
+		return false
+	}
+	s.mu.Lock()
+	s.user, s.authenticated = username, true
+	s.mu.Unlock()
+	return true
+}
+
+// needsAuth reports whether the session must authenticate before running commands.
+// Connections are implicitly the default user unless it requires a password.
+func (r *Tealis) needsAuth(s *Session) bool {
+	s.mu.Lock()
+	authenticated := s.authenticated
+	s.mu.Unlock()
+	if authenticated {
+		return false
+	}
+	r.acl.mu.RLock()
+	defer r.acl.mu.RUnlock()
+	def, ok := r.acl.users["default"]
+	return !ok || !def.Enabled || !def.NoPass
+}
+
+// checkPermissions enforces authentication and the session user's ACL rules. It returns
+// nil when the command may run.
+func (r *Tealis) checkPermissions(s *Session, cmd *Command, parts []string) protocol.Reply {
+	if cmd.noAuth {
+		return nil
+	}
+	if r.needsAuth(s) {
+		return protocol.Error("NOAUTH Authentication required.")
+	}
+	username := s.User()
+
+	r.acl.mu.RLock()
+	defer r.acl.mu.RUnlock()
+
+	u, ok := r.acl.users[username]
+	if !ok || !u.canRun(cmd, parts) {
+		name := cmd.Name
+		if cmd.container && len(parts) > 1 {
+			name += "|" + strings.ToLower(parts[1])
+		}
+		return protocol.Error(fmt.Sprintf("NOPERM User %s has no permissions to run the '%s' command", username, name))
+	}
+	for _, key := range cmd.Keys(parts) {
+		if !u.canAccessKey(key) {
+			return protocol.Error("NOPERM No permissions to access a key")
+		}
+	}
+	if cmd.Name == "psubscribe" || cmd.Name == "punsubscribe" {
+		if !u.canAccessPattern(parts[1]) {
+			return protocol.Error("NOPERM No permissions to access a channel")
+		}
+	} else if cmd.Has(FlagPubSub) && len(parts) > 1 && !u.canAccessChannel(parts[1]) {
+		return protocol.Error("NOPERM No permissions to access a channel")
+	}
+	return nil
+}
+
+// LoadACLFile sets the ACL file used by ACL LOAD and ACL SAVE and loads it if it exists.
+func (r *Tealis) LoadACLFile(path string) error {
+	r.acl.mu.Lock()
+	r.acl.file = path
+	r.acl.mu.Unlock()
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	return r.loadACL()
+}
+
+// loadACL replaces all users with the ones in the ACL file. The file is validated as a
+// whole first, so a broken file leaves the current users in place.
+func (r *Tealis) loadACL() error {
+	r.acl.mu.RLock()
+	path := r.acl.file
+	r.acl.mu.RUnlock()
+	if path == "" {
+		return fmt.Errorf("This instance is not configured to use an ACL file")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	users := make(map[string]*User)
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "user" {
+			return fmt.Errorf("%s:%d: should start with user keyword", path, lineNo)
+		}
+		u := newUser(fields[1])
+		for _, rule := range fields[2:] {
+			if err := u.applyRule(rule); err != nil {
+				return fmt.Errorf("%s:%d: %v. Error in user declaration '%s'", path, lineNo, err, rule)
+			}
+		}
+		users[u.Name] = u
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if _, ok := users["default"]; !ok {
+		users["default"] = defaultUser()
+	}
+
+	r.acl.mu.Lock()
+	r.acl.users = users
+	r.acl.mu.Unlock()
+	return nil
+}
+
+// saveACL writes all users to the ACL file, replacing it atomically.
+func (r *Tealis) saveACL() error {
+	r.acl.mu.RLock()
+	path := r.acl.file
+	lines := make([]string, 0, len(r.acl.users))
+	for _, u := range r.acl.users {
+		lines = append(lines, u.describe())
+	}
+	r.acl.mu.RUnlock()
+	if path == "" {
+		return fmt.Errorf("This instance is not configured to use an ACL file")
+	}
+	sort.Strings(lines)
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".acl-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func cmdAuth(store *Tealis, session *Session, parts []string) protocol.Reply {
+	username, password := "default", parts[1]
+	if len(parts) == 3 {
+		username, password = parts[1], parts[2]
+	} else if len(parts) > 3 {
+		return protocol.Error("ERR syntax error")
+	}
+	if !store.Authenticate(session, username, password) {
+		return protocol.Error("WRONGPASS invalid username-password pair or user is disabled.")
+	}
+	return protocol.OK
+}
+
+func cmdACL(store *Tealis, session *Session, parts []string) protocol.Reply {
+	switch strings.ToUpper(parts[1]) {
+	case "WHOAMI":
+		return protocol.BulkString(session.User())
+
+	case "SETUSER":
+		if len(parts) < 3 {
+			return protocol.WrongArgs("acl|setuser")
+		}
+		if err := store.SetUser(parts[2], parts[3:]...); err != nil {
+			return protocol.Errorf("%v", err)
+		}
+		return protocol.OK
+
+	case "GETUSER":
+		if len(parts) != 3 {
+			return protocol.WrongArgs("acl|getuser")
+		}
+		store.acl.mu.RLock()
+		defer store.acl.mu.RUnlock()
+		u, ok := store.acl.users[parts[2]]
+		if !ok {
+			return protocol.Null{}
+		}
+		flags := protocol.Array{protocol.BulkString("off")}
+		if u.Enabled {
+			flags[0] = protocol.BulkString("on")
+		}
+		if u.NoPass {
+			flags = append(flags, protocol.BulkString("nopass"))
+		}
+		keys := make([]string, len(u.keyPatterns))
+		for i, pattern := range u.keyPatterns {
+			keys[i] = "~" + pattern
+		}
+		channels := make([]string, len(u.channels))
+		for i, pattern := range u.channels {
+			channels[i] = "&" + pattern
+		}
+		return protocol.Map{
+			{Key: protocol.BulkString("flags"), Value: flags},
+			{Key: protocol.BulkString("passwords"), Value: protocol.StringArray(u.sortedPasswords())},
+			{Key: protocol.BulkString("commands"), Value: protocol.BulkString(u.commandDescription())},
+			{Key: protocol.BulkString("keys"), Value: protocol.BulkString(strings.Join(keys, " "))},
+			{Key: protocol.BulkString("channels"), Value: protocol.BulkString(strings.Join(channels, " "))},
+		}
+
+	case "DELUSER":
+		if len(parts) < 3 {
+			return protocol.WrongArgs("acl|deluser")
+		}
+		deleted := make(map[string]bool)
+		store.acl.mu.Lock()
+		for _, name := range parts[2:] {
+			if name == "default" {
+				store.acl.mu.Unlock()
+				return protocol.Error("ERR The 'default' user cannot be removed")
+			}
+		}
+		for _, name := range parts[2:] {
+			if _, ok := store.acl.users[name]; ok {
+				delete(store.acl.users, name)
+				deleted[name] = true
+			}
+		}
+		store.acl.mu.Unlock()
+		// Clients authenticated as a deleted user are disconnected
+		for _, s := range store.Sessions() {
+			if deleted[s.User()] {
+				s.kill(s == session)
+			}
+		}
+		return protocol.Integer(len(deleted))
+
+	case "LIST":
+		store.acl.mu.RLock()
+		lines := make([]string, 0, len(store.acl.users))
+		for _, u := range store.acl.users {
+			lines = append(lines, u.describe())
+		}
+		store.acl.mu.RUnlock()
+		sort.Strings(lines)
+		return protocol.StringArray(lines)
+
+	case "USERS":
+		store.acl.mu.RLock()
+		names := make([]string, 0, len(store.acl.users))
+		for name := range store.acl.users {
+			names = append(names, name)
+		}
+		store.acl.mu.RUnlock()
+		sort.Strings(names)
+		return protocol.StringArray(names)
+
+	case "CAT":
+		seen := make(map[string]bool)
+		var names []string
+		for _, cmd := range sortedCommands() {
+			if len(parts) == 3 {
+				for _, category := range cmd.Categories() {
+					if strings.EqualFold(category, "@"+parts[2]) {
+						names = append(names, cmd.Name)
+						break
+					}
+				}
+				continue
+			}
+			for _, category := range cmd.Categories() {
+				if !seen[category] {
+					seen[category] = true
+					names = append(names, strings.TrimPrefix(category, "@"))
+				}
+			}
+		}
+		if len(parts) == 3 && len(names) == 0 {
+			return protocol.Errorf("Unknown category '%s'", parts[2])
+		}
+		sort.Strings(names)
+		return protocol.StringArray(names)
+
+	case "LOAD":
+		if err := store.loadACL(); err != nil {
+			return protocol.Errorf("%v", err)
+		}
+		return protocol.OK
+
+	case "SAVE":
+		if err := store.saveACL(); err != nil {
+			return protocol.Errorf("There was an error trying to save the ACLs: %v", err)
+		}
+		return protocol.OK
+
+	default:
+		return protocol.Errorf("unknown subcommand '%s'. Try ACL LIST.", parts[1])
+	}
+}
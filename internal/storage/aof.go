@@ -0,0 +1,333 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"tealis/internal/protocol"
+	"time"
+)
+
+// States of the MULTI/EXEC block around the commands of a transaction in the AOF. MULTI is
+// only written once the transaction logs its first write, so read-only transactions leave
+// no trace.
+const (
+	aofTxnNone    = iota
+	aofTxnPending // EXEC is running, nothing logged yet
+	aofTxnOpen    // MULTI was logged, EXEC must follow
+)
+
+// feedAOF logs a write command that ran successfully and replied reply. Relative expiries are
+// logged as the absolute time they resolved to, so replaying the AOF later does not extend
+// them, and generated stream IDs as the ID they resolved to.
+func (r *Tealis) feedAOF(cmd *Command, parts []string, reply protocol.Reply) {
+	entries := [][]string{parts}
+	switch cmd.Name {
+	case "xadd":
+		if id, ok := reply.(protocol.BulkString); ok {
+			entry := append([]string{}, parts...)
+			entry[2] = string(id)
+			entries = [][]string{entry}
+		}
+	case "ex", "expire", "pexpire", "expireat", "pexpireat", "getex":
+		entries = [][]string{r.pexpireatEntry(parts[1])}
+	case "set":
+		// Options make the outcome depend on the key, so the outcome itself is logged
+		if len(parts) > 3 {
+			entries = r.setEntries(parts[1])
+		}
+	}
+
+	r.logAOF(entries)
+}
+
+// logAOF writes entries to the AOF, inside the MULTI/EXEC block of a running EXEC. They are
+// entries of the database r; the AOF selects it first if its last entries were of another.
+func (r *Tealis) logAOF(entries [][]string) {
+	if len(entries) == 0 {
+		return
+	}
+
+	var buf []byte
+	if r.aofTxn == aofTxnPending {
+		buf = protocol.Append(buf, protocol.StringArray([]string{"MULTI"}), protocol.RESP2)
+		r.aofTxn = aofTxnOpen
+	}
+	for _, entry := range entries {
+		buf = protocol.Append(buf, protocol.StringArray(entry), protocol.RESP2)
+	}
+	r.writeAOF(r.db, buf)
+}
+
+// pexpireatEntry returns the PEXPIREAT command that restores a key's current expiry, or the
+// DEL of a key an expiry in the past removed.
+func (r *Tealis) pexpireatEntry(key string) []string {
+	if !r.Exists(key) {
+		return []string{"DEL", key}
+	}
+	at, ok := r.expiryOf(key)
+	if !ok {
+		return []string{"PERSIST", key}
+	}
+	return []string{"PEXPIREAT", key, strconv.FormatInt(at.UnixMilli(), 10)}
+}
+
+// setEntries returns the commands that restore a string key as it is now.
+func (r *Tealis) setEntries(key string) [][]string {
+	r.Mu.RLock()
+	current, exists := r.Store[key]
+	r.Mu.RUnlock()
+	value, ok := current.(string)
+	switch {
+	case !exists:
+		return [][]string{{"DEL", key}}
+	case !ok:
+		return nil // SET did not apply to a key of another type
+	}
+	return [][]string{{"SET", key, value}, r.pexpireatEntry(key)}
+}
+
+// beginAOFTransaction frames the writes of an EXEC as a MULTI/EXEC block in the AOF so a
+// crash in the middle never replays half a transaction. The caller must hold execMu
+// exclusively until endAOFTransaction.
+func (r *Tealis) beginAOFTransaction() {
+	r.aofTxn = aofTxnPending
+}
+
+func (r *Tealis) endAOFTransaction() {
+	if r.aofTxn == aofTxnOpen {
+		r.AppendToAOF("EXEC")
+	}
+	r.aofTxn = aofTxnNone
+}
+
+// StartAOFFsync fsyncs the AOF once a second when appendfsync is everysec.
+func (r *Tealis) StartAOFFsync(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if r.Config().AppendFsync != "everysec" {
+					continue
+				}
+				r.aofMu.Lock()
+				r.syncAOFLocked()
+				r.aofMu.Unlock()
+			}
+		}
+	}()
+}
+
+// syncAOFLocked fsyncs the AOF if it was written since the last fsync. The caller must
+// hold aofMu.
+func (r *Tealis) syncAOFLocked() {
+	if !r.aofDirty || r.AofFile == nil {
+		return
+	}
+	if err := r.AofFile.Sync(); err != nil {
+		log.Printf("Error syncing AOF: %v", err)
+		return
+	}
+	r.aofDirty = false
+}
+
+// Load restores the data on startup: the latest snapshot first, then the commands the AOF
+// recorded after that snapshot was taken.
+func (r *Tealis) Load() error {
+	start := time.Now()
+	base, offset, err := r.loadSnapshot(snapshotFile)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		base, offset = readAOFBase(r.aofFilePath+"/aof.txt"), 0
+	case err != nil:
+		return err
+	default:
+		log.Printf("DB loaded from snapshot: %d keys in %v", r.keyCount(), time.Since(start))
+	}
+
+	if !r.aofEnabled() {
+		return nil
+	}
+	size, err := r.aofSize()
+	if err != nil {
+		return err
+	}
+	if base != readAOFBase(r.aofFilePath+"/aof.txt") || size < offset {
+		// The AOF was rewritten after the snapshot and holds the whole dataset on its own
+		log.Printf("AOF was rewritten after the snapshot was taken, loading it alone")
+		r.FlushAll()
+		offset = 0
+	}
+
+	start = time.Now()
+	loaded, err := r.replayAOF(offset)
+	if err != nil {
+		return err
+	}
+	log.Printf("DB loaded from append only file: %d commands in %v", loaded, time.Since(start))
+	// Automatic rewrites measure growth from the size the AOF was loaded with
+	if size, err = r.aofSize(); err == nil {
+		r.aofMu.Lock()
+		r.aofBaseSize = size
+		r.aofMu.Unlock()
+	}
+	return nil
+}
+
+// replayAOF runs the AOF commands from offset onwards through the command dispatcher, without
+// logging them again, and returns how many were applied. When the AOF starts with a snapshot
+// preamble and is replayed from the start, the preamble is loaded first and the commands
+// after it are replayed on top. A last command cut short by a crash is truncated away when
+// aof-load-truncated is set; otherwise loading fails.
+func (r *Tealis) replayAOF(offset int64) (int, error) {
+	path := r.aofFilePath + "/aof.txt"
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to open AOF file: %w", err)
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("failed to read AOF file: %w", err)
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read AOF file: %w", err)
+	}
+
+	r.loading.Store(true)
+	defer r.loading.Store(false)
+	// The AOF is replayed on behalf of a client that may run anything
+	loader := &Session{user: "default", authenticated: true, protocol: protocol.RESP2, subscriptions: make(map[string]struct{}), patterns: make(map[string]struct{})}
+	apply := func(entries ...aofEntry) {
+		r.execMu.RLock()
+		defer r.execMu.RUnlock()
+		for _, e := range entries {
+			if reply := r.selected(loader).call(e.cmd, loader, e.parts); protocol.IsError(reply) {
+				log.Printf("AOF command %q failed while loading: %s", e.parts, reply)
+			}
+		}
+	}
+
+	pos := 0
+	// An AOF rewritten with aof-use-snapshot-preamble starts with the data as a snapshot
+	if offset == 0 && isSnapshot(data) {
+		state, n, err := decodeSnapshotPrefix(data)
+		if err != nil {
+			return 0, fmt.Errorf("bad file format reading the append only file preamble at offset %d: %w", n, err)
+		}
+		r.Mu.Lock()
+		err = r.setKeyspacesLocked(state.dbs)
+		r.Mu.Unlock()
+		if err != nil {
+			return 0, fmt.Errorf("failed to load the append only file preamble: %w", err)
+		}
+		log.Printf("Loaded the snapshot preamble of the append only file: %d keys", r.keyCount())
+		pos = n
+	}
+
+	loaded := 0
+	pos, err = scanAOF(data, pos, offset, func(entries ...aofEntry) {
+		apply(entries...)
+		loaded += len(entries)
+	})
+	if err != nil {
+		return loaded, err
+	}
+
+	if pos < len(data) {
+		end := offset + int64(pos)
+		if !r.Config().AOFLoadTruncated {
+			return loaded, fmt.Errorf("unexpected end of file reading the append only file at offset %d; set aof-load-truncated yes to truncate it and start", end)
+		}
+		log.Printf("!!! Warning: short read while loading the AOF. Truncating the AOF at offset %d", end)
+		r.aofMu.Lock()
+		err := os.Truncate(path, end)
+		r.aofMu.Unlock()
+		if err != nil {
+			return loaded, fmt.Errorf("failed to truncate AOF file: %w", err)
+		}
+	}
+	return loaded, nil
+}
+
+// aofEntry is a write command read from the AOF.
+type aofEntry struct {
+	cmd   *Command
+	parts []string
+}
+
+// scanAOF reads the commands of an AOF from pos on and hands every write and SELECT outside a
+// transaction, and every transaction once its EXEC is read, to apply. It returns where the
+// complete commands end: a command cut short by a crash, or a transaction without its EXEC,
+// ends them early. On error it returns where the bad command starts. Offsets in errors count
+// from base, where data starts in the file.
+func scanAOF(data []byte, pos int, base int64, apply func(entries ...aofEntry)) (int, error) {
+	// Commands of a transaction are held back until its EXEC is read
+	var txn []aofEntry
+	txnStart := -1
+	for pos < len(data) {
+		parts, size, err := protocol.ParseRequest(data[pos:])
+		if errors.Is(err, protocol.ErrIncomplete) {
+			break
+		}
+		if err != nil {
+			return pos, fmt.Errorf("bad file format reading the append only file at offset %d: %v", base+int64(pos), err)
+		}
+		start, resp := pos, data[pos] == '*'
+		pos += size
+		if len(parts) == 0 {
+			continue
+		}
+
+		// The first command of a rewritten AOF only identifies it
+		if strings.EqualFold(parts[0], aofBaseCommand) {
+			continue
+		}
+
+		cmd, ok := LookupCommand(parts[0])
+		if !ok {
+			return start, fmt.Errorf("unknown command '%s' reading the append only file at offset %d", parts[0], base+int64(start))
+		}
+		// Inline entries come from AOFs written before transactions were framed; their
+		// MULTI lines have no EXEC and mean nothing
+		if cmd.Name == "multi" && resp {
+			txn, txnStart = nil, start
+			continue
+		}
+		if cmd.Name == "exec" && txnStart >= 0 {
+			apply(txn...)
+			txn, txnStart = nil, -1
+			continue
+		}
+		// Older AOFs logged every command; only writes change the data, in the database
+		// the last SELECT chose
+		if (!cmd.Has(FlagWrite) || cmd.Has(FlagAdmin)) && cmd.Name != "select" {
+			continue
+		}
+		if !cmd.CheckArity(len(parts)) {
+			return start, fmt.Errorf("wrong number of arguments for '%s' reading the append only file at offset %d", cmd.Name, base+int64(start))
+		}
+		if txnStart >= 0 {
+			txn = append(txn, aofEntry{cmd, parts})
+			continue
+		}
+		apply(aofEntry{cmd, parts})
+	}
+	// A transaction without its EXEC was cut short like a partial command
+	if txnStart >= 0 {
+		pos = txnStart
+	}
+	return pos, nil
+}
@@ -0,0 +1,235 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var errSaveInProgress = errors.New("Background save already in progress")
+
+// saveView is the point-in-time view of the data a save or an AOF rewrite writes. Taking it
+// only copies the key maps; values are encoded afterwards while commands keep running. A
+// write command encodes the keys it is about to change into the view first, so the save
+// still sees the values they had when the view was taken (copy-on-write).
+type saveView struct {
+	seq      uint64
+	dirty    int64 // writes the view contains that no earlier save did
+	header   []byte
+	keys     []dbKey // ordered by database, then by name
+	commands bool    // keys are encoded as the commands that recreate them, not as records
+
+	mu       sync.Mutex
+	values   map[dbKey]interface{} // values nobody encoded yet
+	records  map[dbKey][]byte      // keys a write encoded before the save reached them
+	expiries map[dbKey]time.Time
+	err      error // the first value that failed to encode
+}
+
+// preserve encodes the given keys of database db, or every key not encoded yet if keys is
+// nil, before a command changes them.
+func (v *saveView) preserve(db int, keys []string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if keys == nil {
+		for key := range v.values {
+			v.encodeLocked(key)
+		}
+		return
+	}
+	for _, key := range keys {
+		v.encodeLocked(dbKey{db, key})
+	}
+}
+
+// encodeLocked encodes a key into records unless it was already. The caller must hold v.mu.
+func (v *saveView) encodeLocked(key dbKey) {
+	value, ok := v.values[key]
+	if !ok {
+		return
+	}
+	delete(v.values, key)
+	expiry, hasExpiry := v.expiries[key]
+	var record []byte
+	var err error
+	if v.commands {
+		record, err = appendKeyCommands(nil, key.key, value)
+		if hasExpiry {
+			record = appendCommand(record, "PEXPIREAT", key.key, strconv.FormatInt(expiry.UnixMilli(), 10))
+		}
+	} else {
+		record, err = appendSnapshotRecord(nil, key.key, value, expiry, hasExpiry)
+	}
+	if err != nil && v.err == nil {
+		v.err = err
+	}
+	v.records[key] = record
+}
+
+// encode builds the snapshot or the AOF of the view, key by key.
+func (v *saveView) encode() ([]byte, error) {
+	buf := v.header
+	db := 0
+	for _, key := range v.keys {
+		if key.db != db {
+			if v.commands {
+				buf = appendCommand(buf, "SELECT", strconv.Itoa(key.db))
+			} else {
+				buf = appendSnapshotSelectDB(buf, key.db)
+			}
+			db = key.db
+		}
+		v.mu.Lock()
+		v.encodeLocked(key)
+		buf = append(buf, v.records[key]...)
+		delete(v.records, key)
+		err := v.err
+		v.mu.Unlock()
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode key %q: %w", key.key, err)
+		}
+	}
+	if v.commands {
+		return buf, nil
+	}
+	return appendSnapshotEnd(buf), nil
+}
+
+// SaveSnapshot saves a snapshot of the current state of the database. Commands are held
+// back only while the view of the data is taken, not while it is encoded and written.
+func (r *Tealis) SaveSnapshot() error {
+	r.execMu.Lock()
+	view, err := r.startSaveLocked()
+	r.execMu.Unlock()
+	if err != nil {
+		return err
+	}
+	return r.finishSave(view)
+}
+
+// BackgroundSave starts saving a snapshot in the background.
+func (r *Tealis) BackgroundSave() error {
+	r.execMu.Lock()
+	defer r.execMu.Unlock()
+	return r.backgroundSaveLocked()
+}
+
+// backgroundSaveLocked takes the view of the data for a background save and writes it in
+// the background. The caller must hold execMu exclusively.
+func (r *Tealis) backgroundSaveLocked() error {
+	view, err := r.startSaveLocked()
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := r.finishSave(view); err != nil {
+			log.Printf("Background saving error: %v", err)
+		}
+	}()
+	return nil
+}
+
+// startSaveLocked takes the point-in-time view of a save. The caller must hold execMu
+// exclusively, which makes the view consistent with the AOF position recorded with it.
+func (r *Tealis) startSaveLocked() (*saveView, error) {
+	if !r.saving.CompareAndSwap(false, true) {
+		return nil, errSaveInProgress
+	}
+	base, offset, err := r.aofPosition()
+	if err != nil {
+		r.saving.Store(false)
+		return nil, err
+	}
+
+	view := r.takeViewLocked(appendSnapshotHeader(nil, snapshotState{saved: time.Now(), aofBase: base, aofOffset: offset}), false)
+	r.snapshotSeq++
+	view.seq = r.snapshotSeq
+	view.dirty = r.dirty.Load()
+
+	r.bgSaves.Add(1)
+	r.saveStatsMu.Lock()
+	r.saveStarted = time.Now()
+	r.saveStatsMu.Unlock()
+	r.saveView.Store(view)
+	return view, nil
+}
+
+// takeViewLocked takes a point-in-time view of the data, to be encoded after header. The
+// caller must hold execMu exclusively.
+func (r *Tealis) takeViewLocked(header []byte, commands bool) *saveView {
+	view := &saveView{
+		header:   header,
+		commands: commands,
+		values:   make(map[dbKey]interface{}),
+		records:  make(map[dbKey][]byte),
+		expiries: make(map[dbKey]time.Time),
+	}
+	r.Mu.RLock()
+	for _, db := range r.dbs {
+		for key, value := range db.Store {
+			view.values[dbKey{db.db, key}] = value
+		}
+		for key, expiry := range db.Expiries {
+			view.expiries[dbKey{db.db, key}] = expiry
+		}
+	}
+	r.Mu.RUnlock()
+	view.keys = make([]dbKey, 0, len(view.values))
+	for key := range view.values {
+		view.keys = append(view.keys, key)
+	}
+	sort.Slice(view.keys, func(i, j int) bool {
+		a, b := view.keys[i], view.keys[j]
+		return a.db < b.db || a.db == b.db && a.key < b.key
+	})
+	return view
+}
+
+// finishSave encodes and writes the view of a save, records how it went and starts the
+// save BGSAVE SCHEDULE asked for meanwhile.
+func (r *Tealis) finishSave(view *saveView) error {
+	defer r.bgSaves.Done()
+	data, err := view.encode()
+	r.saveView.Store(nil)
+	if err == nil {
+		err = r.writeSnapshot(capturedSnapshot{seq: view.seq, data: data})
+	}
+	r.recordSave(view, err)
+	r.saving.Store(false)
+
+	if !r.shuttingDown.Load() && r.saveScheduled.CompareAndSwap(true, false) {
+		go func() {
+			if err := r.BackgroundSave(); err != nil && !errors.Is(err, errSaveInProgress) {
+				log.Printf("Error starting the scheduled background save: %v", err)
+			}
+		}()
+	}
+	return err
+}
+
+// recordSave records the outcome of a save for LASTSAVE, INFO persistence and the save
+// rules. Writes that came in while the save ran still count as unsaved.
+func (r *Tealis) recordSave(view *saveView, err error) {
+	r.saveStatsMu.Lock()
+	defer r.saveStatsMu.Unlock()
+	r.lastSaveOK = err == nil
+	r.saveDuration = time.Since(r.saveStarted)
+	if err == nil {
+		r.lastSave = time.Now()
+		r.dirty.Add(-view.dirty)
+	}
+}
+
+// preserveForSave encodes the keys a write command is about to change into the views of a
+// running save and a running AOF rewrite. Commands without keys may change anything.
+func (r *Tealis) preserveForSave(cmd *Command, parts []string) {
+	for _, view := range []*saveView{r.saveView.Load(), r.aofRewriteView.Load()} {
+		if view != nil {
+			view.preserve(r.db, cmd.Keys(parts))
+		}
+	}
+}
@@ -11,13 +11,16 @@ func (r *Tealis) SetBitfield(key string, bitType string, offset int, value int)
 	r.Mu.Lock()
 	defer r.Mu.Unlock()
 
+	bitfield, exists, err := valueOf[[]byte](r.lookupWriteLocked(key))
+	if err != nil {
+		return err
+	}
 	// Initialize the bitfield if it doesn't exist.
-	if _, exists := r.Store[key]; !exists {
-		r.Store[key] = make([]byte, 0)
+	if !exists {
+		bitfield = make([]byte, 0)
+		r.setLocked(key, bitfield)
 	}
 
-	bitfield := r.Store[key].([]byte)
-
 	switch bitType {
 	case "i8":
 		// Initialize the bitfield if it doesn't exist.
@@ -25,7 +28,7 @@ func (r *Tealis) SetBitfield(key string, bitType string, offset int, value int)
 			// Initialize with a signed 8-bit integer (e.g., -128)
 			// Convert signed int8 to byte by directly casting
 			val := int8(-128)
-			r.Store[key] = []byte{byte(val)} // Store the signed int8 as byte (two's complement)
+			r.setLocked(key, []byte{byte(val)}) // Store the signed int8 as byte (two's complement)
 		}
 		if value < math.MinInt8 || value > math.MaxInt8 {
 			return errors.New("value out of range for i8")
@@ -38,7 +41,7 @@ func (r *Tealis) SetBitfield(key string, bitType string, offset int, value int)
 			// Initialize with an unsigned 16-bit integer (e.g., 65535)
 			// Store the uint16 value as two bytes (little-endian or big-endian depending on your need)
 			val := uint16(65535)
-			r.Store[key] = []byte{byte(val & 0xFF), byte(val >> 8)} // Little-endian format
+			r.setLocked(key, []byte{byte(val & 0xFF), byte(val >> 8)}) // Little-endian format
 		}
 
 		if value < 0 || value > math.MaxUint16 {
@@ -56,12 +59,14 @@ func (r *Tealis) GetBitfield(key string, bitType string, offset int) (int, error
 	r.Mu.RLock()
 	defer r.Mu.RUnlock()
 
-	if _, exists := r.Store[key]; !exists {
+	bitfield, exists, err := valueOf[[]byte](r.lookupLocked(key))
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
 		return 0, errors.New("key not found")
 	}
 
-	bitfield := r.Store[key].([]byte)
-
 	switch bitType {
 	case "i8":
 		return getBitfieldValue(bitfield, offset, 8)
@@ -77,12 +82,14 @@ func (r *Tealis) IncrByBitfield(key string, bitType string, offset int, incremen
 	r.Mu.Lock()
 	defer r.Mu.Unlock()
 
-	if _, exists := r.Store[key]; !exists {
+	bitfield, exists, err := valueOf[[]byte](r.lookupWriteLocked(key))
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
 		return 0, errors.New("key not found")
 	}
 
-	bitfield := r.Store[key].([]byte)
-
 	// Get the current value
 	currentValue, err := getBitfieldValue(bitfield, offset, getBitfieldSize(bitType))
 	if err != nil {
@@ -173,8 +180,7 @@ func (r *Tealis) setBitfieldValue(bitfield []byte, offset int, value int, size i
 			bitfield[byteIndex] &= ^(1 << (7 - bitIndex)) // Set bit to 0
 		}
 	}
-	r.Store[key] = bitfield
-	print(bitfield)
+	r.setLocked(key, bitfield)
 	return nil
 }
 
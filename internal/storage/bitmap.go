@@ -1,20 +1,24 @@
 package storage
 
 import (
+	"errors"
 	"math/bits"
 )
 
 // SETBIT sets the bit at the specified offset in the key's value.
-func (r *Tealis) SETBIT(key string, offset, value int) int {
+func (r *Tealis) SETBIT(key string, offset, value int) (int, error) {
 	r.Mu.Lock()
 	defer r.Mu.Unlock()
 
 	if offset < 0 {
-		return 0 // Invalid offset
+		return 0, nil // Invalid offset
 	}
 
 	// Ensure the value is a byte slice
-	data, _ := r.Store[key].([]byte)
+	data, _, err := valueOf[[]byte](r.lookupWriteLocked(key))
+	if err != nil {
+		return 0, err
+	}
 	byteIndex := offset / 8
 	bitIndex := offset % 8
 
@@ -37,97 +41,106 @@ func (r *Tealis) SETBIT(key string, offset, value int) int {
 	}
 
 	// Update the store
-	r.Store[key] = data
-	return int(prev)
+	r.setLocked(key, data)
+	return int(prev), nil
 }
 
 // GETBIT retrieves the bit at the specified offset in the key's value.
-func (r *Tealis) GETBIT(key string, offset int) int {
+func (r *Tealis) GETBIT(key string, offset int) (int, error) {
 	r.Mu.RLock()
 	defer r.Mu.RUnlock()
 
 	if offset < 0 {
-		return 0
+		return 0, nil
 	}
 
-	data, _ := r.Store[key].([]byte)
+	data, _, err := valueOf[[]byte](r.lookupLocked(key))
 	byteIndex := offset / 8
 	if byteIndex >= len(data) {
-		return 0 // Out of range, default to 0
+		return 0, err // Out of range, default to 0
 	}
 
 	bitIndex := offset % 8
-	return int((data[byteIndex] >> bitIndex) & 1)
+	return int((data[byteIndex] >> bitIndex) & 1), nil
 }
 
 // BITCOUNT counts the number of bits set to 1 in the key's value.
-func (r *Tealis) BITCOUNT(key string) int {
+func (r *Tealis) BITCOUNT(key string) (int, error) {
 	r.Mu.RLock()
 	defer r.Mu.RUnlock()
 
-	data, _ := r.Store[key].([]byte)
+	data, _, err := valueOf[[]byte](r.lookupLocked(key))
 	count := 0
 	for _, b := range data {
 		count += bits.OnesCount8(b)
 	}
-	return count
+	return count, err
 }
 
-// BITOP performs bitwise operations between keys and stores the result in a destination key.
-func (r *Tealis) BITOP(op string, destKey string, keys ...string) {
+// BITRESTORE replaces a key with a bitmap holding the given bytes, as written by AOF
+// rewrites.
+func (r *Tealis) BITRESTORE(key string, data []byte) {
 	r.Mu.Lock()
 	defer r.Mu.Unlock()
+	r.setLocked(key, append([]byte(nil), data...))
+}
 
-	// Check for no keys or invalid operation
-	if len(keys) == 0 {
-		panic("-ERR wrong number of arguments")
-	}
+// BITOP performs bitwise operations between keys, stores the result in a destination key and
+// returns its length. Missing keys count as empty strings, padded with zeros like shorter
+// values; a result that is empty deletes the destination.
+func (r *Tealis) BITOP(op string, destKey string, keys ...string) (int, error) {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
 
-	// Fetch the data for the first key to initialize the result slice
-	firstKey := keys[0]
-	result, _ := r.Store[firstKey].([]byte)
-	if result == nil {
-		panic("-ERR no such key")
+	switch {
+	case len(keys) == 0:
+		return 0, errors.New("ERR wrong number of arguments for 'bitop' command")
+	case op != "AND" && op != "OR" && op != "XOR" && op != "NOT":
+		return 0, errors.New("ERR syntax error")
+	case op == "NOT" && len(keys) != 1:
+		return 0, errors.New("ERR BITOP NOT must be called with a single source key.")
 	}
-
-	// Iterate through the keys
+	values := make([][]byte, len(keys))
+	size := 0
 	for i, key := range keys {
-		data, _ := r.Store[key].([]byte)
-		if data == nil {
-			panic("-ERR no such key")
-		}
-
-		// Align the data size
-		if len(result) < len(data) {
-			newResult := make([]byte, len(data))
-			copy(newResult, result)
-			result = newResult
-		} else if len(result) > len(data) {
-			newData := make([]byte, len(result))
-			copy(newData, data)
-			data = newData
+		data, _, err := valueOf[[]byte](r.lookupLocked(key))
+		if err != nil {
+			return 0, err
 		}
+		values[i] = data
+		size = max(size, len(data))
+	}
 
-		// Perform the operation
+	// The result starts as a copy of the first key, never the key itself
+	result := make([]byte, size)
+	copy(result, values[0])
+	for _, data := range values[1:] {
 		for j := range result {
+			var b byte
+			if j < len(data) {
+				b = data[j]
+			}
 			switch op {
 			case "AND":
-				result[j] &= data[j]
+				result[j] &= b
 			case "OR":
-				result[j] |= data[j]
+				result[j] |= b
 			case "XOR":
-				result[j] ^= data[j]
-			case "NOT":
-				if i != 0 {
-					panic("-ERR NOT must be applied to a single key")
-				}
-				result[j] = ^data[j]
-			default:
-				panic("-ERR unknown BITOP operation")
+				result[j] ^= b
 			}
 		}
 	}
+	if op == "NOT" {
+		for j := range result {
+			result[j] = ^result[j]
+		}
+	}
 
-	// Store the result back into the destination key
-	r.Store[destKey] = result
+	if size == 0 {
+		r.deleteLocked(destKey)
+		delete(r.Expiries, destKey)
+		return 0, nil
+	}
+	r.setLocked(destKey, result)
+	return size, nil
 }
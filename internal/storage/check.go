@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc64"
+	"sort"
+	"time"
+)
+
+// Offline inspection of snapshot and AOF files, for tealis-check. Nothing here touches a
+// running store.
+
+// CorruptError tells where a snapshot or AOF stops being valid and why.
+type CorruptError struct {
+	Offset int64
+	Err    error
+}
+
+func (e *CorruptError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *CorruptError) Unwrap() error {
+	return e.Err
+}
+
+// SnapshotKey describes one key of a snapshot.
+type SnapshotKey struct {
+	DB     int // the database the key is in
+	Name   string
+	Type   string    // the snapshot type name: string, list, hash, zset...
+	Size   int       // bytes the key takes in the snapshot
+	Expiry time.Time // zero without one
+	Digest uint64    // checksum of the type and value, equal for equal values
+}
+
+// SnapshotInfo is what InspectSnapshot found in a snapshot.
+type SnapshotInfo struct {
+	Saved     time.Time
+	AOFBase   string // the rewrite of the AOF the snapshot was taken against
+	AOFOffset int64  // the size that AOF had
+	Legacy    bool   // a JSON snapshot of an older version
+	Size      int    // length of the snapshot; an AOF preamble is followed by commands
+	Keys      []SnapshotKey
+}
+
+// InspectSnapshot validates a snapshot file, binary or legacy JSON, and describes its keys,
+// sorted by database and name. A snapshot that does not validate returns a *CorruptError.
+func InspectSnapshot(data []byte) (*SnapshotInfo, error) {
+	if !isSnapshot(data) {
+		return inspectLegacySnapshot(data)
+	}
+	info, err := inspectSnapshotPrefix(data)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size != len(data) {
+		return nil, &CorruptError{Offset: int64(info.Size), Err: fmt.Errorf("%w: data after the end of the snapshot", errSnapshotCorrupt)}
+	}
+	return info, nil
+}
+
+// inspectSnapshotPrefix describes the binary snapshot data starts with.
+func inspectSnapshotPrefix(data []byte) (*SnapshotInfo, error) {
+	var keys []SnapshotKey
+	state, n, err := walkSnapshot(data, func(r snapshotRecord) {
+		keys = append(keys, SnapshotKey{
+			DB:     r.db,
+			Name:   r.key,
+			Type:   r.codec.name,
+			Size:   r.end - r.start,
+			Expiry: r.expiry,
+			Digest: crc64.Checksum(data[r.valueStart:r.end], crcTable),
+		})
+	})
+	if err != nil {
+		return nil, &CorruptError{Offset: int64(n), Err: err}
+	}
+	sortSnapshotKeys(keys)
+	return &SnapshotInfo{Saved: state.saved, AOFBase: state.aofBase, AOFOffset: state.aofOffset, Size: n, Keys: keys}, nil
+}
+
+// inspectLegacySnapshot validates a JSON snapshot. JSON keeps no types, so keys are described
+// by the type their decoded value would be saved as.
+func inspectLegacySnapshot(data []byte) (*SnapshotInfo, error) {
+	var state struct {
+		Store    map[string]interface{} `json:"store"`
+		Expiries map[string]string      `json:"expiries"`
+		Offset   int64                  `json:"aof_offset"`
+		Base     string                 `json:"aof_base"`
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		offset := int64(0)
+		if syntaxErr, ok := err.(*json.SyntaxError); ok {
+			offset = syntaxErr.Offset
+		}
+		return nil, &CorruptError{Offset: offset, Err: fmt.Errorf("%w: %v", errSnapshotCorrupt, err)}
+	}
+
+	info := &SnapshotInfo{AOFBase: state.Base, AOFOffset: state.Offset, Legacy: true, Size: len(data)}
+	for key, value := range state.Store {
+		encoded, _ := json.Marshal(value)
+		k := SnapshotKey{Name: key, Type: "unknown", Size: len(encoded), Digest: crc64.Checksum(encoded, crcTable)}
+		if codec, ok := codecOf(value); ok {
+			k.Type = codec.name
+		}
+		if expiry, err := time.Parse(time.RFC3339, state.Expiries[key]); err == nil {
+			k.Expiry = expiry
+		}
+		info.Keys = append(info.Keys, k)
+	}
+	sortSnapshotKeys(info.Keys)
+	return info, nil
+}
+
+// sortSnapshotKeys orders keys by database, then by name.
+func sortSnapshotKeys(keys []SnapshotKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].DB != keys[j].DB {
+			return keys[i].DB < keys[j].DB
+		}
+		return keys[i].Name < keys[j].Name
+	})
+}
+
+// AOFInfo is what CheckAOF found in an AOF.
+type AOFInfo struct {
+	Preamble  *SnapshotInfo // the snapshot the AOF starts with, nil if it has none
+	Base      string        // the rewrite the AOF comes from, "" if it was never rewritten
+	Commands  int           // writes a load would replay, transactions included
+	ValidSize int64         // where the complete commands end
+	Size      int64
+}
+
+// Truncated reports whether the AOF ends with a command or transaction cut short, which
+// truncating it at ValidSize repairs.
+func (info *AOFInfo) Truncated() bool {
+	return info.ValidSize < info.Size
+}
+
+// CheckAOF validates an AOF the way loading it would: the snapshot preamble if there is one,
+// then every command. A corrupt file returns a *CorruptError along with what was read before
+// the corruption. A command cut short at the end is not an error; it shows in
+// AOFInfo.Truncated.
+func CheckAOF(data []byte) (*AOFInfo, error) {
+	info := &AOFInfo{Size: int64(len(data))}
+	pos := 0
+	if isSnapshot(data) {
+		preamble, err := inspectSnapshotPrefix(data)
+		if err != nil {
+			return info, err
+		}
+		info.Preamble, info.Base, pos = preamble, preamble.AOFBase, preamble.Size
+	}
+
+	end, err := scanAOF(data, pos, 0, func(entries ...aofEntry) {
+		for _, e := range entries {
+			if e.cmd.Name != "select" {
+				info.Commands++
+			}
+		}
+	})
+	info.ValidSize = int64(end)
+	if err != nil {
+		return info, &CorruptError{Offset: int64(end), Err: err}
+	}
+	if info.Preamble == nil {
+		info.Base = aofBaseOf(data)
+	}
+	return info, nil
+}
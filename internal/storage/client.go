@@ -0,0 +1,306 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"tealis/internal/protocol"
+	"time"
+)
+
+// Info renders the session the way CLIENT LIST and CLIENT INFO report it.
+func (s *Session) Info() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	flags := ""
+	if len(s.subscriptions) > 0 || len(s.patterns) > 0 {
+		flags += "P"
+	}
+	if s.inMulti {
+		flags += "x"
+	}
+	if s.closing {
+		flags += "c"
+	}
+	if flags == "" {
+		flags = "N"
+	}
+	multi := -1
+	if s.inMulti {
+		multi = len(s.queue)
+	}
+	lastCmd := s.lastCmd
+	if lastCmd == "" {
+		lastCmd = "NULL"
+	}
+	return fmt.Sprintf("id=%d addr=%s name=%s transport=%s age=%d idle=%d flags=%s db=%d sub=%d psub=%d multi=%d watch=%d user=%s resp=%d cmd=%s",
+		s.ID, s.Addr, s.name, s.Transport,
+		int64(now.Sub(s.Created).Seconds()), int64(now.Sub(s.lastActive).Seconds()),
+		flags, s.db, len(s.subscriptions), len(s.patterns), multi, len(s.watching), s.user, s.protocol, lastCmd)
+}
+
+// Closing reports whether the session was killed. Connection handlers stop reading once
+// the pending replies are written.
+func (s *Session) Closing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+// recordCommand remembers the last command the client sent, for CLIENT LIST.
+func (s *Session) recordCommand(cmd *Command, parts []string) {
+	name := cmd.Name
+	if cmd.container && len(parts) > 1 {
+		name += "|" + strings.ToLower(parts[1])
+	}
+	s.mu.Lock()
+	s.lastCmd, s.lastActive = name, time.Now()
+	s.mu.Unlock()
+}
+
+// kill disconnects the session. The connection is closed right away unless the client is
+// killing itself, in which case it is closed after its reply is written.
+func (s *Session) kill(self bool) {
+	s.mu.Lock()
+	s.closing = true
+	s.mu.Unlock()
+	if self {
+		return
+	}
+	if closer, ok := s.out.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// PauseClients holds back commands for the given duration. With writesOnly set, commands
+// that do not write keep running.
+func (r *Tealis) PauseClients(d time.Duration, writesOnly bool) {
+	r.pauseMu.Lock()
+	defer r.pauseMu.Unlock()
+	end := time.Now().Add(d)
+	// A new pause never shortens a running one, matching Redis
+	if end.After(r.pauseEnd) {
+		r.pauseEnd = end
+	}
+	r.pauseWritesOnly = writesOnly
+	if r.unpause == nil {
+		r.unpause = make(chan struct{})
+	}
+}
+
+// UnpauseClients lifts a pause started with PauseClients.
+func (r *Tealis) UnpauseClients() {
+	r.pauseMu.Lock()
+	defer r.pauseMu.Unlock()
+	r.pauseEnd = time.Time{}
+	if r.unpause != nil {
+		close(r.unpause)
+		r.unpause = nil
+	}
+}
+
+// waitWhilePaused blocks a command until the clients pause is over.
+func (r *Tealis) waitWhilePaused(write bool) {
+	for {
+		r.pauseMu.Lock()
+		remaining := time.Until(r.pauseEnd)
+		if remaining <= 0 || (r.pauseWritesOnly && !write) {
+			r.pauseMu.Unlock()
+			return
+		}
+		unpause := r.unpause
+		r.pauseMu.Unlock()
+
+		select {
+		case <-unpause:
+		case <-time.After(remaining):
+		}
+	}
+}
+
+func cmdClient(store *Tealis, session *Session, parts []string) protocol.Reply {
+	switch strings.ToUpper(parts[1]) {
+	case "ID":
+		if len(parts) != 2 {
+			return protocol.WrongArgs("client|id")
+		}
+		return protocol.Integer(session.ID)
+
+	case "INFO":
+		if len(parts) != 2 {
+			return protocol.WrongArgs("client|info")
+		}
+		return protocol.BulkString(session.Info() + "\n")
+
+	case "LIST":
+		return clientList(store, parts[2:])
+
+	case "SETNAME":
+		if len(parts) != 3 {
+			return protocol.WrongArgs("client|setname")
+		}
+		name := parts[2]
+		for _, c := range name {
+			if c <= ' ' || c > '~' {
+				return protocol.Error("ERR Client names cannot contain spaces, newlines or special characters.")
+			}
+		}
+		session.SetName(name)
+		return protocol.OK
+
+	case "GETNAME":
+		if len(parts) != 2 {
+			return protocol.WrongArgs("client|getname")
+		}
+		if name := session.Name(); name != "" {
+			return protocol.BulkString(name)
+		}
+		return protocol.Null{}
+
+	case "KILL":
+		return clientKill(store, session, parts[2:])
+
+	case "PAUSE":
+		if len(parts) != 3 && len(parts) != 4 {
+			return protocol.WrongArgs("client|pause")
+		}
+		ms, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil || ms < 0 {
+			return protocol.Error("ERR timeout is not an integer or out of range")
+		}
+		writesOnly := false
+		if len(parts) == 4 {
+			switch strings.ToUpper(parts[3]) {
+			case "WRITE":
+				writesOnly = true
+			case "ALL":
+			default:
+				return protocol.Error("ERR syntax error")
+			}
+		}
+		store.PauseClients(time.Duration(ms)*time.Millisecond, writesOnly)
+		return protocol.OK
+
+	case "UNPAUSE":
+		if len(parts) != 2 {
+			return protocol.WrongArgs("client|unpause")
+		}
+		store.UnpauseClients()
+		return protocol.OK
+
+	default:
+		return protocol.Errorf("unknown subcommand '%s'. Try CLIENT LIST.", parts[1])
+	}
+}
+
+// clientList implements CLIENT LIST [TYPE normal|pubsub] [ID id ...].
+func clientList(store *Tealis, args []string) protocol.Reply {
+	var kind string
+	var ids map[uint64]bool
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "TYPE":
+			if i+1 >= len(args) {
+				return protocol.Error("ERR syntax error")
+			}
+			kind = strings.ToLower(args[i+1])
+			if kind != "normal" && kind != "pubsub" {
+				return protocol.Errorf("Unknown client type '%s'", args[i+1])
+			}
+			i++
+		case "ID":
+			if i+1 >= len(args) {
+				return protocol.Error("ERR syntax error")
+			}
+			ids = make(map[uint64]bool)
+			for i++; i < len(args); i++ {
+				id, err := strconv.ParseUint(args[i], 10, 64)
+				if err != nil {
+					return protocol.Errorf("Invalid client ID")
+				}
+				ids[id] = true
+			}
+		default:
+			return protocol.Error("ERR syntax error")
+		}
+	}
+
+	var b strings.Builder
+	for _, s := range store.sortedSessions() {
+		if ids != nil && !ids[s.ID] {
+			continue
+		}
+		if kind != "" && (s.SubscriptionCount() > 0) != (kind == "pubsub") {
+			continue
+		}
+		b.WriteString(s.Info())
+		b.WriteByte('\n')
+	}
+	return protocol.BulkString(b.String())
+}
+
+// clientKill implements both the old CLIENT KILL addr:port form and the filter form
+// CLIENT KILL [ID id] [ADDR addr] [USER user] [SKIPME yes|no].
+func clientKill(store *Tealis, session *Session, args []string) protocol.Reply {
+	if len(args) == 0 {
+		return protocol.WrongArgs("client|kill")
+	}
+	if len(args) == 1 {
+		for _, s := range store.Sessions() {
+			if s.Addr == args[0] {
+				s.kill(s == session)
+				return protocol.OK
+			}
+		}
+		return protocol.Error("ERR No such client")
+	}
+	if len(args)%2 != 0 {
+		return protocol.Error("ERR syntax error")
+	}
+
+	var id uint64
+	var addr, user string
+	skipMe := true
+	for i := 0; i < len(args); i += 2 {
+		value := args[i+1]
+		switch strings.ToUpper(args[i]) {
+		case "ID":
+			n, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return protocol.Error("ERR client-id should be greater than 0")
+			}
+			id = n
+		case "ADDR":
+			addr = value
+		case "USER":
+			user = value
+		case "SKIPME":
+			switch strings.ToLower(value) {
+			case "yes":
+				skipMe = true
+			case "no":
+				skipMe = false
+			default:
+				return protocol.Error("ERR syntax error")
+			}
+		default:
+			return protocol.Error("ERR syntax error")
+		}
+	}
+
+	killed := 0
+	for _, s := range store.Sessions() {
+		if (id != 0 && s.ID != id) || (addr != "" && s.Addr != addr) || (user != "" && s.User() != user) {
+			continue
+		}
+		if s == session && skipMe {
+			continue
+		}
+		s.kill(s == session)
+		killed++
+	}
+	return protocol.Integer(killed)
+}
@@ -0,0 +1,548 @@
+package storage
+
+import (
+	"sort"
+	"strings"
+	"tealis/internal/protocol"
+)
+
+// CommandFlag describes how a command behaves. AOF logging, ACL checks and routing use the
+// flags to tell writes from reads without knowing about individual commands.
+type CommandFlag uint
+
+const (
+	// FlagWrite marks commands that may modify the dataset.
+	FlagWrite CommandFlag = 1 << iota
+	// FlagReadonly marks commands that only read data.
+	FlagReadonly
+	// FlagAdmin marks server administration commands (persistence, configuration, ...).
+	FlagAdmin
+	// FlagPubSub marks publish/subscribe commands.
+	FlagPubSub
+	// FlagBlocking marks commands that may block the client.
+	FlagBlocking
+	// FlagDangerous marks writes that drop or replace whole databases. Key patterns cannot
+	// limit them, so ACL rules grant them through @admin and @dangerous only, not @write.
+	FlagDangerous
+)
+
+var flagNames = []struct {
+	flag CommandFlag
+	name string
+}{
+	{FlagWrite, "write"},
+	{FlagReadonly, "readonly"},
+	{FlagAdmin, "admin"},
+	{FlagPubSub, "pubsub"},
+	{FlagBlocking, "blocking"},
+}
+
+// commandHandler executes a command whose arity has already been checked.
+type commandHandler func(store *Tealis, session *Session, parts []string) protocol.Reply
+
+// Command is one entry of the command table.
+type Command struct {
+	// Name is the lower-case command name as reported by COMMAND.
+	Name string
+	// Arity follows the Redis convention: a positive value is the exact number of arguments
+	// including the command name, a negative value -N means at least N arguments.
+	Arity int
+	Flags CommandFlag
+	// FirstKey, LastKey and Step locate the key arguments. LastKey may be negative to count
+	// from the end of the arguments; a FirstKey of 0 means the command takes no keys.
+	FirstKey int
+	LastKey  int
+	Step     int
+	// Group and Summary are reported by COMMAND DOCS.
+	Group   string
+	Summary string
+
+	handler commandHandler
+	// unqueued commands run immediately even while the client is inside MULTI
+	unqueued bool
+	// container commands take a subcommand as their first argument
+	container bool
+	// noAuth commands may run before the client authenticates
+	noAuth bool
+	// exclusive commands run while no other command does, like EXEC
+	exclusive bool
+}
+
+// Has reports whether the command has the given flag.
+func (c *Command) Has(flag CommandFlag) bool {
+	return c.Flags&flag != 0
+}
+
+// CheckArity reports whether a request with argc arguments (including the command name)
+// is valid for the command.
+func (c *Command) CheckArity(argc int) bool {
+	if c.Arity >= 0 {
+		return argc == c.Arity
+	}
+	return argc >= -c.Arity
+}
+
+// Keys returns the key arguments of a request for the command.
+func (c *Command) Keys(parts []string) []string {
+	if c.FirstKey <= 0 || c.FirstKey >= len(parts) {
+		return nil
+	}
+	last := c.LastKey
+	if last < 0 {
+		last = len(parts) + last
+	}
+	if last >= len(parts) {
+		last = len(parts) - 1
+	}
+	step := c.Step
+	if step <= 0 {
+		step = 1
+	}
+	var keys []string
+	for i := c.FirstKey; i <= last; i += step {
+		keys = append(keys, parts[i])
+	}
+	return keys
+}
+
+// Categories returns the ACL categories of the command, derived from its flags and group.
+// Dangerous commands are only in @admin and @dangerous, so granting the categories of their
+// flags or group, such as @write or @keyspace, does not grant them.
+func (c *Command) Categories() []string {
+	if c.Has(FlagDangerous) {
+		return []string{"@admin", "@dangerous"}
+	}
+	var categories []string
+	if c.Has(FlagWrite) {
+		categories = append(categories, "@write")
+	}
+	if c.Has(FlagReadonly) {
+		categories = append(categories, "@read")
+	}
+	if c.Has(FlagAdmin) {
+		categories = append(categories, "@admin", "@dangerous")
+	}
+	if c.Has(FlagPubSub) {
+		categories = append(categories, "@pubsub")
+	}
+	if c.Has(FlagBlocking) {
+		categories = append(categories, "@blocking")
+	}
+	if category, ok := groupCategories[c.Group]; ok {
+		categories = append(categories, category)
+	}
+	return categories
+}
+
+var groupCategories = map[string]string{
+	"generic":      "@keyspace",
+	"string":       "@string",
+	"list":         "@list",
+	"set":          "@set",
+	"sorted-set":   "@sortedset",
+	"hash":         "@hash",
+	"stream":       "@stream",
+	"geo":          "@geo",
+	"bitmap":       "@bitmap",
+	"hyperloglog":  "@hyperloglog",
+	"connection":   "@connection",
+	"transactions": "@transaction",
+	"json":         "@json",
+	"timeseries":   "@timeseries",
+	"vector":       "@vector",
+}
+
+// commandList is the command table. Keep it grouped the same way the handlers are.
+var commandList = []*Command{
+	// Connection and transactions
+	{Name: "hello", Arity: -1, Group: "connection", Summary: "Handshakes with the server and selects the protocol version", handler: cmdHello, noAuth: true},
+	{Name: "auth", Arity: -2, Group: "connection", Summary: "Authenticates the connection", handler: cmdAuth, noAuth: true},
+	{Name: "quit", Arity: -1, Group: "connection", Summary: "Closes the connection", handler: cmdQuit, unqueued: true, noAuth: true},
+	{Name: "command", Arity: -1, Group: "server", Summary: "Returns detailed information about commands", handler: cmdCommand, container: true},
+	{Name: "client", Arity: -2, Flags: FlagAdmin, Group: "connection", Summary: "Inspects, names, kills and pauses client connections", handler: cmdClient, container: true},
+	{Name: "multi", Arity: 1, Group: "transactions", Summary: "Starts a transaction", handler: cmdMulti, unqueued: true},
+	{Name: "exec", Arity: 1, Group: "transactions", Summary: "Executes all commands in a transaction", handler: cmdExec, unqueued: true},
+	{Name: "discard", Arity: 1, Group: "transactions", Summary: "Discards a transaction", handler: cmdDiscard, unqueued: true},
+	{Name: "watch", Arity: -2, FirstKey: 1, LastKey: -1, Step: 1, Group: "transactions", Summary: "Monitors changes to keys to determine the execution of a transaction", handler: cmdWatch, unqueued: true},
+	{Name: "select", Arity: 2, Group: "connection", Summary: "Changes the selected database", handler: cmdSelect},
+	{Name: "unwatch", Arity: 1, Group: "transactions", Summary: "Forgets about all watched keys", handler: cmdUnwatch},
+
+	// Keyspace
+	{Name: "del", Arity: 2, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "generic", Summary: "Deletes a key", handler: cmdDel},
+	{Name: "exists", Arity: 2, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Group: "generic", Summary: "Determines whether a key exists", handler: cmdExists},
+	{Name: "ex", Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "generic", Summary: "Sets the expiration time of a key in seconds", handler: cmdEx},
+	{Name: "expire", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "generic", Summary: "Sets the expiration time of a key in seconds", handler: cmdExpire},
+	{Name: "pexpire", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "generic", Summary: "Sets the expiration time of a key in milliseconds", handler: cmdPExpire},
+	{Name: "expireat", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "generic", Summary: "Sets the expiration time of a key to a Unix timestamp", handler: cmdExpireAt},
+	{Name: "ttl", Arity: 2, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Group: "generic", Summary: "Returns the remaining time to live of a key in seconds", handler: cmdTTL},
+	{Name: "pttl", Arity: 2, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Group: "generic", Summary: "Returns the remaining time to live of a key in milliseconds", handler: cmdPTTL},
+	{Name: "expiretime", Arity: 2, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Group: "generic", Summary: "Returns the expiration time of a key as a Unix timestamp", handler: cmdExpireTime},
+	{Name: "pexpiretime", Arity: 2, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Group: "generic", Summary: "Returns the expiration time of a key as a Unix timestamp in milliseconds", handler: cmdPExpireTime},
+	{Name: "pexpireat", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "generic", Summary: "Sets the expiration time of a key to a Unix timestamp in milliseconds", handler: cmdPExpireAt},
+	{Name: "persist", Arity: 2, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "generic", Summary: "Removes the expiration time of a key", handler: cmdPersist},
+	{Name: "keys", Arity: 2, Flags: FlagReadonly, Group: "generic", Summary: "Returns all key names that match a pattern", handler: cmdKeys},
+	{Name: "scan", Arity: -2, Flags: FlagReadonly, Group: "generic", Summary: "Iterates over the key names in the database", handler: cmdScan},
+	{Name: "move", Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "generic", Summary: "Moves a key to another database", handler: cmdMove},
+	{Name: "swapdb", Arity: 3, Flags: FlagWrite | FlagDangerous, Group: "generic", Summary: "Swaps two databases", handler: cmdSwapDB},
+	{Name: "dbsize", Arity: 1, Flags: FlagReadonly, Group: "generic", Summary: "Returns the number of keys in the database", handler: cmdDBSize},
+	{Name: "flushdb", Arity: -1, Flags: FlagWrite | FlagDangerous, Group: "generic", Summary: "Removes all keys from the current database", handler: cmdFlushDB},
+	{Name: "flushall", Arity: -1, Flags: FlagWrite | FlagDangerous, Group: "generic", Summary: "Removes all keys from all databases", handler: cmdFlushAll},
+
+	// Access control
+	{Name: "shutdown", Arity: -1, Flags: FlagAdmin, Group: "server", Summary: "Saves the database if asked to and stops the server", handler: cmdShutdown},
+	{Name: "config", Arity: -2, Flags: FlagAdmin, Group: "server", Summary: "Reads, changes and rewrites the server configuration", handler: cmdConfig, container: true},
+	{Name: "acl", Arity: -2, Flags: FlagAdmin, Group: "server", Summary: "Manages users and their permissions", handler: cmdACL, container: true},
+
+	// Persistence
+	{Name: "save", Arity: 1, Flags: FlagAdmin, Group: "server", Summary: "Synchronously saves the database to disk", handler: cmdSave, exclusive: true},
+	{Name: "bgsave", Arity: -1, Flags: FlagAdmin, Group: "server", Summary: "Asynchronously saves the database to disk", handler: cmdBgSave, exclusive: true},
+	{Name: "lastsave", Arity: 1, Flags: FlagAdmin, Group: "server", Summary: "Returns the Unix timestamp of the last successful save", handler: cmdLastSave},
+	{Name: "info", Arity: -1, Flags: FlagAdmin, Group: "server", Summary: "Returns information and statistics about the server", handler: cmdInfo},
+	{Name: "restore", Arity: -1, Flags: FlagAdmin | FlagWrite | FlagDangerous, Group: "server", Summary: "Lists snapshot generations or restores the database from one", handler: cmdRestore, exclusive: true},
+	{Name: "bgrewriteaof", Arity: 1, Flags: FlagAdmin, Group: "server", Summary: "Asynchronously rewrites the append-only file", handler: cmdBgRewriteAOF},
+	{Name: "aof", Arity: -1, Flags: FlagAdmin, Group: "server", Summary: "Reports the AOF status or rewrites the AOF", handler: cmdAOF, exclusive: true},
+
+	// Strings
+	{Name: "set", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "string", Summary: "Sets the string value of a key", handler: cmdSet},
+	{Name: "get", Arity: 2, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Group: "string", Summary: "Returns the string value of a key", handler: cmdGet},
+	{Name: "getex", Arity: -2, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "string", Summary: "Returns the string value of a key after setting its expiration time", handler: cmdGetEx},
+	{Name: "append", Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "string", Summary: "Appends a string to the value of a key", handler: cmdAppend},
+	{Name: "strlen", Arity: 2, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Group: "string", Summary: "Returns the length of a string value", handler: cmdStrLen},
+	{Name: "incr", Arity: 2, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "string", Summary: "Increments the integer value of a key by one", handler: cmdIncr},
+	{Name: "decr", Arity: 2, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "string", Summary: "Decrements the integer value of a key by one", handler: cmdDecr},
+	{Name: "incrby", Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "string", Summary: "Increments the integer value of a key by a number", handler: cmdIncrBy},
+	{Name: "decrby", Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "string", Summary: "Decrements the integer value of a key by a number", handler: cmdDecrBy},
+	{Name: "getrange", Arity: 4, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Group: "string", Summary: "Returns a substring of a string value", handler: cmdGetRange},
+	{Name: "setrange", Arity: 4, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "string", Summary: "Overwrites part of a string value from an offset", handler: cmdSetRange},
+
+	// JSON
+	{Name: "json.set", Arity: 4, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "json", Summary: "Sets the JSON value at a path", handler: cmdJSONSet},
+	{Name: "json.get", Arity: 3, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Group: "json", Summary: "Returns the JSON value at a path", handler: cmdJSONGet},
+	{Name: "json.del", Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "json", Summary: "Deletes the JSON value at a path", handler: cmdJSONDel},
+	{Name: "json.arrappend", Arity: 4, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "json", Summary: "Appends comma separated values to the JSON array at a path", handler: cmdJSONArrAppend},
+
+	// Lists
+	{Name: "lpush", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "list", Summary: "Prepends one or more elements to a list", handler: cmdLPush},
+	{Name: "rpush", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "list", Summary: "Appends one or more elements to a list", handler: cmdRPush},
+	{Name: "lpop", Arity: 2, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "list", Summary: "Removes and returns the first element of a list", handler: cmdLPop},
+	{Name: "rpop", Arity: 2, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "list", Summary: "Removes and returns the last element of a list", handler: cmdRPop},
+	{Name: "llen", Arity: 2, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Group: "list", Summary: "Returns the length of a list", handler: cmdLLen},
+	{Name: "lrange", Arity: 4, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Group: "list", Summary: "Returns a range of elements from a list", handler: cmdLRange},
+
+	// Sets
+	{Name: "sadd", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "set", Summary: "Adds one or more members to a set", handler: cmdSAdd},
+	{Name: "smembers", Arity: 2, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Group: "set", Summary: "Returns all members of a set", handler: cmdSMembers},
+	{Name: "srem", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "set", Summary: "Removes one or more members from a set", handler: cmdSRem},
+	{Name: "sismember", Arity: 3, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Group: "set", Summary: "Determines whether a member belongs to a set", handler: cmdSIsMember},
+	{Name: "sscan", Arity: -3, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Group: "set", Summary: "Iterates over members of a set", handler: cmdSScan},
+
+	// Hashes
+	{Name: "hset", Arity: 4, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "hash", Summary: "Sets the value of a field in a hash", handler: cmdHSet},
+	{Name: "hget", Arity: 3, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Group: "hash", Summary: "Returns the value of a field in a hash", handler: cmdHGet},
+	{Name: "hmset", Arity: -4, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "hash", Summary: "Sets the values of multiple fields in a hash", handler: cmdHMSet},
+	{Name: "hgetall", Arity: 2, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Group: "hash", Summary: "Returns all fields and values of a hash", handler: cmdHGetAll},
+	{Name: "hdel", Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "hash", Summary: "Deletes a field from a hash", handler: cmdHDel},
+	{Name: "hexists", Arity: 3, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Group: "hash", Summary: "Determines whether a field exists in a hash", handler: cmdHExists},
+	{Name: "hscan", Arity: -3, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Group: "hash", Summary: "Iterates over fields and values of a hash", handler: cmdHScan},
+
+	// Sorted sets
+	{Name: "zadd", Arity: 4, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "sorted-set", Summary: "Adds a member to a sorted set or updates its score", handler: cmdZAdd},
+	{Name: "zrange", Arity: 4, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Group: "sorted-set", Summary: "Returns members of a sorted set within a range of indexes", handler: cmdZRange},
+	{Name: "zscore", Arity: 3, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Group: "sorted-set", Summary: "Returns the score of a member in a sorted set", handler: cmdZScore},
+	{Name: "zrank", Arity: 3, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Group: "sorted-set", Summary: "Returns the index of a member in a sorted set", handler: cmdZRank},
+	{Name: "zrem", Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "sorted-set", Summary: "Removes a member from a sorted set", handler: cmdZRem},
+	{Name: "zrangebyscore", Arity: 4, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Group: "sorted-set", Summary: "Returns members of a sorted set within a range of scores", handler: cmdZRangeByScore},
+	{Name: "zscan", Arity: -3, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Group: "sorted-set", Summary: "Iterates over members and scores of a sorted set", handler: cmdZScan},
+
+	// Streams
+	{Name: "xadd", Arity: -5, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "stream", Summary: "Appends a new entry to a stream", handler: cmdXAdd},
+	{Name: "xread", Arity: -3, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Group: "stream", Summary: "Returns stream entries after an ID", handler: cmdXRead},
+	{Name: "xrange", Arity: 4, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Group: "stream", Summary: "Returns stream entries within a range of IDs", handler: cmdXRange},
+	{Name: "xlen", Arity: 2, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Group: "stream", Summary: "Returns the number of entries in a stream", handler: cmdXLen},
+	{Name: "xgroup", Arity: -4, Flags: FlagWrite, FirstKey: 2, LastKey: 2, Step: 1, Group: "stream", Summary: "Creates a consumer group or a consumer in one", handler: cmdXGroup, container: true},
+	{Name: "xreadgroup", Arity: -5, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "stream", Summary: "Returns stream entries for a consumer of a group", handler: cmdXReadGroup},
+	{Name: "xclaim", Arity: -6, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "stream", Summary: "Changes the consumer that stream entries of a group are pending for", handler: cmdXClaim},
+	{Name: "xack", Arity: -4, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "stream", Summary: "Acknowledges entries read by a consumer group", handler: cmdXAck},
+
+	// Geospatial
+	{Name: "geoadd", Arity: -5, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "geo", Summary: "Adds one or more members to a geospatial index", handler: cmdGeoAdd},
+	{Name: "geodist", Arity: -4, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Group: "geo", Summary: "Returns the distance between two members of a geospatial index", handler: cmdGeoDist},
+	{Name: "georadius", Arity: -6, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Group: "geo", Summary: "Returns members of a geospatial index within a radius", handler: cmdGeoRadius},
+
+	// Bitmaps
+	{Name: "setbit", Arity: 4, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "bitmap", Summary: "Sets or clears the bit at an offset", handler: cmdSetBit},
+	{Name: "getbit", Arity: 3, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Group: "bitmap", Summary: "Returns the bit value at an offset", handler: cmdGetBit},
+	{Name: "bitcount", Arity: 2, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Group: "bitmap", Summary: "Counts the set bits in a string", handler: cmdBitCount},
+	{Name: "bitrestore", Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "bitmap", Summary: "Recreates a bitmap from its bytes, as written by AOF rewrites", handler: cmdBitRestore},
+	{Name: "bitop", Arity: -4, Flags: FlagWrite, FirstKey: 2, LastKey: -1, Step: 1, Group: "bitmap", Summary: "Performs bitwise operations on strings and stores the result", handler: cmdBitOp},
+	{Name: "bitfield", Arity: -5, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "bitmap", Summary: "Reads, sets or increments an integer field of a bitmap", handler: cmdBitField},
+
+	// HyperLogLog
+	{Name: "pfadd", Arity: -2, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "hyperloglog", Summary: "Adds elements to a HyperLogLog", handler: cmdPFAdd},
+	{Name: "pfrestore", Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "hyperloglog", Summary: "Recreates a HyperLogLog from its registers, as written by AOF rewrites", handler: cmdPFRestore},
+	{Name: "pfmerge", Arity: -2, Flags: FlagWrite, FirstKey: 1, LastKey: -1, Step: 1, Group: "hyperloglog", Summary: "Merges HyperLogLogs into one", handler: cmdPFMerge},
+	{Name: "pfcount", Arity: -2, Flags: FlagReadonly, FirstKey: 1, LastKey: -1, Step: 1, Group: "hyperloglog", Summary: "Returns the approximate cardinality of HyperLogLogs", handler: cmdPFCount},
+
+	// Time series
+	{Name: "ts.create", Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "timeseries", Summary: "Creates a time series", handler: cmdTSCreate},
+	{Name: "ts.add", Arity: 4, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "timeseries", Summary: "Appends a sample to a time series", handler: cmdTSAdd},
+	{Name: "ts.range", Arity: 4, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Group: "timeseries", Summary: "Returns samples within a time range", handler: cmdTSRange},
+	{Name: "ts.get", Arity: 2, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Group: "timeseries", Summary: "Returns the latest sample of a time series", handler: cmdTSGet},
+
+	// Pub/sub
+	{Name: "subscribe", Arity: 2, Flags: FlagPubSub, Group: "pubsub", Summary: "Listens for messages published to a channel", handler: cmdSubscribe},
+	{Name: "unsubscribe", Arity: 2, Flags: FlagPubSub, Group: "pubsub", Summary: "Stops listening to a channel", handler: cmdUnsubscribe},
+	{Name: "psubscribe", Arity: 2, Flags: FlagPubSub, Group: "pubsub", Summary: "Listens for messages published to channels matching a pattern", handler: cmdPSubscribe},
+	{Name: "punsubscribe", Arity: 2, Flags: FlagPubSub, Group: "pubsub", Summary: "Stops listening to a pattern", handler: cmdPUnsubscribe},
+	{Name: "publish", Arity: -3, Flags: FlagPubSub, Group: "pubsub", Summary: "Posts a message to a channel", handler: cmdPublish},
+
+	// Vectors
+	{Name: "vector.set", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Group: "vector", Summary: "Stores a vector", handler: cmdVectorSet},
+	{Name: "vector.get", Arity: 2, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Group: "vector", Summary: "Returns a vector", handler: cmdVectorGet},
+	{Name: "vector.search", Arity: -4, Flags: FlagReadonly, Group: "vector", Summary: "Returns the k vectors nearest to a query", handler: cmdVectorSearch},
+}
+
+// commandAliases maps shorthand names to the commands they stand for.
+var commandAliases = map[string]string{
+	"SUB": "SUBSCRIBE",
+	"PUB": "PUBLISH",
+}
+
+// commands indexes the command table by upper-case name.
+var commands = map[string]*Command{}
+
+func init() {
+	for _, cmd := range commandList {
+		commands[strings.ToUpper(cmd.Name)] = cmd
+	}
+}
+
+// LookupCommand finds a command by name, case-insensitively.
+func LookupCommand(name string) (*Command, bool) {
+	name = strings.ToUpper(name)
+	if target, ok := commandAliases[name]; ok {
+		name = target
+	}
+	cmd, ok := commands[name]
+	return cmd, ok
+}
+
+// ProcessCommand looks the command up in the command table, checks its arity and runs it.
+func ProcessCommand(parts []string, store *Tealis, session *Session) protocol.Reply {
+	if len(parts) == 0 {
+		return protocol.Error("ERR Empty command")
+	}
+	if store.shuttingDown.Load() {
+		return protocol.Error("ERR Server is shutting down")
+	}
+	cmd, ok := LookupCommand(parts[0])
+	if !ok {
+		// A command rejected while queueing makes the whole transaction fail at EXEC
+		session.flagMultiError()
+		return protocol.Errorf("unknown command '%s'", parts[0])
+	}
+	if !cmd.CheckArity(len(parts)) {
+		session.flagMultiError()
+		return protocol.WrongArgs(cmd.Name)
+	}
+	session.recordCommand(cmd, parts)
+	if denied := store.checkPermissions(session, cmd, parts); denied != nil {
+		session.flagMultiError()
+		return denied
+	}
+	if session.InMulti() && !cmd.unqueued {
+		return store.APPENDTO(session, parts)
+	}
+	// CLIENT itself is never paused so that CLIENT UNPAUSE can get through
+	if cmd.Name != "client" {
+		store.waitWhilePaused(cmd.Has(FlagWrite) || cmd.Name == "exec")
+	}
+	if cmd.Name == "exec" {
+		// EXEC takes the execution lock exclusively itself
+		return cmd.handler(store, session, parts)
+	}
+
+	if cmd.exclusive {
+		store.execMu.Lock()
+		defer store.execMu.Unlock()
+		return store.selected(session).call(cmd, session, parts)
+	}
+
+	store.execMu.RLock()
+	defer store.execMu.RUnlock()
+	return store.selected(session).call(cmd, session, parts)
+}
+
+// call runs a validated command against the database r. The caller must hold execMu.
+func (r *Tealis) call(cmd *Command, session *Session, parts []string) protocol.Reply {
+	keys := cmd.Keys(parts)
+	var before int64
+	if cmd.Has(FlagWrite) {
+		// Reads run side by side; writes run one at a time up to their AOF entry
+		r.writeMu.Lock()
+		defer r.writeMu.Unlock()
+		r.expireKeysLocked(keys)
+		before = r.changes
+	} else {
+		r.expireKeys(keys)
+	}
+	missing := r.missingKeys(cmd, keys)
+	if cmd.Has(FlagWrite) {
+		r.preserveForSave(cmd, parts)
+	}
+	reply := cmd.handler(r, session, parts)
+	if !protocol.IsError(reply) {
+		r.notifyCommand(cmd, parts, reply, missing)
+	}
+	if !cmd.Has(FlagWrite) {
+		return reply
+	}
+	if n := r.changes - before; n > 0 {
+		// Only writes that changed data are logged; the AOF is not fed while it is replayed,
+		// nor by admin commands such as RESTORE that rewrite it themselves
+		if !r.loading.Load() && !cmd.Has(FlagAdmin) {
+			r.feedAOF(cmd, parts, reply)
+			r.dirty.Add(n)
+		}
+		// Invalidate transactions watching the keys; keyless writes may touch anything
+		if len(keys) > 0 {
+			r.touch(keys...)
+		} else {
+			r.touchAll()
+		}
+	}
+	return reply
+}
+
+// changed records that the running write command made n changes: keys, members, fields or
+// expiries it set or removed. Write handlers call it; a write that changed nothing is not
+// logged to the AOF, does not count as unsaved and does not abort transactions WATCHing its
+// keys.
+func (r *Tealis) changed(n int) {
+	r.changes += int64(n)
+}
+
+// sortedCommands returns the command table ordered by name.
+func sortedCommands() []*Command {
+	list := make([]*Command, 0, len(commands))
+	for _, cmd := range commands {
+		list = append(list, cmd)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func cmdCommand(store *Tealis, session *Session, parts []string) protocol.Reply {
+	if len(parts) == 1 {
+		infos := make(protocol.Array, 0, len(commands))
+		for _, cmd := range sortedCommands() {
+			infos = append(infos, commandInfo(cmd))
+		}
+		return infos
+	}
+
+	switch strings.ToUpper(parts[1]) {
+	case "COUNT":
+		if len(parts) != 2 {
+			return protocol.WrongArgs("command|count")
+		}
+		return protocol.Integer(len(commands))
+
+	case "LIST":
+		if len(parts) != 2 {
+			return protocol.WrongArgs("command|list")
+		}
+		names := make([]string, 0, len(commands))
+		for _, cmd := range sortedCommands() {
+			names = append(names, cmd.Name)
+		}
+		return protocol.StringArray(names)
+
+	case "INFO":
+		if len(parts) == 2 {
+			return cmdCommand(store, session, parts[:1])
+		}
+		infos := make(protocol.Array, 0, len(parts)-2)
+		for _, name := range parts[2:] {
+			if cmd, ok := LookupCommand(name); ok {
+				infos = append(infos, commandInfo(cmd))
+			} else {
+				infos = append(infos, protocol.NullArray{})
+			}
+		}
+		return infos
+
+	case "DOCS":
+		list := sortedCommands()
+		if len(parts) > 2 {
+			list = list[:0]
+			for _, name := range parts[2:] {
+				if cmd, ok := LookupCommand(name); ok {
+					list = append(list, cmd)
+				}
+			}
+		}
+		docs := make(protocol.Map, 0, len(list))
+		for _, cmd := range list {
+			docs = append(docs, protocol.MapEntry{Key: protocol.BulkString(cmd.Name), Value: commandDocs(cmd)})
+		}
+		return docs
+
+	case "GETKEYS":
+		if len(parts) < 3 {
+			return protocol.WrongArgs("command|getkeys")
+		}
+		cmd, ok := LookupCommand(parts[2])
+		if !ok {
+			return protocol.Error("ERR Invalid command specified")
+		}
+		args := parts[2:]
+		if !cmd.CheckArity(len(args)) {
+			return protocol.Error("ERR Invalid number of arguments specified for command")
+		}
+		keys := cmd.Keys(args)
+		if len(keys) == 0 {
+			return protocol.Error("ERR The command has no key arguments")
+		}
+		return protocol.StringArray(keys)
+
+	default:
+		return protocol.Errorf("unknown subcommand '%s'. Try COMMAND DOCS.", parts[1])
+	}
+}
+
+// commandInfo builds the COMMAND INFO entry of a command: name, arity, flags, first key,
+// last key, step, ACL categories, tips, key specs and subcommands.
+func commandInfo(cmd *Command) protocol.Reply {
+	flags := protocol.Set{}
+	for _, f := range flagNames {
+		if cmd.Has(f.flag) {
+			flags = append(flags, protocol.SimpleString(f.name))
+		}
+	}
+	categories := protocol.Set{}
+	for _, category := range cmd.Categories() {
+		categories = append(categories, protocol.SimpleString(category))
+	}
+	return protocol.Array{
+		protocol.BulkString(cmd.Name),
+		protocol.Integer(cmd.Arity),
+		flags,
+		protocol.Integer(cmd.FirstKey),
+		protocol.Integer(cmd.LastKey),
+		protocol.Integer(cmd.Step),
+		categories,
+		protocol.Array{},
+		protocol.Array{},
+		protocol.Array{},
+	}
+}
+
+// commandDocs builds the COMMAND DOCS entry of a command.
+func commandDocs(cmd *Command) protocol.Reply {
+	return protocol.Map{
+		{Key: protocol.BulkString("summary"), Value: protocol.BulkString(cmd.Summary)},
+		{Key: protocol.BulkString("since"), Value: protocol.BulkString(Version)},
+		{Key: protocol.BulkString("group"), Value: protocol.BulkString(cmd.Group)},
+	}
+}
@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"tealis/internal/config"
+	"tealis/internal/logging"
+	"tealis/internal/protocol"
+)
+
+// Config returns a copy of the current settings.
+func (r *Tealis) Config() config.Config {
+	r.configMu.RLock()
+	defer r.configMu.RUnlock()
+	return r.config
+}
+
+// SetConfig changes settings at runtime from name/value pairs, like CONFIG SET. Either all
+// of them are applied or, if one is invalid or immutable, none is.
+func (r *Tealis) SetConfig(pairs ...string) error {
+	if len(pairs)%2 != 0 {
+		return fmt.Errorf("wrong number of arguments for 'config|set' command")
+	}
+	r.configMu.Lock()
+	defer r.configMu.Unlock()
+
+	updated := r.config
+	seen := make(map[string]bool)
+	for i := 0; i < len(pairs); i += 2 {
+		name, value := strings.ToLower(pairs[i]), pairs[i+1]
+		if seen[name] {
+			return fmt.Errorf("CONFIG SET failed (possibly related to argument '%s') - duplicate parameter", name)
+		}
+		seen[name] = true
+		if _, ok := updated.Get(name); ok && !config.Mutable(name) {
+			return fmt.Errorf("CONFIG SET failed (possibly related to argument '%s') - can't set immutable config", name)
+		}
+		if err := updated.Set(name, value); err != nil {
+			return fmt.Errorf("CONFIG SET failed (possibly related to argument '%s') - %v", name, err)
+		}
+	}
+	if err := r.applyConfig(r.config, updated); err != nil {
+		return fmt.Errorf("CONFIG SET failed - %v", err)
+	}
+	r.config = updated
+	return nil
+}
+
+// applyConfig puts into effect the settings that changed at runtime. Settings read on use,
+// like maxclients and timeout, need nothing here.
+func (r *Tealis) applyConfig(old, updated config.Config) error {
+	if updated.AppendOnly != old.AppendOnly {
+		if err := r.setAppendOnly(updated.AppendOnly); err != nil {
+			return err
+		}
+	}
+	r.notifyEvents.Store(int64(updated.NotifyKeyspaceEvents))
+	if updated.LogLevel != old.LogLevel {
+		level, _ := logging.ParseLevel(updated.LogLevel)
+		logging.SetLevel(level)
+	}
+	return nil
+}
+
+// setAppendOnly turns the AOF on or off.
+func (r *Tealis) setAppendOnly(enable bool) error {
+	r.aofMu.Lock()
+	defer r.aofMu.Unlock()
+
+	if !enable {
+		r.enableAOF = false
+		if r.AofFile != nil {
+			r.AofFile.Sync()
+			r.AofFile.Close()
+			r.AofFile = nil
+		}
+		log.Printf("AOF disabled")
+		return nil
+	}
+	if err := os.MkdirAll(r.aofFilePath, 0755); err != nil {
+		return fmt.Errorf("failed to create AOF directory: %w", err)
+	}
+	if err := r.openAOF(); err != nil {
+		return err
+	}
+	r.enableAOF = true
+	log.Printf("AOF enabled")
+	return nil
+}
+
+// MaxClientsReached reports whether a new connection would exceed maxclients.
+func (r *Tealis) MaxClientsReached() bool {
+	maxClients := r.Config().MaxClients
+	r.sessionsMu.Lock()
+	defer r.sessionsMu.Unlock()
+	return len(r.sessions) >= maxClients
+}
+
+func cmdConfig(store *Tealis, session *Session, parts []string) protocol.Reply {
+	switch strings.ToUpper(parts[1]) {
+	case "GET":
+		if len(parts) < 3 {
+			return protocol.WrongArgs("config|get")
+		}
+		cfg := store.Config()
+		reply := protocol.Map{}
+		for _, name := range config.Names() {
+			for _, pattern := range parts[2:] {
+				if globMatch(strings.ToLower(pattern), name) {
+					value, _ := cfg.Get(name)
+					reply = append(reply, protocol.MapEntry{Key: protocol.BulkString(name), Value: protocol.BulkString(value)})
+					break
+				}
+			}
+		}
+		return reply
+
+	case "SET":
+		if len(parts) < 4 || len(parts)%2 != 0 {
+			return protocol.WrongArgs("config|set")
+		}
+		if err := store.SetConfig(parts[2:]...); err != nil {
+			return protocol.Errorf("%v", err)
+		}
+		return protocol.OK
+
+	case "REWRITE":
+		if len(parts) != 2 {
+			return protocol.WrongArgs("config|rewrite")
+		}
+		cfg := store.Config()
+		if cfg.File() == "" {
+			return protocol.Error("ERR The server is running without a config file")
+		}
+		if err := cfg.Rewrite(); err != nil {
+			return protocol.Errorf("Rewriting config file: %v", err)
+		}
+		return protocol.OK
+
+	default:
+		return protocol.Errorf("unknown subcommand '%s'. Try CONFIG GET, CONFIG SET or CONFIG REWRITE.", parts[1])
+	}
+}
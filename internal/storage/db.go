@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"tealis/internal/config"
+	"tealis/internal/protocol"
+	"time"
+)
+
+// A server has the number of databases the databases setting asks for, numbered from 0.
+// Sessions start in database 0 and SELECT another; everything that reads or writes keys runs
+// against the selected one. Keys are only ever looked up within one database, so the same
+// name in two databases is two unrelated keys.
+
+// dbKey names a key of one database, for the state kept across databases.
+type dbKey struct {
+	db  int
+	key string
+}
+
+// keyspace holds the keys of one database and their expiries.
+type keyspace struct {
+	store    map[string]interface{}
+	expiries map[string]time.Time
+}
+
+func newKeyspace() keyspace {
+	return keyspace{store: make(map[string]interface{}), expiries: make(map[string]time.Time)}
+}
+
+// selected returns the database the session selected.
+func (r *Tealis) selected(s *Session) *Tealis {
+	return r.dbs[s.DB()]
+}
+
+// database returns the database an index argument names.
+func (r *Tealis) database(index string) (*Tealis, error) {
+	i, err := strconv.Atoi(index)
+	if err != nil {
+		return nil, errInvalidDBIndex
+	}
+	if i < 0 || i >= len(r.dbs) {
+		return nil, errDBIndexOutOfRange
+	}
+	return r.dbs[i], nil
+}
+
+var (
+	errInvalidDBIndex    = errors.New("ERR invalid DB index")
+	errDBIndexOutOfRange = errors.New("ERR DB index is out of range")
+)
+
+// setKeyspacesLocked replaces the keys of every database, emptying the databases spaces has
+// none for. The caller must hold Mu exclusively.
+func (r *Tealis) setKeyspacesLocked(spaces []keyspace) error {
+	for i := len(r.dbs); i < len(spaces); i++ {
+		if len(spaces[i].store) > 0 {
+			return fmt.Errorf("database %d has keys but the databases setting is %d", i, len(r.dbs))
+		}
+	}
+	for i, db := range r.dbs {
+		space := newKeyspace()
+		if i < len(spaces) {
+			space = spaces[i]
+		}
+		db.Store, db.Expiries = space.store, space.expiries
+		db.scan = &scanIndexes{}
+	}
+	return nil
+}
+
+// keyCount returns how many keys the databases hold altogether, expired or not.
+func (r *Tealis) keyCount() int {
+	r.Mu.RLock()
+	defer r.Mu.RUnlock()
+	keys := 0
+	for _, db := range r.dbs {
+		keys += len(db.Store)
+	}
+	return keys
+}
+
+// DBSize returns the number of keys in the database that have not expired.
+func (r *Tealis) DBSize() int {
+	r.Mu.RLock()
+	defer r.Mu.RUnlock()
+	size := len(r.Store)
+	now := time.Now()
+	for key := range r.Expiries {
+		if r.expiredLocked(key, now) {
+			size--
+		}
+	}
+	return size
+}
+
+// Move moves a key and its expiry to another database and reports whether it did. A key
+// that already exists in the other database is left where it is.
+func (r *Tealis) Move(key string, dest *Tealis) bool {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+
+	now := time.Now()
+	if !r.liveLocked(key, now) || dest.liveLocked(key, now) {
+		return false
+	}
+	dest.setLocked(key, r.Store[key])
+	if expiry, ok := r.Expiries[key]; ok {
+		dest.Expiries[key] = expiry
+	}
+	r.deleteLocked(key)
+	delete(r.Expiries, key)
+	return true
+}
+
+// SwapDB swaps the keys of two databases. Clients that selected either one see the keys of
+// the other from then on.
+func (r *Tealis) SwapDB(a, b *Tealis) {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	a.Store, b.Store = b.Store, a.Store
+	a.Expiries, b.Expiries = b.Expiries, a.Expiries
+	a.scan, b.scan = b.scan, a.scan
+}
+
+// FlushDB deletes every key of the database.
+func (r *Tealis) FlushDB() {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	r.Store, r.Expiries = make(map[string]interface{}), make(map[string]time.Time)
+	r.scan = &scanIndexes{}
+}
+
+// FlushAll deletes every key of every database.
+func (r *Tealis) FlushAll() {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	r.setKeyspacesLocked(nil)
+}
+
+func cmdSelect(store *Tealis, session *Session, parts []string) protocol.Reply {
+	db, err := store.database(parts[1])
+	if err != nil {
+		return errorReply(err)
+	}
+	session.mu.Lock()
+	session.db = db.db
+	session.mu.Unlock()
+	return protocol.OK
+}
+
+func cmdMove(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key := parts[1]
+	dest, err := store.database(parts[2])
+	if err != nil {
+		return errorReply(err)
+	}
+	if dest == store {
+		return protocol.Error("ERR source and destination objects are the same")
+	}
+	// An expired key in the destination is deleted, and logged as such, before the key
+	// moves in over it
+	dest.expireKeysLocked([]string{key})
+	if !store.Move(key, dest) {
+		return protocol.Integer(0)
+	}
+	store.changed(1)
+	dest.touch(key)
+	return protocol.Integer(1)
+}
+
+func cmdSwapDB(store *Tealis, session *Session, parts []string) protocol.Reply {
+	a, err := store.database(parts[1])
+	if err != nil {
+		return errorReply(err)
+	}
+	b, err := store.database(parts[2])
+	if err != nil {
+		return errorReply(err)
+	}
+	store.SwapDB(a, b)
+	store.changed(1)
+	return protocol.OK
+}
+
+func cmdDBSize(store *Tealis, session *Session, parts []string) protocol.Reply {
+	return protocol.Integer(store.DBSize())
+}
+
+// parseFlushMode checks the optional ASYNC or SYNC of FLUSHDB and FLUSHALL. Dropping the
+// key maps is as fast either way; the garbage collector frees the keys in the background.
+func parseFlushMode(parts []string) bool {
+	if len(parts) == 1 {
+		return true
+	}
+	mode := strings.ToUpper(parts[1])
+	return len(parts) == 2 && (mode == "ASYNC" || mode == "SYNC")
+}
+
+func cmdFlushDB(store *Tealis, session *Session, parts []string) protocol.Reply {
+	if !parseFlushMode(parts) {
+		return protocol.Error("ERR syntax error")
+	}
+	store.FlushDB()
+	store.changed(1)
+	return protocol.OK
+}
+
+func cmdFlushAll(store *Tealis, session *Session, parts []string) protocol.Reply {
+	if !parseFlushMode(parts) {
+		return protocol.Error("ERR syntax error")
+	}
+	store.FlushAll()
+	store.changed(1)
+	return protocol.OK
+}
+
+// notifyMove publishes the move_from event of a key MOVE moved in the source database and
+// its move_to event in the destination.
+func (r *Tealis) notifyMove(key, db string) {
+	dest, err := r.database(db)
+	if err != nil {
+		return
+	}
+	r.notifyKeyspaceEvent(config.NotifyGeneric, "move_from", key)
+	dest.notifyKeyspaceEvent(config.NotifyGeneric, "move_to", key)
+}
@@ -0,0 +1,492 @@
+package storage
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"tealis/internal/config"
+	"tealis/internal/protocol"
+	"time"
+)
+
+// Conditions of EXPIRE and its variants. A key without an expiry counts as expiring never,
+// so GT never applies to it and LT always does.
+const (
+	expireNX = 1 << iota // only if the key has no expiry
+	expireXX             // only if the key has an expiry
+	expireGT             // only if the new expiry is later
+	expireLT             // only if the new expiry is earlier
+)
+
+// Keys expire lazily, when a command or accessor finds them expired, and actively, when
+// StartCleanup samples them. Either way expiredLocked is the one check that decides.
+
+// expiredLocked reports whether a key has an expiry that passed. Nothing expires while the AOF
+// is replayed: the AOF logs every expiry that happened as a DEL, and expiring keys early
+// would replay later writes onto missing keys. The caller must hold Mu.
+func (r *Tealis) expiredLocked(key string, now time.Time) bool {
+	expiry, ok := r.Expiries[key]
+	return ok && !expiry.After(now) && !r.loading.Load()
+}
+
+// liveLocked reports whether a key exists and has not expired. The caller must hold Mu.
+func (r *Tealis) liveLocked(key string, now time.Time) bool {
+	_, ok := r.Store[key]
+	return ok && !r.expiredLocked(key, now)
+}
+
+// lookupLocked returns the value of a key for reading, nil if it is missing or expired. The
+// caller must hold Mu, shared or exclusively.
+func (r *Tealis) lookupLocked(key string) interface{} {
+	if r.expiredLocked(key, time.Now()) {
+		return nil
+	}
+	return r.Store[key]
+}
+
+// lookupWriteLocked returns the value of a key for writing, nil if it is missing or expired.
+// An expired key is deleted first so a write never inherits its expiry. The caller must hold
+// Mu exclusively.
+func (r *Tealis) lookupWriteLocked(key string) interface{} {
+	if r.expiredLocked(key, time.Now()) {
+		r.deleteLocked(key)
+		delete(r.Expiries, key)
+		return nil
+	}
+	return r.Store[key]
+}
+
+// valueOf checks the type of a value looked up in the store. It reports false if the key does
+// not exist and fails with WRONGTYPE if the key holds another type.
+func valueOf[T any](value interface{}) (T, bool, error) {
+	var zero T
+	if value == nil {
+		return zero, false, nil
+	}
+	v, ok := value.(T)
+	if !ok {
+		return zero, false, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+	}
+	return v, true, nil
+}
+
+// expireKeys deletes those of a command's keys that expired before it runs, and logs their
+// deletion to the AOF so replaying it sees the same keys the command saw.
+func (r *Tealis) expireKeys(keys []string) {
+	if !r.anyExpired(keys, time.Now()) {
+		return
+	}
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	r.expireKeysLocked(keys)
+}
+
+// anyExpired reports whether any of the keys has an expiry that passed.
+func (r *Tealis) anyExpired(keys []string, now time.Time) bool {
+	r.Mu.RLock()
+	defer r.Mu.RUnlock()
+	for _, key := range keys {
+		if r.expiredLocked(key, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// expireKeysLocked is expireKeys for callers that hold writeMu.
+func (r *Tealis) expireKeysLocked(keys []string) {
+	now := time.Now()
+	if !r.anyExpired(keys, now) {
+		return
+	}
+
+	r.Mu.Lock()
+	var deleted []string
+	for _, key := range keys {
+		if r.expiredLocked(key, now) {
+			r.deleteLocked(key)
+			delete(r.Expiries, key)
+			deleted = append(deleted, key)
+		}
+	}
+	r.Mu.Unlock()
+	r.logExpired(deleted)
+}
+
+// logExpired logs keys that expired as DELs, counts them as changes and notifies them.
+func (r *Tealis) logExpired(keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	entries := make([][]string, len(keys))
+	for i, key := range keys {
+		entries[i] = []string{"DEL", key}
+	}
+	r.logAOF(entries)
+	r.dirty.Add(int64(len(keys)))
+	r.touch(keys...)
+	for _, key := range keys {
+		r.notifyKeyspaceEvent(config.NotifyExpired, "expired", key)
+	}
+}
+
+// Active expiry samples keys with an expiry rather than scanning them all, so its cost
+// follows the number of keys that expired instead of the number of keys.
+const (
+	activeExpireInterval = 100 * time.Millisecond
+	activeExpireSample   = 20                    // keys checked per round
+	activeExpireBudget   = 25 * time.Millisecond // time a cycle may take
+)
+
+// activeExpireCycle deletes expired keys of every database within the budget. A cycle that
+// runs out of budget carries on with the next database the next time.
+func (r *Tealis) activeExpireCycle(budget time.Duration) {
+	deadline := time.Now().Add(budget)
+	for range r.dbs {
+		db := r.dbs[r.activeExpireNext]
+		r.activeExpireNext = (r.activeExpireNext + 1) % len(r.dbs)
+		db.activeExpireDB(deadline)
+		if !time.Now().Before(deadline) {
+			return
+		}
+	}
+}
+
+// activeExpireDB deletes expired keys of the database in rounds of activeExpireSample keys,
+// going on while more than a quarter of a round had expired and the deadline is not reached.
+func (r *Tealis) activeExpireDB(deadline time.Time) {
+	for {
+		// Expiring keys between the commands of a running EXEC would break its atomicity
+		r.execMu.RLock()
+		r.writeMu.Lock()
+		now := time.Now()
+		r.Mu.Lock()
+		sampled := 0
+		var expired []string
+		// Iterating a map starts at a random key, which makes the first keys a random sample
+		for key := range r.Expiries {
+			if sampled == activeExpireSample {
+				break
+			}
+			sampled++
+			if r.expiredLocked(key, now) {
+				r.deleteLocked(key)
+				delete(r.Expiries, key)
+				expired = append(expired, key)
+			}
+		}
+		r.Mu.Unlock()
+		r.logExpired(expired)
+		r.writeMu.Unlock()
+		r.execMu.RUnlock()
+
+		if sampled < activeExpireSample || len(expired)*4 <= sampled || !time.Now().Before(deadline) {
+			return
+		}
+	}
+}
+
+// ExpireAt sets an absolute expiry on an existing key if the conditions allow it and reports
+// whether it did. An expiry that already passed deletes the key, except while the AOF is
+// loaded: the commands logged after it ran while the key was alive, so it stays until the
+// first lookup after loading.
+func (r *Tealis) ExpireAt(key string, at time.Time, conditions int) bool {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+
+	now := time.Now()
+	if !r.liveLocked(key, now) {
+		return false
+	}
+	current, hasExpiry := r.Expiries[key]
+	switch {
+	case conditions&expireNX != 0 && hasExpiry,
+		conditions&expireXX != 0 && !hasExpiry,
+		conditions&expireGT != 0 && (!hasExpiry || !at.After(current)),
+		conditions&expireLT != 0 && hasExpiry && !at.Before(current):
+		return false
+	}
+	if !at.After(now) && !r.loading.Load() {
+		r.deleteLocked(key)
+		delete(r.Expiries, key)
+		return true
+	}
+	r.Expiries[key] = at
+	return true
+}
+
+// EX sets a relative expiry on an existing key and reports whether it did.
+func (r *Tealis) EX(key string, duration time.Duration) bool {
+	return r.ExpireAt(key, time.Now().Add(duration), 0)
+}
+
+// PExpireAt sets an absolute expiry time on an existing key.
+func (r *Tealis) PExpireAt(key string, at time.Time) bool {
+	return r.ExpireAt(key, at, 0)
+}
+
+// PTTL returns the remaining time to live of a key in milliseconds, -1 if it has no expiry
+// and -2 if it does not exist.
+func (r *Tealis) PTTL(key string) int64 {
+	r.Mu.RLock()
+	defer r.Mu.RUnlock()
+
+	now := time.Now()
+	if !r.liveLocked(key, now) {
+		return -2
+	}
+	expiry, ok := r.Expiries[key]
+	if !ok {
+		return -1
+	}
+	return expiry.Sub(now).Milliseconds()
+}
+
+// TTL returns the remaining time to live of a key in seconds, rounded, -1 if it has no
+// expiry and -2 if it does not exist.
+func (r *Tealis) TTL(key string) int64 {
+	ttl := r.PTTL(key)
+	if ttl < 0 {
+		return ttl
+	}
+	return (ttl + 500) / 1000
+}
+
+// ExpireTime returns the time a key expires at, with ok false if it does not exist; a key
+// without an expiry returns the zero time.
+func (r *Tealis) ExpireTime(key string) (time.Time, bool) {
+	r.Mu.RLock()
+	defer r.Mu.RUnlock()
+
+	if !r.liveLocked(key, time.Now()) {
+		return time.Time{}, false
+	}
+	return r.Expiries[key], true
+}
+
+// PERSIST removes the expiry from a key, making it persistent.
+func (r *Tealis) PERSIST(key string) int {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+
+	if !r.liveLocked(key, time.Now()) {
+		return 0
+	}
+	if _, exists := r.Expiries[key]; exists {
+		delete(r.Expiries, key)
+		return 1
+	}
+	return 0 // Key exists but has no expiry
+}
+
+// expiryOf returns the expiry time of a key, if it has one.
+func (r *Tealis) expiryOf(key string) (time.Time, bool) {
+	r.Mu.RLock()
+	defer r.Mu.RUnlock()
+	at, ok := r.Expiries[key]
+	return at, ok
+}
+
+// expiryUnits are the units of the expiry arguments of EXPIRE, SET and GETEX: relative
+// seconds or milliseconds, or absolute Unix seconds or milliseconds.
+var expiryUnits = map[string]struct {
+	unit     time.Duration
+	absolute bool
+}{
+	"EX":   {time.Second, false},
+	"PX":   {time.Millisecond, false},
+	"EXAT": {time.Second, true},
+	"PXAT": {time.Millisecond, true},
+}
+
+var errInvalidExpire = errors.New("invalid expire time")
+
+// parseExpiry turns an expiry argument into the time it stands for. SET and GETEX only
+// accept positive ones; EXPIRE also accepts those that already passed.
+func parseExpiry(value string, unit time.Duration, absolute, positive bool) (time.Time, error) {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, errors.New("value is not an integer or out of range")
+	}
+	if positive && n <= 0 {
+		return time.Time{}, errInvalidExpire
+	}
+	// Keep the result within what time.Time and Unix milliseconds hold
+	limit := int64(math.MaxInt64 / 2 / int64(unit))
+	if n > limit || n < -limit {
+		return time.Time{}, errInvalidExpire
+	}
+	if absolute {
+		return time.UnixMilli(0).Add(time.Duration(n) * unit), nil
+	}
+	return time.Now().Add(time.Duration(n) * unit), nil
+}
+
+// parseExpireConditions parses the NX, XX, GT and LT options of EXPIRE.
+func parseExpireConditions(options []string) (int, protocol.Reply) {
+	conditions := 0
+	for _, option := range options {
+		switch strings.ToUpper(option) {
+		case "NX":
+			conditions |= expireNX
+		case "XX":
+			conditions |= expireXX
+		case "GT":
+			conditions |= expireGT
+		case "LT":
+			conditions |= expireLT
+		default:
+			return 0, protocol.Errorf("Unsupported option %s", option)
+		}
+	}
+	if conditions&expireNX != 0 && conditions != expireNX {
+		return 0, protocol.Error("ERR NX and XX, GT or LT options at the same time are not compatible")
+	}
+	if conditions&expireGT != 0 && conditions&expireLT != 0 {
+		return 0, protocol.Error("ERR GT and LT options at the same time are not compatible")
+	}
+	return conditions, nil
+}
+
+// expireCommand builds the handler of EXPIRE, PEXPIRE, EXPIREAT or PEXPIREAT.
+func expireCommand(unit time.Duration, absolute bool) commandHandler {
+	return func(store *Tealis, session *Session, parts []string) protocol.Reply {
+		conditions, errReply := parseExpireConditions(parts[3:])
+		if errReply != nil {
+			return errReply
+		}
+		at, err := parseExpiry(parts[2], unit, absolute, false)
+		if errors.Is(err, errInvalidExpire) {
+			return protocol.Errorf("invalid expire time in '%s' command", strings.ToLower(parts[0]))
+		}
+		if err != nil {
+			return protocol.Errorf("%v", err)
+		}
+		if store.ExpireAt(parts[1], at, conditions) {
+			store.changed(1)
+			return protocol.Integer(1)
+		}
+		return protocol.Integer(0)
+	}
+}
+
+var (
+	cmdExpire    = expireCommand(time.Second, false)
+	cmdPExpire   = expireCommand(time.Millisecond, false)
+	cmdExpireAt  = expireCommand(time.Second, true)
+	cmdPExpireAt = expireCommand(time.Millisecond, true)
+)
+
+func cmdEx(store *Tealis, session *Session, parts []string) protocol.Reply {
+	// EX predates EXPIRE and also takes fractions of a second
+	duration, err := strconv.ParseFloat(parts[2], 64)
+	if err != nil || math.IsNaN(duration) || math.IsInf(duration, 0) {
+		return protocol.Errorf("invalid duration: %s", parts[2])
+	}
+	if store.EX(parts[1], time.Duration(duration*float64(time.Second))) {
+		store.changed(1)
+		return protocol.Integer(1)
+	}
+	return protocol.Integer(0)
+}
+
+func cmdTTL(store *Tealis, session *Session, parts []string) protocol.Reply {
+	return protocol.Integer(store.TTL(parts[1]))
+}
+
+func cmdPTTL(store *Tealis, session *Session, parts []string) protocol.Reply {
+	return protocol.Integer(store.PTTL(parts[1]))
+}
+
+// expireTimeCommand builds the handler of EXPIRETIME or PEXPIRETIME.
+func expireTimeCommand(unit time.Duration) commandHandler {
+	return func(store *Tealis, session *Session, parts []string) protocol.Reply {
+		at, ok := store.ExpireTime(parts[1])
+		switch {
+		case !ok:
+			return protocol.Integer(-2)
+		case at.IsZero():
+			return protocol.Integer(-1)
+		}
+		return protocol.Integer(at.UnixMilli() / int64(unit/time.Millisecond))
+	}
+}
+
+var (
+	cmdExpireTime  = expireTimeCommand(time.Second)
+	cmdPExpireTime = expireTimeCommand(time.Millisecond)
+)
+
+func cmdPersist(store *Tealis, session *Session, parts []string) protocol.Reply {
+	removed := store.PERSIST(parts[1])
+	store.changed(removed)
+	return protocol.Integer(removed)
+}
+
+// GetEx returns the string value of a key and changes its expiry: to expiry if persist is
+// false and expiry is set, to none if persist is true. An expiry that already passed deletes
+// the key, except while the AOF is loaded, as with ExpireAt.
+func (r *Tealis) GetEx(key string, expiry time.Time, persist bool) (string, bool, error) {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+
+	now := time.Now()
+	if !r.liveLocked(key, now) {
+		return "", false, nil
+	}
+	value, ok := r.Store[key].(string)
+	if !ok {
+		return "", false, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+	}
+	switch {
+	case persist:
+		delete(r.Expiries, key)
+	case expiry.IsZero():
+	case !expiry.After(now) && !r.loading.Load():
+		r.deleteLocked(key)
+		delete(r.Expiries, key)
+	default:
+		r.Expiries[key] = expiry
+	}
+	return value, true, nil
+}
+
+func cmdGetEx(store *Tealis, session *Session, parts []string) protocol.Reply {
+	var expiry time.Time
+	persist := false
+	switch {
+	case len(parts) == 2:
+	case len(parts) == 3 && strings.ToUpper(parts[2]) == "PERSIST":
+		persist = true
+	case len(parts) == 4:
+		unit, ok := expiryUnits[strings.ToUpper(parts[2])]
+		if !ok {
+			return protocol.Error("ERR syntax error")
+		}
+		var err error
+		expiry, err = parseExpiry(parts[3], unit.unit, unit.absolute, true)
+		if errors.Is(err, errInvalidExpire) {
+			return protocol.Error("ERR invalid expire time in 'getex' command")
+		}
+		if err != nil {
+			return protocol.Errorf("%v", err)
+		}
+	default:
+		return protocol.Error("ERR syntax error")
+	}
+
+	_, hadExpiry := store.expiryOf(parts[1])
+	value, ok, err := store.GetEx(parts[1], expiry, persist)
+	if err != nil {
+		return errorReply(err)
+	}
+	if !ok {
+		return protocol.Null{}
+	}
+	// Without an option GETEX only reads, and PERSIST only changes a key with an expiry
+	if !expiry.IsZero() || persist && hadExpiry {
+		store.changed(1)
+	}
+	return protocol.BulkString(value)
+}
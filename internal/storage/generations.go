@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"tealis/internal/protocol"
+	"time"
+)
+
+// Every saved snapshot is also kept as a generation named after the time it was written,
+// such as dump-20240102T150405.123456789Z.tdb, until snapshot-retention newer ones exist.
+// Generations share their data with dump.tdb through a hard link where the file system
+// allows it.
+const (
+	generationPrefix = "dump-"
+	generationSuffix = ".tdb"
+	generationLayout = "20060102T150405.000000000Z"
+)
+
+// writeFileAtomic replaces dir/name with data: the data is written to a temporary file in the
+// same directory, fsynced and renamed over the old file, so readers and crashes only ever see
+// the old or the new contents.
+func writeFileAtomic(dir, name string, data []byte) error {
+	tmp, err := os.CreateTemp(dir, "temp-*"+generationSuffix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, name)); err != nil {
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// syncDir fsyncs a directory so a rename in it survives a crash. Not every platform can,
+// which only costs that guarantee.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// keepGeneration keeps the snapshot just written to dump.tdb as a new generation and removes
+// the generations beyond snapshot-retention. Failing to keep one is logged but does not fail
+// the save: dump.tdb is already safely written. The caller must hold snapshotMutex.
+func (r *Tealis) keepGeneration(data []byte) {
+	retention := r.Config().SnapshotRetention
+	if retention > 0 {
+		name := generationPrefix + time.Now().UTC().Format(generationLayout) + generationSuffix
+		err := os.Link(filepath.Join(r.snapshotPath, snapshotFile), filepath.Join(r.snapshotPath, name))
+		if err != nil {
+			err = writeFileAtomic(r.snapshotPath, name, data)
+		}
+		if err != nil {
+			log.Printf("Error keeping snapshot generation %s: %v", name, err)
+		}
+	}
+
+	generations, err := r.generations()
+	if err != nil {
+		log.Printf("Error listing snapshot generations: %v", err)
+		return
+	}
+	for len(generations) > retention {
+		oldest := generations[len(generations)-1]
+		if err := os.Remove(filepath.Join(r.snapshotPath, oldest)); err != nil {
+			log.Printf("Error removing snapshot generation %s: %v", oldest, err)
+		}
+		generations = generations[:len(generations)-1]
+	}
+}
+
+// generations returns the names of the snapshot generations, newest first.
+func (r *Tealis) generations() ([]string, error) {
+	entries, err := os.ReadDir(r.snapshotPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if isGeneration(entry.Name()) && entry.Type().IsRegular() {
+			names = append(names, entry.Name())
+		}
+	}
+	// The timestamps sort the same way as the times they stand for
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	return names, nil
+}
+
+// isGeneration reports whether a file name is one of a snapshot generation.
+func isGeneration(name string) bool {
+	if !strings.HasPrefix(name, generationPrefix) || !strings.HasSuffix(name, generationSuffix) {
+		return false
+	}
+	stamp := strings.TrimSuffix(strings.TrimPrefix(name, generationPrefix), generationSuffix)
+	_, err := time.Parse(generationLayout, stamp)
+	return err == nil
+}
+
+// Generations returns the names of the snapshot generations, newest first.
+func (r *Tealis) Generations() ([]string, error) {
+	r.snapshotMutex.Lock()
+	defer r.snapshotMutex.Unlock()
+	return r.generations()
+}
+
+// restoreLocked replaces the data with a snapshot, dump.tdb or a generation, and makes the
+// restored data the data the server comes back with after a restart: the AOF is rewritten
+// from it and it is saved as the latest snapshot. The caller must hold execMu exclusively.
+func (r *Tealis) restoreLocked(name string) error {
+	if name != snapshotFile && !isGeneration(name) {
+		return fmt.Errorf("no such snapshot generation '%s'", name)
+	}
+	if r.saving.Load() {
+		return errSaveInProgress
+	}
+	if r.aofRewriting.Load() {
+		return errAOFRewriteInProgress
+	}
+	if _, _, err := r.loadSnapshot(name); err != nil {
+		return err
+	}
+	if r.aofEnabled() {
+		if err := r.rewriteAOFLocked(); err != nil {
+			return err
+		}
+	}
+	return r.saveSnapshotLocked()
+}
+
+func cmdRestore(store *Tealis, session *Session, parts []string) protocol.Reply {
+	// RESTORE runs with execMu held exclusively, like SAVE
+	if len(parts) > 2 {
+		return protocol.Error("ERR syntax error")
+	}
+	name := snapshotFile
+	if len(parts) == 2 {
+		if strings.ToUpper(parts[1]) == "LIST" {
+			generations, err := store.Generations()
+			if err != nil {
+				return protocol.Errorf("Failed to list snapshot generations: %v", err)
+			}
+			return protocol.StringArray(generations)
+		}
+		name = parts[1]
+	}
+	if err := store.restoreLocked(name); err != nil {
+		return protocol.Errorf("Failed to load snapshot: %v", err)
+	}
+	store.changed(1)
+	return protocol.OK
+}
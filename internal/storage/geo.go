@@ -1,58 +1,62 @@
 package storage
 
 import (
+	"errors"
 	"math"
 	"sort"
 )
 
-func (r *Tealis) GEOAdd(key string, lat, lon float64, member string) {
+func (r *Tealis) GEOAdd(key string, lat, lon float64, member string) error {
 	r.Mu.Lock()
 	defer r.Mu.Unlock()
 
 	// Check if the key exists and is a GeoSet
-	if val, exists := r.Store[key]; exists {
+	if val := r.lookupWriteLocked(key); val != nil {
 		if geo, ok := val.(*GeoSet); ok {
 			geo.Add(member, lat, lon)
-			return
+			return nil
 		}
-		panic("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
 	}
 
 	// If key doesn't exist, create a new GeoSet
 	geo := NewGeoSet()
 	geo.Add(member, lat, lon)
-	r.Store[key] = geo
+	r.setLocked(key, geo)
+	return nil
 }
 
-func (r *Tealis) GEODist(key, member1, member2 string) float64 {
+// GEODist returns the distance between two members, with ok false if the key or either
+// member does not exist.
+func (r *Tealis) GEODist(key, member1, member2 string) (float64, bool, error) {
 	r.Mu.RLock()
 	defer r.Mu.RUnlock()
 
-	if val, exists := r.Store[key]; exists {
+	if val := r.lookupLocked(key); val != nil {
 		if geo, ok := val.(*GeoSet); ok {
 			loc1, exists1 := geo.Locations[member1]
 			loc2, exists2 := geo.Locations[member2]
 			if exists1 && exists2 {
-				return geo.Distance(loc1.Latitude, loc1.Longitude, loc2.Latitude, loc2.Longitude)
+				return geo.Distance(loc1.Latitude, loc1.Longitude, loc2.Latitude, loc2.Longitude), true, nil
 			}
-			panic("One or both members do not exist")
+			return 0, false, nil // One or both members do not exist
 		}
-		panic("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return 0, false, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
 	}
-	panic("Key does not exist")
+	return 0, false, nil // Key does not exist
 }
 
-func (r *Tealis) GEOSearch(key string, lat, lon, radius float64) []string {
+func (r *Tealis) GEOSearch(key string, lat, lon, radius float64) ([]string, error) {
 	r.Mu.RLock()
 	defer r.Mu.RUnlock()
 
-	if val, exists := r.Store[key]; exists {
+	if val := r.lookupLocked(key); val != nil {
 		if geo, ok := val.(*GeoSet); ok {
-			return geo.SearchByRadius(lat, lon, radius)
+			return geo.SearchByRadius(lat, lon, radius), nil
 		}
-		panic("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
 	}
-	return nil // Key does not exist
+	return nil, nil // Key does not exist
 }
 
 // GeoLocation represents a geographic location.
@@ -0,0 +1,83 @@
+package storage
+
+// globMatch reports whether s matches a glob pattern the way Redis matches them in KEYS, SCAN,
+// PSUBSCRIBE, CONFIG GET and ACL key and channel patterns: * matches any run of bytes, ? any
+// one byte, [abc], [a-z] and [^abc] one byte of a class and \ makes the byte after it
+// literal. Unlike path.Match, * also matches /, and a malformed pattern still matches what it
+// spells.
+func globMatch(pattern, s string) bool {
+	p, i := 0, 0
+	// Where the last * was, and the byte of s it is matched up to; a mismatch after it
+	// retries with the * taking one more byte
+	star, starI := -1, 0
+	for i < len(s) {
+		if p < len(pattern) {
+			if pattern[p] == '*' {
+				star, starI = p, i
+				p++
+				continue
+			}
+			if ok, next := globMatchOne(pattern, p, s[i]); ok {
+				p, i = next, i+1
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		starI++
+		p, i = star+1, starI
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// globMatchOne matches the element of pattern at p, anything but a *, against c and returns
+// where the next element starts.
+func globMatchOne(pattern string, p int, c byte) (bool, int) {
+	switch pattern[p] {
+	case '?':
+		return true, p + 1
+	case '[':
+		return globMatchClass(pattern, p+1, c)
+	case '\\':
+		// A trailing backslash stands for itself
+		if p+1 < len(pattern) {
+			p++
+		}
+	}
+	return pattern[p] == c, p + 1
+}
+
+// globMatchClass matches c against the character class that starts at p, after its [, and
+// returns where the class ends. A class left open runs to the end of the pattern.
+func globMatchClass(pattern string, p int, c byte) (bool, int) {
+	negated := p < len(pattern) && pattern[p] == '^'
+	if negated {
+		p++
+	}
+	matched := false
+	for p < len(pattern) && pattern[p] != ']' {
+		switch {
+		case pattern[p] == '\\' && p+1 < len(pattern):
+			matched = matched || pattern[p+1] == c
+			p += 2
+		case p+2 < len(pattern) && pattern[p+1] == '-' && pattern[p+2] != ']':
+			lo, hi := pattern[p], pattern[p+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			matched = matched || lo <= c && c <= hi
+			p += 3
+		default:
+			matched = matched || pattern[p] == c
+			p++
+		}
+	}
+	if p < len(pattern) {
+		p++ // the closing ]
+	}
+	return matched != negated, p
+}
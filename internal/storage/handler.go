@@ -1,1006 +1,1248 @@
-// in your commands package (e.g., awesomeProject/internal/commands/handler.go)
-
 package storage
 
 import (
 	"encoding/json"
-
+	"errors"
 	"fmt"
-	"log"
+	"sort"
 	"strconv"
 	"strings"
+	"tealis/internal/logging"
+	"tealis/internal/protocol"
 	"time"
 )
 
-func ProcessCommand(parts []string, store *Tealis, clientID string) string {
-	if len(parts) == 0 {
-		return "-ERR Empty command"
-	}
-	// Join the array into a single string with spaces separating the elements
-	commandString := strings.Join(parts, " ")
-	command := strings.ToUpper(parts[0])
-	if store.multi && !(command == "EXEC" || command == "DISCARD") {
-		return store.APPENDTO(clientID, commandString)
-	}
-	if command == "EXEC" {
-		print("EXECCCCCCC")
-	}
-	store.AppendToAOF(commandString)
-	switch command {
-	case "MULTI":
-		store.MULTI(clientID)
-		if store.multi {
-			return "+OK MULTI\r\n"
-		}
-		return "-NOT MULTI"
-
-	case "EXEC":
-		return store.EXEC(clientID)
-	case "DISCARD":
-		store.DISCARD(clientID)
-		return "+OK\r\n"
-	// other cases for different commands (GET, SET, etc.)
-	case "SET":
-		if len(parts) < 3 {
-			return "-ERR SET requires key and value"
-		}
-		key, value := parts[1], parts[2]
-		var ttl time.Duration
-		if len(parts) == 5 && strings.ToUpper(parts[3]) == "EX" {
-			ttlSecs, err := strconv.Atoi(parts[4])
+func cmdMulti(store *Tealis, session *Session, parts []string) protocol.Reply {
+	return store.MULTI(session)
+}
+
+func cmdExec(store *Tealis, session *Session, parts []string) protocol.Reply {
+	return store.EXEC(session)
+}
+
+func cmdDiscard(store *Tealis, session *Session, parts []string) protocol.Reply {
+	return store.DISCARD(session)
+}
+
+func cmdWatch(store *Tealis, session *Session, parts []string) protocol.Reply {
+	if session.InMulti() {
+		return protocol.Error("ERR WATCH inside MULTI is not allowed")
+	}
+	store.WATCH(session, parts[1:]...)
+	return protocol.OK
+}
+
+func cmdUnwatch(store *Tealis, session *Session, parts []string) protocol.Reply {
+	store.UNWATCH(session)
+	return protocol.OK
+}
+
+func cmdSet(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key, value := parts[1], parts[2]
+	var opts SetOptions
+	hasExpiry := false
+	for i := 3; i < len(parts); i++ {
+		option := strings.ToUpper(parts[i])
+		switch option {
+		case "NX":
+			opts.NX = true
+		case "XX":
+			opts.XX = true
+		case "GET":
+			opts.Get = true
+		case "KEEPTTL":
+			opts.KeepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if hasExpiry || i+1 == len(parts) {
+				return protocol.Error("ERR syntax error")
+			}
+			unit := expiryUnits[option]
+			expiry, err := parseExpiry(parts[i+1], unit.unit, unit.absolute, true)
+			if errors.Is(err, errInvalidExpire) {
+				return protocol.Error("ERR invalid expire time in 'set' command")
+			}
 			if err != nil {
-				return "-ERR Invalid TTL"
+				return protocol.Errorf("%v", err)
 			}
-			ttl = time.Duration(ttlSecs) * time.Second
-			log.Printf("SET expiry: %d", ttlSecs)
+			logging.Debugf("SET expiry: %s %s", option, parts[i+1])
+			opts.Expiry, hasExpiry = expiry, true
+			i++
+		default:
+			return protocol.Error("ERR syntax error")
 		}
-		store.Set(key, value, ttl)
-		return "+OK"
+	}
+	if opts.NX && opts.XX || opts.KeepTTL && hasExpiry {
+		return protocol.Error("ERR syntax error")
+	}
 
-	case "GET":
-		if len(parts) < 2 {
-			return "-ERR GET requires a key"
-		}
-		key := parts[1]
-		value, exists := store.Get(key)
-		if !exists {
-			return "$-1"
-		}
-		return "$" + strconv.Itoa(len(value)) + "\r\n" + value
+	old, existed, set, err := store.SetWithOptions(key, value, opts)
+	if err != nil {
+		return errorReply(err)
+	}
+	if set {
+		store.changed(1)
+	}
+	switch {
+	case opts.Get && !existed:
+		return protocol.Null{}
+	case opts.Get:
+		return protocol.BulkString(old)
+	case !set:
+		return protocol.Null{}
+	}
+	return protocol.OK
+}
 
-	case "DEL":
-		if len(parts) < 2 {
-			return "-ERR DEL requires a key"
-		}
-		key := parts[1]
-		if store.Del(key) {
-			return ":1"
-		}
-		return ":0"
+func cmdGet(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key := parts[1]
+	value, exists, err := store.Get(key)
+	if err != nil {
+		return errorReply(err)
+	}
+	if !exists {
+		return protocol.Null{}
+	}
+	return protocol.BulkString(value)
+}
+
+func cmdDel(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key := parts[1]
+	if store.Del(key) {
+		store.changed(1)
+		return protocol.Integer(1)
+	}
+	return protocol.Integer(0)
+}
+
+func cmdExists(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key := parts[1]
+	if store.Exists(key) {
+		return protocol.Integer(1)
+	}
+	return protocol.Integer(0)
+}
 
-	case "EXISTS":
-		if len(parts) < 2 {
-			return "-ERR EXISTS requires a key"
+func cmdHello(store *Tealis, session *Session, parts []string) protocol.Reply {
+	version := protocol.RESP2
+	if len(parts) > 1 {
+		v, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return protocol.Error("ERR Protocol version is not an integer or out of range")
 		}
-		key := parts[1]
-		if store.Exists(key) {
-			return ":1"
+		version = v
+	} else {
+		version = session.ProtocolVersion()
+	}
+	// Options are applied only once they are all valid and the credentials check out
+	var username, password, name string
+	auth, setName := false, false
+	for i := 2; i < len(parts); i++ {
+		switch {
+		case strings.EqualFold(parts[i], "AUTH") && i+2 < len(parts):
+			username, password, auth = parts[i+1], parts[i+2], true
+			i += 2
+		case strings.EqualFold(parts[i], "SETNAME") && i+1 < len(parts):
+			name, setName = parts[i+1], true
+			i++
+		default:
+			return protocol.Errorf("syntax error in HELLO option '%s'", parts[i])
 		}
-		return ":0"
+	}
+	if version != protocol.RESP2 && version != protocol.RESP3 {
+		return protocol.Error("NOPROTO unsupported protocol version")
+	}
+	if auth && !store.Authenticate(session, username, password) {
+		return protocol.Error("WRONGPASS invalid username-password pair or user is disabled.")
+	}
+	if !auth && store.needsAuth(session) {
+		return protocol.Error("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+	}
+	if setName {
+		session.SetName(name)
+	}
+	return store.HELLO(session, version)
+}
 
-	case "QUIT":
-		return "+OK"
+func cmdQuit(store *Tealis, session *Session, parts []string) protocol.Reply {
+	return protocol.OK
+}
 
-	case "EX":
-		if len(parts) < 2 {
-			return "ERR: EX command requires a key and a duration"
-		}
+func cmdSave(store *Tealis, session *Session, parts []string) protocol.Reply {
+	// SAVE runs with execMu held exclusively
+	if err := store.saveSnapshotLocked(); err != nil {
+		return protocol.Errorf("Failed to save snapshot: %v", err)
+	}
+	return protocol.OK
+}
 
-		// Convert the second part to a float representing the time duration
-		duration, err := strconv.ParseFloat(parts[2], 64)
-		if err != nil {
-			return fmt.Sprintf("ERR: invalid duration: %v", err)
-		}
+func cmdBgSave(store *Tealis, session *Session, parts []string) protocol.Reply {
+	// BGSAVE runs with execMu held exclusively, so the view it takes is the data as of now
+	if len(parts) > 2 || (len(parts) == 2 && strings.ToUpper(parts[1]) != "SCHEDULE") {
+		return protocol.Error("ERR syntax error")
+	}
+	if len(parts) == 2 && store.saving.Load() {
+		store.saveScheduled.Store(true)
+		return protocol.SimpleString("Background saving scheduled")
+	}
+	if err := store.backgroundSaveLocked(); err != nil {
+		return protocol.Errorf("%v", err)
+	}
+	return protocol.SimpleString("Background saving started")
+}
 
-		// Set expiry using the EX method (duration is in seconds, so we multiply by time.Second)
-		store.EX(parts[1], time.Duration(duration*float64(time.Second)))
-		return "OK" // Success message
+func cmdLastSave(store *Tealis, session *Session, parts []string) protocol.Reply {
+	store.saveStatsMu.Lock()
+	defer store.saveStatsMu.Unlock()
+	return protocol.Integer(store.lastSave.Unix())
+}
 
-	case "TTL":
-		if len(parts) < 2 {
-			return "-ERR TTL requires a key"
-		}
-		key := parts[1]
+func cmdBgRewriteAOF(store *Tealis, session *Session, parts []string) protocol.Reply {
+	if err := store.BackgroundRewriteAOF(); err != nil {
+		return protocol.Errorf("%v", err)
+	}
+	return protocol.SimpleString("Background append only file rewriting started")
+}
 
-		return strconv.FormatInt(store.TTL(key), 10)
-	case "PERSIST":
-		if len(parts) < 2 {
-			return "-ERR PERSIST requires a key"
-		}
-		key := parts[1]
-		return strconv.Itoa(store.PERSIST(key))
-	case "SAVE":
-		if err := store.SaveSnapshot(); err != nil {
-			return fmt.Sprintf("-ERR Failed to save snapshot: %v\r\n", err)
-		}
-		return "+OK Snapshot saved\r\n"
-	case "RESTORE":
-		if err := store.LoadSnapshot(); err != nil {
-			return fmt.Sprintf("-ERR Failed to load snapshot: %v\r\n", err)
+func cmdAOF(store *Tealis, session *Session, parts []string) protocol.Reply {
+	// AOF command: Check if AOF is enabled or force AOF rewrite
+	if len(parts) == 2 && strings.ToUpper(parts[1]) == "REWRITE" {
+		// AOF runs with execMu held exclusively, so the rewrite blocks like SAVE does
+		err := store.rewriteAOFLocked()
+		if err != nil {
+			return protocol.Errorf("AOF rewrite failed: %v", err)
 		}
-		return "+OK Snapshot restored\r\n"
+		return protocol.SimpleString("AOF rewrite completed")
+	}
+	if store.aofEnabled() {
+		return protocol.SimpleString("AOF is enabled")
+	}
+	return protocol.SimpleString("AOF is disabled")
+}
 
-	case "BGSAVE":
-		// BGSAVE command: Create a snapshot in the background
-		go func() {
-			if err := store.SaveSnapshot(); err != nil {
-				log.Printf("Error saving snapshot: %v", err)
-			}
+func cmdAppend(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key, value := parts[1], parts[2]
+	newLength, err := store.Append(key, value)
+	if err != nil {
+		return errorReply(err)
+	}
+	store.changed(1)
+	return protocol.Integer(newLength)
+}
 
-		}()
-		return "+OK\r\n"
+func cmdStrLen(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key := parts[1]
+	length, err := store.StrLen(key)
+	if err != nil {
+		return errorReply(err)
+	}
+	return protocol.Integer(length)
+}
 
-	case "AOF":
-		// AOF command: Check if AOF is enabled or force AOF rewrite
-		if len(parts) == 2 && strings.ToUpper(parts[1]) == "REWRITE" {
-			// Forcing an AOF rewrite logic can be added here (e.g., compacting the AOF file)
-			err := store.RewriteAOF()
-			if err != nil {
-				return "err rewrite"
-			}
-			return "+OK AOF rewrite triggered\r\n"
-		}
-		if store.enableAOF {
-			return "+AOF is enabled\r\n"
-		} else {
-			return "+AOF is disabled\r\n"
-		}
+func cmdIncr(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key := parts[1]
+	newValue, err := store.IncrBy(key, 1)
+	if err != nil {
+		return errorReply(err)
+	}
+	store.changed(1)
+	return protocol.Integer(newValue)
+}
 
-	case "APPEND":
-		if len(parts) < 3 {
-			return "-ERR APPEND requires key and value"
-		}
-		key, value := parts[1], parts[2]
-		newLength := store.Append(key, value)
-		return ":" + strconv.Itoa(newLength)
+func cmdDecr(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key := parts[1]
+	newValue, err := store.IncrBy(key, -1)
+	if err != nil {
+		return errorReply(err)
+	}
+	store.changed(1)
+	return protocol.Integer(newValue)
+}
 
-	case "STRLEN":
-		if len(parts) < 2 {
-			return "-ERR STRLEN requires a key"
-		}
-		key := parts[1]
-		length := store.StrLen(key)
-		return ":" + strconv.Itoa(length)
+func cmdIncrBy(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key, incrStr := parts[1], parts[2]
+	incr, err := strconv.Atoi(incrStr)
+	if err != nil {
+		return protocol.Error("ERR Increment must be an integer")
+	}
+	newValue, err := store.IncrBy(key, incr)
+	if err != nil {
+		return errorReply(err)
+	}
+	store.changed(1)
+	return protocol.Integer(newValue)
+}
 
-	case "INCR":
-		if len(parts) < 2 {
-			return "-ERR INCR requires a key"
-		}
-		key := parts[1]
-		newValue, err := store.IncrBy(key, 1)
-		if err != nil {
-			return "-ERR " + err.Error()
-		}
-		return ":" + strconv.Itoa(newValue)
+func cmdDecrBy(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key, decrStr := parts[1], parts[2]
+	decr, err := strconv.Atoi(decrStr)
+	if err != nil {
+		return protocol.Error("ERR Decrement must be an integer")
+	}
+	newValue, err := store.IncrBy(key, -decr)
+	if err != nil {
+		return errorReply(err)
+	}
+	store.changed(1)
+	return protocol.Integer(newValue)
+}
 
-	case "DECR":
-		if len(parts) < 2 {
-			return "-ERR DECR requires a key"
-		}
-		key := parts[1]
-		newValue, err := store.IncrBy(key, -1)
-		if err != nil {
-			return "-ERR " + err.Error()
-		}
-		return ":" + strconv.Itoa(newValue)
+func cmdGetRange(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key, startStr, endStr := parts[1], parts[2], parts[3]
+	start, err1 := strconv.Atoi(startStr)
+	end, err2 := strconv.Atoi(endStr)
+	if err1 != nil || err2 != nil {
+		return protocol.Error("ERR Start and end must be integers")
+	}
+	result, err := store.GetRange(key, start, end)
+	if err != nil {
+		return errorReply(err)
+	}
+	return protocol.BulkString(result)
+}
 
-	case "INCRBY":
-		if len(parts) < 3 {
-			return "-ERR INCRBY requires a key and increment value"
-		}
-		key, incrStr := parts[1], parts[2]
-		incr, err := strconv.Atoi(incrStr)
-		if err != nil {
-			return "-ERR Increment must be an integer"
-		}
-		newValue, err := store.IncrBy(key, incr)
-		if err != nil {
-			return "-ERR " + err.Error()
-		}
-		return ":" + strconv.Itoa(newValue)
+func cmdSetRange(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key, offsetStr, value := parts[1], parts[2], parts[3]
+	offset, err := strconv.Atoi(offsetStr)
+	if err != nil {
+		return protocol.Error("ERR Offset must be an integer")
+	}
+	if offset < 0 {
+		return protocol.Error("ERR offset is out of range")
+	}
+	newLength, err := store.SetRange(key, offset, value)
+	if err != nil {
+		return errorReply(err)
+	}
+	store.changed(1)
+	return protocol.Integer(newLength)
+}
 
-	case "DECRBY":
-		if len(parts) < 3 {
-			return "-ERR DECRBY requires a key and decrement value"
-		}
-		key, decrStr := parts[1], parts[2]
-		decr, err := strconv.Atoi(decrStr)
-		if err != nil {
-			return "-ERR Decrement must be an integer"
-		}
-		newValue, err := store.IncrBy(key, -decr)
-		if err != nil {
-			return "-ERR " + err.Error()
-		}
-		return ":" + strconv.Itoa(newValue)
+func cmdKeys(store *Tealis, session *Session, parts []string) protocol.Reply {
+	pattern := parts[1]
+	keys := store.Keys(pattern)
+	if len(keys) == 0 {
+		return protocol.Array{}
+	}
+	return protocol.StringArray(keys)
+}
 
-	case "GETRANGE":
-		if len(parts) < 4 {
-			return "-ERR GETRANGE requires key, start, and end"
-		}
-		key, startStr, endStr := parts[1], parts[2], parts[3]
-		start, err1 := strconv.Atoi(startStr)
-		end, err2 := strconv.Atoi(endStr)
-		if err1 != nil || err2 != nil {
-			return "-ERR Start and end must be integers"
-		}
-		result := store.GetRange(key, start, end)
-		return "$" + strconv.Itoa(len(result)) + "\r\n" + result
+func cmdJSONSet(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key, path, value := parts[1], parts[2], parts[3]
+	err := store.JSONSet(key, path, value)
+	if err != nil {
+		return errorReply(err)
+	}
+	store.changed(1)
+	return protocol.OK
+}
 
-	case "SETRANGE":
-		if len(parts) < 4 {
-			return "-ERR SETRANGE requires key, offset, and value"
-		}
-		key, offsetStr, value := parts[1], parts[2], parts[3]
-		offset, err := strconv.Atoi(offsetStr)
-		if err != nil {
-			return "-ERR Offset must be an integer"
-		}
-		newLength := store.SetRange(key, offset, value)
-		return ":" + strconv.Itoa(newLength)
+func cmdJSONGet(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key, path := parts[1], parts[2]
 
-	case "KEYS":
-		if len(parts) < 2 {
-			return "-ERR KEYS requires a pattern"
-		}
-		pattern := parts[1]
-		keys := store.Keys(pattern)
-		if len(keys) == 0 {
-			return "(empty list or set)"
-		}
-		return formatArrayResponse(keys)
+	// Retrieve the value from the store
+	value, err := store.JSONGet(key, path)
+	if err != nil {
+		return errorReply(err)
+	}
 
-		// JSON commands
-	case "JSON.SET":
-		if len(parts) < 4 {
-			return "-ERR JSON.SET requires key, path, and value"
-		}
-		key, path, value := parts[1], parts[2], parts[3]
-		fmt.Printf("")
-		fmt.Printf("%s handler set %s %s %s\n", parts, key, path, value)
-		err := store.JSONSet(key, path, value)
-		if err != nil {
-			return "-ERR " + err.Error()
-		}
-		return "+OK"
+	// Serialize the value to a JSON string
+	jsonValue, err := json.Marshal(value)
+	if err != nil {
+		return protocol.Errorf("Failed to serialize value to JSON: %v", err)
+	}
 
-	case "JSON.GET":
-		if len(parts) < 3 {
-			return "-ERR JSON.GET requires key and path"
-		}
-		key, path := parts[1], parts[2]
+	return protocol.BulkString(jsonValue)
+}
 
-		// Retrieve the value from the store
-		value, err := store.JSONGet(key, path)
-		if err != nil {
-			return "-ERR " + err.Error()
-		}
+func cmdJSONDel(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key, path := parts[1], parts[2]
 
-		// Serialize the value to a JSON string
-		jsonValue, err := json.Marshal(value)
-		if err != nil {
-			return "-ERR Failed to serialize value to JSON: " + err.Error()
-		}
+	var err = store.JSONDel(key, path)
+	if err != nil {
+		return errorReply(err)
+	}
+	store.changed(1)
+	return protocol.Integer(1)
+}
 
-		// Return the serialized value with the correct RESP formatting
-		return "$" + strconv.Itoa(len(jsonValue)) + "\r\n" + string(jsonValue)
+func cmdJSONArrAppend(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key, path, stringVal := parts[1], parts[2], parts[3]
+	stringArr := strings.Split(stringVal, ",")
+	// Step 2: Convert the slice of strings to a slice of interface{}
+	stringInterface := make([]interface{}, len(stringArr))
+	for i, v := range stringArr {
+		stringInterface[i] = v
+	}
+	err := store.JSONArrAppend(key, path, stringInterface)
+	if err != nil {
+		return errorReply(err)
+	}
+	store.changed(1)
+	return protocol.Integer(1)
+}
 
-	case "JSON.DEL":
-		if len(parts) < 3 {
-			return "-ERR JSON.DEL requires key and path"
-		}
-		key, path := parts[1], parts[2]
+func cmdLPush(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key := parts[1]
+	elements := parts[2:]
+	newLength, err := store.LPUSH(key, elements...)
+	if err != nil {
+		return errorReply(err)
+	}
+	store.changed(len(elements))
+	return protocol.Integer(newLength)
+}
 
-		var err = store.JSONDel(key, path)
-		if err != nil {
-			return "-ERR " + err.Error()
-		}
-		return ":1"
+func cmdRPush(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key := parts[1]
+	elements := parts[2:]
+	newLength, err := store.RPUSH(key, elements...)
+	if err != nil {
+		return errorReply(err)
+	}
+	store.changed(len(elements))
+	return protocol.Integer(newLength)
+}
 
-	case "JSON.ARRAPPEND":
-		if len(parts) < 4 {
-			return "-ERR JSON.ARRAPPEND requires key, path, and value(s)"
-		}
-		key, path, stringVal := parts[1], parts[2], parts[3]
-		stringArr := strings.Split(stringVal, ",")
-		// Step 2: Convert the slice of strings to a slice of interface{}
-		stringInterface := make([]interface{}, len(stringArr))
-		for i, v := range stringArr {
-			stringInterface[i] = v
-		}
-		err := store.JSONArrAppend(key, path, stringInterface)
-		if err != nil {
-			return "-ERR " + err.Error()
-		}
-		return ":1"
-	case "LPUSH":
-		if len(parts) < 3 {
-			return "-ERR LPUSH requires a key and one or more elements"
-		}
-		key := parts[1]
-		elements := parts[2:]
-		newLength := store.LPUSH(key, elements...)
-		return fmt.Sprintf(":%d", newLength)
-
-	case "RPUSH":
-		if len(parts) < 3 {
-			return "-ERR RPUSH requires a key and one or more elements"
-		}
-		key := parts[1]
-		elements := parts[2:]
-		newLength := store.RPUSH(key, elements...)
-		return fmt.Sprintf(":%d", newLength)
-
-	case "LPOP":
-		if len(parts) < 2 {
-			return "-ERR LPOP requires a key"
-		}
-		key := parts[1]
-		element, ok := store.LPOP(key)
-		if !ok {
-			return "$-1"
-		}
-		return "$" + strconv.Itoa(len(element)) + "\r\n" + element
+func cmdLPop(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key := parts[1]
+	element, ok, err := store.LPOP(key)
+	if err != nil {
+		return errorReply(err)
+	}
+	if !ok {
+		return protocol.Null{}
+	}
+	store.changed(1)
+	return protocol.BulkString(element)
+}
 
-	case "RPOP":
-		if len(parts) < 2 {
-			return "-ERR RPOP requires a key"
-		}
-		key := parts[1]
-		element, ok := store.RPOP(key)
-		if !ok {
-			return "$-1"
-		}
-		return "$" + strconv.Itoa(len(element)) + "\r\n" + element
+func cmdRPop(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key := parts[1]
+	element, ok, err := store.RPOP(key)
+	if err != nil {
+		return errorReply(err)
+	}
+	if !ok {
+		return protocol.Null{}
+	}
+	store.changed(1)
+	return protocol.BulkString(element)
+}
 
-	case "LLEN":
-		if len(parts) < 2 {
-			return "-ERR LLEN requires a key"
-		}
-		key := parts[1]
-		length := store.LLEN(key)
-		return fmt.Sprintf(":%d", length)
+func cmdLLen(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key := parts[1]
+	length, err := store.LLEN(key)
+	if err != nil {
+		return errorReply(err)
+	}
+	return protocol.Integer(length)
+}
 
-	case "LRANGE":
-		if len(parts) < 4 {
-			return "-ERR LRANGE requires a key, start, and end"
-		}
-		key := parts[1]
-		start, err1 := strconv.Atoi(parts[2])
-		end, err2 := strconv.Atoi(parts[3])
-		if err1 != nil || err2 != nil {
-			return "-ERR Start and end must be integers"
-		}
-		elements := store.LRANGE(key, start, end)
-		return formatArrayResponse(elements)
-	case "SADD":
-		if len(parts) < 3 {
-			return "-ERR SADD requires a key and one or more members"
-		}
-		key := parts[1]
-		members := parts[2:]
-		addedCount := store.SADD(key, members...)
-		return fmt.Sprintf(":%d", addedCount)
-
-	case "SMEMBERS":
-		if len(parts) < 2 {
-			return "-ERR SMEMBERS requires a key"
-		}
-		key := parts[1]
-		members := store.SMEMBERS(key)
-		if len(members) == 0 {
-			return "(empty list or set)"
-		}
-		return formatArrayResponse(members)
-	case "SREM":
-		if len(parts) < 3 {
-			return "-ERR SREM requires a key and one or more members"
-		}
-		key := parts[1]
-		members := parts[2:]
-		removedCount := store.SREM(key, members...)
-		return fmt.Sprintf(":%d", removedCount)
-	case "SISMEMBER":
-		if len(parts) < 3 {
-			return "-ERR SISMEMBER requires a key and a member"
-		}
-		key := parts[1]
-		member := parts[2]
-		exists := store.SISMEMBER(key, member)
-		if exists {
-			return ":1"
-		}
-		return ":0"
-	case "HSET":
-		if len(parts) < 4 {
-			return "-ERR HSET requires key, field, and value"
-		}
-		key, field, value := parts[1], parts[2], parts[3]
-		added := store.HSET(key, field, value)
-		return ":" + strconv.Itoa(added)
+func cmdLRange(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key := parts[1]
+	start, err1 := strconv.Atoi(parts[2])
+	end, err2 := strconv.Atoi(parts[3])
+	if err1 != nil || err2 != nil {
+		return protocol.Error("ERR Start and end must be integers")
+	}
+	elements, err := store.LRANGE(key, start, end)
+	if err != nil {
+		return errorReply(err)
+	}
+	return protocol.StringArray(elements)
+}
 
-	case "HGET":
-		if len(parts) < 3 {
-			return "-ERR HGET requires key and field"
-		}
-		key, field := parts[1], parts[2]
-		value, exists := store.HGET(key, field)
-		if !exists {
-			return "$-1"
-		}
-		valueStr := fmt.Sprintf("%v", value)
-		return "$" + strconv.Itoa(len(valueStr)) + "\r\n" + valueStr
+func cmdSAdd(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key := parts[1]
+	members := parts[2:]
+	addedCount, err := store.SADD(key, members...)
+	if err != nil {
+		return errorReply(err)
+	}
+	store.changed(addedCount)
+	return protocol.Integer(addedCount)
+}
 
-	case "HMSET":
-		if len(parts) < 4 || len(parts[2:])%2 != 0 {
-			return "-ERR HMSET requires key and field-value pairs"
-		}
-		key := parts[1]
-		fields := make(map[string]interface{})
-		for i := 2; i < len(parts); i += 2 {
-			fields[parts[i]] = parts[i+1]
-		}
-		store.HMSET(key, fields)
-		return "+OK"
+func cmdSMembers(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key := parts[1]
+	members, err := store.SMEMBERS(key)
+	if err != nil {
+		return errorReply(err)
+	}
+	return protocol.StringSet(members)
+}
 
-	case "HGETALL":
-		if len(parts) < 2 {
-			return "-ERR HGETALL requires a key"
-		}
-		key := parts[1]
-		fields := store.HGETALL(key)
-		if fields == nil {
-			return "$-1"
-		}
-		return formatHashResponse(fields)
+func cmdSRem(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key := parts[1]
+	members := parts[2:]
+	removedCount, err := store.SREM(key, members...)
+	if err != nil {
+		return errorReply(err)
+	}
+	store.changed(removedCount)
+	return protocol.Integer(removedCount)
+}
 
-	case "HDEL":
-		if len(parts) < 3 {
-			return "-ERR HDEL requires key and field"
-		}
-		key, field := parts[1], parts[2]
-		deleted := store.HDEL(key, field)
-		return ":" + strconv.Itoa(deleted)
+func cmdSIsMember(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key := parts[1]
+	member := parts[2]
+	exists, err := store.SISMEMBER(key, member)
+	if err != nil {
+		return errorReply(err)
+	}
+	if exists {
+		return protocol.Integer(1)
+	}
+	return protocol.Integer(0)
+}
 
-	case "HEXISTS":
-		if len(parts) < 3 {
-			return "-ERR HEXISTS requires key and field"
-		}
-		key, field := parts[1], parts[2]
-		exists := store.HEXISTS(key, field)
-		if exists {
-			return ":1"
-		}
-		return ":0"
+func cmdHSet(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key, field, value := parts[1], parts[2], parts[3]
+	added, err := store.HSET(key, field, value)
+	if err != nil {
+		return errorReply(err)
+	}
+	store.changed(1)
+	return protocol.Integer(added)
+}
 
-	case "ZADD":
-		if len(parts) < 4 {
-			return "-ERR ZADD requires key, score, and member"
-		}
-		key := parts[1]
-		score, err := strconv.ParseFloat(parts[2], 64)
-		if err != nil {
-			return "-ERR Score must be a float"
-		}
-		member := parts[3]
-		added := store.ZAdd(key, score, member)
-		return ":" + strconv.Itoa(added)
+func cmdHGet(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key, field := parts[1], parts[2]
+	value, exists, err := store.HGET(key, field)
+	if err != nil {
+		return errorReply(err)
+	}
+	if !exists {
+		return protocol.Null{}
+	}
+	valueStr := fmt.Sprintf("%v", value)
+	return protocol.BulkString(valueStr)
+}
 
-	case "ZRANGE":
-		if len(parts) < 4 {
-			return "-ERR ZRANGE requires key, start, and stop"
-		}
-		key := parts[1]
-		start, err1 := strconv.Atoi(parts[2])
-		stop, err2 := strconv.Atoi(parts[3])
-		if err1 != nil || err2 != nil {
-			return "-ERR Start and stop must be integers"
-		}
-		members := store.ZRange(key, start, stop)
-		if len(members) == 0 {
-			return "(empty list or set)"
-		}
-		return formatArrayResponse(members)
+func cmdHMSet(store *Tealis, session *Session, parts []string) protocol.Reply {
+	if len(parts[2:])%2 != 0 {
+		return protocol.WrongArgs("hmset")
+	}
+	key := parts[1]
+	fields := make(map[string]interface{})
+	for i := 2; i < len(parts); i += 2 {
+		fields[parts[i]] = parts[i+1]
+	}
+	if err := store.HMSET(key, fields); err != nil {
+		return errorReply(err)
+	}
+	store.changed(len(fields))
+	return protocol.OK
+}
 
-	case "ZRANK":
-		if len(parts) < 3 {
-			return "-ERR ZRANK requires key and member"
-		}
-		key, member := parts[1], parts[2]
-		rank := store.ZRank(key, member)
-		if rank == -1 {
-			return "(nil)"
-		}
-		return ":" + strconv.Itoa(rank)
+func cmdHGetAll(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key := parts[1]
+	fields, err := store.HGETALL(key)
+	if err != nil {
+		return errorReply(err)
+	}
+	return formatHashResponse(fields)
+}
 
-	case "ZREM":
-		if len(parts) < 3 {
-			return "-ERR ZREM requires key and member"
-		}
-		key, member := parts[1], parts[2]
-		removed := store.ZRem(key, member)
-		if removed {
-			return ":1"
-		}
-		return ":0"
+func cmdHDel(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key, field := parts[1], parts[2]
+	deleted, err := store.HDEL(key, field)
+	if err != nil {
+		return errorReply(err)
+	}
+	store.changed(deleted)
+	return protocol.Integer(deleted)
+}
 
-	case "ZRANGEBYSCORE":
-		if len(parts) < 4 {
-			return "-ERR ZRANGEBYSCORE requires key, min, and max"
-		}
-		key := parts[1]
-		min, err1 := strconv.ParseFloat(parts[2], 64)
-		max, err2 := strconv.ParseFloat(parts[3], 64)
-		if err1 != nil || err2 != nil {
-			return "-ERR Min and max must be floats"
-		}
-		members := store.ZRangeByScore(key, min, max)
-		if len(members) == 0 {
-			return "(empty list or set)"
-		}
-		return formatArrayResponse(members)
-	case "XADD":
-		// Check for at least 4 arguments: key, ID, and at least one field-value pair
-		if len(parts) < 4 || len(parts[3:])%2 != 0 {
-			return "-ERR XADD requires at least key, ID, and field-value pairs"
-		}
+func cmdHExists(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key, field := parts[1], parts[2]
+	exists, err := store.HEXISTS(key, field)
+	if err != nil {
+		return errorReply(err)
+	}
+	if exists {
+		return protocol.Integer(1)
+	}
+	return protocol.Integer(0)
+}
 
-		key := parts[1]
-		id := parts[2]
+func cmdZAdd(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key := parts[1]
+	score, err := strconv.ParseFloat(parts[2], 64)
+	if err != nil {
+		return protocol.Error("ERR Score must be a float")
+	}
+	member := parts[3]
+	added, err := store.ZAdd(key, score, member)
+	if err != nil {
+		return errorReply(err)
+	}
+	store.changed(1)
+	return protocol.Integer(added)
+}
 
-		// Parse field-value pairs
-		fields := make(map[string]string)
-		for i := 3; i < len(parts); i += 2 {
-			fields[parts[i]] = parts[i+1]
-		}
+func cmdZRange(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key := parts[1]
+	start, err1 := strconv.Atoi(parts[2])
+	stop, err2 := strconv.Atoi(parts[3])
+	if err1 != nil || err2 != nil {
+		return protocol.Error("ERR Start and stop must be integers")
+	}
+	members, err := store.ZRange(key, start, stop)
+	if err != nil {
+		return errorReply(err)
+	}
+	if len(members) == 0 {
+		return protocol.Array{}
+	}
+	return protocol.StringArray(members)
+}
 
-		// Add the entry to the stream
-		result := store.XAdd(key, id, fields)
-		return fmt.Sprintf("+%s", result)
+func cmdZScore(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key, member := parts[1], parts[2]
+	score, exists, err := store.ZScore(key, member)
+	if err != nil {
+		return errorReply(err)
+	}
+	if !exists {
+		return protocol.Null{}
+	}
+	return protocol.Double(score)
+}
 
-	case "XREAD":
-		if len(parts) < 3 {
-			return "-ERR XREAD requires key and start ID"
-		}
-		key := parts[1]
-		startID := parts[2]
-		count := 0
-		if len(parts) > 3 {
-			var err error
-			count, err = strconv.Atoi(parts[3])
-			if err != nil {
-				return "-ERR Invalid count argument"
-			}
-		}
-		result := store.XRead(key, startID, count)
-		return formatEntries(result)
+func cmdZRank(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key, member := parts[1], parts[2]
+	rank, err := store.ZRank(key, member)
+	if err != nil {
+		return errorReply(err)
+	}
+	if rank == -1 {
+		return protocol.Null{}
+	}
+	return protocol.Integer(rank)
+}
 
-	case "XRANGE":
-		if len(parts) != 4 {
-			return "-ERR XRANGE requires key, start ID, and end ID"
-		}
-		key := parts[1]
-		startID := parts[2]
-		endID := parts[3]
-		result := store.XRange(key, startID, endID)
-		return formatEntries(result)
-
-	case "XLEN":
-		if len(parts) != 2 {
-			return "-ERR XLEN requires key"
-		}
-		key := parts[1]
-		result := store.XLen(key)
-		return fmt.Sprintf(":%d", result)
+func cmdZRem(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key, member := parts[1], parts[2]
+	removed, err := store.ZRem(key, member)
+	if err != nil {
+		return errorReply(err)
+	}
+	if removed {
+		store.changed(1)
+		return protocol.Integer(1)
+	}
+	return protocol.Integer(0)
+}
 
-	case "XGROUP":
-		if len(parts) < 4 || strings.ToUpper(parts[1]) != "CREATE" {
-			return "-ERR XGROUP CREATE requires key and group name"
-		}
-		key := parts[2]
-		groupName := parts[3]
-		success := store.XGroupCreate(key, groupName)
-		if success {
-			return "+OK"
-		}
-		return "-ERR XGROUP CREATE failed"
+func cmdZRangeByScore(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key := parts[1]
+	min, err1 := strconv.ParseFloat(parts[2], 64)
+	max, err2 := strconv.ParseFloat(parts[3], 64)
+	if err1 != nil || err2 != nil {
+		return protocol.Error("ERR Min and max must be floats")
+	}
+	members, err := store.ZRangeByScore(key, min, max)
+	if err != nil {
+		return errorReply(err)
+	}
+	if len(members) == 0 {
+		return protocol.Array{}
+	}
+	return protocol.StringArray(members)
+}
 
-	case "XREADGROUP":
-		if len(parts) < 5 {
-			return "-ERR XREADGROUP requires key, group, consumer, and start ID"
-		}
-		key := parts[1]
-		groupName := parts[2]
-		consumerName := parts[3]
-		startID := parts[4]
-		count := 0
-		if len(parts) > 5 {
-			var err error
-			count, err = strconv.Atoi(parts[5])
-			if err != nil {
-				return "-ERR Invalid count argument"
-			}
-		}
-		result := store.XReadGroup(key, groupName, consumerName, startID, count)
-		return formatEntries(result)
+func cmdXAdd(store *Tealis, session *Session, parts []string) protocol.Reply {
+	// Fields must come in field-value pairs
+	if len(parts[3:])%2 != 0 {
+		return protocol.WrongArgs("xadd")
+	}
 
-	case "XACK":
-		if len(parts) < 4 {
-			return "-ERR XACK requires key, group, and at least one ID"
-		}
-		key := parts[1]
-		groupName := parts[2]
-		ids := parts[3:]
-		result := store.XAck(key, groupName, ids)
-		return fmt.Sprintf(":%d", result)
-	case "GEOADD":
-		if len(parts) < 5 || (len(parts)-2)%3 != 0 {
-			return "-ERR GEOADD requires key, longitude, latitude, and member"
-		}
-		key := parts[1]
-		for i := 2; i < len(parts); i += 3 {
-			longitude, err1 := strconv.ParseFloat(parts[i], 64)
-			latitude, err2 := strconv.ParseFloat(parts[i+1], 64)
-			member := parts[i+2]
-			if err1 != nil || err2 != nil {
-				return "-ERR Longitude and latitude must be valid floating-point numbers"
-			}
-			store.GEOAdd(key, longitude, latitude, member)
-		}
-		return ":1" // Success indicator
+	key := parts[1]
+	id := parts[2]
 
-	case "GEODIST":
-		if len(parts) < 4 || len(parts) > 5 {
-			return "-ERR GEODIST requires key, member1, member2, and an optional unit"
-		}
-		key, member1, member2 := parts[1], parts[2], parts[3]
-		// Default unit is meters
-		if len(parts) == 5 {
+	// Parse field-value pairs
+	fields := make(map[string]string)
+	for i := 3; i < len(parts); i += 2 {
+		fields[parts[i]] = parts[i+1]
+	}
 
-		}
-		distance := store.GEODist(key, member1, member2)
-		return fmt.Sprintf(":%f", distance)
+	// Add the entry to the stream
+	result, err := store.XAdd(key, id, fields)
+	if err != nil {
+		return errorReply(err)
+	}
+	store.changed(1)
+	return protocol.BulkString(result)
+}
 
-	case "GEORADIUS":
-		if len(parts) < 6 {
-			return "-ERR GEORADIUS requires key, longitude, latitude, radius, and unit"
-		}
-		key := parts[1]
-		longitude, err1 := strconv.ParseFloat(parts[2], 64)
-		latitude, err2 := strconv.ParseFloat(parts[3], 64)
-		radius, err3 := strconv.ParseFloat(parts[4], 64)
-		if err1 != nil || err2 != nil || err3 != nil {
-			return "-ERR Longitude, latitude, and radius must be valid numbers"
-		}
-		results := store.GEOSearch(key, longitude, latitude, radius)
-		if len(results) == 0 {
-			return "(empty list or set)"
+func cmdXRead(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key := parts[1]
+	startID := parts[2]
+	count := 0
+	if len(parts) > 3 {
+		var err error
+		count, err = strconv.Atoi(parts[3])
+		if err != nil {
+			return protocol.Error("ERR Invalid count argument")
 		}
-		return formatArrayResponse(results)
+	}
+	result, err := store.XRead(key, startID, count)
+	if err != nil {
+		return errorReply(err)
+	}
+	return formatEntries(result)
+}
+
+func cmdXRange(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key := parts[1]
+	startID := parts[2]
+	endID := parts[3]
+	result, err := store.XRange(key, startID, endID)
+	if err != nil {
+		return errorReply(err)
+	}
+	return formatEntries(result)
+}
+
+func cmdXLen(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key := parts[1]
+	result, err := store.XLen(key)
+	if err != nil {
+		return errorReply(err)
+	}
+	return protocol.Integer(result)
+}
 
-	case "SETBIT":
-		if len(parts) != 4 {
-			return "-ERR wrong number of arguments for 'SETBIT' command"
+func cmdXGroup(store *Tealis, session *Session, parts []string) protocol.Reply {
+	switch strings.ToUpper(parts[1]) {
+	case "CREATE":
+	case "CREATECONSUMER":
+		if len(parts) != 5 {
+			return protocol.WrongArgs("xgroup|createconsumer")
 		}
-		key := parts[1]
-		offset, err := strconv.Atoi(parts[2])
+		key, groupName := parts[2], parts[3]
+		created, ok, err := store.XGroupCreateConsumer(key, groupName, parts[4])
 		if err != nil {
-			return "-ERR offset is not an integer"
+			return errorReply(err)
 		}
-		value, err := strconv.Atoi(parts[3])
-		if err != nil || (value != 0 && value != 1) {
-			return "-ERR bit value is not an integer or out of range"
+		if !ok {
+			return protocol.Error(fmt.Sprintf("NOGROUP No such key '%s' or consumer group '%s'", key, groupName))
 		}
-		prev := store.SETBIT(key, offset, value)
-		return ":" + strconv.Itoa(prev)
-
-	case "GETBIT":
-		if len(parts) != 3 {
-			return "-ERR wrong number of arguments for 'GETBIT' command"
+		if !created {
+			return protocol.Integer(0)
 		}
-		key := parts[1]
-		offset, err := strconv.Atoi(parts[2])
+		store.changed(1)
+		return protocol.Integer(1)
+	default:
+		return protocol.Errorf("unknown subcommand '%s'", parts[1])
+	}
+	key := parts[2]
+	groupName := parts[3]
+	success, err := store.XGroupCreate(key, groupName)
+	if err != nil {
+		return errorReply(err)
+	}
+	if success {
+		store.changed(1)
+		return protocol.OK
+	}
+	return protocol.Error("ERR XGROUP CREATE failed")
+}
+
+func cmdXReadGroup(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key := parts[1]
+	groupName := parts[2]
+	consumerName := parts[3]
+	startID := parts[4]
+	count := 0
+	if len(parts) > 5 {
+		var err error
+		count, err = strconv.Atoi(parts[5])
 		if err != nil {
-			return "-ERR offset is not an integer"
+			return protocol.Error("ERR Invalid count argument")
 		}
-		bit := store.GETBIT(key, offset)
-		return ":" + strconv.Itoa(bit)
+	}
+	result, err := store.XReadGroup(key, groupName, consumerName, startID, count)
+	if err != nil {
+		return errorReply(err)
+	}
+	// Delivered entries become pending for the consumer
+	store.changed(len(result))
+	return formatEntries(result)
+}
 
-	case "BITCOUNT":
-		if len(parts) != 2 {
-			return "-ERR wrong number of arguments for 'BITCOUNT' command"
-		}
-		key := parts[1]
-		count := store.BITCOUNT(key)
-		return ":" + strconv.Itoa(count)
+func cmdXAck(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key := parts[1]
+	groupName := parts[2]
+	ids := parts[3:]
+	result, err := store.XAck(key, groupName, ids)
+	if err != nil {
+		return errorReply(err)
+	}
+	store.changed(result)
+	return protocol.Integer(result)
+}
 
-	case "BITOP":
-		if len(parts) < 4 {
-			return "-ERR wrong number of arguments for 'BITOP' command"
+func cmdXClaim(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key, groupName, consumerName := parts[1], parts[2], parts[3]
+	if _, err := strconv.ParseInt(parts[4], 10, 64); err != nil {
+		return protocol.Error("ERR Invalid min-idle-time argument for XCLAIM")
+	}
+	// IDs come first, options after them
+	ids := parts[5:]
+	force, justID := false, false
+	for len(ids) > 0 {
+		option := strings.ToUpper(ids[len(ids)-1])
+		if option == "FORCE" {
+			force = true
+		} else if option == "JUSTID" {
+			justID = true
+		} else {
+			break
 		}
-		op := strings.ToUpper(parts[1])
-		destKey := parts[2]
-		keys := parts[3:]
-		if op != "AND" && op != "OR" && op != "XOR" && op != "NOT" {
-			return "-ERR unknown operation"
+		ids = ids[:len(ids)-1]
+	}
+	if len(ids) == 0 {
+		return protocol.WrongArgs("xclaim")
+	}
+	claimed, ok, err := store.XClaim(key, groupName, consumerName, ids, force)
+	if err != nil {
+		return errorReply(err)
+	}
+	if !ok {
+		return protocol.Error(fmt.Sprintf("NOGROUP No such key '%s' or consumer group '%s'", key, groupName))
+	}
+	store.changed(len(claimed))
+	if justID {
+		result := make([]string, len(claimed))
+		for i, entry := range claimed {
+			result[i] = entry.ID
+		}
+		return protocol.StringArray(result)
+	}
+	return formatEntries(claimed)
+}
+
+func cmdGeoAdd(store *Tealis, session *Session, parts []string) protocol.Reply {
+	if (len(parts)-2)%3 != 0 {
+		return protocol.WrongArgs("geoadd")
+	}
+	key := parts[1]
+	for i := 2; i < len(parts); i += 3 {
+		longitude, err1 := strconv.ParseFloat(parts[i], 64)
+		latitude, err2 := strconv.ParseFloat(parts[i+1], 64)
+		member := parts[i+2]
+		if err1 != nil || err2 != nil {
+			return protocol.Error("ERR Longitude and latitude must be valid floating-point numbers")
 		}
-		if op == "NOT" && len(keys) != 1 {
-			return "-ERR NOT operation takes only one key"
+		if err := store.GEOAdd(key, longitude, latitude, member); err != nil {
+			return errorReply(err)
 		}
-		store.BITOP(op, destKey, keys...)
-		// Return the length of the resulting key
-		result, _ := store.Store[destKey].([]byte)
-		return ":" + strconv.Itoa(len(result))
-	case "BITFIELD":
-		myKey := parts[1]
-		bitType := parts[3]
-		action := parts[2]
-		offset, _ := strconv.Atoi(parts[4])
-		bfCommand := strings.ToUpper(action)
-		incrementBy, _ := strconv.Atoi(parts[5])
-		switch bfCommand {
-		case "SET":
-			// Parse the value to set
-			value, _ := strconv.Atoi(parts[5])
-			// Call the SetBitfield method
-			err := store.SetBitfield(myKey, bitType, offset, value)
-			if err != nil {
-				// Return an error message if the operation fails
-				return fmt.Sprintf("ERROR: %s", err.Error())
-			}
-			// Return success
-			return "OK"
-		case "INCRBY":
+		store.changed(1)
+	}
+	return protocol.Integer(1) // Success indicator
+}
 
-			value, err := store.IncrByBitfield(myKey, bitType, offset, incrementBy)
-			if err != nil {
-				// Return an error message if the operation fails
-				return fmt.Sprintf("ERROR: %s", err.Error())
-			}
-			// Return success
-			return fmt.Sprintf(":OK  %d", value)
+func cmdGeoDist(store *Tealis, session *Session, parts []string) protocol.Reply {
+	if len(parts) > 5 {
+		return protocol.Error("ERR syntax error")
+	}
+	key, member1, member2 := parts[1], parts[2], parts[3]
+	// Default unit is meters
+	if len(parts) == 5 {
 
-		case "GET":
-			// Call the GetBitfield method
-			value, err := store.GetBitfield(myKey, bitType, offset)
-			if err != nil {
-				// Return an error message if the operation fails
-				return fmt.Sprintf("ERROR: %s", err.Error())
-			}
-			// Return the value as a string
-			return fmt.Sprintf("%d", value)
+	}
+	distance, ok, err := store.GEODist(key, member1, member2)
+	if err != nil {
+		return errorReply(err)
+	}
+	if !ok {
+		return protocol.Null{}
+	}
+	return protocol.BulkString(protocol.FormatDouble(distance))
+}
 
-		default:
-			// Handle unsupported commands
-			return fmt.Sprintf("ERROR: Unsupported BITFIELD action '%s'", bfCommand)
-		}
-	case "PFADD":
-		pfkey := parts[1]
-		pfValues := parts[2:] // Remaining parts are the values to add
-		var successCount int  // Count of successful additions, if needed
-		var err error         // To store any error from PFAdd
-
-		for _, value := range pfValues {
-			err = store.PFAdd(pfkey, value) // Call PFAdd for each value
-			if err != nil {
-				// Handle the error (log, return an error, etc.)
-				return fmt.Sprintf("%s", err) // or continue to the next value, depending on your use case
-			}
-			successCount++ // Increment count if PFAdd succeeds
-		}
+func cmdGeoRadius(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key := parts[1]
+	longitude, err1 := strconv.ParseFloat(parts[2], 64)
+	latitude, err2 := strconv.ParseFloat(parts[3], 64)
+	radius, err3 := strconv.ParseFloat(parts[4], 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return protocol.Error("ERR Longitude, latitude, and radius must be valid numbers")
+	}
+	results, err := store.GEOSearch(key, longitude, latitude, radius)
+	if err != nil {
+		return errorReply(err)
+	}
+	if len(results) == 0 {
+		return protocol.Array{}
+	}
+	return protocol.StringArray(results)
+}
 
-		return fmt.Sprintf("%d", successCount) // Return the total number of successful additions, or the result you need
-	case "PFMERGE":
-		targetKey := parts[1]   // The key to store the merged result
-		sourceKeys := parts[2:] // The list of keys to merge
+func cmdSetBit(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key := parts[1]
+	offset, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return protocol.Error("ERR offset is not an integer")
+	}
+	value, err := strconv.Atoi(parts[3])
+	if err != nil || (value != 0 && value != 1) {
+		return protocol.Error("ERR bit value is not an integer or out of range")
+	}
+	prev, err := store.SETBIT(key, offset, value)
+	if err != nil {
+		return errorReply(err)
+	}
+	store.changed(1)
+	return protocol.Integer(prev)
+}
 
-		// Call PFMerge to merge all source keys into the target key
-		err := store.PFMerge(targetKey, sourceKeys...)
-		if err != nil {
-			// Handle the error (log it, return an error, etc.)
-			return fmt.Sprintf("%s", err)
-		}
+func cmdGetBit(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key := parts[1]
+	offset, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return protocol.Error("ERR offset is not an integer")
+	}
+	bit, err := store.GETBIT(key, offset)
+	if err != nil {
+		return errorReply(err)
+	}
+	return protocol.Integer(bit)
+}
 
-		return "OK" // Indicating that the merge was successful
-	case "PFCOUNT":
-		keys := parts[1:] // The list of keys to count the unique elements for
-		totalCount := int64(0)
+func cmdBitCount(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key := parts[1]
+	count, err := store.BITCOUNT(key)
+	if err != nil {
+		return errorReply(err)
+	}
+	return protocol.Integer(count)
+}
 
-		// Iterate over each key and get the approximate cardinality
-		for _, key := range keys {
-			count, err := store.PFCount(key) // Get the approximate count for each HyperLogLog key
-			if err != nil {
-				// Handle the error (log it, return an error, etc.)
-				return fmt.Sprintf("%s", err)
-			}
-			totalCount += count // Accumulate the count
-		}
+func cmdBitRestore(store *Tealis, session *Session, parts []string) protocol.Reply {
+	store.BITRESTORE(parts[1], []byte(parts[2]))
+	store.changed(1)
+	return protocol.OK
+}
 
-		return fmt.Sprintf("%d", totalCount) // Return the total approximate count as a string
-	case "TS.CREATE":
-		if len(parts) < 3 {
-			return "-ERR TS.CREATE requires key and aggregation method"
-		}
-		key := parts[1]
-		aggregation := strings.ToLower(parts[2])
-		if aggregation != "avg" && aggregation != "min" && aggregation != "max" {
-			return "-ERR Invalid aggregation method. Choose 'avg', 'min', or 'max'."
-		}
-		err := store.TSCreate(key, aggregation)
-		if err != nil {
-			return fmt.Sprintf("-ERR %s", err)
-		}
-		return "+OK"
+func cmdBitOp(store *Tealis, session *Session, parts []string) protocol.Reply {
+	op := strings.ToUpper(parts[1])
+	destKey := parts[2]
+	keys := parts[3:]
+	if op != "AND" && op != "OR" && op != "XOR" && op != "NOT" {
+		return protocol.Error("ERR unknown operation")
+	}
+	if op == "NOT" && len(keys) != 1 {
+		return protocol.Error("ERR NOT operation takes only one key")
+	}
+	length, err := store.BITOP(op, destKey, keys...)
+	if err != nil {
+		return errorReply(err)
+	}
+	store.changed(1)
+	return protocol.Integer(length)
+}
 
-	case "TS.ADD":
-		if len(parts) < 4 {
-			return "-ERR TS.ADD requires key, timestamp, and value"
+// maxBitOffset is the last bit of a 512MB string, the largest value Redis allows.
+const maxBitOffset = 8*(512<<20) - 1
+
+func cmdBitField(store *Tealis, session *Session, parts []string) protocol.Reply {
+	myKey := parts[1]
+	bfCommand := strings.ToUpper(parts[2])
+	bitType := parts[3]
+	offset, err := strconv.Atoi(parts[4])
+	if err != nil || offset < 0 || offset > maxBitOffset {
+		return protocol.Error("ERR bit offset is not an integer or out of range")
+	}
+	switch bfCommand {
+	case "SET", "INCRBY":
+		// SET and INCRBY take a value after the offset
+		if len(parts) != 6 {
+			return protocol.WrongArgs("bitfield")
 		}
-		key := parts[1]
-		timestampSecs, err := strconv.Atoi(parts[2])
+		value, err := strconv.Atoi(parts[5])
 		if err != nil {
-			return "-ERR Invalid timestamp"
+			return protocol.Error("ERR value is not an integer or out of range")
 		}
-		timestamp := time.Unix(int64(timestampSecs), 0)
-		value, err := strconv.ParseFloat(parts[3], 64)
-		if err != nil {
-			return "-ERR Invalid value"
+		if bfCommand == "SET" {
+			if err := store.SetBitfield(myKey, bitType, offset, value); err != nil {
+				return errorReply(err)
+			}
+			store.changed(1)
+			return protocol.OK
 		}
-		err = store.TSAdd(key, timestamp, value)
+		newValue, err := store.IncrByBitfield(myKey, bitType, offset, value)
 		if err != nil {
-			return fmt.Sprintf("-ERR %s", err)
+			return errorReply(err)
 		}
-		return "+OK"
+		store.changed(1)
+		// Return the new value
+		return protocol.Integer(newValue)
 
-	case "TS.RANGE":
-		if len(parts) < 4 {
-			return "-ERR TS.RANGE requires key, start, and end timestamps"
+	case "GET":
+		if len(parts) != 5 {
+			return protocol.WrongArgs("bitfield")
 		}
-		key := parts[1]
-		startSecs, err := strconv.Atoi(parts[2])
+		value, err := store.GetBitfield(myKey, bitType, offset)
 		if err != nil {
-			return "-ERR Invalid start timestamp"
+			return errorReply(err)
 		}
-		start := time.Unix(int64(startSecs), 0)
+		return protocol.Integer(value)
 
-		endSecs, err := strconv.Atoi(parts[3])
-		if err != nil {
-			return "-ERR Invalid end timestamp"
-		}
-		end := time.Unix(int64(endSecs), 0)
+	default:
+		// Handle unsupported commands
+		return protocol.Errorf("Unsupported BITFIELD action '%s'", bfCommand)
+	}
+}
+
+func cmdPFAdd(store *Tealis, session *Session, parts []string) protocol.Reply {
+	pfkey := parts[1]
+	pfValues := parts[2:] // Remaining parts are the values to add
+	var successCount int  // Count of successful additions, if needed
+	var err error         // To store any error from PFAdd
 
-		dataPoints, err := store.TSRange(key, start, end)
+	for _, value := range pfValues {
+		err = store.PFAdd(pfkey, value) // Call PFAdd for each value
 		if err != nil {
-			return fmt.Sprintf("-ERR %s", err)
+			// Handle the error (log, return an error, etc.)
+			return errorReply(err)
 		}
+		successCount++ // Increment count if PFAdd succeeds
+	}
+	store.changed(successCount)
 
-		if len(dataPoints) == 0 {
-			return "$-1"
-		}
+	return protocol.Integer(successCount) // Return the total number of successful additions
+}
 
-		var response string
-		for _, dp := range dataPoints {
-			response += fmt.Sprintf("%d %f\r\n", dp.Timestamp.Unix(), dp.Value)
-		}
-		return "$" + strconv.Itoa(len(response)) + "\r\n" + response
+func cmdPFRestore(store *Tealis, session *Session, parts []string) protocol.Reply {
+	if err := store.PFRestore(parts[1], []byte(parts[2])); err != nil {
+		return errorReply(err)
+	}
+	store.changed(1)
+	return protocol.OK
+}
 
-	case "TS.GET":
-		if len(parts) < 2 {
-			return "-ERR TS.GET requires key"
-		}
-		key := parts[1]
-		latest, err := store.TSGet(key)
+func cmdPFMerge(store *Tealis, session *Session, parts []string) protocol.Reply {
+	targetKey := parts[1]   // The key to store the merged result
+	sourceKeys := parts[2:] // The list of keys to merge
+
+	// Call PFMerge to merge all source keys into the target key
+	err := store.PFMerge(targetKey, sourceKeys...)
+	if err != nil {
+		return errorReply(err)
+	}
+	store.changed(1)
+
+	return protocol.OK // Indicating that the merge was successful
+}
+
+func cmdPFCount(store *Tealis, session *Session, parts []string) protocol.Reply {
+	keys := parts[1:] // The list of keys to count the unique elements for
+	totalCount := int64(0)
+
+	// Iterate over each key and get the approximate cardinality
+	for _, key := range keys {
+		count, err := store.PFCount(key) // Get the approximate count for each HyperLogLog key
 		if err != nil {
-			return fmt.Sprintf("-ERR %s", err)
+			return errorReply(err)
 		}
-		return fmt.Sprintf("%d %f\r\n", latest.Timestamp.Unix(), latest.Value)
+		totalCount += count // Accumulate the count
+	}
 
-	case "SUBSCRIBE", "SUB":
-		if len(parts) < 2 {
-			return "-ERR Missing channel name\r\n"
-		}
-		channel := parts[1]
-		return store.Subscribe(clientID, channel)
+	return protocol.Integer(totalCount) // Return the total approximate count
+}
 
-	case "UNSUBSCRIBE":
-		if len(parts) < 2 {
-			return "-ERR Missing channel name\r\n"
-		}
-		channel := parts[1]
-		return store.Unsubscribe(clientID, channel)
+func cmdTSCreate(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key := parts[1]
+	aggregation := strings.ToLower(parts[2])
+	if aggregation != "avg" && aggregation != "min" && aggregation != "max" {
+		return protocol.Error("ERR Invalid aggregation method. Choose 'avg', 'min', or 'max'.")
+	}
+	err := store.TSCreate(key, aggregation)
+	if err != nil {
+		return errorReply(err)
+	}
+	store.changed(1)
+	return protocol.OK
+}
 
-	case "PUBLISH", "PUB":
-		if len(parts) < 3 {
-			return "-ERR Missing channel or message\r\n"
-		}
-		channel := parts[1]
-		message := strings.Join(parts[2:], " ")
-		return store.Publish(channel, message)
+func cmdTSAdd(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key := parts[1]
+	timestampSecs, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return protocol.Error("ERR Invalid timestamp")
+	}
+	timestamp := time.Unix(int64(timestampSecs), 0)
+	value, err := strconv.ParseFloat(parts[3], 64)
+	if err != nil {
+		return protocol.Error("ERR Invalid value")
+	}
+	err = store.TSAdd(key, timestamp, value)
+	if err != nil {
+		return errorReply(err)
+	}
+	store.changed(1)
+	return protocol.OK
+}
 
-	case "VECTOR.SET":
-		if len(parts) < 3 {
-			return "-ERR Usage: VECTOR.SET key [values...]\r\n"
-		}
-		key := parts[1]
-		vector := make([]float64, len(parts[2:]))
-		for i, v := range parts[2:] {
-			val, err := strconv.ParseFloat(v, 64)
-			if err != nil {
-				return "-ERR Invalid vector value\r\n"
-			}
-			vector[i] = val
-		}
-		return store.VectorSet(key, vector)
-	case "VECTOR.GET":
-		if len(parts) != 2 {
-			return "-ERR Usage: VECTOR.GET key\r\n"
-		}
-		key := parts[1]
-		return store.VectorGet(key)
-	case "VECTOR.SEARCH":
-		if len(parts) < 4 {
-			return "-ERR Usage: VECTOR.SEARCH [query...] k\r\n"
-		}
-		query := make([]float64, len(parts[1:len(parts)-1]))
-		for i, v := range parts[1 : len(parts)-1] {
-			val, err := strconv.ParseFloat(v, 64)
-			if err != nil {
-				return "-ERR Invalid query vector value\r\n"
-			}
-			query[i] = val
-		}
-		k, err := strconv.Atoi(parts[len(parts)-1])
-		if err != nil || k <= 0 {
-			return "-ERR Invalid k value\r\n"
+func cmdTSRange(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key := parts[1]
+	startSecs, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return protocol.Error("ERR Invalid start timestamp")
+	}
+	start := time.Unix(int64(startSecs), 0)
+
+	endSecs, err := strconv.Atoi(parts[3])
+	if err != nil {
+		return protocol.Error("ERR Invalid end timestamp")
+	}
+	end := time.Unix(int64(endSecs), 0)
+
+	dataPoints, err := store.TSRange(key, start, end)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	response := make(protocol.Array, len(dataPoints))
+	for i, dp := range dataPoints {
+		response[i] = formatDataPoint(dp)
+	}
+	return response
+}
+
+func cmdTSGet(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key := parts[1]
+	latest, err := store.TSGet(key)
+	if err != nil {
+		return errorReply(err)
+	}
+	return formatDataPoint(latest)
+}
+
+func cmdSubscribe(store *Tealis, session *Session, parts []string) protocol.Reply {
+	channel := parts[1]
+	count := store.Subscribe(session, channel)
+	return protocol.Push{protocol.BulkString("subscribe"), protocol.BulkString(channel), protocol.Integer(count)}
+}
+
+func cmdUnsubscribe(store *Tealis, session *Session, parts []string) protocol.Reply {
+	channel := parts[1]
+	count := store.Unsubscribe(session, channel)
+	return protocol.Push{protocol.BulkString("unsubscribe"), protocol.BulkString(channel), protocol.Integer(count)}
+}
+
+func cmdPSubscribe(store *Tealis, session *Session, parts []string) protocol.Reply {
+	pattern := parts[1]
+	count := store.PSubscribe(session, pattern)
+	return protocol.Push{protocol.BulkString("psubscribe"), protocol.BulkString(pattern), protocol.Integer(count)}
+}
+
+func cmdPUnsubscribe(store *Tealis, session *Session, parts []string) protocol.Reply {
+	pattern := parts[1]
+	count := store.PUnsubscribe(session, pattern)
+	return protocol.Push{protocol.BulkString("punsubscribe"), protocol.BulkString(pattern), protocol.Integer(count)}
+}
+
+func cmdPublish(store *Tealis, session *Session, parts []string) protocol.Reply {
+	channel := parts[1]
+	message := strings.Join(parts[2:], " ")
+	return protocol.Integer(store.Publish(channel, message))
+}
+
+func cmdVectorSet(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key := parts[1]
+	vector := make([]float64, len(parts[2:]))
+	for i, v := range parts[2:] {
+		val, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return protocol.Error("ERR Invalid vector value")
 		}
-		return store.VectorSearch(query, k)
+		vector[i] = val
+	}
+	store.VectorSet(key, vector)
+	store.changed(1)
+	return protocol.OK
+}
 
-	default:
-		return "-ERR Unknown command"
+func cmdVectorGet(store *Tealis, session *Session, parts []string) protocol.Reply {
+	key := parts[1]
+	vector, err := store.VectorGet(key)
+	if err != nil {
+		return errorReply(err)
 	}
+	response, _ := json.Marshal(vector)
+	return protocol.BulkString(response)
 }
 
-// formatEntries converts stream entries into a string representation.
-func formatEntries(entries []StreamEntry) string {
-	if len(entries) == 0 {
-		return "(empty list or set)"
+func cmdVectorSearch(store *Tealis, session *Session, parts []string) protocol.Reply {
+	query := make([]float64, len(parts[1:len(parts)-1]))
+	for i, v := range parts[1 : len(parts)-1] {
+		val, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return protocol.Error("ERR Invalid query vector value")
+		}
+		query[i] = val
 	}
-	var sb strings.Builder
+	k, err := strconv.Atoi(parts[len(parts)-1])
+	if err != nil || k <= 0 {
+		return protocol.Error("ERR Invalid k value")
+	}
+	matches := store.VectorSearch(query, k)
+	results := make(protocol.Array, len(matches))
+	for i, match := range matches {
+		results[i] = protocol.Array{protocol.BulkString(match.Key), protocol.Double(match.Distance)}
+	}
+	return results
+}
+
+// formatEntries converts stream entries into an array of [id, [field, value, ...]] pairs.
+func formatEntries(entries []StreamEntry) protocol.Reply {
+	result := make(protocol.Array, 0, len(entries))
 	for _, entry := range entries {
-		sb.WriteString(fmt.Sprintf("%s: %v\r\n", entry.ID, entry.Fields))
+		fields := make([]string, 0, len(entry.Fields))
+		for field := range entry.Fields {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		pairs := make(protocol.Array, 0, len(fields)*2)
+		for _, field := range fields {
+			pairs = append(pairs, protocol.BulkString(field), protocol.BulkString(entry.Fields[field]))
+		}
+		result = append(result, protocol.Array{protocol.BulkString(entry.ID), pairs})
 	}
-	return sb.String()
+	return result
 }
 
-// Helper to format an array response for the KEYS command
-func formatArrayResponse(items []string) string {
-	var response strings.Builder
-	response.WriteString("*" + strconv.Itoa(len(items)) + "\r\n")
-	for _, item := range items {
-		response.WriteString("$" + strconv.Itoa(len(item)) + "\r\n")
-		response.WriteString(item + "\r\n")
+// formatHashResponse converts a hash into a map reply.
+func formatHashResponse(fields map[string]interface{}) protocol.Reply {
+	names := make([]string, 0, len(fields))
+	for field := range fields {
+		names = append(names, field)
 	}
-	return response.String()
+	sort.Strings(names)
+	response := make(protocol.Map, 0, len(fields))
+	for _, field := range names {
+		response = append(response, protocol.MapEntry{
+			Key:   protocol.BulkString(field),
+			Value: protocol.BulkString(fmt.Sprintf("%v", fields[field])),
+		})
+	}
+	return response
+}
+
+// formatDataPoint converts a time series sample into a [timestamp, value] pair.
+func formatDataPoint(dp DataPoint) protocol.Reply {
+	return protocol.Array{protocol.Integer(dp.Timestamp.Unix()), protocol.Double(dp.Value)}
 }
 
-func formatHashResponse(fields map[string]interface{}) string {
-	var response strings.Builder
-	response.WriteString("*" + strconv.Itoa(len(fields)*2) + "\r\n")
-	for field, value := range fields {
-		fieldStr := fmt.Sprintf("%v", field)
-		valueStr := fmt.Sprintf("%v", value)
-		response.WriteString("$" + strconv.Itoa(len(fieldStr)) + "\r\n" + fieldStr + "\r\n")
-		response.WriteString("$" + strconv.Itoa(len(valueStr)) + "\r\n" + valueStr + "\r\n")
+// errorReply converts a storage error into an error reply, keeping error codes such as WRONGTYPE.
+func errorReply(err error) protocol.Reply {
+	msg := err.Error()
+	if code, _, found := strings.Cut(msg, " "); found && code != "" && strings.ToUpper(code) == code && code[0] >= 'A' && code[0] <= 'Z' {
+		return protocol.Error(msg)
 	}
-	return response.String()
+	return protocol.Error("ERR " + msg)
 }
@@ -1,14 +1,17 @@
 package storage
 
-func (r *Tealis) HSET(key, field string, value interface{}) int {
+func (r *Tealis) HSET(key, field string, value interface{}) (int, error) {
 	r.Mu.Lock()
 	defer r.Mu.Unlock()
 
 	// Retrieve or create the hash
-	hash, ok := r.Store[key].(map[string]interface{})
+	hash, ok, err := valueOf[map[string]interface{}](r.lookupWriteLocked(key))
+	if err != nil {
+		return 0, err
+	}
 	if !ok {
 		hash = make(map[string]interface{})
-		r.Store[key] = hash
+		r.setLocked(key, hash)
 	}
 
 	// Check if the field already exists
@@ -19,49 +22,55 @@ func (r *Tealis) HSET(key, field string, value interface{}) int {
 
 	// Return 1 if a new field was added, 0 if the field was updated
 	if exists {
-		return 0
+		return 0, nil
 	}
-	return 1
+	r.memberAdded(key, field)
+	return 1, nil
 }
-func (r *Tealis) HGET(key, field string) (interface{}, bool) {
+func (r *Tealis) HGET(key, field string) (interface{}, bool, error) {
 	r.Mu.RLock()
 	defer r.Mu.RUnlock()
 
 	// Retrieve the hash
-	hash, ok := r.Store[key].(map[string]interface{})
+	hash, ok, err := valueOf[map[string]interface{}](r.lookupLocked(key))
 	if !ok {
-		return nil, false
+		return nil, false, err
 	}
 
 	// Retrieve the field's value
 	value, exists := hash[field]
-	return value, exists
+	return value, exists, nil
 }
 
-func (r *Tealis) HMSET(key string, fields map[string]interface{}) {
+func (r *Tealis) HMSET(key string, fields map[string]interface{}) error {
 	r.Mu.Lock()
 	defer r.Mu.Unlock()
 
 	// Retrieve or create the hash
-	hash, ok := r.Store[key].(map[string]interface{})
+	hash, ok, err := valueOf[map[string]interface{}](r.lookupWriteLocked(key))
+	if err != nil {
+		return err
+	}
 	if !ok {
 		hash = make(map[string]interface{})
-		r.Store[key] = hash
+		r.setLocked(key, hash)
 	}
 
 	// Set all fields in the hash
 	for field, value := range fields {
 		hash[field] = value
+		r.memberAdded(key, field)
 	}
+	return nil
 }
-func (r *Tealis) HGETALL(key string) map[string]interface{} {
+func (r *Tealis) HGETALL(key string) (map[string]interface{}, error) {
 	r.Mu.RLock()
 	defer r.Mu.RUnlock()
 
 	// Retrieve the hash
-	hash, ok := r.Store[key].(map[string]interface{})
+	hash, ok, err := valueOf[map[string]interface{}](r.lookupLocked(key))
 	if !ok {
-		return nil
+		return nil, err
 	}
 
 	// Return a copy of the hash
@@ -69,38 +78,39 @@ func (r *Tealis) HGETALL(key string) map[string]interface{} {
 	for field, value := range hash {
 		result[field] = value
 	}
-	return result
+	return result, nil
 }
 
-func (r *Tealis) HDEL(key string, field string) int {
+func (r *Tealis) HDEL(key string, field string) (int, error) {
 	r.Mu.Lock()
 	defer r.Mu.Unlock()
 
 	// Retrieve the hash
-	hash, ok := r.Store[key].(map[string]interface{})
+	hash, ok, err := valueOf[map[string]interface{}](r.lookupWriteLocked(key))
 	if !ok {
-		return 0
+		return 0, err
 	}
 
 	// Delete the field
 	if _, exists := hash[field]; exists {
 		delete(hash, field)
-		return 1
+		r.memberRemoved(key, field)
+		return 1, nil
 	}
-	return 0
+	return 0, nil
 }
 
-func (r *Tealis) HEXISTS(key, field string) bool {
+func (r *Tealis) HEXISTS(key, field string) (bool, error) {
 	r.Mu.RLock()
 	defer r.Mu.RUnlock()
 
 	// Retrieve the hash
-	hash, ok := r.Store[key].(map[string]interface{})
+	hash, ok, err := valueOf[map[string]interface{}](r.lookupLocked(key))
 	if !ok {
-		return false
+		return false, err
 	}
 
 	// Check if the field exists
 	_, exists := hash[field]
-	return exists
+	return exists, nil
 }
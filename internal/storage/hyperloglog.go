@@ -97,7 +97,7 @@ func (r *Tealis) PFAdd(key string, value string) error {
 	r.Mu.Lock()
 	defer r.Mu.Unlock()
 
-	if val, exists := r.Store[key]; exists {
+	if val := r.lookupWriteLocked(key); val != nil {
 		if hll, ok := val.(*HyperLogLog); ok {
 			hll.Add(value)
 			return nil
@@ -108,7 +108,7 @@ func (r *Tealis) PFAdd(key string, value string) error {
 	// Create a new HyperLogLog if the key does not exist
 	hll := NewHyperLogLog(14) // Default precision of 14
 	hll.Add(value)
-	r.Store[key] = hll
+	r.setLocked(key, hll)
 	return nil
 }
 
@@ -116,7 +116,7 @@ func (r *Tealis) PFCount(key string) (int64, error) {
 	r.Mu.RLock()
 	defer r.Mu.RUnlock()
 
-	if val, exists := r.Store[key]; exists {
+	if val := r.lookupLocked(key); val != nil {
 		if hll, ok := val.(*HyperLogLog); ok {
 			return hll.Count(), nil
 		}
@@ -125,17 +125,45 @@ func (r *Tealis) PFCount(key string) (int64, error) {
 	return 0, errors.New("key does not exist") // Key does not exist
 }
 
+// PFRestore replaces a key with a HyperLogLog holding the given registers, as written by
+// AOF rewrites.
+func (r *Tealis) PFRestore(key string, registers []byte) error {
+	hll, err := newHyperLogLogFromRegisters(registers)
+	if err != nil {
+		return err
+	}
+
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	r.setLocked(key, hll)
+	return nil
+}
+
+// newHyperLogLogFromRegisters recreates a HyperLogLog from a copy of its registers.
+func newHyperLogLogFromRegisters(registers []byte) (*HyperLogLog, error) {
+	precision := bits.Len(uint(len(registers))) - 1
+	if precision < 4 || precision > 18 || len(registers) != 1<<precision {
+		return nil, errors.New("invalid HyperLogLog registers")
+	}
+	hll := NewHyperLogLog(uint8(precision))
+	copy(hll.registers, registers)
+	return hll, nil
+}
+
 func (r *Tealis) PFMerge(dest string, sources ...string) error {
 	r.Mu.Lock()
 	defer r.Mu.Unlock()
 
 	var merged *HyperLogLog
 	for _, source := range sources {
-		if val, exists := r.Store[source]; exists {
+		if val := r.lookupWriteLocked(source); val != nil {
 			if hll, ok := val.(*HyperLogLog); ok {
 				if merged == nil {
 					merged = NewHyperLogLog(14) // Use the same precision
 				}
+				if hll.m != merged.m {
+					return errors.New("ERR cannot merge HyperLogLogs with different register sizes")
+				}
 				merged.Merge(hll)
 			} else {
 				return errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
@@ -145,6 +173,6 @@ func (r *Tealis) PFMerge(dest string, sources ...string) error {
 		}
 	}
 
-	r.Store[dest] = merged
+	r.setLocked(dest, merged)
 	return nil
 }
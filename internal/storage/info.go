@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"tealis/internal/protocol"
+	"time"
+)
+
+func cmdInfo(store *Tealis, session *Session, parts []string) protocol.Reply {
+	if len(parts) > 2 {
+		return protocol.Error("ERR syntax error")
+	}
+	section := "all"
+	if len(parts) == 2 {
+		section = strings.ToLower(parts[1])
+	}
+	var b strings.Builder
+	if section == "all" || section == "default" || section == "persistence" {
+		store.infoPersistence(&b)
+	}
+	if section == "all" || section == "default" || section == "keyspace" {
+		store.infoKeyspace(&b)
+	}
+	return protocol.BulkString(b.String())
+}
+
+// infoPersistence writes the persistence section of INFO.
+func (r *Tealis) infoPersistence(b *strings.Builder) {
+	boolInt := func(v bool) int {
+		if v {
+			return 1
+		}
+		return 0
+	}
+	status := func(ok bool) string {
+		if ok {
+			return "ok"
+		}
+		return "err"
+	}
+
+	r.saveStatsMu.Lock()
+	lastSave, lastSaveOK, started, duration := r.lastSave, r.lastSaveOK, r.saveStarted, r.saveDuration
+	r.saveStatsMu.Unlock()
+	saving := r.saving.Load()
+	lastDuration := -1 // no save finished yet
+	if duration >= 0 {
+		lastDuration = int(duration.Seconds())
+	}
+	current := -1
+	if saving {
+		current = int(time.Since(started).Seconds())
+	}
+
+	fmt.Fprintf(b, "# Persistence\r\n")
+	fmt.Fprintf(b, "loading:%d\r\n", boolInt(r.loading.Load()))
+	fmt.Fprintf(b, "rdb_changes_since_last_save:%d\r\n", r.dirty.Load())
+	fmt.Fprintf(b, "rdb_bgsave_in_progress:%d\r\n", boolInt(saving))
+	fmt.Fprintf(b, "rdb_bgsave_scheduled:%d\r\n", boolInt(r.saveScheduled.Load()))
+	fmt.Fprintf(b, "rdb_last_save_time:%d\r\n", lastSave.Unix())
+	fmt.Fprintf(b, "rdb_last_bgsave_status:%s\r\n", status(lastSaveOK))
+	fmt.Fprintf(b, "rdb_last_bgsave_time_sec:%d\r\n", lastDuration)
+	fmt.Fprintf(b, "rdb_current_bgsave_time_sec:%d\r\n", current)
+	fmt.Fprintf(b, "aof_enabled:%d\r\n", boolInt(r.aofEnabled()))
+	fmt.Fprintf(b, "aof_rewrite_in_progress:%d\r\n", boolInt(r.aofRewriting.Load()))
+}
+
+// infoKeyspace writes the keyspace section of INFO: the keys of every database that has some
+// and how many of them expire.
+func (r *Tealis) infoKeyspace(b *strings.Builder) {
+	r.Mu.RLock()
+	defer r.Mu.RUnlock()
+	if b.Len() > 0 {
+		b.WriteString("\r\n")
+	}
+	fmt.Fprintf(b, "# Keyspace\r\n")
+	for _, db := range r.dbs {
+		if len(db.Store) > 0 {
+			fmt.Fprintf(b, "db%d:keys=%d,expires=%d\r\n", db.db, len(db.Store), len(db.Expiries))
+		}
+	}
+}
@@ -14,25 +14,18 @@ func (r *Tealis) JSONSet(key string, path string, value string) error {
 	r.Mu.Lock()
 	defer r.Mu.Unlock()
 
+	if existing := r.lookupWriteLocked(key); existing != nil && !isJSONDocument(existing) {
+		return errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+	}
+
 	// Handle the special case where the path is "."
 
 	// Step 1: Unmarshal the JSON into a map
 	var result map[string]interface{}
-	err := json.Unmarshal([]byte(value), &result)
-	if err != nil {
-		fmt.Printf("Error unmarshaling JSON: %v", err)
-	}
-	// Directly serialize the value as JSON and store it
-	serializedData, err := json.Marshal(result)
-	if err != nil {
-		return err
+	if err := json.Unmarshal([]byte(value), &result); err != nil {
+		return fmt.Errorf("ERR invalid JSON: %v", err)
 	}
-	var jsonData map[string]interface{}
-	if err := json.Unmarshal(serializedData, &jsonData); err != nil {
-		return err
-	}
-	fmt.Printf("unserial %s", jsonData)
-	r.Store[key] = result
+	r.setLocked(key, result)
 	return nil
 }
 
@@ -40,10 +33,13 @@ func (r *Tealis) JSONSet(key string, path string, value string) error {
 func (r *Tealis) JSONGet(key string, path string) (interface{}, error) {
 
 	// Retrieve the raw JSON data from the store
-	existing, exists := r.Store[key]
-	if !exists {
+	existing := r.lookupLocked(key)
+	if existing == nil {
 		return nil, fmt.Errorf("key not found")
 	}
+	if !isJSONDocument(existing) {
+		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+	}
 
 	// Unmarshal the stored JSON string into a generic interface
 	var jsonData interface{}
@@ -76,8 +72,8 @@ func (r *Tealis) JSONDel(key string, path string) error {
 
 	// If the path is empty or only contains "." delete the whole data
 	if path == "" || path == "." {
-		if _, exists := r.Store[key]; exists {
-			delete(r.Store, key)
+		if r.lookupWriteLocked(key) != nil {
+			r.deleteLocked(key)
 			delete(r.Expiries, key)
 			return nil
 		}
@@ -123,13 +119,23 @@ func (r *Tealis) JSONDel(key string, path string) error {
 	if err != nil {
 		return err
 	}
-	r.Store[key] = string(serializedData)
+	r.setLocked(key, string(serializedData))
 	if done {
 		return nil
 	}
 	return fmt.Errorf("path '%s' not found", path)
 }
 
+// isJSONDocument reports whether a value can be a JSON document. Documents are stored parsed,
+// and serialized once JSON.DEL or JSON.ARRAPPEND changed them.
+func isJSONDocument(value interface{}) bool {
+	switch value.(type) {
+	case map[string]interface{}, string:
+		return true
+	}
+	return false
+}
+
 func setAtPath(data interface{}, path string, value interface{}) (interface{}, error) {
 	parts := strings.Split(path, ".")
 	return setValue(data, parts, value)
@@ -270,7 +276,7 @@ func (r *Tealis) JSONArrAppend(key string, path string, values []interface{}) er
 	if err != nil {
 		return err
 	}
-	r.Store[key] = string(serializedData)
+	r.setLocked(key, string(serializedData))
 	if done {
 		return nil
 	}
@@ -1,81 +1,80 @@
 package storage
 
 import (
+	"errors"
 	_ "fmt"
 	_ "sync"
 	_ "time"
 )
 
 // RPUSH appends one or more values to the end of a list.
-func (r *Tealis) RPUSH(key string, values ...string) int {
+func (r *Tealis) RPUSH(key string, values ...string) (int, error) {
 	r.Mu.Lock()
 	defer r.Mu.Unlock()
 
-	// Initialize the list if not already created
-	if _, exists := r.Store[key]; !exists {
-		r.Store[key] = []string{}
+	// A missing key starts as an empty list
+	list, _, err := valueOf[[]string](r.lookupWriteLocked(key))
+	if err != nil {
+		return 0, err
 	}
-
-	// Assert the value as a slice of strings
-	list := r.Store[key].([]string)
-	r.Store[key] = append(list, values...)
-	return len(r.Store[key].([]string))
+	list = append(list, values...)
+	r.setLocked(key, list)
+	return len(list), nil
 }
 
 // LPUSH prepends one or more values to the beginning of a list.
-func (r *Tealis) LPUSH(key string, values ...string) int {
+func (r *Tealis) LPUSH(key string, values ...string) (int, error) {
 	r.Mu.Lock()
 	defer r.Mu.Unlock()
 
-	// Initialize the list if not already created
-	if _, exists := r.Store[key]; !exists {
-		r.Store[key] = []string{}
+	// A missing key starts as an empty list
+	list, _, err := valueOf[[]string](r.lookupWriteLocked(key))
+	if err != nil {
+		return 0, err
 	}
-
-	// Assert the value as a slice of strings
-	list := r.Store[key].([]string)
-	r.Store[key] = append(values, list...)
-	return len(r.Store[key].([]string))
+	list = append(values, list...)
+	r.setLocked(key, list)
+	return len(list), nil
 }
 
 // LPOP removes and returns the first element of the list.
-func (r *Tealis) LPOP(key string) (string, bool) {
+func (r *Tealis) LPOP(key string) (string, bool, error) {
 	r.Mu.Lock()
 	defer r.Mu.Unlock()
 
-	list, exists := r.Store[key].([]string)
-	if !exists || len(list) == 0 {
-		return "", false
+	list, _, err := valueOf[[]string](r.lookupWriteLocked(key))
+	if err != nil || len(list) == 0 {
+		return "", false, err
 	}
 
 	// Pop the first element
-	r.Store[key] = list[1:]
-	return list[0], true
+	r.setLocked(key, list[1:])
+	return list[0], true, nil
 }
 
 // RPOP removes and returns the last element of the list.
-func (r *Tealis) RPOP(key string) (string, bool) {
+func (r *Tealis) RPOP(key string) (string, bool, error) {
 	r.Mu.Lock()
 	defer r.Mu.Unlock()
 
-	list, exists := r.Store[key].([]string)
-	if !exists || len(list) == 0 {
-		return "", false
+	list, _, err := valueOf[[]string](r.lookupWriteLocked(key))
+	if err != nil || len(list) == 0 {
+		return "", false, err
 	}
 
 	// Pop the last element
-	r.Store[key] = list[:len(list)-1]
-	return list[len(list)-1], true
+	r.setLocked(key, list[:len(list)-1])
+	return list[len(list)-1], true, nil
 }
 
 // LRANGE returns a slice of elements in the list within the specified range.
-func (r *Tealis) LRANGE(key string, start, stop int) []string {
+func (r *Tealis) LRANGE(key string, start, stop int) ([]string, error) {
 	r.Mu.RLock()
 	defer r.Mu.RUnlock()
 
-	list, exists := r.Store[key].([]string)
+	list, exists, err := valueOf[[]string](r.lookupLocked(key))
 	if !exists {
-		return nil
+		return nil, err
 	}
 
 	// Handle negative indexing
@@ -95,30 +94,29 @@ func (r *Tealis) LRANGE(key string, start, stop int) []string {
 	}
 
 	if start > stop {
-		return nil
+		return nil, nil
 	}
 
-	return list[start : stop+1]
+	return list[start : stop+1], nil
 }
 
 // LLEN retrieves the length of the list stored at the given key.
-func (r *Tealis) LLEN(key string) int {
+func (r *Tealis) LLEN(key string) (int, error) {
 	r.Mu.RLock()
 	defer r.Mu.RUnlock()
 
 	// Check if the key exists in the store.
-	value, exists := r.Store[key]
-	if !exists {
-		return 0
+	value := r.lookupLocked(key)
+	if value == nil {
+		return 0, nil
 	}
 
 	// Assert the value is a list (i.e., []interface{}).
 	if list, ok := value.([]interface{}); ok {
-		return len(list)
-	} else {
-		return len(value.([]string))
+		return len(list), nil
 	}
-
-	// If the value is not a list, return 0 (not a valid operation for non-lists).
-	return 0
+	if list, ok := value.([]string); ok {
+		return len(list), nil
+	}
+	return 0, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
 }
@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"strconv"
+	"strings"
+	"tealis/internal/config"
+	"tealis/internal/protocol"
+)
+
+// Keyspace notifications publish what commands do to keys, as selected by
+// notify-keyspace-events: __keyspace@<db>__:<key> carries the event and
+// __keyevent@<db>__:<event> the key, where db is the database of the key. They are published
+// after the command ran, through Publish like any message.
+
+// eventClasses are the notification classes of the commands of each group.
+var eventClasses = map[string]config.KeyspaceEvents{
+	"generic":     config.NotifyGeneric,
+	"string":      config.NotifyString,
+	"bitmap":      config.NotifyString,
+	"hyperloglog": config.NotifyString,
+	"list":        config.NotifyList,
+	"set":         config.NotifySet,
+	"hash":        config.NotifyHash,
+	"sorted-set":  config.NotifyZSet,
+	"geo":         config.NotifyZSet,
+	"stream":      config.NotifyStream,
+	"json":        config.NotifyModule,
+	"timeseries":  config.NotifyModule,
+	"vector":      config.NotifyModule,
+}
+
+// eventNames are the events of the writes whose event is not their own name; an empty name
+// notifies nothing.
+var eventNames = map[string]string{
+	"incr":       "incrby",
+	"decr":       "decrby",
+	"hmset":      "hset",
+	"geoadd":     "zadd",
+	"bitop":      "set",
+	"bitfield":   "setbit",
+	"pfmerge":    "pfadd",
+	"xgroup":     "xgroup-create",
+	"xreadgroup": "",
+}
+
+// countingReplies are the writes whose integer reply counts the changes they made, so a reply
+// of 0 means they changed nothing and notify nothing.
+var countingReplies = map[string]bool{
+	"del":   true,
+	"sadd":  true,
+	"srem":  true,
+	"hdel":  true,
+	"zrem":  true,
+	"xack":  true,
+	"pfadd": true,
+}
+
+// notifyKeyspaceEvent publishes an event that happened to a key if notify-keyspace-events
+// selects its class.
+func (r *Tealis) notifyKeyspaceEvent(class config.KeyspaceEvents, event, key string) {
+	events := config.KeyspaceEvents(r.notifyEvents.Load())
+	if events&class == 0 || r.loading.Load() {
+		return
+	}
+	db := strconv.Itoa(r.db)
+	if events&config.NotifyKeyspace != 0 {
+		r.Publish("__keyspace@"+db+"__:"+key, event)
+	}
+	if events&config.NotifyKeyevent != 0 {
+		r.Publish("__keyevent@"+db+"__:"+event, key)
+	}
+}
+
+// missingKeys returns those of a command's keys that do not exist before it runs, when new
+// key or key miss events are published: the key a write may create, or the keys a read
+// misses. It returns nil otherwise.
+func (r *Tealis) missingKeys(cmd *Command, keys []string) []string {
+	events := config.KeyspaceEvents(r.notifyEvents.Load())
+	if events&(config.NotifyKeyspace|config.NotifyKeyevent) == 0 || len(keys) == 0 {
+		return nil
+	}
+	switch {
+	case cmd.Has(FlagWrite) && events&config.NotifyNew != 0:
+		keys = keys[:1]
+	case cmd.Has(FlagReadonly) && events&config.NotifyKeyMiss != 0:
+	default:
+		return nil
+	}
+	var missing []string
+	for _, key := range keys {
+		if !r.Exists(key) {
+			missing = append(missing, key)
+		}
+	}
+	return missing
+}
+
+// notifyCommand publishes the events of a command that ran successfully. missing holds the
+// keys missingKeys found missing before it ran.
+func (r *Tealis) notifyCommand(cmd *Command, parts []string, reply protocol.Reply, missing []string) {
+	if r.notifyEvents.Load() == 0 || r.loading.Load() {
+		return
+	}
+	if cmd.Has(FlagReadonly) {
+		for _, key := range missing {
+			r.notifyKeyspaceEvent(config.NotifyKeyMiss, "keymiss", key)
+		}
+		return
+	}
+	keys := cmd.Keys(parts)
+	if !cmd.Has(FlagWrite) || cmd.Has(FlagAdmin) || len(keys) == 0 {
+		return
+	}
+	// Every write changes its first key only: the destination of BITOP and PFMERGE
+	key := keys[0]
+	if len(missing) > 0 && r.Exists(key) {
+		r.notifyKeyspaceEvent(config.NotifyNew, "new", key)
+	}
+
+	switch cmd.Name {
+	case "ex", "expire", "pexpire", "expireat", "pexpireat":
+		if reply == protocol.Integer(0) {
+			return
+		}
+		r.notifyExpiryChange(key, "expire")
+	case "move":
+		if reply == protocol.Integer(1) {
+			r.notifyMove(key, parts[2])
+		}
+	case "persist":
+		if reply == protocol.Integer(1) {
+			r.notifyKeyspaceEvent(config.NotifyGeneric, "persist", key)
+		}
+	case "getex":
+		if _, null := reply.(protocol.Null); null || len(parts) == 2 {
+			return
+		}
+		if strings.ToUpper(parts[2]) == "PERSIST" {
+			r.notifyKeyspaceEvent(config.NotifyGeneric, "persist", key)
+			return
+		}
+		r.notifyExpiryChange(key, "expire")
+	case "set":
+		if !setApplied(parts, reply) {
+			return
+		}
+		r.notifyKeyspaceEvent(config.NotifyString, "set", key)
+		for _, option := range parts[3:] {
+			if _, ok := expiryUnits[strings.ToUpper(option)]; ok {
+				r.notifyExpiryChange(key, "expire")
+				break
+			}
+		}
+	default:
+		if _, null := reply.(protocol.Null); null {
+			return
+		}
+		if countingReplies[cmd.Name] && reply == protocol.Integer(0) {
+			return
+		}
+		event, ok := eventNames[cmd.Name]
+		if !ok {
+			event = cmd.Name
+		}
+		if event != "" {
+			r.notifyKeyspaceEvent(eventClasses[cmd.Group], event, key)
+		}
+	}
+}
+
+// notifyExpiryChange publishes a change of expiry, or the deletion of the key an expiry in
+// the past caused.
+func (r *Tealis) notifyExpiryChange(key, event string) {
+	if !r.Exists(key) {
+		event = "del"
+	}
+	r.notifyKeyspaceEvent(config.NotifyGeneric, event, key)
+}
+
+// setApplied reports whether a SET that replied reply set its key. SET replies null when NX
+// or XX kept it from setting the key, except with GET, where the reply is the old value.
+func setApplied(parts []string, reply protocol.Reply) bool {
+	nx, xx, get := false, false, false
+	for _, option := range parts[3:] {
+		switch strings.ToUpper(option) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GET":
+			get = true
+		}
+	}
+	_, null := reply.(protocol.Null)
+	switch {
+	case !get:
+		return !null
+	case nx:
+		return null
+	case xx:
+		return !null
+	}
+	return true
+}
@@ -1,128 +1,112 @@
 package storage
 
 import (
-	"fmt"
-	"github.com/gorilla/websocket"
-	"log"
-	"net"
-	"time"
+	"tealis/internal/protocol"
 )
 
-// Subscribe adds a client to a channel's subscriber list.
-func (r *Tealis) Subscribe(clientID, channel string) string {
+// Subscribe adds a session to a channel's subscriber list and returns the number of
+// channels and patterns the session is subscribed to.
+func (r *Tealis) Subscribe(s *Session, channel string) int {
 	r.Mu.Lock()
 	defer r.Mu.Unlock()
 
 	if _, exists := r.pubsubSubscribers[channel]; !exists {
-		r.pubsubSubscribers[channel] = make(map[string]chan string)
+		r.pubsubSubscribers[channel] = make(map[*Session]struct{})
 	}
+	r.pubsubSubscribers[channel][s] = struct{}{}
 
-	if _, exists := r.pubsubSubscribers[channel][clientID]; !exists {
-		r.pubsubSubscribers[channel][clientID] = make(chan string, 100)        // Buffered channel
-		go r.deliverMessages(clientID, r.pubsubSubscribers[channel][clientID]) // Start delivering messages
-	}
-
-	return fmt.Sprintf("+SUBSCRIBED to %s", channel)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscriptions[channel] = struct{}{}
+	return len(s.subscriptions) + len(s.patterns)
 }
 
-// Unsubscribe removes a client from a channel's subscriber list.
-func (r *Tealis) Unsubscribe(clientID, channel string) string {
+// Unsubscribe removes a session from a channel's subscriber list and returns the number of
+// channels and patterns the session is still subscribed to.
+func (r *Tealis) Unsubscribe(s *Session, channel string) int {
 	r.Mu.Lock()
 	defer r.Mu.Unlock()
+	r.unsubscribe(s, channel)
+	return s.SubscriptionCount()
+}
 
+// unsubscribe is Unsubscribe for callers already holding r.Mu.
+func (r *Tealis) unsubscribe(s *Session, channel string) {
 	if subs, exists := r.pubsubSubscribers[channel]; exists {
-		if msgChan, ok := subs[clientID]; ok {
-			close(msgChan)
-			delete(subs, clientID)
-		}
+		delete(subs, s)
 		if len(subs) == 0 {
 			delete(r.pubsubSubscribers, channel) // Remove empty channels
 		}
 	}
-	return fmt.Sprintf("+UNSUBSCRIBED from %s", channel)
+	s.mu.Lock()
+	delete(s.subscriptions, channel)
+	s.mu.Unlock()
 }
 
-// Publish sends a message to all subscribers of a channel.
-func (r *Tealis) Publish(channel, message string) string {
-	r.Mu.RLock()
-	defer r.Mu.RUnlock()
-
-	subscribers, exists := r.pubsubSubscribers[channel]
-	if !exists {
-		return ":0" // No subscribers
-	}
+// PSubscribe adds a session to the subscribers of every channel matching a glob pattern and
+// returns the number of channels and patterns the session is subscribed to.
+func (r *Tealis) PSubscribe(s *Session, pattern string) int {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
 
-	for _, msgChan := range subscribers {
-		select {
-		case msgChan <- message:
-		default:
-			// Drop message if buffer is full to avoid blocking
-		}
+	if _, exists := r.pubsubPatterns[pattern]; !exists {
+		r.pubsubPatterns[pattern] = make(map[*Session]struct{})
 	}
+	r.pubsubPatterns[pattern][s] = struct{}{}
 
-	return fmt.Sprintf(":%d", len(subscribers))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.patterns[pattern] = struct{}{}
+	return len(s.subscriptions) + len(s.patterns)
 }
 
-// deliverMessages sends messages from a channel to a client.
-func (r *Tealis) deliverMessages(clientID string, msgChan chan string) {
-	log.Printf("delivering messages to %s in chan: %v", clientID, msgChan)
-	for msg := range msgChan {
-		// Check if the client is a WebSocket connection
-		if conn, ok := r.ClientConnections[clientID].(*websocket.Conn); ok {
-			time.Sleep(69 * time.Millisecond)
-			r.wsWriteMutex.Lock() // Ensure only one goroutine writes to WebSocket at a time
-			r.Mu.Lock()
-			err := conn.WriteMessage(websocket.TextMessage, []byte(msg))
-			r.wsWriteMutex.Unlock()
-			r.Mu.Unlock()
+// PUnsubscribe removes a session from a pattern's subscribers and returns the number of
+// channels and patterns the session is still subscribed to.
+func (r *Tealis) PUnsubscribe(s *Session, pattern string) int {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	r.punsubscribe(s, pattern)
+	return s.SubscriptionCount()
+}
 
-			if err != nil {
-				log.Printf("Error delivering message to WebSocket client %s: %v", clientID, err)
-				// Handle cleanup if needed (e.g., unsubscribe client)
-				r.Unsubscribe(clientID, "channel") // Clean up the client subscription
-				break
-			}
-		} else if conn, ok := r.ClientConnections[clientID].(net.Conn); ok {
-			// Send message to regular TCP client
-			_, err := conn.Write([]byte(msg + "\r\n"))
-			if err != nil {
-				log.Printf("Error delivering message to TCP client %s: %v", clientID, err)
-				// Handle cleanup if needed (e.g., unsubscribe client)
-				r.Unsubscribe(clientID, "channel") // Clean up the client subscription
-				break
-			}
-		} else if mockConn, ok := r.mockClients[clientID]; ok {
-			// Send message to mock client (i.e., add to Outbox channel)
-			select {
-			case mockConn.Outbox <- msg:
-				// Successfully sent the message to the mock client
-			default:
-				// If the Outbox is full, handle the case
-				log.Printf("Warning: Mock client's Outbox is full, dropping message")
-			}
-		} else {
-			log.Printf("Client %s is neither WebSocket nor TCP, skipping message delivery", clientID)
+// punsubscribe is PUnsubscribe for callers already holding r.Mu.
+func (r *Tealis) punsubscribe(s *Session, pattern string) {
+	if subs, exists := r.pubsubPatterns[pattern]; exists {
+		delete(subs, s)
+		if len(subs) == 0 {
+			delete(r.pubsubPatterns, pattern)
 		}
 	}
+	s.mu.Lock()
+	delete(s.patterns, pattern)
+	s.mu.Unlock()
 }
 
-// MockClientConnection simulates a client connection with an Outbox for receiving messages
-type MockClientConnection struct {
-	Outbox chan string
-}
-
-func NewMockClientConnection() *MockClientConnection {
-	return &MockClientConnection{Outbox: make(chan string, 100)}
-}
-
-func (r *Tealis) AddMockClientConnection(clientID string) {
-	r.Mu.Lock()
-	defer r.Mu.Unlock()
-	r.mockClients[clientID] = NewMockClientConnection()
-}
-
-func (r *Tealis) GetMockClientConnection(clientID string) *MockClientConnection {
+// Publish sends a message to all subscribers of a channel, and to the subscribers of every
+// pattern the channel matches, and returns the number of receivers. A session subscribed to
+// the channel and to matching patterns receives the message once for each.
+func (r *Tealis) Publish(channel, message string) int {
 	r.Mu.RLock()
 	defer r.Mu.RUnlock()
-	return r.mockClients[clientID]
+
+	receivers := 0
+	if subscribers, exists := r.pubsubSubscribers[channel]; exists {
+		msg := protocol.Push{protocol.BulkString("message"), protocol.BulkString(channel), protocol.BulkString(message)}
+		for s := range subscribers {
+			// Delivery is asynchronous; a full outbox drops the message to avoid blocking publishers
+			s.push(msg)
+		}
+		receivers += len(subscribers)
+	}
+	for pattern, subscribers := range r.pubsubPatterns {
+		if !globMatch(pattern, channel) {
+			continue
+		}
+		msg := protocol.Push{protocol.BulkString("pmessage"), protocol.BulkString(pattern), protocol.BulkString(channel), protocol.BulkString(message)}
+		for s := range subscribers {
+			s.push(msg)
+		}
+		receivers += len(subscribers)
+	}
+	return receivers
 }
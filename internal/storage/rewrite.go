@@ -0,0 +1,394 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"tealis/internal/protocol"
+	"time"
+)
+
+// aofRewriteItems is the most elements one command of a rewritten AOF adds, so replaying a
+// large collection never builds one huge request.
+const aofRewriteItems = 64
+
+// aofBaseCommand starts a rewritten AOF. Its argument tells this AOF apart from the one a
+// snapshot was taken against; it is skipped when the AOF is replayed.
+const aofBaseCommand = "AOFBASE"
+
+var errAOFRewriteInProgress = errors.New("Background append only file rewriting already in progress")
+
+// RewriteAOF replaces the AOF with the shortest sequence of commands that recreates the
+// current data. Commands are held back only while the view of the data is taken, not while
+// it is encoded and written; writes logged meanwhile are appended to the new file before it
+// replaces the old one.
+func (r *Tealis) RewriteAOF() error {
+	if !r.aofRewriting.CompareAndSwap(false, true) {
+		return errAOFRewriteInProgress
+	}
+	defer r.aofRewriting.Store(false)
+
+	r.execMu.Lock()
+	view := r.startAOFRewriteLocked()
+	r.execMu.Unlock()
+	return r.finishAOFRewrite(view)
+}
+
+// BackgroundRewriteAOF starts RewriteAOF in the background.
+func (r *Tealis) BackgroundRewriteAOF() error {
+	if r.aofRewriting.Load() {
+		return errAOFRewriteInProgress
+	}
+	go func() {
+		if err := r.RewriteAOF(); err != nil && !errors.Is(err, errAOFRewriteInProgress) {
+			log.Printf("Background AOF rewrite failed: %v", err)
+		}
+	}()
+	return nil
+}
+
+// rewriteAOFLocked rewrites the AOF for callers that already hold execMu exclusively.
+func (r *Tealis) rewriteAOFLocked() error {
+	if !r.aofRewriting.CompareAndSwap(false, true) {
+		return errAOFRewriteInProgress
+	}
+	defer r.aofRewriting.Store(false)
+
+	return r.finishAOFRewrite(r.startAOFRewriteLocked())
+}
+
+// startAOFRewriteLocked takes the point-in-time view of the data a rewrite writes and starts
+// buffering the writes logged from then on. The view is encoded as commands, or as a
+// snapshot preamble when aof-use-snapshot-preamble is set, which loads much faster. The
+// caller must hold execMu exclusively so no write is both in the view and in the buffer.
+func (r *Tealis) startAOFRewriteLocked() *saveView {
+	id := strconv.FormatInt(time.Now().UnixNano(), 10)
+	var view *saveView
+	if r.Config().AOFUseSnapshotPreamble {
+		// The snapshot header identifies the AOF in place of the AOFBASE command
+		view = r.takeViewLocked(appendSnapshotHeader(nil, snapshotState{saved: time.Now(), aofBase: id}), false)
+	} else {
+		view = r.takeViewLocked(appendCommand(nil, aofBaseCommand, id), true)
+	}
+	r.aofRewriteView.Store(view)
+
+	r.aofMu.Lock()
+	r.aofRewriteBuf = []byte{}
+	// The buffered writes go to the end of both files, which may have selected different
+	// databases
+	r.aofDB = -1
+	r.aofMu.Unlock()
+	return view
+}
+
+// finishAOFRewrite encodes the view of a rewrite into a new AOF next to the old one, appends
+// the writes buffered meanwhile and renames it over the old one. The AOF file is reopened so
+// later writes go to the new file.
+func (r *Tealis) finishAOFRewrite(view *saveView) error {
+	path := r.aofFilePath + "/aof.txt"
+	tempPath := r.aofFilePath + "/aof_rewrite.tmp"
+	fail := func(err error) error {
+		r.aofMu.Lock()
+		r.aofRewriteBuf = nil
+		r.aofMu.Unlock()
+		os.Remove(tempPath)
+		return err
+	}
+
+	base, err := view.encode()
+	r.aofRewriteView.Store(nil)
+	if err != nil {
+		return fail(err)
+	}
+
+	if err := os.MkdirAll(r.aofFilePath, 0755); err != nil {
+		return fail(fmt.Errorf("failed to create AOF directory: %w", err))
+	}
+	temp, err := os.Create(tempPath)
+	if err != nil {
+		return fail(fmt.Errorf("failed to create temporary AOF file: %w", err))
+	}
+	defer temp.Close()
+	if _, err := temp.Write(base); err != nil {
+		return fail(fmt.Errorf("failed to write temporary AOF file: %w", err))
+	}
+	// Most of the fsync happens before aofMu is taken
+	if err := temp.Sync(); err != nil {
+		return fail(fmt.Errorf("failed to sync temporary AOF file: %w", err))
+	}
+
+	r.aofMu.Lock()
+	defer r.aofMu.Unlock()
+	buffered := r.aofRewriteBuf
+	r.aofRewriteBuf = nil
+	if _, err := temp.Write(buffered); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to write temporary AOF file: %w", err)
+	}
+	if err := temp.Sync(); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to sync temporary AOF file: %w", err)
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to replace old AOF file: %w", err)
+	}
+
+	// The old file now has no name; keep appending to the one that does
+	if r.AofFile != nil {
+		r.AofFile.Close()
+		r.AofFile = nil
+		if err := r.openAOF(); err != nil {
+			return err
+		}
+		r.aofDirty = false
+	}
+	log.Printf("AOF rewrite completed: %d bytes, %d of them written during the rewrite", len(base)+len(buffered), len(buffered))
+	return nil
+}
+
+// readAOFBase returns the id of the rewrite an AOF comes from, or "" if it was never
+// rewritten.
+func readAOFBase(path string) string {
+	file, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+	head := make([]byte, 128)
+	n, _ := io.ReadFull(file, head)
+	return aofBaseOf(head[:n])
+}
+
+// aofBaseOf returns the rewrite id the AOF data starts with. An AOF with a snapshot preamble
+// carries it in the snapshot header.
+func aofBaseOf(data []byte) string {
+	if isSnapshot(data) {
+		state, err := decodeSnapshotHeader(data)
+		if err != nil {
+			return ""
+		}
+		return state.aofBase
+	}
+	parts, _, err := protocol.ParseRequest(data)
+	if err != nil || len(parts) != 2 || !strings.EqualFold(parts[0], aofBaseCommand) {
+		return ""
+	}
+	return parts[1]
+}
+
+// aofPosition returns the rewrite the AOF comes from and its current size, read together
+// so a rewrite cannot swap the file in between. Replaying the AOF from that size starts in
+// database 0, so the next write selects its database again.
+func (r *Tealis) aofPosition() (string, int64, error) {
+	r.aofMu.Lock()
+	defer r.aofMu.Unlock()
+	r.aofDB = -1
+	info, err := os.Stat(r.aofFilePath + "/aof.txt")
+	if os.IsNotExist(err) {
+		return r.aofBase, 0, nil
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read AOF size: %w", err)
+	}
+	return r.aofBase, info.Size(), nil
+}
+
+// StartAOFRewriteScheduler rewrites the AOF in the background once it has grown by
+// auto-aof-rewrite-percentage since the last rewrite and is at least
+// auto-aof-rewrite-min-size bytes.
+func (r *Tealis) StartAOFRewriteScheduler(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				cfg := r.Config()
+				if cfg.AutoAOFRewritePercentage == 0 || r.aofRewriting.Load() || !r.aofEnabled() {
+					continue
+				}
+				r.aofMu.Lock()
+				baseSize := r.aofBaseSize
+				r.aofMu.Unlock()
+				size, err := r.aofSize()
+				if err != nil || size < cfg.AutoAOFRewriteMinSize {
+					continue
+				}
+				growth := (size - baseSize) * 100 / max(baseSize, 1)
+				if growth < int64(cfg.AutoAOFRewritePercentage) {
+					continue
+				}
+				log.Printf("Starting automatic rewriting of AOF on %d%% growth", growth)
+				if err := r.BackgroundRewriteAOF(); err != nil && !errors.Is(err, errAOFRewriteInProgress) {
+					log.Printf("Error starting the AOF rewrite: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// appendCommand appends one RESP-encoded command to buf.
+func appendCommand(buf []byte, parts ...string) []byte {
+	return protocol.Append(buf, protocol.StringArray(parts), protocol.RESP2)
+}
+
+// appendKeyCommands appends the commands that recreate a key holding value. Empty
+// collections produce no commands since no command creates them.
+func appendKeyCommands(buf []byte, key string, value interface{}) ([]byte, error) {
+	// appendItems spreads the elements of a collection over commands of aofRewriteItems
+	// elements, each element taking width arguments
+	appendItems := func(cmd string, items []string, width int) {
+		for len(items) > 0 {
+			n := min(len(items), aofRewriteItems*width)
+			buf = appendCommand(buf, append([]string{cmd, key}, items[:n]...)...)
+			items = items[n:]
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		buf = appendCommand(buf, "SET", key, v)
+
+	case []string:
+		appendItems("RPUSH", v, 1)
+
+	case []interface{}:
+		// Lists read back from a JSON snapshot
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = fmt.Sprint(item)
+		}
+		appendItems("RPUSH", items, 1)
+
+	case map[string]struct{}:
+		appendItems("SADD", sortedKeys(v), 1)
+
+	case map[string]interface{}:
+		// Hashes and JSON documents are both stored as maps; only a hash has nothing but
+		// string values
+		if fields, ok := hashFields(v); ok && len(fields) > 0 {
+			appendItems("HMSET", fields, 2)
+			break
+		}
+		doc, err := json.Marshal(v)
+		if err != nil {
+			return buf, fmt.Errorf("failed to encode JSON document %s: %w", key, err)
+		}
+		buf = appendCommand(buf, "JSON.SET", key, ".", string(doc))
+
+	case *SortedSet:
+		v.mu.RLock()
+		for node := v.header.forward[0]; node != nil; node = node.forward[0] {
+			buf = appendCommand(buf, "ZADD", key, formatFloat(node.score), node.key)
+		}
+		v.mu.RUnlock()
+
+	case *GeoSet:
+		items := make([]string, 0, 3*len(v.Locations))
+		for _, name := range sortedKeys(v.Locations) {
+			// GEOADD stores the coordinates in the order it is given them
+			loc := v.Locations[name]
+			items = append(items, formatFloat(loc.Latitude), formatFloat(loc.Longitude), name)
+		}
+		appendItems("GEOADD", items, 3)
+
+	case *Stream:
+		v.mu.RLock()
+		for _, entry := range v.Entries {
+			parts := []string{"XADD", key, entry.ID}
+			for _, field := range sortedKeys(entry.Fields) {
+				parts = append(parts, field, entry.Fields[field])
+			}
+			buf = appendCommand(buf, parts...)
+		}
+		for _, name := range sortedKeys(v.ConsumerGroups) {
+			group := v.ConsumerGroups[name]
+			buf = appendCommand(buf, "XGROUP", "CREATE", key, name)
+			for _, consumer := range sortedKeys(group.Consumers) {
+				// Consumers with nothing pending are kept too
+				buf = appendCommand(buf, "XGROUP", "CREATECONSUMER", key, name, consumer)
+				// Acknowledged entries stay in the consumer's list but not in the group's
+				var pending []string
+				for _, id := range group.Consumers[consumer].Pending {
+					if _, ok := group.Pending[id]; ok {
+						pending = append(pending, id)
+					}
+				}
+				for len(pending) > 0 {
+					n := min(len(pending), aofRewriteItems)
+					parts := append([]string{"XCLAIM", key, name, consumer, "0"}, pending[:n]...)
+					buf = appendCommand(buf, append(parts, "FORCE", "JUSTID")...)
+					pending = pending[n:]
+				}
+			}
+		}
+		v.mu.RUnlock()
+
+	case *HyperLogLog:
+		buf = appendCommand(buf, "PFRESTORE", key, string(v.registers))
+
+	case *TimeSeries:
+		v.mu.RLock()
+		buf = appendCommand(buf, "TS.CREATE", key, v.aggregation)
+		for _, point := range v.Points {
+			buf = appendCommand(buf, "TS.ADD", key, strconv.FormatInt(point.Timestamp.Unix(), 10), formatFloat(point.Value))
+		}
+		v.mu.RUnlock()
+
+	case []byte:
+		if len(v) > 0 {
+			buf = appendCommand(buf, "BITRESTORE", key, string(v))
+		}
+
+	case []float64:
+		if len(v) > 0 {
+			parts := []string{"VECTOR.SET", key}
+			for _, f := range v {
+				parts = append(parts, formatFloat(f))
+			}
+			buf = appendCommand(buf, parts...)
+		}
+
+	default:
+		return buf, fmt.Errorf("unsupported type %T for key %s", value, key)
+	}
+	return buf, nil
+}
+
+// hashFields returns the field-value pairs of a map that holds only strings.
+func hashFields(m map[string]interface{}) ([]string, bool) {
+	fields := make([]string, 0, 2*len(m))
+	for _, field := range sortedKeys(m) {
+		value, ok := m[field].(string)
+		if !ok {
+			return nil, false
+		}
+		fields = append(fields, field, value)
+	}
+	return fields, true
+}
+
+// sortedKeys returns the keys of a map in order, so rewrites of the same data are identical.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatFloat formats a float so that parsing it gives back the same value.
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,442 @@
+package storage
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"iter"
+	"maps"
+	"math/bits"
+	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"tealis/internal/protocol"
+	"time"
+)
+
+// SCAN and its per-collection variants iterate without keeping any state on the server. Every
+// name has a fixed position, a hash of the name, and a cursor is the position the next call
+// starts from: a call returns the COUNT names with the lowest positions from the cursor on,
+// together with any other names at the last of those positions, and the position after it.
+// Since positions do not depend on what else is stored, names added or removed while a scan
+// runs never move the others: every name present for the whole scan is returned exactly once.
+// The first scan of a keyspace or collection indexes its names by position; writes keep the
+// index up to date from then on, so a call costs O(log N + COUNT).
+//
+// Building an index is the expensive part: the first call sorts every name, O(N log N),
+// holding Mu shared, so writers wait for it, in the order of a second per million names. An
+// index also keeps about 64 bytes per name for as long as it is kept up to date: the keyspace
+// index until FLUSHDB, FLUSHALL or SWAPDB replaces it, and the index of a collection until its
+// key is deleted or overwritten. Only keyspaces and collections that were scanned pay either.
+
+// scanDefaultCount is how many names a call returns without COUNT.
+const scanDefaultCount = 10
+
+// scanMaxLevel bounds the levels of a scan index, which stays fast up to about 2^32 names.
+const scanMaxLevel = 32
+
+var errInvalidCursor = errors.New("ERR invalid cursor")
+
+// scanPosition returns the position of a name in scan order: its 64-bit FNV-1a hash.
+func scanPosition(name string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(name); i++ {
+		h ^= uint64(name[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+// scanIndex is a skip list of names ordered by scan position, then by name.
+type scanIndex struct {
+	head   scanNode
+	level  int
+	length int
+}
+
+type scanNode struct {
+	pos  uint64
+	name string
+	next []*scanNode
+}
+
+// newScanIndex indexes the size names of names. Sorting them and linking the nodes in order
+// is several times faster than inserting them one by one.
+func newScanIndex(names iter.Seq[string], size int) *scanIndex {
+	x := &scanIndex{head: scanNode{next: make([]*scanNode, scanMaxLevel)}, level: 1}
+	sorted := make([]scanNode, 0, size)
+	for name := range names {
+		sorted = append(sorted, scanNode{pos: scanPosition(name), name: name})
+	}
+	slices.SortFunc(sorted, func(a, b scanNode) int {
+		if a.pos != b.pos {
+			return cmp.Compare(a.pos, b.pos)
+		}
+		return strings.Compare(a.name, b.name)
+	})
+	var tails [scanMaxLevel]*scanNode
+	for i := range tails {
+		tails[i] = &x.head
+	}
+	for _, entry := range sorted {
+		node := &scanNode{pos: entry.pos, name: entry.name, next: make([]*scanNode, randomScanLevel())}
+		for i := range node.next {
+			tails[i].next[i] = node
+			tails[i] = node
+		}
+		x.level = max(x.level, len(node.next))
+	}
+	x.length = len(sorted)
+	return x
+}
+
+// randomScanLevel returns the level of a new node: each level above the first with
+// probability 1/2.
+func randomScanLevel() int {
+	return min(bits.TrailingZeros64(^rand.Uint64())+1, scanMaxLevel)
+}
+
+// before reports whether the node comes before the name at pos.
+func (n *scanNode) before(pos uint64, name string) bool {
+	return n.pos < pos || n.pos == pos && n.name < name
+}
+
+// seek returns the first node at or after the name at pos. If update is not nil it is set to
+// the last node before it on every level.
+func (x *scanIndex) seek(pos uint64, name string, update []*scanNode) *scanNode {
+	node := &x.head
+	for i := x.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].before(pos, name) {
+			node = node.next[i]
+		}
+		if update != nil {
+			update[i] = node
+		}
+	}
+	return node.next[0]
+}
+
+// insert adds a name to the index unless it is there already.
+func (x *scanIndex) insert(name string) {
+	pos := scanPosition(name)
+	var update [scanMaxLevel]*scanNode
+	if node := x.seek(pos, name, update[:]); node != nil && node.pos == pos && node.name == name {
+		return
+	}
+	level := randomScanLevel()
+	for ; x.level < level; x.level++ {
+		update[x.level] = &x.head
+	}
+	node := &scanNode{pos: pos, name: name, next: make([]*scanNode, level)}
+	for i := range node.next {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+	x.length++
+}
+
+// remove takes a name out of the index if it is there.
+func (x *scanIndex) remove(name string) {
+	pos := scanPosition(name)
+	var update [scanMaxLevel]*scanNode
+	node := x.seek(pos, name, update[:])
+	if node == nil || node.pos != pos || node.name != name {
+		return
+	}
+	for i := range node.next {
+		update[i].next[i] = node.next[i]
+	}
+	for x.level > 1 && x.head.next[x.level-1] == nil {
+		x.level--
+	}
+	x.length--
+}
+
+// page returns the names one call from cursor returns, in scan order, and the cursor of the
+// next call, 0 once there is none.
+func (x *scanIndex) page(cursor uint64, count int) ([]string, uint64) {
+	var names []string
+	var last *scanNode
+	node := x.seek(cursor, "", nil)
+	for ; node != nil && len(names) < count; node = node.next[0] {
+		names = append(names, node.name)
+		last = node
+	}
+	// The next call starts after the last position, so the names sharing it come along
+	for ; node != nil && node.pos == last.pos; node = node.next[0] {
+		names = append(names, node.name)
+	}
+	if node == nil {
+		return names, 0
+	}
+	return names, last.pos + 1
+}
+
+// scanIndexes are the scan indexes of a database: one of its keys and one of each hash, set
+// and sorted set in it, each built on its first scan.
+type scanIndexes struct {
+	// mu is held while an index is built or read. Scans do so holding Mu shared; writes
+	// change the indexes holding Mu exclusively, which keeps scans out.
+	mu          sync.Mutex
+	keys        *scanIndex
+	collections map[string]*scanIndex
+}
+
+// currentIndex returns index, or a new index of names if there is none yet or it does not
+// hold the size names it should.
+func currentIndex(index *scanIndex, names iter.Seq[string], size int) *scanIndex {
+	if index == nil || index.length != size {
+		index = newScanIndex(names, size)
+	}
+	return index
+}
+
+// scanKeysLocked returns the keys one SCAN call from cursor returns, expired ones included,
+// and the next cursor. The caller must hold Mu.
+func (r *Tealis) scanKeysLocked(cursor uint64, count int) ([]string, uint64) {
+	r.scan.mu.Lock()
+	defer r.scan.mu.Unlock()
+	r.scan.keys = currentIndex(r.scan.keys, maps.Keys(r.Store), len(r.Store))
+	return r.scan.keys.page(cursor, count)
+}
+
+// scanCollectionLocked returns the names one call from cursor returns of the collection at
+// key, which holds the size names names, and the next cursor. The caller must hold Mu.
+func (r *Tealis) scanCollectionLocked(key string, names iter.Seq[string], size int, cursor uint64, count int) ([]string, uint64) {
+	r.scan.mu.Lock()
+	defer r.scan.mu.Unlock()
+	if r.scan.collections == nil {
+		r.scan.collections = make(map[string]*scanIndex)
+	}
+	index := currentIndex(r.scan.collections[key], names, size)
+	r.scan.collections[key] = index
+	return index.page(cursor, count)
+}
+
+// setLocked stores the value of a key. Keys are only ever added to and deleted from Store
+// through setLocked and deleteLocked, which keep the scan indexes in step. The caller must
+// hold Mu exclusively.
+func (r *Tealis) setLocked(key string, value interface{}) {
+	if _, ok := r.Store[key]; !ok && r.scan.keys != nil {
+		r.scan.keys.insert(key)
+	}
+	// A new value is not the collection that was indexed
+	delete(r.scan.collections, key)
+	r.Store[key] = value
+}
+
+// deleteLocked deletes a key, but not its expiry. The caller must hold Mu exclusively.
+func (r *Tealis) deleteLocked(key string) {
+	if _, ok := r.Store[key]; ok && r.scan.keys != nil {
+		r.scan.keys.remove(key)
+	}
+	delete(r.scan.collections, key)
+	delete(r.Store, key)
+}
+
+// memberAdded and memberRemoved keep the index of the hash, set or sorted set at key in step
+// with a field or member added to or removed from it. The caller must hold Mu exclusively.
+func (r *Tealis) memberAdded(key, member string) {
+	if index := r.scan.collections[key]; index != nil {
+		index.insert(member)
+	}
+}
+
+func (r *Tealis) memberRemoved(key, member string) {
+	if index := r.scan.collections[key]; index != nil {
+		index.remove(member)
+	}
+}
+
+// scanOptions are the arguments of a SCAN call after its cursor.
+type scanOptions struct {
+	cursor   uint64
+	pattern  string // "" matches every name
+	count    int
+	typeName string // SCAN only: the type the keys must have, "" for any
+	noValues bool   // HSCAN only: return the fields without their values
+}
+
+// parseScanOptions parses the cursor at parts[start] and the options after it. TYPE is only
+// accepted by SCAN and NOVALUES only by HSCAN.
+func parseScanOptions(parts []string, start int, scanType, noValues bool) (scanOptions, error) {
+	cursor, err := strconv.ParseUint(parts[start], 10, 64)
+	if err != nil {
+		return scanOptions{}, errInvalidCursor
+	}
+	opts := scanOptions{cursor: cursor, count: scanDefaultCount}
+	for i := start + 1; i < len(parts); i++ {
+		option := strings.ToUpper(parts[i])
+		hasValue := i+1 < len(parts)
+		switch {
+		case option == "MATCH" && hasValue:
+			i++
+			opts.pattern = parts[i]
+		case option == "COUNT" && hasValue:
+			i++
+			count, err := strconv.Atoi(parts[i])
+			if err != nil {
+				return scanOptions{}, errors.New("ERR value is not an integer or out of range")
+			}
+			if count < 1 {
+				return scanOptions{}, errors.New("ERR syntax error")
+			}
+			opts.count = count
+		case option == "TYPE" && hasValue && scanType:
+			i++
+			opts.typeName = strings.ToLower(parts[i])
+		case option == "NOVALUES" && noValues:
+			opts.noValues = true
+		default:
+			return scanOptions{}, errors.New("ERR syntax error")
+		}
+	}
+	return opts, nil
+}
+
+// matches reports whether a name passes the MATCH pattern.
+func (opts scanOptions) matches(name string) bool {
+	return opts.pattern == "" || opts.pattern == "*" || globMatch(opts.pattern, name)
+}
+
+// Scan returns the keys of the database one SCAN call from a cursor returns, and the next
+// cursor. MATCH and TYPE filter a page after it is taken, so a call may return fewer keys than
+// COUNT, or none, before the scan is complete. Keys of a type are matched by the type names of
+// snapshots: string, list, set, hash, json, zset, geo, stream, hyperloglog, timeseries, bitmap
+// and vector.
+func (r *Tealis) Scan(opts scanOptions) ([]string, uint64) {
+	r.Mu.RLock()
+	defer r.Mu.RUnlock()
+
+	page, next := r.scanKeysLocked(opts.cursor, opts.count)
+	keys := page[:0]
+	now := time.Now()
+	for _, key := range page {
+		if r.expiredLocked(key, now) || !opts.matches(key) {
+			continue
+		}
+		if opts.typeName != "" {
+			if codec, ok := codecOf(r.Store[key]); !ok || codec.name != opts.typeName {
+				continue
+			}
+		}
+		keys = append(keys, key)
+	}
+	return keys, next
+}
+
+// HScan returns the fields, and unless NOVALUES their values, of a hash one HSCAN call from a
+// cursor returns, and the next cursor.
+func (r *Tealis) HScan(key string, opts scanOptions) ([]string, uint64, error) {
+	r.Mu.RLock()
+	defer r.Mu.RUnlock()
+
+	value := r.lookupLocked(key)
+	if value == nil {
+		return nil, 0, nil
+	}
+	hash, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, 0, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+	}
+	page, next := r.scanCollectionLocked(key, maps.Keys(hash), len(hash), opts.cursor, opts.count)
+	var items []string
+	for _, field := range page {
+		if !opts.matches(field) {
+			continue
+		}
+		items = append(items, field)
+		if !opts.noValues {
+			items = append(items, fmt.Sprintf("%v", hash[field]))
+		}
+	}
+	return items, next, nil
+}
+
+// SScan returns the members of a set one SSCAN call from a cursor returns, and the next
+// cursor.
+func (r *Tealis) SScan(key string, opts scanOptions) ([]string, uint64, error) {
+	r.Mu.RLock()
+	defer r.Mu.RUnlock()
+
+	value := r.lookupLocked(key)
+	if value == nil {
+		return nil, 0, nil
+	}
+	set, ok := value.(map[string]struct{})
+	if !ok {
+		return nil, 0, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+	}
+	page, next := r.scanCollectionLocked(key, maps.Keys(set), len(set), opts.cursor, opts.count)
+	var members []string
+	for _, member := range page {
+		if opts.matches(member) {
+			members = append(members, member)
+		}
+	}
+	return members, next, nil
+}
+
+// ZScan returns the members of a sorted set, each followed by its score, one ZSCAN call from
+// a cursor returns, and the next cursor.
+func (r *Tealis) ZScan(key string, opts scanOptions) ([]string, uint64, error) {
+	r.Mu.RLock()
+	defer r.Mu.RUnlock()
+
+	value := r.lookupLocked(key)
+	if value == nil {
+		return nil, 0, nil
+	}
+	zset, ok := value.(*SortedSet)
+	if !ok {
+		return nil, 0, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+	}
+	zset.mu.RLock()
+	defer zset.mu.RUnlock()
+	page, next := r.scanCollectionLocked(key, maps.Keys(zset.scores), len(zset.scores), opts.cursor, opts.count)
+	var items []string
+	for _, member := range page {
+		if opts.matches(member) {
+			items = append(items, member, formatFloat(zset.scores[member]))
+		}
+	}
+	return items, next, nil
+}
+
+// scanReply builds the reply of a SCAN call: the next cursor and the names.
+func scanReply(items []string, next uint64) protocol.Reply {
+	return protocol.Array{protocol.BulkString(strconv.FormatUint(next, 10)), protocol.StringArray(items)}
+}
+
+func cmdScan(store *Tealis, session *Session, parts []string) protocol.Reply {
+	opts, err := parseScanOptions(parts, 1, true, false)
+	if err != nil {
+		return errorReply(err)
+	}
+	keys, next := store.Scan(opts)
+	return scanReply(keys, next)
+}
+
+// collectionScanCommand builds the handler of HSCAN, SSCAN or ZSCAN from the method that scans
+// the collection.
+func collectionScanCommand(scan func(r *Tealis, key string, opts scanOptions) ([]string, uint64, error), noValues bool) commandHandler {
+	return func(store *Tealis, session *Session, parts []string) protocol.Reply {
+		opts, err := parseScanOptions(parts, 2, false, noValues)
+		if err != nil {
+			return errorReply(err)
+		}
+		items, next, err := scan(store, parts[1], opts)
+		if err != nil {
+			return errorReply(err)
+		}
+		return scanReply(items, next)
+	}
+}
+
+var (
+	cmdHScan = collectionScanCommand((*Tealis).HScan, true)
+	cmdSScan = collectionScanCommand((*Tealis).SScan, false)
+	cmdZScan = collectionScanCommand((*Tealis).ZScan, false)
+)
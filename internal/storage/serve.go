@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"tealis/internal/logging"
+	"tealis/internal/protocol"
+)
+
+// Serve runs the requests a client sends over in on behalf of the session and writes their
+// replies through the session, in the order the requests came in. Requests may be pipelined:
+// one read can hold several of them and one request can be split across reads. Serve returns
+// nil once the client quits or is killed, the error of in once reading fails, and the
+// *protocol.ProtocolError of a malformed request after reporting it to the client.
+//
+// Clients typing inline commands, such as telnet users, are prompted with "> " after the
+// replies to their commands and after an empty line. A new connection is not greeted with a
+// prompt, as a RESP client would read it as the start of a reply; telnet users press enter to
+// get their first one. A client that sends a RESP frame is never prompted again.
+func (r *Tealis) Serve(in io.Reader, s *Session) error {
+	c := &clientConn{store: r, session: s}
+	buf := make([]byte, 16*1024)
+	for {
+		n, err := in.Read(buf)
+		if n > 0 {
+			done, err := c.handle(buf[:n])
+			if done || err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// clientConn is the state Serve keeps between reads.
+type clientConn struct {
+	store   *Tealis
+	session *Session
+	input   []byte // bytes received but not yet parsed into a request
+	output  []byte // encoded replies waiting to be written
+	resp    bool   // the client sent a RESP frame, so it is not prompted
+}
+
+// handle runs the complete requests in the input after data is appended to it and writes
+// their replies. It reports whether the connection is done.
+func (c *clientConn) handle(data []byte) (bool, error) {
+	// Terminals in character mode send every key on its own; a backspace erases the last
+	// character on the screen too
+	if !c.resp && data[0] == '\b' && len(c.input) > 0 {
+		c.session.Write([]byte(" \b \b"))
+	}
+	c.input = append(c.input, data...)
+
+	// Run every complete request; a trailing partial one waits for the next read
+	consumed := 0
+	prompt := false
+	done := false
+	for !done {
+		if consumed < len(c.input) && c.input[consumed] == '*' {
+			c.resp = true
+		}
+		parts, size, err := protocol.ParseRequest(c.input[consumed:])
+		if errors.Is(err, protocol.ErrIncomplete) {
+			break
+		}
+		if err != nil {
+			c.output = append(c.output, "-ERR "+err.Error()+"\r\n"...)
+			c.session.Write(c.output)
+			return true, err
+		}
+		consumed += size
+		prompt = true
+		if len(parts) == 0 {
+			continue
+		}
+
+		logging.Debugf("Received command from %s: %q", c.session.Addr, parts)
+		// Replies are queued so they keep the order of the requests
+		reply := ProcessCommand(parts, c.store, c.session)
+		c.output = protocol.Append(c.output, reply, c.session.ProtocolVersion())
+		if strings.EqualFold(parts[0], "QUIT") {
+			log.Printf("Client %s sent QUIT. Closing connection.", c.session.Addr)
+			done = true
+		} else if c.session.Closing() {
+			log.Printf("Client %s was killed. Closing connection.", c.session.Addr)
+			done = true
+		}
+	}
+
+	// Keep only the unparsed tail so a large pipeline does not pin the whole buffer
+	if consumed > 0 {
+		c.input = append(c.input[:0:0], c.input[consumed:]...)
+	}
+	if prompt && !c.resp && !done {
+		c.output = append(c.output, "> "...)
+	}
+	if len(c.output) > 0 {
+		if _, err := c.session.Write(c.output); err != nil {
+			return true, err
+		}
+		c.output = c.output[:0]
+	}
+	return done, nil
+}
@@ -0,0 +1,244 @@
+package storage
+
+import (
+	"io"
+	"log"
+	"maps"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"tealis/internal/protocol"
+	"time"
+)
+
+// Transports a session can be connected over.
+const (
+	TransportTCP       = "tcp"
+	TransportWebSocket = "ws"
+	TransportHTTP      = "http"
+)
+
+// outboxSize bounds the pushes (pub/sub messages, ...) waiting to be written to a slow client.
+const outboxSize = 100
+
+// Session is the state of one client connection, whatever transport it uses.
+// Every request is executed on behalf of a session.
+type Session struct {
+	ID        uint64
+	Transport string
+	Addr      string
+	Created   time.Time
+
+	mu            sync.Mutex
+	name          string
+	db            int
+	user          string
+	authenticated bool // the client ran AUTH (or HELLO AUTH) successfully
+	protocol      int
+	inMulti       bool
+	multiError    bool                // a command was rejected while queueing; EXEC must abort
+	queue         [][]string          // commands queued by MULTI
+	watching      map[dbKey]uint64    // watched key -> version seen by WATCH
+	subscriptions map[string]struct{} // channels the client is subscribed to
+	patterns      map[string]struct{} // patterns the client is subscribed to
+	lastCmd       string
+	lastActive    time.Time
+	closing       bool // killed with CLIENT KILL
+
+	writeMu sync.Mutex // serializes replies and pushes on the output writer
+	out     io.Writer
+	outbox  chan protocol.Reply
+	done    chan struct{}
+}
+
+// NewSession registers a new client session. Replies and pushes for the client are written
+// to out; out may be nil for transports that cannot receive pushes, such as HTTP.
+func (r *Tealis) NewSession(transport, addr string, out io.Writer) *Session {
+	s := &Session{
+		ID:            atomic.AddUint64(&r.nextSessionID, 1),
+		Transport:     transport,
+		Addr:          addr,
+		Created:       time.Now(),
+		lastActive:    time.Now(),
+		user:          "default",
+		protocol:      protocol.RESP2,
+		subscriptions: make(map[string]struct{}),
+		patterns:      make(map[string]struct{}),
+		out:           out,
+		done:          make(chan struct{}),
+	}
+	if out != nil {
+		s.outbox = make(chan protocol.Reply, outboxSize)
+		go s.deliver()
+	}
+
+	r.sessionsMu.Lock()
+	r.sessions[s.ID] = s
+	r.sessionsMu.Unlock()
+	return s
+}
+
+// CloseSession drops a disconnected client's subscriptions and forgets the session.
+func (r *Tealis) CloseSession(s *Session) {
+	r.Mu.Lock()
+	channels, patterns := s.subscriptionsSnapshot()
+	for channel := range channels {
+		r.unsubscribe(s, channel)
+	}
+	for pattern := range patterns {
+		r.punsubscribe(s, pattern)
+	}
+	r.Mu.Unlock()
+	r.UNWATCH(s)
+
+	r.sessionsMu.Lock()
+	delete(r.sessions, s.ID)
+	r.sessionsMu.Unlock()
+
+	s.mu.Lock()
+	s.queue, s.inMulti, s.multiError = nil, false, false
+	s.mu.Unlock()
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+}
+
+// sortedSessions returns all connected sessions ordered by ID.
+func (r *Tealis) sortedSessions() []*Session {
+	list := r.Sessions()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Session looks up a connected session by ID.
+func (r *Tealis) Session(id uint64) (*Session, bool) {
+	r.sessionsMu.Lock()
+	defer r.sessionsMu.Unlock()
+	s, ok := r.sessions[id]
+	return s, ok
+}
+
+// Sessions returns all connected sessions.
+func (r *Tealis) Sessions() []*Session {
+	r.sessionsMu.Lock()
+	defer r.sessionsMu.Unlock()
+	list := make([]*Session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		list = append(list, s)
+	}
+	return list
+}
+
+// Name returns the name set with CLIENT SETNAME.
+func (s *Session) Name() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.name
+}
+
+// SetName changes the session name.
+func (s *Session) SetName(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.name = name
+}
+
+// DB returns the index of the selected database.
+func (s *Session) DB() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.db
+}
+
+// User returns the user the session is authenticated as.
+func (s *Session) User() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.user
+}
+
+// ProtocolVersion returns the RESP version negotiated with HELLO (RESP2 by default).
+func (s *Session) ProtocolVersion() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.protocol
+}
+
+// InMulti reports whether the session is queueing commands for a transaction.
+func (s *Session) InMulti() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inMulti
+}
+
+// flagMultiError dooms the transaction being queued, if any, after a command was rejected.
+func (s *Session) flagMultiError() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inMulti {
+		s.multiError = true
+	}
+}
+
+// SubscriptionCount returns the number of channels and patterns the session is subscribed to.
+func (s *Session) SubscriptionCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.subscriptions) + len(s.patterns)
+}
+
+func (s *Session) subscriptionsSnapshot() (channels, patterns map[string]struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.subscriptions), maps.Clone(s.patterns)
+}
+
+// Write sends already encoded bytes to the client. Connection handlers write their replies
+// through the session so they never interleave with pushes delivered in the background.
+func (s *Session) Write(p []byte) (int, error) {
+	if s.out == nil {
+		return len(p), nil
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.out.Write(p)
+}
+
+// WriteReply encodes a reply with the session's protocol version and writes it.
+func (s *Session) WriteReply(reply protocol.Reply) error {
+	_, err := s.Write(protocol.Encode(reply, s.ProtocolVersion()))
+	return err
+}
+
+// push queues an out-of-band message for the client. It never blocks: when the client
+// is not keeping up the message is dropped.
+func (s *Session) push(msg protocol.Reply) bool {
+	if s.outbox == nil {
+		return false
+	}
+	select {
+	case <-s.done:
+		return false
+	case s.outbox <- msg:
+		return true
+	default:
+		log.Printf("Outbox of client %d is full, dropping message", s.ID)
+		return false
+	}
+}
+
+// deliver writes queued pushes to the client until the session is closed.
+func (s *Session) deliver() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case msg := <-s.outbox:
+			if err := s.WriteReply(msg); err != nil {
+				log.Printf("Error delivering message to client %d: %v", s.ID, err)
+			}
+		}
+	}
+}
@@ -1,34 +1,37 @@
 package storage
 
 // SADD adds one or more members to a set.
-func (r *Tealis) SADD(key string, members ...string) int {
+func (r *Tealis) SADD(key string, members ...string) (int, error) {
 	r.Mu.Lock()
 	defer r.Mu.Unlock()
 
+	set, exists, err := valueOf[map[string]struct{}](r.lookupWriteLocked(key))
+	if err != nil {
+		return 0, err
+	}
 	// Initialize the set if not already created
-	if _, exists := r.Store[key]; !exists {
-		r.Store[key] = make(map[string]struct{})
+	if !exists {
+		set = make(map[string]struct{})
+		r.setLocked(key, set)
 	}
 
-	// Assert the value as a map of strings (set)
-	set := r.Store[key].(map[string]struct{})
-
 	// Add members to the set
 	for _, member := range members {
 		set[member] = struct{}{}
+		r.memberAdded(key, member)
 	}
 
-	return len(set)
+	return len(set), nil
 }
 
 // SREM removes one or more members from a set.
-func (r *Tealis) SREM(key string, members ...string) int {
+func (r *Tealis) SREM(key string, members ...string) (int, error) {
 	r.Mu.Lock()
 	defer r.Mu.Unlock()
 
-	set, exists := r.Store[key].(map[string]struct{})
+	set, exists, err := valueOf[map[string]struct{}](r.lookupWriteLocked(key))
 	if !exists {
-		return 0
+		return 0, err
 	}
 
 	// Remove members from the set
@@ -36,35 +39,36 @@ func (r *Tealis) SREM(key string, members ...string) int {
 	for _, member := range members {
 		if _, exists := set[member]; exists {
 			delete(set, member)
+			r.memberRemoved(key, member)
 			count++
 		}
 	}
 
-	return count
+	return count, nil
 }
 
 // SISMEMBER checks if a member exists in the set.
-func (r *Tealis) SISMEMBER(key, member string) bool {
+func (r *Tealis) SISMEMBER(key, member string) (bool, error) {
 	r.Mu.RLock()
 	defer r.Mu.RUnlock()
 
-	set, exists := r.Store[key].(map[string]struct{})
+	set, exists, err := valueOf[map[string]struct{}](r.lookupLocked(key))
 	if !exists {
-		return false
+		return false, err
 	}
 
 	_, exists = set[member]
-	return exists
+	return exists, nil
 }
 
 // SMEMBERS returns all members of a set.
-func (r *Tealis) SMEMBERS(key string) []string {
+func (r *Tealis) SMEMBERS(key string) ([]string, error) {
 	r.Mu.RLock()
 	defer r.Mu.RUnlock()
 
-	set, exists := r.Store[key].(map[string]struct{})
+	set, exists, err := valueOf[map[string]struct{}](r.lookupLocked(key))
 	if !exists {
-		return nil
+		return nil, err
 	}
 
 	// Convert the set to a slice
@@ -73,19 +77,19 @@ func (r *Tealis) SMEMBERS(key string) []string {
 		members = append(members, member)
 	}
 
-	return members
+	return members, nil
 }
 
 // SUNION returns the union of multiple sets.
-func (r *Tealis) SUNION(keys ...string) []string {
+func (r *Tealis) SUNION(keys ...string) ([]string, error) {
 	r.Mu.RLock()
 	defer r.Mu.RUnlock()
 
 	union := make(map[string]struct{})
 	for _, key := range keys {
-		set, exists := r.Store[key].(map[string]struct{})
-		if !exists {
-			continue
+		set, _, err := valueOf[map[string]struct{}](r.lookupLocked(key))
+		if err != nil {
+			return nil, err
 		}
 
 		// Add all members of the set to the union
@@ -100,22 +104,26 @@ func (r *Tealis) SUNION(keys ...string) []string {
 		members = append(members, member)
 	}
 
-	return members
+	return members, nil
 }
 
 // SINTER returns the intersection of multiple sets.
-func (r *Tealis) SINTER(keys ...string) []string {
+func (r *Tealis) SINTER(keys ...string) ([]string, error) {
 	r.Mu.RLock()
 	defer r.Mu.RUnlock()
 
 	if len(keys) == 0 {
-		return nil
+		return nil, nil
+	}
+	sets, err := r.setsLocked(keys)
+	if err != nil {
+		return nil, err
 	}
 
 	// Get the first set
-	firstSet, exists := r.Store[keys[0]].(map[string]struct{})
-	if !exists {
-		return nil
+	firstSet := sets[0]
+	if firstSet == nil {
+		return nil, nil
 	}
 
 	// Intersect the first set with the others
@@ -125,10 +133,9 @@ func (r *Tealis) SINTER(keys ...string) []string {
 	}
 
 	// For each subsequent set, keep only the members that are common
-	for _, key := range keys[1:] {
-		set, exists := r.Store[key].(map[string]struct{})
-		if !exists {
-			return nil
+	for _, set := range sets[1:] {
+		if set == nil {
+			return nil, nil
 		}
 
 		for member := range intersection {
@@ -144,22 +151,26 @@ func (r *Tealis) SINTER(keys ...string) []string {
 		members = append(members, member)
 	}
 
-	return members
+	return members, nil
 }
 
 // SDIFF returns the difference between multiple sets.
-func (r *Tealis) SDIFF(keys ...string) []string {
+func (r *Tealis) SDIFF(keys ...string) ([]string, error) {
 	r.Mu.RLock()
 	defer r.Mu.RUnlock()
 
 	if len(keys) == 0 {
-		return nil
+		return nil, nil
+	}
+	sets, err := r.setsLocked(keys)
+	if err != nil {
+		return nil, err
 	}
 
 	// Get the first set
-	firstSet, exists := r.Store[keys[0]].(map[string]struct{})
-	if !exists {
-		return nil
+	firstSet := sets[0]
+	if firstSet == nil {
+		return nil, nil
 	}
 
 	// Store the difference
@@ -169,12 +180,7 @@ func (r *Tealis) SDIFF(keys ...string) []string {
 	}
 
 	// Subtract the other sets
-	for _, key := range keys[1:] {
-		set, exists := r.Store[key].(map[string]struct{})
-		if !exists {
-			continue
-		}
-
+	for _, set := range sets[1:] {
 		for member := range set {
 			delete(difference, member)
 		}
@@ -186,5 +192,19 @@ func (r *Tealis) SDIFF(keys ...string) []string {
 		members = append(members, member)
 	}
 
-	return members
+	return members, nil
+}
+
+// setsLocked returns the sets of keys, nil for those that do not exist. Any key of another type
+// fails the whole command with WRONGTYPE, as in Redis. The caller must hold Mu.
+func (r *Tealis) setsLocked(keys []string) ([]map[string]struct{}, error) {
+	sets := make([]map[string]struct{}, len(keys))
+	for i, key := range keys {
+		set, _, err := valueOf[map[string]struct{}](r.lookupLocked(key))
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = set
+	}
+	return sets, nil
 }
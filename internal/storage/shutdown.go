@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"tealis/internal/protocol"
+)
+
+// Whether Shutdown writes a final snapshot.
+const (
+	ShutdownDefault = iota // save if save rules are configured
+	ShutdownSave
+	ShutdownNoSave
+)
+
+// ShutdownRequests delivers the save mode of SHUTDOWN commands. The server stops by calling
+// Shutdown with it, the same way it does on SIGTERM.
+func (r *Tealis) ShutdownRequests() <-chan int {
+	return r.shutdownRequests
+}
+
+// Shutdown stops the store in order: new commands are refused, running commands get until
+// the context deadline to finish, an in-flight BGSAVE is waited for, a final snapshot is
+// written if the mode asks for one, the AOF is fsynced and closed, and every client is
+// disconnected. The store cannot be used afterwards. If commands are still running at the
+// deadline no final snapshot is written, since it could hold half of a command, and an
+// error is returned.
+func (r *Tealis) Shutdown(ctx context.Context, mode int) error {
+	r.shuttingDown.Store(true)
+
+	// Holding execMu exclusively waits for running commands and keeps any more from running
+	var saveErr error
+	locked := waitContext(ctx, r.execMu.Lock)
+	if !locked {
+		log.Printf("Timed out waiting for running commands, shutting down anyway")
+		saveErr = errors.New("timed out waiting for running commands")
+	}
+
+	if !waitContext(ctx, r.bgSaves.Wait) {
+		log.Printf("Timed out waiting for the background save, shutting down anyway")
+	}
+	save := mode == ShutdownSave || (mode == ShutdownDefault && len(r.Config().SaveRules) > 0)
+	switch {
+	case save && !locked:
+		log.Printf("Not saving the final snapshot while commands are still running")
+	case save:
+		log.Printf("Saving the final snapshot before exiting...")
+		if saveErr = r.saveSnapshotLocked(); saveErr != nil {
+			log.Printf("Error saving the final snapshot: %v", saveErr)
+		}
+	}
+
+	r.aofMu.Lock()
+	if r.AofFile != nil {
+		if err := r.AofFile.Sync(); err != nil {
+			log.Printf("Error syncing AOF: %v", err)
+		}
+		r.AofFile.Close()
+		r.AofFile = nil
+	}
+	r.enableAOF = false
+	r.aofMu.Unlock()
+
+	for _, s := range r.Sessions() {
+		s.kill(false)
+	}
+	return saveErr
+}
+
+// waitContext runs a blocking function and reports whether it returned before the context
+// was done. The function keeps running in the background if it did not.
+func waitContext(ctx context.Context, fn func()) bool {
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func cmdShutdown(store *Tealis, session *Session, parts []string) protocol.Reply {
+	mode := ShutdownDefault
+	if len(parts) > 2 {
+		return protocol.Error("ERR syntax error")
+	}
+	if len(parts) == 2 {
+		switch strings.ToUpper(parts[1]) {
+		case "SAVE":
+			mode = ShutdownSave
+		case "NOSAVE":
+			mode = ShutdownNoSave
+		default:
+			return protocol.Error("ERR syntax error")
+		}
+	}
+	select {
+	case store.shutdownRequests <- mode:
+	default:
+		// A shutdown is already on its way
+	}
+	return protocol.OK
+}
@@ -0,0 +1,668 @@
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"math"
+	"time"
+)
+
+// Snapshot file layout, version 2:
+//
+//	"TEALISDB" | version | header | records | opEOF | CRC-64 of everything before it
+//
+// The version is a big-endian uint16. The header holds the save time in Unix milliseconds and
+// the AOF the snapshot was taken against: its rewrite id and its size. A record is an optional
+// opExpiry followed by the expiry in Unix milliseconds, then the type tag of the value, the
+// key and the value as its codec encodes it. Records are keys of database 0 until an
+// opSelectDB followed by a database index; version 1 has no opSelectDB and only database 0.
+// Integers are varints, strings and byte slices are length-prefixed and floats are 8
+// little-endian bytes.
+const (
+	snapshotMagic   = "TEALISDB"
+	snapshotVersion = 2
+
+	snapshotFile       = "dump.tdb"
+	legacySnapshotFile = "text.json" // JSON snapshots of older versions, loaded if there is no other
+)
+
+const (
+	opExpiry   byte = 0xfd
+	opSelectDB byte = 0xfe
+	opEOF      byte = 0xff
+)
+
+// Type tags of the values in a snapshot. Never reuse or renumber them: files written by
+// older versions must keep loading.
+const (
+	tagString byte = iota
+	tagList
+	tagSet
+	tagHash
+	tagJSON
+	tagSortedSet
+	tagGeo
+	tagStream
+	tagHyperLogLog
+	tagTimeSeries
+	tagBitmap
+	tagVector
+)
+
+var crcTable = crc64.MakeTable(crc64.ECMA)
+
+var errSnapshotCorrupt = errors.New("snapshot is corrupt")
+
+// snapshotState is the content of a snapshot file.
+type snapshotState struct {
+	saved     time.Time
+	aofBase   string
+	aofOffset int64
+	dbs       []keyspace // indexed by database
+}
+
+// valueCodec encodes and decodes the values of one type.
+type valueCodec struct {
+	tag    byte
+	name   string
+	encode func(e *snapshotEncoder, value interface{})
+	decode func(d *snapshotDecoder) interface{}
+}
+
+var valueCodecs = map[byte]*valueCodec{
+	tagString:      {tagString, "string", encodeString, decodeString},
+	tagList:        {tagList, "list", encodeList, decodeList},
+	tagSet:         {tagSet, "set", encodeSet, decodeSet},
+	tagHash:        {tagHash, "hash", encodeHash, decodeHash},
+	tagJSON:        {tagJSON, "json", encodeJSON, decodeJSON},
+	tagSortedSet:   {tagSortedSet, "zset", encodeSortedSet, decodeSortedSet},
+	tagGeo:         {tagGeo, "geo", encodeGeo, decodeGeo},
+	tagStream:      {tagStream, "stream", encodeStream, decodeStream},
+	tagHyperLogLog: {tagHyperLogLog, "hyperloglog", encodeHyperLogLog, decodeHyperLogLog},
+	tagTimeSeries:  {tagTimeSeries, "timeseries", encodeTimeSeries, decodeTimeSeries},
+	tagBitmap:      {tagBitmap, "bitmap", encodeBitmap, decodeBitmap},
+	tagVector:      {tagVector, "vector", encodeVector, decodeVector},
+}
+
+// codecOf returns the codec for a value held in the store.
+func codecOf(value interface{}) (*valueCodec, bool) {
+	var tag byte
+	switch v := value.(type) {
+	case string:
+		tag = tagString
+	case []string, []interface{}:
+		tag = tagList
+	case map[string]struct{}:
+		tag = tagSet
+	case map[string]interface{}:
+		// Hashes and JSON documents are both stored as maps; only a hash has nothing but
+		// string values
+		tag = tagJSON
+		if _, ok := hashFields(v); ok && len(v) > 0 {
+			tag = tagHash
+		}
+	case *SortedSet:
+		tag = tagSortedSet
+	case *GeoSet:
+		tag = tagGeo
+	case *Stream:
+		tag = tagStream
+	case *HyperLogLog:
+		tag = tagHyperLogLog
+	case *TimeSeries:
+		tag = tagTimeSeries
+	case []byte:
+		tag = tagBitmap
+	case []float64:
+		tag = tagVector
+	default:
+		return nil, false
+	}
+	return valueCodecs[tag], true
+}
+
+// appendSnapshotHeader starts a snapshot with its magic, version and header.
+func appendSnapshotHeader(buf []byte, state snapshotState) []byte {
+	e := &snapshotEncoder{buf: append(buf, snapshotMagic...)}
+	e.buf = binary.BigEndian.AppendUint16(e.buf, snapshotVersion)
+	e.putInt(state.saved.UnixMilli())
+	e.putString(state.aofBase)
+	e.putInt(state.aofOffset)
+	return e.buf
+}
+
+// appendSnapshotSelectDB makes the records that follow keys of database db.
+func appendSnapshotSelectDB(buf []byte, db int) []byte {
+	e := &snapshotEncoder{buf: append(buf, opSelectDB)}
+	e.putUint(uint64(db))
+	return e.buf
+}
+
+// appendSnapshotRecord appends the record of one key.
+func appendSnapshotRecord(buf []byte, key string, value interface{}, expiry time.Time, hasExpiry bool) ([]byte, error) {
+	codec, ok := codecOf(value)
+	if !ok {
+		return buf, fmt.Errorf("unsupported type %T for key %s", value, key)
+	}
+	e := &snapshotEncoder{buf: buf}
+	if hasExpiry {
+		e.putByte(opExpiry)
+		e.putInt(expiry.UnixMilli())
+	}
+	e.putByte(codec.tag)
+	e.putString(key)
+	codec.encode(e, value)
+	return e.buf, nil
+}
+
+// appendSnapshotEnd ends a snapshot with opEOF and the checksum.
+func appendSnapshotEnd(buf []byte) []byte {
+	buf = append(buf, opEOF)
+	return binary.LittleEndian.AppendUint64(buf, crc64.Checksum(buf, crcTable))
+}
+
+// decodeSnapshot decodes a snapshot file. Nothing is returned unless the whole file is
+// intact: the checksum must match and every record must decode.
+func decodeSnapshot(data []byte) (snapshotState, error) {
+	state, n, err := decodeSnapshotPrefix(data)
+	if err != nil {
+		return snapshotState{}, err
+	}
+	if n != len(data) {
+		return snapshotState{}, fmt.Errorf("%w: data after the end of the snapshot", errSnapshotCorrupt)
+	}
+	return state, nil
+}
+
+// decodeSnapshotPrefix decodes the snapshot data starts with and returns how long it is.
+// Whatever follows the snapshot, such as the commands after the preamble of an AOF, is left
+// alone.
+func decodeSnapshotPrefix(data []byte) (snapshotState, int, error) {
+	var dbs []keyspace
+	state, n, err := walkSnapshot(data, func(r snapshotRecord) {
+		for len(dbs) <= r.db {
+			dbs = append(dbs, newKeyspace())
+		}
+		dbs[r.db].store[r.key] = r.value
+		if !r.expiry.IsZero() {
+			dbs[r.db].expiries[r.key] = r.expiry
+		}
+	})
+	if err != nil {
+		return snapshotState{}, n, err
+	}
+	state.dbs = dbs
+	return state, n, nil
+}
+
+// snapshotRecord is one decoded record of a snapshot and where it is in the data.
+type snapshotRecord struct {
+	db         int
+	key        string
+	value      interface{}
+	codec      *valueCodec
+	expiry     time.Time // zero without one
+	start, end int
+	valueStart int // where the type tag is, after the expiry
+}
+
+// walkSnapshot decodes the snapshot data starts with and hands every record to fn. It returns
+// the header and how long the snapshot is, or on error the offset where it stops being valid:
+// the record that does not decode, or the checksum that does not match. Records are handed
+// over before the checksum is checked.
+func walkSnapshot(data []byte, fn func(r snapshotRecord)) (snapshotState, int, error) {
+	d, err := newSnapshotDecoder(data)
+	if err != nil {
+		return snapshotState{}, 0, err
+	}
+	offset := func() int { return len(data) - len(d.data) }
+	state := d.header()
+	if d.err != nil {
+		return snapshotState{}, 0, d.err
+	}
+	db := 0
+	for {
+		start := offset()
+		op := d.byte()
+		if op == opEOF {
+			break
+		}
+		if op == opSelectDB {
+			// Indexes past the configured databases are rejected when the snapshot is loaded
+			index := d.uint()
+			if index > math.MaxUint16 {
+				d.fail(fmt.Sprintf("database index %d out of range", index))
+			}
+			db = int(index)
+			if d.err != nil {
+				return snapshotState{}, start, d.err
+			}
+			continue
+		}
+		record := snapshotRecord{db: db, start: start}
+		if op == opExpiry {
+			record.expiry = time.UnixMilli(d.int())
+			record.valueStart = offset()
+			op = d.byte()
+		} else {
+			record.valueStart = start
+		}
+		codec, ok := valueCodecs[op]
+		if !ok {
+			d.fail(fmt.Sprintf("unknown type tag %d", op))
+		}
+		if d.err != nil {
+			return snapshotState{}, start, d.err
+		}
+		record.codec = codec
+		record.key = d.string()
+		record.value = codec.decode(d)
+		if d.err != nil {
+			return snapshotState{}, start, d.err
+		}
+		record.end = offset()
+		fn(record)
+	}
+	end := offset()
+	if len(d.data) < 8 {
+		return snapshotState{}, end, fmt.Errorf("%w: missing checksum", errSnapshotCorrupt)
+	}
+	if crc64.Checksum(data[:end], crcTable) != binary.LittleEndian.Uint64(d.data) {
+		return snapshotState{}, end, fmt.Errorf("%w: checksum mismatch", errSnapshotCorrupt)
+	}
+	return state, end + 8, nil
+}
+
+// decodeSnapshotHeader decodes only the header of the snapshot data starts with, without
+// checking it against the checksum.
+func decodeSnapshotHeader(data []byte) (snapshotState, error) {
+	d, err := newSnapshotDecoder(data)
+	if err != nil {
+		return snapshotState{}, err
+	}
+	state := d.header()
+	return state, d.err
+}
+
+// isSnapshot reports whether data starts with a snapshot.
+func isSnapshot(data []byte) bool {
+	return len(data) >= len(snapshotMagic) && string(data[:len(snapshotMagic)]) == snapshotMagic
+}
+
+// newSnapshotDecoder checks the magic and version of a snapshot and returns a decoder
+// positioned at its header.
+func newSnapshotDecoder(data []byte) (*snapshotDecoder, error) {
+	if len(data) < len(snapshotMagic)+2 || !isSnapshot(data) {
+		return nil, fmt.Errorf("%w: not a tealis snapshot", errSnapshotCorrupt)
+	}
+	if version := binary.BigEndian.Uint16(data[len(snapshotMagic):]); version > snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", version)
+	}
+	return &snapshotDecoder{data: data[len(snapshotMagic)+2:]}, nil
+}
+
+// header decodes the header appendSnapshotHeader wrote.
+func (d *snapshotDecoder) header() snapshotState {
+	var state snapshotState
+	state.saved = time.UnixMilli(d.int())
+	state.aofBase = d.string()
+	state.aofOffset = d.int()
+	return state
+}
+
+// snapshotEncoder appends values to a buffer.
+type snapshotEncoder struct {
+	buf []byte
+}
+
+func (e *snapshotEncoder) putByte(b byte) {
+	e.buf = append(e.buf, b)
+}
+
+func (e *snapshotEncoder) putUint(n uint64) {
+	e.buf = binary.AppendUvarint(e.buf, n)
+}
+
+func (e *snapshotEncoder) putInt(n int64) {
+	e.buf = binary.AppendVarint(e.buf, n)
+}
+
+func (e *snapshotEncoder) putString(s string) {
+	e.putUint(uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *snapshotEncoder) putFloat(f float64) {
+	e.buf = binary.LittleEndian.AppendUint64(e.buf, math.Float64bits(f))
+}
+
+func (e *snapshotEncoder) putStrings(items []string) {
+	e.putUint(uint64(len(items)))
+	for _, item := range items {
+		e.putString(item)
+	}
+}
+
+// snapshotDecoder reads values from a buffer. The first error sticks: later reads return
+// zero values, so decoders check it once at the end.
+type snapshotDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *snapshotDecoder) fail(reason string) {
+	if d.err == nil {
+		d.err = fmt.Errorf("%w: %s", errSnapshotCorrupt, reason)
+	}
+	d.data = nil
+}
+
+func (d *snapshotDecoder) byte() byte {
+	if len(d.data) == 0 {
+		d.fail("unexpected end of data")
+		return 0
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b
+}
+
+func (d *snapshotDecoder) uint() uint64 {
+	n, size := binary.Uvarint(d.data)
+	if size <= 0 {
+		d.fail("bad integer")
+		return 0
+	}
+	d.data = d.data[size:]
+	return n
+}
+
+func (d *snapshotDecoder) int() int64 {
+	n, size := binary.Varint(d.data)
+	if size <= 0 {
+		d.fail("bad integer")
+		return 0
+	}
+	d.data = d.data[size:]
+	return n
+}
+
+// length reads the length of a collection whose elements take at least one byte each, so a
+// corrupt length cannot make the decoder allocate more than the file holds.
+func (d *snapshotDecoder) length() int {
+	n := d.uint()
+	if n > uint64(len(d.data)) {
+		d.fail("length out of range")
+		return 0
+	}
+	return int(n)
+}
+
+func (d *snapshotDecoder) string() string {
+	n := d.length()
+	s := string(d.data[:n])
+	d.data = d.data[n:]
+	return s
+}
+
+func (d *snapshotDecoder) float() float64 {
+	if len(d.data) < 8 {
+		d.fail("unexpected end of data")
+		return 0
+	}
+	f := math.Float64frombits(binary.LittleEndian.Uint64(d.data))
+	d.data = d.data[8:]
+	return f
+}
+
+func (d *snapshotDecoder) strings() []string {
+	items := make([]string, d.length())
+	for i := range items {
+		items[i] = d.string()
+	}
+	return items
+}
+
+func encodeString(e *snapshotEncoder, value interface{}) {
+	e.putString(value.(string))
+}
+
+func decodeString(d *snapshotDecoder) interface{} {
+	return d.string()
+}
+
+func encodeList(e *snapshotEncoder, value interface{}) {
+	switch v := value.(type) {
+	case []string:
+		e.putStrings(v)
+	case []interface{}:
+		// Lists read back from a JSON snapshot
+		e.putUint(uint64(len(v)))
+		for _, item := range v {
+			e.putString(fmt.Sprint(item))
+		}
+	}
+}
+
+func decodeList(d *snapshotDecoder) interface{} {
+	return d.strings()
+}
+
+func encodeSet(e *snapshotEncoder, value interface{}) {
+	e.putStrings(sortedKeys(value.(map[string]struct{})))
+}
+
+func decodeSet(d *snapshotDecoder) interface{} {
+	members := d.strings()
+	set := make(map[string]struct{}, len(members))
+	for _, member := range members {
+		set[member] = struct{}{}
+	}
+	return set
+}
+
+func encodeHash(e *snapshotEncoder, value interface{}) {
+	fields, _ := hashFields(value.(map[string]interface{}))
+	e.putStrings(fields)
+}
+
+func decodeHash(d *snapshotDecoder) interface{} {
+	fields := d.strings()
+	if len(fields)%2 != 0 {
+		d.fail("odd number of hash fields")
+		return nil
+	}
+	hash := make(map[string]interface{}, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		hash[fields[i]] = fields[i+1]
+	}
+	return hash
+}
+
+func encodeJSON(e *snapshotEncoder, value interface{}) {
+	// Documents only hold values that came out of json.Unmarshal, which always marshal
+	doc, _ := json.Marshal(value)
+	e.putString(string(doc))
+}
+
+func decodeJSON(d *snapshotDecoder) interface{} {
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(d.string()), &doc); err != nil && d.err == nil {
+		d.fail("bad JSON document")
+	}
+	if doc == nil {
+		doc = make(map[string]interface{})
+	}
+	return doc
+}
+
+func encodeSortedSet(e *snapshotEncoder, value interface{}) {
+	ss := value.(*SortedSet)
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	e.putUint(uint64(ss.length))
+	for node := ss.header.forward[0]; node != nil; node = node.forward[0] {
+		e.putString(node.key)
+		e.putFloat(node.score)
+	}
+}
+
+func decodeSortedSet(d *snapshotDecoder) interface{} {
+	ss := NewSortedSet()
+	for n := d.length(); n > 0 && d.err == nil; n-- {
+		member := d.string()
+		ss.ZAdd(member, d.float())
+	}
+	return ss
+}
+
+func encodeGeo(e *snapshotEncoder, value interface{}) {
+	geo := value.(*GeoSet)
+	names := sortedKeys(geo.Locations)
+	e.putUint(uint64(len(names)))
+	for _, name := range names {
+		loc := geo.Locations[name]
+		e.putString(name)
+		e.putFloat(loc.Latitude)
+		e.putFloat(loc.Longitude)
+	}
+	e.putStrings(geo.Sorted)
+}
+
+func decodeGeo(d *snapshotDecoder) interface{} {
+	geo := NewGeoSet()
+	for n := d.length(); n > 0 && d.err == nil; n-- {
+		name := d.string()
+		geo.Locations[name] = GeoLocation{Latitude: d.float(), Longitude: d.float(), Name: name}
+	}
+	geo.Sorted = d.strings()
+	return geo
+}
+
+func encodeStream(e *snapshotEncoder, value interface{}) {
+	stream := value.(*Stream)
+	stream.mu.RLock()
+	defer stream.mu.RUnlock()
+	e.putUint(uint64(len(stream.Entries)))
+	for _, entry := range stream.Entries {
+		encodeStreamEntry(e, entry)
+	}
+	e.putUint(uint64(len(stream.ConsumerGroups)))
+	for _, name := range sortedKeys(stream.ConsumerGroups) {
+		group := stream.ConsumerGroups[name]
+		e.putString(name)
+		e.putUint(uint64(len(group.Pending)))
+		for _, id := range sortedKeys(group.Pending) {
+			encodeStreamEntry(e, group.Pending[id])
+		}
+		e.putUint(uint64(len(group.Consumers)))
+		for _, consumer := range sortedKeys(group.Consumers) {
+			e.putString(consumer)
+			e.putStrings(group.Consumers[consumer].Pending)
+		}
+	}
+}
+
+func encodeStreamEntry(e *snapshotEncoder, entry StreamEntry) {
+	e.putString(entry.ID)
+	fields := make([]string, 0, 2*len(entry.Fields))
+	for _, field := range sortedKeys(entry.Fields) {
+		fields = append(fields, field, entry.Fields[field])
+	}
+	e.putStrings(fields)
+}
+
+func decodeStream(d *snapshotDecoder) interface{} {
+	stream := &Stream{Entries: []StreamEntry{}, ConsumerGroups: make(map[string]*ConsumerGroup)}
+	for n := d.length(); n > 0 && d.err == nil; n-- {
+		stream.Entries = append(stream.Entries, decodeStreamEntry(d))
+	}
+	for n := d.length(); n > 0 && d.err == nil; n-- {
+		group := &ConsumerGroup{Consumers: make(map[string]*Consumer), Pending: make(map[string]StreamEntry)}
+		stream.ConsumerGroups[d.string()] = group
+		for m := d.length(); m > 0 && d.err == nil; m-- {
+			entry := decodeStreamEntry(d)
+			group.Pending[entry.ID] = entry
+		}
+		for m := d.length(); m > 0 && d.err == nil; m-- {
+			name := d.string()
+			group.Consumers[name] = &Consumer{Pending: d.strings()}
+		}
+	}
+	return stream
+}
+
+func decodeStreamEntry(d *snapshotDecoder) StreamEntry {
+	entry := StreamEntry{ID: d.string(), Fields: make(map[string]string)}
+	fields := d.strings()
+	if len(fields)%2 != 0 {
+		d.fail("odd number of stream entry fields")
+		return entry
+	}
+	for i := 0; i < len(fields); i += 2 {
+		entry.Fields[fields[i]] = fields[i+1]
+	}
+	return entry
+}
+
+func encodeHyperLogLog(e *snapshotEncoder, value interface{}) {
+	e.putString(string(value.(*HyperLogLog).registers))
+}
+
+func decodeHyperLogLog(d *snapshotDecoder) interface{} {
+	registers := d.string()
+	hll, err := newHyperLogLogFromRegisters([]byte(registers))
+	if err != nil {
+		d.fail(err.Error())
+		return nil
+	}
+	return hll
+}
+
+func encodeTimeSeries(e *snapshotEncoder, value interface{}) {
+	ts := value.(*TimeSeries)
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	e.putString(ts.aggregation)
+	e.putUint(uint64(len(ts.Points)))
+	for _, point := range ts.Points {
+		e.putInt(point.Timestamp.UnixNano())
+		e.putFloat(point.Value)
+	}
+}
+
+func decodeTimeSeries(d *snapshotDecoder) interface{} {
+	ts := NewTimeSeries()
+	ts.aggregation = d.string()
+	for n := d.length(); n > 0 && d.err == nil; n-- {
+		ts.Points = append(ts.Points, DataPoint{Timestamp: time.Unix(0, d.int()), Value: d.float()})
+	}
+	return ts
+}
+
+func encodeBitmap(e *snapshotEncoder, value interface{}) {
+	e.putString(string(value.([]byte)))
+}
+
+func decodeBitmap(d *snapshotDecoder) interface{} {
+	return []byte(d.string())
+}
+
+func encodeVector(e *snapshotEncoder, value interface{}) {
+	vector := value.([]float64)
+	e.putUint(uint64(len(vector)))
+	for _, f := range vector {
+		e.putFloat(f)
+	}
+}
+
+func decodeVector(d *snapshotDecoder) interface{} {
+	vector := make([]float64, d.length())
+	for i := range vector {
+		vector[i] = d.float()
+	}
+	return vector
+}
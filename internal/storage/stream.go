@@ -29,17 +29,20 @@ type Consumer struct {
 // --- Stream Operations ---
 
 // XAdd adds an entry to the stream.
-func (r *Tealis) XAdd(key string, id string, fields map[string]string) string {
+func (r *Tealis) XAdd(key string, id string, fields map[string]string) (string, error) {
 	r.Mu.Lock()
 	defer r.Mu.Unlock()
 
-	stream, ok := r.Store[key].(*Stream)
+	stream, ok, err := valueOf[*Stream](r.lookupWriteLocked(key))
+	if err != nil {
+		return "", err
+	}
 	if !ok {
 		stream = &Stream{
 			Entries:        []StreamEntry{},
 			ConsumerGroups: make(map[string]*ConsumerGroup),
 		}
-		r.Store[key] = stream
+		r.setLocked(key, stream)
 	}
 
 	if id == "*" {
@@ -51,17 +54,17 @@ func (r *Tealis) XAdd(key string, id string, fields map[string]string) string {
 	stream.Entries = append(stream.Entries, entry)
 	stream.mu.Unlock()
 
-	return id
+	return id, nil
 }
 
 // XRead reads entries from streams.
-func (r *Tealis) XRead(key string, startID string, count int) []StreamEntry {
+func (r *Tealis) XRead(key string, startID string, count int) ([]StreamEntry, error) {
 	r.Mu.RLock()
 	defer r.Mu.RUnlock()
 
-	stream, ok := r.Store[key].(*Stream)
+	stream, ok, err := valueOf[*Stream](r.lookupLocked(key))
 	if !ok {
-		return nil
+		return nil, err
 	}
 
 	stream.mu.RLock()
@@ -69,8 +72,6 @@ func (r *Tealis) XRead(key string, startID string, count int) []StreamEntry {
 
 	var result []StreamEntry
 	for _, entry := range stream.Entries {
-		entryId := entry.ID
-		print(entryId)
 		if entry.ID > startID {
 			result = append(result, entry)
 			if count > 0 && len(result) >= count {
@@ -78,17 +79,17 @@ func (r *Tealis) XRead(key string, startID string, count int) []StreamEntry {
 			}
 		}
 	}
-	return result
+	return result, nil
 }
 
 // XRange retrieves entries within a range.
-func (r *Tealis) XRange(key, startID, endID string) []StreamEntry {
+func (r *Tealis) XRange(key, startID, endID string) ([]StreamEntry, error) {
 	r.Mu.RLock()
 	defer r.Mu.RUnlock()
 
-	stream, ok := r.Store[key].(*Stream)
+	stream, ok, err := valueOf[*Stream](r.lookupLocked(key))
 	if !ok {
-		return nil
+		return nil, err
 	}
 
 	stream.mu.RLock()
@@ -100,59 +101,84 @@ func (r *Tealis) XRange(key, startID, endID string) []StreamEntry {
 			result = append(result, entry)
 		}
 	}
-	return result
+	return result, nil
 }
 
 // XLen returns the length of the stream.
-func (r *Tealis) XLen(key string) int {
+func (r *Tealis) XLen(key string) (int, error) {
 	r.Mu.RLock()
 	defer r.Mu.RUnlock()
 
-	stream, ok := r.Store[key].(*Stream)
+	stream, ok, err := valueOf[*Stream](r.lookupLocked(key))
 	if !ok {
-		return 0
+		return 0, err
 	}
 
 	stream.mu.RLock()
 	defer stream.mu.RUnlock()
 
-	return len(stream.Entries)
+	return len(stream.Entries), nil
 }
 
 // --- Consumer Group Operations ---
 
 // XGroupCreate CREATE creates a consumer group.
-func (r *Tealis) XGroupCreate(key, groupName string) bool {
+func (r *Tealis) XGroupCreate(key, groupName string) (bool, error) {
 	r.Mu.Lock()
 	defer r.Mu.Unlock()
 
-	stream, ok := r.Store[key].(*Stream)
+	stream, ok, err := valueOf[*Stream](r.lookupWriteLocked(key))
 	if !ok {
-		return false
+		return false, err
 	}
 
 	stream.mu.Lock()
 	defer stream.mu.Unlock()
 
 	if _, exists := stream.ConsumerGroups[groupName]; exists {
-		return false
+		return false, nil
 	}
 
 	stream.ConsumerGroups[groupName] = &ConsumerGroup{
 		Consumers: make(map[string]*Consumer),
 		Pending:   make(map[string]StreamEntry),
 	}
-	return true
+	return true, nil
+}
+
+// XGroupCreateConsumer CREATECONSUMER adds a consumer with nothing pending to a group and
+// reports whether it was created. ok is false if the stream or group does not exist.
+func (r *Tealis) XGroupCreateConsumer(key, groupName, consumerName string) (created, ok bool, err error) {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+
+	stream, ok, err := valueOf[*Stream](r.lookupWriteLocked(key))
+	if !ok {
+		return false, false, err
+	}
+
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+
+	group, exists := stream.ConsumerGroups[groupName]
+	if !exists {
+		return false, false, nil
+	}
+	if _, exists := group.Consumers[consumerName]; exists {
+		return false, true, nil
+	}
+	group.Consumers[consumerName] = &Consumer{Pending: []string{}}
+	return true, true, nil
 }
 
 // XReadGroup reads entries for a consumer in a group.
-func (r *Tealis) XReadGroup(key, groupName, consumerName, startID string, count int) []StreamEntry {
+func (r *Tealis) XReadGroup(key, groupName, consumerName, startID string, count int) ([]StreamEntry, error) {
 	r.Mu.Lock()
 	defer r.Mu.Unlock()
 
-	stream, ok := r.Store[key].(*Stream)
+	stream, ok, err := valueOf[*Stream](r.lookupWriteLocked(key))
 	if !ok {
-		return nil
+		return nil, err
 	}
 
 	stream.mu.Lock()
@@ -160,7 +186,7 @@ func (r *Tealis) XReadGroup(key, groupName, consumerName, startID string, count
 
 	group, exists := stream.ConsumerGroups[groupName]
 	if !exists {
-		return nil
+		return nil, nil
 	}
 
 	consumer, exists := group.Consumers[consumerName]
@@ -180,17 +206,17 @@ func (r *Tealis) XReadGroup(key, groupName, consumerName, startID string, count
 			}
 		}
 	}
-	return result
+	return result, nil
 }
 
 // XAck acknowledges messages for a consumer group.
-func (r *Tealis) XAck(key, groupName string, ids []string) int {
+func (r *Tealis) XAck(key, groupName string, ids []string) (int, error) {
 	r.Mu.Lock()
 	defer r.Mu.Unlock()
 
-	stream, ok := r.Store[key].(*Stream)
+	stream, ok, err := valueOf[*Stream](r.lookupWriteLocked(key))
 	if !ok {
-		return 0
+		return 0, err
 	}
 
 	stream.mu.Lock()
@@ -198,7 +224,7 @@ func (r *Tealis) XAck(key, groupName string, ids []string) int {
 
 	group, exists := stream.ConsumerGroups[groupName]
 	if !exists {
-		return 0
+		return 0, nil
 	}
 
 	ackCount := 0
@@ -208,5 +234,70 @@ func (r *Tealis) XAck(key, groupName string, ids []string) int {
 			ackCount++
 		}
 	}
-	return ackCount
+	return ackCount, nil
+}
+
+// XClaim moves pending entries of a consumer group to a consumer. With force, entries of the
+// stream that are not pending yet are claimed too. It reports false if the stream or group
+// does not exist.
+func (r *Tealis) XClaim(key, groupName, consumerName string, ids []string, force bool) ([]StreamEntry, bool, error) {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+
+	stream, ok, err := valueOf[*Stream](r.lookupWriteLocked(key))
+	if !ok {
+		return nil, false, err
+	}
+
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+
+	group, exists := stream.ConsumerGroups[groupName]
+	if !exists {
+		return nil, false, nil
+	}
+
+	consumer, exists := group.Consumers[consumerName]
+	if !exists {
+		consumer = &Consumer{Pending: []string{}}
+		group.Consumers[consumerName] = consumer
+	}
+
+	var claimed []StreamEntry
+	for _, id := range ids {
+		entry, pending := group.Pending[id]
+		if !pending {
+			if !force {
+				continue
+			}
+			found := false
+			for _, e := range stream.Entries {
+				if e.ID == id {
+					entry, found = e, true
+					break
+				}
+			}
+			if !found {
+				continue
+			}
+		}
+		// An entry is pending for one consumer at a time
+		for _, other := range group.Consumers {
+			other.Pending = removeID(other.Pending, id)
+		}
+		group.Pending[id] = entry
+		consumer.Pending = append(consumer.Pending, id)
+		claimed = append(claimed, entry)
+	}
+	return claimed, true, nil
+}
+
+// removeID returns ids without id.
+func removeID(ids []string, id string) []string {
+	for i, pending := range ids {
+		if pending == id {
+			return append(ids[:i:i], ids[i+1:]...)
+		}
+	}
+	return ids
 }
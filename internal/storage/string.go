@@ -1,8 +1,8 @@
 package storage
 
 import (
+	"errors"
 	"fmt"
-	"path"
 	"strconv"
 	"strings"
 	"time"
@@ -13,7 +13,7 @@ func (r *Tealis) Set(key, value string, ttl time.Duration) {
 	r.Mu.Lock()
 	defer r.Mu.Unlock()
 
-	r.Store[key] = value
+	r.setLocked(key, value)
 	if ttl > 0 {
 		r.Expiries[key] = time.Now().Add(ttl)
 	} else {
@@ -21,24 +21,55 @@ func (r *Tealis) Set(key, value string, ttl time.Duration) {
 	}
 }
 
-// Get retrieves the value for a key.
-func (r *Tealis) Get(key string) (string, bool) {
-	r.Mu.RLock()
-	defer r.Mu.RUnlock()
+// SetOptions are the conditions and expiry of a SET.
+type SetOptions struct {
+	NX, XX  bool      // only set a missing or an existing key
+	Get     bool      // return the old value, which must be a string
+	KeepTTL bool      // keep the key's expiry instead of clearing it
+	Expiry  time.Time // the new expiry, zero for none
+}
 
-	if expiry, exists := r.Expiries[key]; exists && time.Now().After(expiry) {
-		r.Mu.Lock()
-		delete(r.Store, key)
-		delete(r.Expiries, key)
-		r.Mu.Unlock()
-		return "", false
+// SetWithOptions saves a key-value pair if the options allow it. It returns the old value,
+// whether there was one and whether the key was set. An expiry that already passed sets
+// the key and expires it at once.
+func (r *Tealis) SetWithOptions(key, value string, opts SetOptions) (string, bool, bool, error) {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+
+	now := time.Now()
+	var old string
+	exists := r.liveLocked(key, now)
+	if exists && opts.Get {
+		s, ok := r.Store[key].(string)
+		if !ok {
+			return "", false, false, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		}
+		old = s
+	}
+	if opts.NX && exists || opts.XX && !exists {
+		return old, exists, false, nil
 	}
 
-	value, exists := r.Store[key]
-	if value != nil {
-		return value.(string), exists
+	switch {
+	case !opts.Expiry.IsZero() && !opts.Expiry.After(now):
+		r.deleteLocked(key)
+		delete(r.Expiries, key)
+		return old, exists, true, nil
+	case !opts.Expiry.IsZero():
+		r.Expiries[key] = opts.Expiry
+	case !opts.KeepTTL || !exists:
+		delete(r.Expiries, key)
 	}
-	return "", exists
+	r.setLocked(key, value)
+	return old, exists, true, nil
+}
+
+// Get retrieves the value for a key.
+func (r *Tealis) Get(key string) (string, bool, error) {
+	r.Mu.RLock()
+	defer r.Mu.RUnlock()
+
+	return valueOf[string](r.lookupLocked(key))
 }
 
 // Del deletes a key from the store.
@@ -46,8 +77,8 @@ func (r *Tealis) Del(key string) bool {
 	r.Mu.Lock()
 	defer r.Mu.Unlock()
 
-	if _, exists := r.Store[key]; exists {
-		delete(r.Store, key)
+	if r.lookupWriteLocked(key) != nil {
+		r.deleteLocked(key)
 		delete(r.Expiries, key)
 		return true
 	}
@@ -58,32 +89,29 @@ func (r *Tealis) Del(key string) bool {
 func (r *Tealis) Exists(key string) bool {
 	r.Mu.RLock()
 	defer r.Mu.RUnlock()
-	_, exists := r.Store[key]
-	return exists
+	return r.liveLocked(key, time.Now())
 }
 
 // Append appends a value to an existing key.
-func (r *Tealis) Append(key, value string) int {
+func (r *Tealis) Append(key, value string) (int, error) {
 	r.Mu.Lock()
 	defer r.Mu.Unlock()
 
-	if current, exists := r.Store[key]; exists {
-		r.Store[key] = current.(string) + value
-	} else {
-		r.Store[key] = value
+	current, _, err := valueOf[string](r.lookupWriteLocked(key))
+	if err != nil {
+		return 0, err
 	}
-	return len(r.Store[key].(string))
+	r.setLocked(key, current+value)
+	return len(current) + len(value), nil
 }
 
 // StrLen returns the length of a string value for a key.
-func (r *Tealis) StrLen(key string) int {
+func (r *Tealis) StrLen(key string) (int, error) {
 	r.Mu.RLock()
 	defer r.Mu.RUnlock()
 
-	if value, exists := r.Store[key]; exists {
-		return len(value.(string))
-	}
-	return 0
+	value, _, err := valueOf[string](r.lookupLocked(key))
+	return len(value), err
 }
 
 // IncrBy increments a key by a specified value.
@@ -91,30 +119,33 @@ func (r *Tealis) IncrBy(key string, increment int) (int, error) {
 	r.Mu.Lock()
 	defer r.Mu.Unlock()
 
-	current, exists := r.Store[key]
+	current, exists, err := valueOf[string](r.lookupWriteLocked(key))
+	if err != nil {
+		return 0, err
+	}
 	if !exists {
-		r.Store[key] = strconv.Itoa(increment)
+		r.setLocked(key, strconv.Itoa(increment))
 		return increment, nil
 	}
 
-	currentInt, err := strconv.Atoi(current.(string))
+	currentInt, err := strconv.Atoi(current)
 	if err != nil {
 		return 0, fmt.Errorf("value is not an integer")
 	}
 
 	newValue := currentInt + increment
-	r.Store[key] = strconv.Itoa(newValue)
+	r.setLocked(key, strconv.Itoa(newValue))
 	return newValue, nil
 }
 
 // GetRange retrieves a substring from a value.
-func (r *Tealis) GetRange(key string, start, end int) string {
+func (r *Tealis) GetRange(key string, start, end int) (string, error) {
 	r.Mu.RLock()
 	defer r.Mu.RUnlock()
 
-	value, exists := r.Store[key].(string)
+	value, exists, err := valueOf[string](r.lookupLocked(key))
 	if !exists {
-		return ""
+		return "", err
 	}
 
 	if start < 0 {
@@ -128,7 +159,7 @@ func (r *Tealis) GetRange(key string, start, end int) string {
 		start = 0
 	}
 	if start >= len(value) {
-		return ""
+		return "", nil
 	}
 
 	if end >= len(value) {
@@ -136,20 +167,20 @@ func (r *Tealis) GetRange(key string, start, end int) string {
 	}
 
 	if start > end {
-		return ""
+		return "", nil
 	}
 
-	return value[start : end+1]
+	return value[start : end+1], nil
 }
 
 // SetRange sets a substring at the specified offset.
-func (r *Tealis) SetRange(key string, offset int, value string) int {
+func (r *Tealis) SetRange(key string, offset int, value string) (int, error) {
 	r.Mu.Lock()
 	defer r.Mu.Unlock()
 
-	currentValue, exists := r.Store[key].(string)
-	if !exists {
-		currentValue = ""
+	currentValue, _, err := valueOf[string](r.lookupWriteLocked(key))
+	if err != nil {
+		return 0, err
 	}
 
 	if offset > len(currentValue) {
@@ -157,8 +188,8 @@ func (r *Tealis) SetRange(key string, offset int, value string) int {
 	}
 
 	newValue := currentValue[:offset] + value
-	r.Store[key] = newValue
-	return len(newValue)
+	r.setLocked(key, newValue)
+	return len(newValue), nil
 }
 
 // Keys returns keys that match a pattern.
@@ -167,15 +198,14 @@ func (r *Tealis) Keys(pattern string) []string {
 	defer r.Mu.RUnlock()
 
 	var matchedKeys []string
+	now := time.Now()
 	for key := range r.Store {
-		if pattern == "*" || matchesPattern(key, pattern) {
+		if r.expiredLocked(key, now) {
+			continue
+		}
+		if pattern == "*" || globMatch(pattern, key) {
 			matchedKeys = append(matchedKeys, key)
 		}
 	}
 	return matchedKeys
 }
-
-func matchesPattern(key, pattern string) bool {
-	matched, err := path.Match(pattern, key)
-	return err == nil && matched
-}
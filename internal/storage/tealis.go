@@ -1,160 +1,197 @@
 package storage
 
 import (
-	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
-	"strings"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"tealis/internal/config"
+	"tealis/internal/logging"
+	"tealis/internal/protocol"
 	"time"
 )
 
+// Version is the server version reported by HELLO.
+const Version = "0.1.0"
+
+// Tealis is one of the numbered databases of a server. Every database has its own keys and
+// shares everything else, settings, clients and persistence included, with the others.
+// Commands run against the database their session selected.
 type Tealis struct {
-	Mu                sync.RWMutex
-	Store             map[string]interface{} // Store can hold any data type (string, list, etc.)
-	Expiries          map[string]time.Time
-	Transactions      map[string][]string               // Store queued commands for each transaction
-	pubsubSubscribers map[string]map[string]chan string // channel -> clientID -> message channel
-	ClientConnections map[string]interface{}            // clientID -> connection (can be net.Conn or *websocket.Conn)
-	mockClients       map[string]*MockClientConnection
-	multi             bool
+	*server
+	Store    map[string]interface{} // Store can hold any data type (string, list, etc.)
+	Expiries map[string]time.Time
+	scan     *scanIndexes // positions of the names SCAN and its variants return
+	db       int          // index of the database
+}
+
+// server is the state the databases of a server share.
+type server struct {
+	Mu                sync.RWMutex // guards the keys of every database and the subscribers
+	dbs               []*Tealis
+	pubsubSubscribers map[string]map[*Session]struct{} // channel -> subscribed sessions
+	pubsubPatterns    map[string]map[*Session]struct{} // pattern -> sessions subscribed with PSUBSCRIBE
+	notifyEvents      atomic.Int64                     // notify-keyspace-events, read on every command
+	activeExpireNext  int                              // database active expiry starts with, owned by StartCleanup
+	// Connected clients
+	sessions      map[uint64]*Session
+	sessionsMu    sync.Mutex
+	nextSessionID uint64
+	// Transactions: EXEC holds execMu exclusively while every other command holds it shared
+	execMu sync.RWMutex
+	// Writes, and the expiries of keys, hold writeMu until they are logged so the AOF logs
+	// them in the order they ran
+	writeMu     sync.Mutex
+	changes     int64 // changes made by writes so far, guarded by writeMu
+	watchMu     sync.Mutex
+	watchedKeys map[dbKey]*watchedKey
+	// CLIENT PAUSE state
+	pauseMu         sync.Mutex
+	pauseEnd        time.Time
+	pauseWritesOnly bool
+	unpause         chan struct{}
+	acl             *ACL
+	// Shutdown: SHUTDOWN requests are handed to the server, which calls Shutdown
+	shutdownRequests chan int
+	shuttingDown     atomic.Bool
+	// Settings, changed at runtime with CONFIG SET
+	configMu sync.RWMutex
+	config   config.Config
 	// Persistence options
-	AofFile       *os.File // Append-Only File
-	aofFilePath   string   // Path to the AOF file
-	enableAOF     bool     // Flag to enable/disable AOF
-	snapshotPath  string   // Path to the snapshot file
-	snapshotMutex sync.Mutex
-	wsWriteMutex  sync.Mutex // Mutex for synchronizing WebSocket writes
+	aofMu         sync.Mutex // guards AofFile and enableAOF, which CONFIG SET appendonly changes
+	AofFile       *os.File   // Append-Only File
+	aofDirty      bool       // written since the last fsync
+	aofTxn        int        // MULTI/EXEC framing of the commands EXEC logs, guarded by execMu
+	aofDB         int        // database the AOF commands apply to at its end, -1 if unknown
+	aofBase       string     // identifies the AOF since its last rewrite; snapshots record it
+	aofBaseSize   int64      // AOF size after the last rewrite or load, the base of auto-rewrite growth
+	aofRewriteBuf []byte     // writes logged while a rewrite runs, nil when none does
+	aofRewriting  atomic.Bool
+	aofFilePath   string     // Path to the AOF file
+	enableAOF     bool       // Flag to enable/disable AOF
+	snapshotPath  string     // Path to the snapshot file
+	snapshotMutex sync.Mutex // serializes writing and reading the snapshot file
+	// Snapshots are numbered when captured so an older one never overwrites a newer one
+	snapshotSeq        uint64      // guarded by execMu
+	writtenSnapshotSeq uint64      // guarded by snapshotMutex
+	loading            atomic.Bool // replaying the AOF; commands are not logged again
+	// Saves run from a copy-on-write view of the data while commands keep running
+	saveView       atomic.Pointer[saveView] // the view of the running save, nil when none runs
+	aofRewriteView atomic.Pointer[saveView] // the view of the running AOF rewrite, nil when none runs
+	saving         atomic.Bool
+	saveScheduled  atomic.Bool // BGSAVE SCHEDULE asked for a save once the running one ends
+	bgSaves        sync.WaitGroup
+	saveStatsMu    sync.Mutex
+	lastSave       time.Time // last successful save, for LASTSAVE
+	lastSaveOK     bool
+	saveStarted    time.Time
+	saveDuration   time.Duration // how long the last save took, -1 before the first one
+	dirty          atomic.Int64  // writes since the last successful save
 }
 
 func NewTealis(aofFilePath, snapshotPath string, enableAOF bool) *Tealis {
-	r := &Tealis{
-		Store:             make(map[string]interface{}),
-		Expiries:          make(map[string]time.Time),
-		Transactions:      make(map[string][]string),
-		pubsubSubscribers: make(map[string]map[string]chan string),
-		ClientConnections: make(map[string]interface{}),
-		mockClients:       make(map[string]*MockClientConnection),
-		multi:             false,
+	cfg := config.Default()
+	cfg.AppendDir, cfg.Dir, cfg.AppendOnly = aofFilePath, snapshotPath, enableAOF
+	return NewTealisFromConfig(cfg)
+}
+
+// NewTealisFromConfig creates a store with the persistence settings of cfg and returns its
+// database 0. The settings are kept for CONFIG GET and CONFIG SET.
+func NewTealisFromConfig(cfg config.Config) *Tealis {
+	aofFilePath, snapshotPath, enableAOF := cfg.AppendDir, cfg.Dir, cfg.AppendOnly
+	srv := &server{
+		pubsubSubscribers: make(map[string]map[*Session]struct{}),
+		pubsubPatterns:    make(map[string]map[*Session]struct{}),
+		sessions:          make(map[uint64]*Session),
+		watchedKeys:       make(map[dbKey]*watchedKey),
+		acl:               newACL(),
+		config:            cfg,
+		shutdownRequests:  make(chan int, 1),
 		aofFilePath:       aofFilePath,
 		enableAOF:         enableAOF,
 		snapshotPath:      snapshotPath,
+		lastSave:          time.Now(),
+		lastSaveOK:        true,
+		saveDuration:      -1,
 	}
+	srv.dbs = make([]*Tealis, max(cfg.Databases, 1))
+	for i := range srv.dbs {
+		srv.dbs[i] = &Tealis{
+			server:   srv,
+			Store:    make(map[string]interface{}),
+			Expiries: make(map[string]time.Time),
+			scan:     &scanIndexes{},
+			db:       i,
+		}
+	}
+	r := srv.dbs[0]
+	r.notifyEvents.Store(int64(cfg.NotifyKeyspaceEvents))
 
 	// Open AOF file if enabled
 	if enableAOF {
 		// Ensure the directory for the snapshot exists
 		dir := r.aofFilePath
-		print(dir)
 		if err := os.MkdirAll(dir, 0755); err != nil {
 			_ = fmt.Errorf("failed to create directory for snapshot: %w, path: %s", err, dir)
 		}
-		aofFile, err := os.OpenFile(aofFilePath+"/aof.txt", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
+		if err := r.openAOF(); err != nil {
 			log.Fatalf("Enable AOF Failed to open AOF file: %v", err)
 		}
-		r.AofFile = aofFile
-		r.loadAOF()
 	}
-	// Start cleanup after loading AOF
-	go r.StartCleanup(context.Background())
 	return r
 }
 
-// MULTI starts a transaction.
-func (r *Tealis) MULTI(clientID string) {
-	r.Mu.Lock()
-	defer r.Mu.Unlock()
-	r.Transactions[clientID] = []string{} // Start a new transaction for the client
-	r.multi = true
-}
-
-func (r *Tealis) EXEC(clientID string) string {
-	r.Mu.Lock()
-
-	// Check if there are queued commands for this client
-	commands, ok := r.Transactions[clientID]
-	if !ok {
-		r.Mu.Unlock()
-		return "-ERR No transaction started\r\n"
-	}
-
-	// Copy commands to process outside the lock
-	commandsToExecute := make([]string, len(commands))
-	copy(commandsToExecute, commands)
-
-	// Clear the transaction for the client
-	delete(r.Transactions, clientID)
-
-	r.Mu.Unlock() // Release the lock
-
-	var response []string // This will hold the responses for each command
-	// Return all responses in the transaction, joined by a newline
-	r.multi = false
-	// Process each command
-	for _, cmd := range commandsToExecute {
-		parts := strings.Fields(cmd) // Split the command into parts
-		responseStr := ProcessCommand(parts, r, clientID)
-		response = append(response, responseStr)
-
-		// Log the command execution
-		log.Printf("Executing command in transaction: %s, Response: %s", cmd, responseStr)
-	}
-
-	return strings.Join(response, "\r\n") + "\r\n"
-}
-
-// DISCARD discards all the queued commands in the transaction.
-func (r *Tealis) DISCARD(clientID string) {
-	r.Mu.Lock()
-	defer r.Mu.Unlock()
-	r.multi = false
-	delete(r.Transactions, clientID)
-}
-
-// StartCleanup periodically cleans expired keys.
+// StartCleanup periodically deletes expired keys that no command looked up.
 func (r *Tealis) StartCleanup(ctx context.Context) {
 	go func() {
+		ticker := time.NewTicker(activeExpireInterval)
+		defer ticker.Stop()
 		for {
 			select {
 			case <-ctx.Done():
 				return
-			case <-time.After(time.Second):
-				now := time.Now()
-				r.Mu.Lock()
-				for key, expiry := range r.Expiries {
-					if now.After(expiry) {
-						delete(r.Store, key)
-						delete(r.Expiries, key)
-					}
-				}
-				r.Mu.Unlock()
+			case <-ticker.C:
+				r.activeExpireCycle(activeExpireBudget)
 			}
 		}
 	}()
 }
 
-// EX sets the expiry time for a given key.
-// The duration argument is the time duration after which the key will expire.
-func (r *Tealis) EX(key string, duration time.Duration) {
-	r.Mu.Lock()
-	defer r.Mu.Unlock()
-
-	expiryTime := time.Now().Add(duration)
-	r.Expiries[key] = expiryTime
+// AppendToAOF writes a command to the AOF log, encoded as a RESP array so every argument
+// round-trips exactly. The command is written as is, whatever database the AOF selected.
+func (r *Tealis) AppendToAOF(parts ...string) {
+	r.writeAOF(-1, protocol.Append(nil, protocol.StringArray(parts), protocol.RESP2))
 }
 
-// AppendToAOF writes a command to the AOF log.
-func (r *Tealis) AppendToAOF(command string) {
+// writeAOF appends encoded commands of database db to the AOF, after a SELECT if the AOF
+// selected another, and fsyncs it if appendfsync is always. Commands of db -1 apply to no
+// database in particular.
+func (r *Tealis) writeAOF(db int, data []byte) {
+	// Read before taking aofMu: CONFIG SET holds configMu while it takes aofMu
+	fsyncAlways := r.Config().AppendFsync == "always"
+	r.aofMu.Lock()
+	defer r.aofMu.Unlock()
+
 	// Check if AOF is enabled and AofFile is nil
 	if !r.enableAOF || r.AofFile == nil {
-		log.Printf("AOF is disabled or AofFile is nil, not appending command.")
+		logging.Debugf("AOF is disabled or AofFile is nil, not appending command.")
 		return
 	}
 
+	if db >= 0 && db != r.aofDB {
+		data = append(appendCommand(nil, "SELECT", strconv.Itoa(db)), data...)
+		r.aofDB = db
+	}
+	// A running rewrite replays these writes into the new file when it swaps it in
+	if r.aofRewriteBuf != nil {
+		r.aofRewriteBuf = append(r.aofRewriteBuf, data...)
+	}
+
 	// Reopen the file if it's closed
 	if err := r.ensureAOFFileOpen(); err != nil {
 		log.Printf("Error ensuring AOF file is open: %v", err)
@@ -162,14 +199,59 @@ func (r *Tealis) AppendToAOF(command string) {
 	}
 
 	// Write the command to the AOF file
-	_, err := r.AofFile.WriteString(command + "\n")
+	_, err := r.AofFile.Write(data)
 	if err != nil {
 		log.Printf("Error writing to AOF: %v", err)
 		return
 	}
+	r.aofDirty = true
+	if fsyncAlways {
+		r.syncAOFLocked()
+	}
 
 	// Log successful write
-	log.Printf("fn: Command appended to AOF: %s", command)
+	logging.Debugf("fn: Command appended to AOF: %q", data)
+}
+
+// aofEnabled reports whether writes are logged to the AOF.
+func (r *Tealis) aofEnabled() bool {
+	r.aofMu.Lock()
+	defer r.aofMu.Unlock()
+	return r.enableAOF
+}
+
+// aofSize returns the current size of the AOF file, 0 if there is none.
+func (r *Tealis) aofSize() (int64, error) {
+	r.aofMu.Lock()
+	defer r.aofMu.Unlock()
+	info, err := os.Stat(r.aofFilePath + "/aof.txt")
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read AOF size: %w", err)
+	}
+	return info.Size(), nil
+}
+
+// openAOF opens the AOF for appending and reads which rewrite it comes from. The caller must
+// hold aofMu unless the store is still being created.
+func (r *Tealis) openAOF() error {
+	aofFile, err := os.OpenFile(r.aofFilePath+"/aof.txt", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open AOF file: %w", err)
+	}
+	r.AofFile = aofFile
+	r.aofBase = readAOFBase(aofFile.Name())
+	// Replaying an AOF starts in database 0; where an existing one ends is not known
+	r.aofDB = -1
+	if info, err := aofFile.Stat(); err == nil {
+		r.aofBaseSize = info.Size()
+		if info.Size() == 0 {
+			r.aofDB = 0
+		}
+	}
+	return nil
 }
 
 // ensureAOFFileOpen ensures the AOF file is open.
@@ -192,106 +274,32 @@ func (r *Tealis) AofFileClosed() bool {
 	return err != nil
 }
 
-func (r *Tealis) loadAOF() {
-	r.Mu.RLock()
-	file, err := os.Open(r.aofFilePath + "/aof.txt")
+// saveSnapshotLocked saves a snapshot for callers that already hold execMu exclusively,
+// such as SAVE and shutdown.
+func (r *Tealis) saveSnapshotLocked() error {
+	view, err := r.startSaveLocked()
 	if err != nil {
-		log.Printf("Error loading AOF file: %v", err)
-		r.Mu.RUnlock()
-		return
-	}
-	r.Mu.RUnlock() // Release lock after opening file
-	defer file.Close()
-
-	var commands [][]string
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		command := scanner.Text()
-		parts := strings.Fields(command)
-		if len(parts) > 0 {
-			commands = append(commands, parts)
-		}
-	}
-
-	if err := scanner.Err(); err != nil {
-		log.Printf("Error reading AOF file: %v", err)
-		return
+		return err
 	}
-
+	return r.finishSave(view)
 }
 
-// RewriteAOF rewrites the AOF file to compact its contents and include only the current state.
-func (r *Tealis) RewriteAOF() error {
-	r.Mu.RLock()
-	defer r.Mu.RUnlock()
-
-	// Validate AOF file path
-	if r.aofFilePath == "" {
-		return fmt.Errorf("AOF file path is not set")
-	}
-
-	// Create a temporary file for the new AOF
-	tempFilePath := r.aofFilePath + "/aof_rewrite.tmp"
-	tempFile, err := os.Create(tempFilePath)
-	if err != nil {
-		return fmt.Errorf("failed to create temporary AOF file: %w", err)
-	}
-	defer tempFile.Close()
-
-	// Write the current state to the temporary AOF file
-	for key, value := range r.Store {
-		// Serialize the value into a string command
-		switch v := value.(type) {
-		case string:
-			_, err = tempFile.WriteString(fmt.Sprintf("SET %s %s\n", key, v))
-		case []interface{}:
-			_, err = tempFile.WriteString(fmt.Sprintf("RPUSH %s %s\n", key, formatListForAOF(v)))
-		default:
-			err = fmt.Errorf("unsupported type for key %s", key)
-		}
-		if err != nil {
-			return fmt.Errorf("failed to write to temporary AOF file: %w", err)
-		}
-
-		// If the key has an expiry, add the expiry command
-		if expiry, exists := r.Expiries[key]; exists {
-			ttl := int64(time.Until(expiry).Seconds())
-			if ttl > 0 {
-				_, err = tempFile.WriteString(fmt.Sprintf("EX %s %d\n", key, ttl))
-				if err != nil {
-					return fmt.Errorf("failed to write expiry to temporary AOF file: %w", err)
-				}
-			}
-		}
-	}
-
-	// Atomically replace the old AOF file with the new one
-	oldFilePath := r.aofFilePath + "/aof.txt"
-	err = os.Rename(tempFilePath, oldFilePath)
-	if err != nil {
-		return fmt.Errorf("failed to replace old AOF file: %w", err)
-	}
-
-	log.Printf("AOF rewrite completed successfully")
-	return nil
+// capturedSnapshot is the encoded state of the database at one point in time.
+type capturedSnapshot struct {
+	seq  uint64
+	data []byte
 }
 
-// formatListForAOF formats a list for writing to the AOF file.
-func formatListForAOF(list []interface{}) string {
-	var parts []string
-	for _, item := range list {
-		parts = append(parts, fmt.Sprintf("%v", item))
-	}
-	return strings.Join(parts, " ")
-}
-
-// SaveSnapshot creates a snapshot of the current state of the database.
-func (r *Tealis) SaveSnapshot() error {
+// writeSnapshot writes a captured snapshot to disk unless a more recent one was written
+// meanwhile. The file is replaced atomically, so a crash while saving leaves the previous
+// snapshot intact, and the snapshot is kept as a new generation as well.
+func (r *Tealis) writeSnapshot(snapshot capturedSnapshot) error {
 	r.snapshotMutex.Lock()
 	defer r.snapshotMutex.Unlock()
 
-	r.Mu.RLock()
-	defer r.Mu.RUnlock()
+	if snapshot.seq < r.writtenSnapshotSeq {
+		return nil
+	}
 
 	// Validate snapshot path
 	if r.snapshotPath == "" {
@@ -300,44 +308,67 @@ func (r *Tealis) SaveSnapshot() error {
 
 	// Ensure the directory for the snapshot exists
 	dir := r.snapshotPath
-
 	if err := os.MkdirAll(dir, 0755); err != nil {
-		_ = fmt.Errorf("failed to create directory for snapshot: %w, path: %s", err, dir)
-	}
-	// Create or open the snapshot file
-	file, err := os.Create(r.snapshotPath + "/text.json")
-	if err != nil {
-		return fmt.Errorf("failed to create snapshot file: %w, file loc: %s", err, r.snapshotPath)
-	}
-	defer file.Close()
-
-	encoder := json.NewEncoder(file)
-	state := map[string]interface{}{
-		"store":    r.Store,
-		"expiries": r.Expiries,
+		return fmt.Errorf("failed to create directory for snapshot: %w, path: %s", err, dir)
 	}
-	if err := encoder.Encode(state); err != nil {
-		return fmt.Errorf("failed to encode snapshot: %w", err)
+	if err := writeFileAtomic(dir, snapshotFile, snapshot.data); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
 	}
-
+	r.writtenSnapshotSeq = snapshot.seq
+	r.keepGeneration(snapshot.data)
 	return nil
 }
 
 // LoadSnapshot loads the state from a snapshot file.
 func (r *Tealis) LoadSnapshot() error {
+	_, _, err := r.loadSnapshot(snapshotFile)
+	return err
+}
+
+// loadSnapshot loads the state from a snapshot file, dump.tdb or a generation, and returns
+// the rewrite the AOF came from and the size it had when the snapshot was taken. A snapshot
+// that fails its checksum or does not decode is rejected as a whole and leaves the data as it
+// was.
+func (r *Tealis) loadSnapshot(name string) (string, int64, error) {
 	r.snapshotMutex.Lock()
 	defer r.snapshotMutex.Unlock()
 
-	file, err := os.Open(r.snapshotPath + "/text.json")
+	data, err := os.ReadFile(r.snapshotPath + "/" + name)
+	if errors.Is(err, os.ErrNotExist) && name == snapshotFile {
+		if _, legacyErr := os.Stat(r.snapshotPath + "/" + legacySnapshotFile); legacyErr == nil {
+			return r.loadLegacySnapshot()
+		}
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to open snapshot file: %w", err)
+	}
+	state, err := decodeSnapshot(data)
 	if err != nil {
-		return fmt.Errorf("failed to open snapshot file: %w", err)
+		return "", 0, fmt.Errorf("failed to load snapshot %s: %w", name, err)
+	}
+
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	if err := r.setKeyspacesLocked(state.dbs); err != nil {
+		return "", 0, fmt.Errorf("failed to load snapshot %s: %w", name, err)
+	}
+	return state.aofBase, state.aofOffset, nil
+}
+
+// loadLegacySnapshot loads a JSON snapshot written by an older version. JSON keeps only
+// strings, hashes and JSON documents intact. The caller must hold snapshotMutex.
+func (r *Tealis) loadLegacySnapshot() (string, int64, error) {
+	log.Printf("Loading the legacy JSON snapshot %s; values other than strings and hashes may not survive", legacySnapshotFile)
+	file, err := os.Open(r.snapshotPath + "/" + legacySnapshotFile)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to open snapshot file: %w", err)
 	}
 	defer file.Close()
 
 	decoder := json.NewDecoder(file)
 	state := map[string]interface{}{}
 	if err := decoder.Decode(&state); err != nil {
-		return fmt.Errorf("failed to decode snapshot: %w", err)
+		return "", 0, fmt.Errorf("failed to decode snapshot: %w", err)
 	}
 
 	r.Mu.Lock()
@@ -346,6 +377,7 @@ func (r *Tealis) LoadSnapshot() error {
 	// Restore state
 	if store, ok := state["store"].(map[string]interface{}); ok {
 		r.Store = store
+		r.scan = &scanIndexes{}
 	}
 	if expiries, ok := state["expiries"].(map[string]interface{}); ok {
 		r.Expiries = make(map[string]time.Time)
@@ -355,29 +387,57 @@ func (r *Tealis) LoadSnapshot() error {
 			}
 		}
 	}
-
-	return nil
+	// Snapshots taken before the AOF offset was recorded have none
+	offset, _ := state["aof_offset"].(float64)
+	base, _ := state["aof_base"].(string)
+	return base, int64(offset), nil
 }
 
-func (r *Tealis) GetClientConnection(clientID string) (interface{}, error) {
-	r.Mu.RLock()
-	defer r.Mu.RUnlock()
-
-	conn, exists := r.ClientConnections[clientID]
-	if !exists {
-		return nil, fmt.Errorf("client %s not found", clientID)
+// HELLO switches a client to the requested protocol version and describes the server.
+func (r *Tealis) HELLO(s *Session, version int) protocol.Reply {
+	if version != protocol.RESP2 && version != protocol.RESP3 {
+		return protocol.Error("NOPROTO unsupported protocol version")
+	}
+	s.mu.Lock()
+	s.protocol = version
+	s.mu.Unlock()
+
+	return protocol.Map{
+		{Key: protocol.BulkString("server"), Value: protocol.BulkString("tealis")},
+		{Key: protocol.BulkString("version"), Value: protocol.BulkString(Version)},
+		{Key: protocol.BulkString("proto"), Value: protocol.Integer(version)},
+		{Key: protocol.BulkString("id"), Value: protocol.Integer(s.ID)},
+		{Key: protocol.BulkString("mode"), Value: protocol.BulkString("standalone")},
+		{Key: protocol.BulkString("role"), Value: protocol.BulkString("master")},
+		{Key: protocol.BulkString("modules"), Value: protocol.Array{}},
 	}
-	return conn, nil
 }
 
-func (r *Tealis) StartSnapshotScheduler(ctx context.Context, interval time.Duration) {
+// saveRetryDelay is how long the scheduler waits before retrying a save that failed.
+const saveRetryDelay = 5 * time.Second
+
+// StartSnapshotScheduler saves a snapshot in the background whenever a save rule matches:
+// at least that many writes happened and that much time passed since the last save. An idle
+// store is never saved, and a busy one is saved by the rules with shorter periods. The rules
+// are read on every tick, so CONFIG SET save takes effect without a restart.
+func (r *Tealis) StartSnapshotScheduler(ctx context.Context) {
 	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
 		for {
 			select {
 			case <-ctx.Done():
 				return
-			case <-time.After(interval):
-				if err := r.SaveSnapshot(); err != nil {
+			case now := <-ticker.C:
+				if r.saving.Load() {
+					continue
+				}
+				rule, ok := r.dueSaveRule(now)
+				if !ok {
+					continue
+				}
+				log.Printf("%d changes in %d seconds. Saving...", rule.Changes, int64(rule.Period/time.Second))
+				if err := r.BackgroundSave(); err != nil && !errors.Is(err, errSaveInProgress) {
 					log.Printf("Error saving snapshot: %v", err)
 				}
 			}
@@ -385,60 +445,19 @@ func (r *Tealis) StartSnapshotScheduler(ctx context.Context, interval time.Durat
 	}()
 }
 
-// APPENDTO appends a command to the transaction queue for the given client.
-func (r *Tealis) APPENDTO(clientID string, command string) string {
-	r.Mu.Lock()
-	defer r.Mu.Unlock()
-
-	// Check if the client has an active transaction
-	if _, ok := r.Transactions[clientID]; !ok {
-		return "- appendto ERR No transaction started\r\n"
-	}
-
-	// Append the command to the client's transaction queue
-	r.Transactions[clientID] = append(r.Transactions[clientID], command)
-
-	// Return a success message
-	return "+QUEUED\r\n"
-}
-
-// TTL returns the time-to-live (TTL) of a key in seconds.
-func (r *Tealis) TTL(key string) int64 {
-	r.Mu.RLock()
-	defer r.Mu.RUnlock()
-
-	// Check if the key exists
-	if _, exists := r.Store[key]; !exists {
-		return -2 // Key does not exist
+// dueSaveRule returns the save rule that asks for a save now, if any.
+func (r *Tealis) dueSaveRule(now time.Time) (config.SaveRule, bool) {
+	r.saveStatsMu.Lock()
+	lastSave, lastSaveOK, lastAttempt := r.lastSave, r.lastSaveOK, r.saveStarted
+	r.saveStatsMu.Unlock()
+	if !lastSaveOK && now.Sub(lastAttempt) < saveRetryDelay {
+		return config.SaveRule{}, false
 	}
-
-	// Check if the key has an expiry
-	if expiry, exists := r.Expiries[key]; exists {
-		remaining := time.Until(expiry).Seconds()
-		if remaining > 0 {
-			return int64(remaining) // Return remaining time in seconds
+	dirty := r.dirty.Load()
+	for _, rule := range r.Config().SaveRules {
+		if dirty >= rule.Changes && now.Sub(lastSave) >= rule.Period {
+			return rule, true
 		}
-		return -2 // Key has expired
-	}
-
-	return -1 // Key exists but has no expiry
-}
-
-// PERSIST removes the expiry from a key, making it persistent.
-func (r *Tealis) PERSIST(key string) int {
-	r.Mu.Lock()
-	defer r.Mu.Unlock()
-
-	// Check if the key exists
-	if _, exists := r.Store[key]; !exists {
-		return 0 // Key does not exist
-	}
-
-	// Check if the key has an expiry
-	if _, exists := r.Expiries[key]; exists {
-		delete(r.Expiries, key) // Remove the expiry
-		return 1                // Expiry removed
 	}
-
-	return 0 // Key exists but has no expiry
+	return config.SaveRule{}, false
 }
@@ -34,12 +34,12 @@ func (r *Tealis) TSCreate(key string, aggregation string) error {
 	defer r.Mu.Unlock()
 
 	// Check if the key already exists
-	if _, exists := r.Store[key]; exists {
+	if r.lookupWriteLocked(key) != nil {
 		return fmt.Errorf("time series %s already exists", key)
 	}
 
 	// Create a new time series with specified aggregation
-	r.Store[key] = NewTimeSeries()
+	r.setLocked(key, NewTimeSeries())
 	ts := r.Store[key].(*TimeSeries)
 	ts.aggregation = aggregation
 	return nil
@@ -51,7 +51,10 @@ func (r *Tealis) TSAdd(key string, timestamp time.Time, value float64) error {
 	defer r.Mu.Unlock()
 
 	// Find the time series for the given key
-	ts, exists := r.Store[key].(*TimeSeries)
+	ts, exists, err := valueOf[*TimeSeries](r.lookupWriteLocked(key))
+	if err != nil {
+		return err
+	}
 	if !exists {
 		return fmt.Errorf("time series %s not found", key)
 	}
@@ -73,7 +76,10 @@ func (r *Tealis) TSRange(key string, start, end time.Time) ([]DataPoint, error)
 	defer r.Mu.RUnlock()
 
 	// Find the time series for the given key
-	ts, exists := r.Store[key].(*TimeSeries)
+	ts, exists, err := valueOf[*TimeSeries](r.lookupLocked(key))
+	if err != nil {
+		return nil, err
+	}
 	if !exists {
 		return nil, fmt.Errorf("time series %s not found", key)
 	}
@@ -97,7 +103,10 @@ func (r *Tealis) TSGet(key string) (DataPoint, error) {
 	defer r.Mu.RUnlock()
 
 	// Find the time series for the given key
-	ts, exists := r.Store[key].(*TimeSeries)
+	ts, exists, err := valueOf[*TimeSeries](r.lookupLocked(key))
+	if err != nil {
+		return DataPoint{}, err
+	}
 	if !exists {
 		return DataPoint{}, fmt.Errorf("time series %s not found", key)
 	}
@@ -119,7 +128,10 @@ func (r *Tealis) DownSample(key string, start, end time.Time, interval time.Dura
 	defer r.Mu.RUnlock()
 
 	// Find the time series for the given key
-	ts, exists := r.Store[key].(*TimeSeries)
+	ts, exists, err := valueOf[*TimeSeries](r.lookupLocked(key))
+	if err != nil {
+		return nil, err
+	}
 	if !exists {
 		return nil, fmt.Errorf("time series %s not found", key)
 	}
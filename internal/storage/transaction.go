@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"tealis/internal/logging"
+	"tealis/internal/protocol"
+)
+
+// watchedKey tracks the version of a key that at least one client is watching. Versions
+// are only kept for watched keys, so unwatched writes cost a map lookup and nothing else.
+type watchedKey struct {
+	version  uint64
+	watchers int
+}
+
+// MULTI starts a transaction for the session.
+func (r *Tealis) MULTI(s *Session) protocol.Reply {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inMulti {
+		return protocol.Error("ERR MULTI calls can not be nested")
+	}
+	s.queue = [][]string{} // Start a new transaction for the client
+	s.inMulti, s.multiError = true, false
+	return protocol.OK
+}
+
+// APPENDTO appends a command to the session's transaction queue.
+func (r *Tealis) APPENDTO(s *Session, parts []string) protocol.Reply {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Check if the client has an active transaction
+	if !s.inMulti {
+		return protocol.Error("ERR No transaction started")
+	}
+
+	// Append the command to the client's transaction queue
+	s.queue = append(s.queue, parts)
+
+	// Return a success message
+	return protocol.SimpleString("QUEUED")
+}
+
+// EXEC runs the commands queued by the session's transaction. The commands run while
+// every other command is held back, so no client observes a partially applied transaction.
+// EXEC fails with EXECABORT if a command was rejected while queueing and replies with a
+// null array if a watched key changed since WATCH.
+func (r *Tealis) EXEC(s *Session) protocol.Reply {
+	s.mu.Lock()
+	// Check if there are queued commands for this client
+	if !s.inMulti {
+		s.mu.Unlock()
+		return protocol.Error("ERR EXEC without MULTI")
+	}
+	commandsToExecute, failed := s.queue, s.multiError
+	s.queue, s.inMulti, s.multiError = nil, false, false
+	s.mu.Unlock()
+	defer r.UNWATCH(s)
+
+	if failed {
+		return protocol.Error("EXECABORT Transaction discarded because of previous errors.")
+	}
+
+	r.execMu.Lock()
+	defer r.execMu.Unlock()
+
+	if r.watchedKeysChanged(s) {
+		return protocol.NullArray{}
+	}
+
+	r.beginAOFTransaction()
+	defer r.endAOFTransaction()
+
+	// This will hold the responses for each command
+	response := make(protocol.Array, 0, len(commandsToExecute))
+	// Process each command
+	for _, parts := range commandsToExecute {
+		// Commands were looked up and checked when they were queued, and run against the database selected when they run, which SELECT may change
+		cmd, _ := LookupCommand(parts[0])
+		reply := r.selected(s).call(cmd, s, parts)
+		response = append(response, reply)
+
+		// Log the command execution
+		logging.Debugf("Executing command in transaction: %q, Response: %q", parts, protocol.EncodeRESP2(reply))
+	}
+
+	return response
+}
+
+// DISCARD discards all the queued commands in the transaction.
+func (r *Tealis) DISCARD(s *Session) protocol.Reply {
+	s.mu.Lock()
+	if !s.inMulti {
+		s.mu.Unlock()
+		return protocol.Error("ERR DISCARD without MULTI")
+	}
+	s.queue, s.inMulti, s.multiError = nil, false, false
+	s.mu.Unlock()
+
+	r.UNWATCH(s)
+	return protocol.OK
+}
+
+// WATCH marks keys of the database to be checked by the session's next EXEC.
+func (r *Tealis) WATCH(s *Session, keys ...string) {
+	r.watchMu.Lock()
+	defer r.watchMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.watching == nil {
+		s.watching = make(map[dbKey]uint64)
+	}
+	for _, name := range keys {
+		key := dbKey{r.db, name}
+		if _, ok := s.watching[key]; ok {
+			continue
+		}
+		wk, ok := r.watchedKeys[key]
+		if !ok {
+			wk = &watchedKey{}
+			r.watchedKeys[key] = wk
+		}
+		wk.watchers++
+		s.watching[key] = wk.version
+	}
+}
+
+// UNWATCH forgets all keys watched by the session.
+func (r *Tealis) UNWATCH(s *Session) {
+	r.watchMu.Lock()
+	defer r.watchMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key := range s.watching {
+		if wk, ok := r.watchedKeys[key]; ok {
+			wk.watchers--
+			if wk.watchers == 0 {
+				delete(r.watchedKeys, key)
+			}
+		}
+	}
+	s.watching = nil
+}
+
+// watchedKeysChanged reports whether any key watched by the session was modified since WATCH.
+func (r *Tealis) watchedKeysChanged(s *Session) bool {
+	r.watchMu.Lock()
+	defer r.watchMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, version := range s.watching {
+		if wk, ok := r.watchedKeys[key]; !ok || wk.version != version {
+			return true
+		}
+	}
+	return false
+}
+
+// touch bumps the version of modified keys of the database so transactions watching them
+// abort.
+func (r *Tealis) touch(keys ...string) {
+	r.watchMu.Lock()
+	defer r.watchMu.Unlock()
+	for _, key := range keys {
+		if wk, ok := r.watchedKeys[dbKey{r.db, key}]; ok {
+			wk.version++
+		}
+	}
+}
+
+// touchAll bumps every watched key, for commands that replace the whole dataset.
+func (r *Tealis) touchAll() {
+	r.watchMu.Lock()
+	defer r.watchMu.Unlock()
+	for _, wk := range r.watchedKeys {
+		wk.version++
+	}
+}
@@ -1,66 +1,63 @@
 package storage
 
 import (
-	"encoding/json"
-	"fmt"
+	"errors"
 	"math"
 	"sort"
-	"strings"
+	"time"
 )
 
-func (r *Tealis) VectorSet(key string, vector []float64) string {
+func (r *Tealis) VectorSet(key string, vector []float64) {
 	r.Mu.Lock()
 	defer r.Mu.Unlock()
-	r.Store[key] = vector
-	if r.enableAOF {
-		r.AppendToAOF(fmt.Sprintf("VECTOR.SET %s %v", key, vector))
-	}
-	return "+OK\r\n"
+	r.setLocked(key, vector)
 }
 
-func (r *Tealis) VectorGet(key string) string {
+func (r *Tealis) VectorGet(key string) ([]float64, error) {
 	r.Mu.RLock()
 	defer r.Mu.RUnlock()
-	if value, exists := r.Store[key]; exists {
+	if value := r.lookupLocked(key); value != nil {
 		if vector, ok := value.([]float64); ok {
-			response, _ := json.Marshal(vector)
-			return fmt.Sprintf("$%d\r\n%s\r\n", len(response), response)
+			return vector, nil
 		}
-		return "-ERR Key is not a vector\r\n"
+		return nil, errors.New("Key is not a vector")
 	}
-	return "-ERR Key not found\r\n"
+	return nil, errors.New("Key not found")
+}
+
+// VectorMatch is a single VECTOR.SEARCH result.
+type VectorMatch struct {
+	Key      string
+	Distance float64
 }
 
-func (r *Tealis) VectorSearch(query []float64, k int) string {
+func (r *Tealis) VectorSearch(query []float64, k int) []VectorMatch {
 	r.Mu.RLock()
 	defer r.Mu.RUnlock()
 
-	type result struct {
-		key      string
-		distance float64
-	}
-
-	results := []result{}
+	results := []VectorMatch{}
 
+	now := time.Now()
 	for key, value := range r.Store {
+		if r.expiredLocked(key, now) {
+			continue
+		}
 		if vector, ok := value.([]float64); ok {
 			dist := CosineSimilarity(query, vector)
-			results = append(results, result{key: key, distance: dist})
+			results = append(results, VectorMatch{Key: key, Distance: dist})
 		}
 	}
 
 	// Sort by distance (smallest first)
 	sort.Slice(results, func(i, j int) bool {
-		return results[i].distance < results[j].distance
+		return results[i].Distance < results[j].Distance
 	})
 
 	// Take the top-k results
-	var response []string
-	for i := 0; i < k && i < len(results); i++ {
-		response = append(response, fmt.Sprintf("%s: %f", results[i].key, results[i].distance))
+	if k < len(results) {
+		results = results[:k]
 	}
-
-	return strings.Join(response, "\r\n") + "\r\n"
+	return results
 }
 
 func CosineSimilarity(a, b []float64) float64 {
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"errors"
 	"math/rand"
 	"sync"
 	"time"
@@ -14,6 +15,7 @@ type SortedSet struct {
 	header  *skipListNode
 	level   int
 	length  int
+	scores  map[string]float64 // score of every member
 	randSrc rand.Source
 }
 
@@ -29,6 +31,7 @@ func NewSortedSet() *SortedSet {
 	return &SortedSet{
 		header:  newSkipListNode("", 0, maxLevel),
 		level:   1,
+		scores:  make(map[string]float64),
 		randSrc: rand.NewSource(time.Now().UnixNano()),
 	}
 }
@@ -54,6 +57,9 @@ func (s *SortedSet) ZAdd(key string, score float64) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	// An existing member is re-inserted so it moves to the position of its new score
+	s.remove(key)
+
 	update := make([]*skipListNode, maxLevel)
 	current := s.header
 
@@ -65,12 +71,6 @@ func (s *SortedSet) ZAdd(key string, score float64) {
 		update[i] = current
 	}
 
-	// Check if the key already exists
-	if current.forward[0] != nil && current.forward[0].key == key {
-		current.forward[0].score = score // Update the score if the key exists
-		return
-	}
-
 	// Insert new node
 	newLevel := s.randomLevel()
 	if newLevel > s.level {
@@ -85,6 +85,7 @@ func (s *SortedSet) ZAdd(key string, score float64) {
 		update[i].forward[i] = node
 	}
 	s.length++
+	s.scores[key] = score
 }
 
 func (s *SortedSet) ZRange(start, end int) []string {
@@ -112,17 +113,13 @@ func (s *SortedSet) ZRank(key string) int {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	current := s.header
+	// Nodes are ordered by score, so the member has to be located by walking the bottom level
 	rank := 0
-
-	for i := s.level - 1; i >= 0; i-- {
-		for current.forward[i] != nil && current.forward[i].key < key {
-			rank++
-			current = current.forward[i]
+	for current := s.header.forward[0]; current != nil; current = current.forward[0] {
+		if current.key == key {
+			return rank
 		}
-	}
-	if current.forward[0] != nil && current.forward[0].key == key {
-		return rank
+		rank++
 	}
 	return -1 // Key not found
 }
@@ -130,11 +127,21 @@ func (s *SortedSet) ZRank(key string) int {
 func (s *SortedSet) ZRem(key string) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	return s.remove(key)
+}
+
+// remove unlinks a member from the skip list. The caller must hold s.mu.
+func (s *SortedSet) remove(key string) bool {
+	// Nodes are ordered by (score, key), so look the score up first
+	score, ok := s.scores[key]
+	if !ok {
+		return false // Key not found
+	}
 
 	update := make([]*skipListNode, maxLevel)
 	current := s.header
 	for i := s.level - 1; i >= 0; i-- {
-		for current.forward[i] != nil && current.forward[i].key < key {
+		for current.forward[i] != nil && (current.forward[i].score < score || (current.forward[i].score == score && current.forward[i].key < key)) {
 			current = current.forward[i]
 		}
 		update[i] = current
@@ -157,9 +164,19 @@ func (s *SortedSet) ZRem(key string) bool {
 		s.level--
 	}
 	s.length--
+	delete(s.scores, key)
 	return true
 }
 
+// ZScore returns the score of a member.
+func (s *SortedSet) ZScore(key string) (float64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	score, ok := s.scores[key]
+	return score, ok
+}
+
 func (s *SortedSet) ZRangeByScore(min, max float64) []string {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -178,75 +195,96 @@ func (s *SortedSet) ZRangeByScore(min, max float64) []string {
 	return result
 }
 
-func (r *Tealis) ZAdd(key string, score float64, member string) int {
+func (r *Tealis) ZAdd(key string, score float64, member string) (int, error) {
 	r.Mu.Lock()
 	defer r.Mu.Unlock()
 
 	// Check if the key exists and is a sorted set
-	if val, exists := r.Store[key]; exists {
+	if val := r.lookupWriteLocked(key); val != nil {
 		if ss, ok := val.(*SortedSet); ok {
 			ss.ZAdd(member, score)
-			return 1
+			r.memberAdded(key, member)
+			return 1, nil
 		}
-		panic("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return 0, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
 	}
 
 	// If key doesn't exist, create a new SortedSet
 	ss := NewSortedSet()
 	ss.ZAdd(member, score)
-	r.Store[key] = ss
-	return 1
+	r.setLocked(key, ss)
+	return 1, nil
 }
 
-func (r *Tealis) ZRange(key string, start, end int) []string {
+// sortedSetLocked returns the sorted set of a key for reading, nil if the key does not
+// exist. The caller must hold Mu.
+func (r *Tealis) sortedSetLocked(key string) (*SortedSet, error) {
+	val := r.lookupLocked(key)
+	if val == nil {
+		return nil, nil
+	}
+	ss, ok := val.(*SortedSet)
+	if !ok {
+		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+	}
+	return ss, nil
+}
+
+func (r *Tealis) ZRange(key string, start, end int) ([]string, error) {
 	r.Mu.RLock()
 	defer r.Mu.RUnlock()
 
-	// Check if the key exists and is a sorted set
-	if val, exists := r.Store[key]; exists {
-		if ss, ok := val.(*SortedSet); ok {
-			return ss.ZRange(start, end)
-		}
-		panic("WRONGTYPE Operation against a key holding the wrong kind of value")
+	ss, err := r.sortedSetLocked(key)
+	if ss == nil {
+		return nil, err // Key does not exist or is not a sorted set
 	}
-	return nil // Key does not exist
+	return ss.ZRange(start, end), nil
 }
 
-func (r *Tealis) ZRank(key string, member string) int {
+func (r *Tealis) ZRank(key string, member string) (int, error) {
 	r.Mu.RLock()
 	defer r.Mu.RUnlock()
 
-	if val, exists := r.Store[key]; exists {
-		if ss, ok := val.(*SortedSet); ok {
-			return ss.ZRank(member)
-		}
-		panic("WRONGTYPE Operation against a key holding the wrong kind of value")
+	ss, err := r.sortedSetLocked(key)
+	if ss == nil {
+		return -1, err
 	}
-	return -1 // Key does not exist
+	return ss.ZRank(member), nil
 }
 
-func (r *Tealis) ZRem(key string, member string) bool {
+func (r *Tealis) ZScore(key string, member string) (float64, bool, error) {
+	r.Mu.RLock()
+	defer r.Mu.RUnlock()
+
+	ss, err := r.sortedSetLocked(key)
+	if ss == nil {
+		return 0, false, err
+	}
+	score, ok := ss.ZScore(member)
+	return score, ok, nil
+}
+
+func (r *Tealis) ZRem(key string, member string) (bool, error) {
 	r.Mu.Lock()
 	defer r.Mu.Unlock()
 
-	if val, exists := r.Store[key]; exists {
+	if val := r.lookupWriteLocked(key); val != nil {
 		if ss, ok := val.(*SortedSet); ok {
-			return ss.ZRem(member)
+			r.memberRemoved(key, member)
+			return ss.ZRem(member), nil
 		}
-		panic("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return false, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
 	}
-	return false // Key does not exist
+	return false, nil // Key does not exist
 }
 
-func (r *Tealis) ZRangeByScore(key string, min, max float64) []string {
+func (r *Tealis) ZRangeByScore(key string, min, max float64) ([]string, error) {
 	r.Mu.RLock()
 	defer r.Mu.RUnlock()
 
-	if val, exists := r.Store[key]; exists {
-		if ss, ok := val.(*SortedSet); ok {
-			return ss.ZRangeByScore(min, max)
-		}
-		panic("WRONGTYPE Operation against a key holding the wrong kind of value")
+	ss, err := r.sortedSetLocked(key)
+	if ss == nil {
+		return nil, err
 	}
-	return nil // Key does not exist
+	return ss.ZRangeByScore(min, max), nil
 }
@@ -2,71 +2,165 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"errors"
+	"flag"
 	"github.com/gorilla/websocket"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"tealis/internal/config"
+	"tealis/internal/logging"
 	"tealis/internal/protocol"
 	"tealis/internal/storage"
 	"time"
 )
 
 func main() {
+	// Settings come from the config file, TEALIS_* environment variables and flags
+	cfg, err := config.FromArgs(os.Args[1:], os.Getenv, os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if cfg.LogFile != "" {
+		logFile, err := os.OpenFile(cfg.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatalf("Failed to open log file: %v", err)
+		}
+		defer logFile.Close()
+		log.SetOutput(logFile)
+	}
+	level, _ := logging.ParseLevel(cfg.LogLevel)
+	logging.SetLevel(level)
+
 	// Create the Redis clone instance
-	aofFilePath := "./snapshot"
-	snapshotPath := "./snapshot"
-	store := storage.NewTealis(aofFilePath, snapshotPath, true)
+	store := storage.NewTealisFromConfig(cfg)
+	if cfg.ACLFile != "" {
+		if err := store.LoadACLFile(cfg.ACLFile); err != nil {
+			log.Fatalf("Error loading ACL file: %v", err)
+		}
+	}
+	// Restore the data from the latest snapshot and the AOF written since
+	if err := store.Load(); err != nil {
+		log.Fatalf("Failed to load data: %v", err)
+	}
 	// Create a context for cancellation
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	// Start background cleanup task for expired keys
 	store.StartCleanup(ctx)
-	store.StartSnapshotScheduler(ctx, 5*60*time.Second)
+	store.StartSnapshotScheduler(ctx)
+	store.StartAOFFsync(ctx)
+	store.StartAOFRewriteScheduler(ctx)
+	var servers []*http.Server
 	// Start WebSocket server on a separate goroutine (e.g., 8080)
-	go func() {
-		http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+	if cfg.WSPort != 0 {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 			websocketHandler(store, w, r)
 		})
-		log.Println("WebSocket server is running on port 8080...")
-		log.Fatal(http.ListenAndServe(":8080", nil))
-	}()
+		servers = append(servers, serveHTTP("WebSocket server", listenAddr(cfg, cfg.WSPort), mux))
+	}
 	// Start HTTP command API server
-	go func() {
-		http.Handle("/command", handleCommand(store))
-		log.Println("HTTP command API server is running on port 8081...")
-		log.Fatal(http.ListenAndServe(":8081", nil))
-	}()
-	// Start HTTP server for the frontend on port 8081
-	go serveFrontend()
-
-	// Set up a listener on port 6379 for the Redis clone
-	listener, err := net.Listen("tcp", ":6379")
-	if err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	if cfg.HTTPPort != 0 {
+		mux := http.NewServeMux()
+		mux.Handle("/command", handleCommand(store))
+		servers = append(servers, serveHTTP("HTTP command API server", listenAddr(cfg, cfg.HTTPPort), mux))
+	}
+	// Start HTTP server for the frontend
+	if cfg.FrontendPort != 0 {
+		servers = append(servers, serveHTTP("Frontend server", listenAddr(cfg, cfg.FrontendPort), frontendHandler(cfg.FrontendDir)))
 	}
-	defer listener.Close()
 
-	// Log that the server is running
-	log.Println("Redis clone is running on port 6379...")
-	log.Println("use `telnet 127.0.0.1 6379` to connect")
+	// Set up a listener for the Redis clone
+	var listener net.Listener
+	if cfg.Port != 0 {
+		addr := listenAddr(cfg, cfg.Port)
+		listener, err = net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+
+		// Log that the server is running
+		log.Printf("Redis clone is running on %s...", addr)
+		log.Printf("use `telnet 127.0.0.1 %d` to connect", cfg.Port)
+
+		// Start accepting connections for Redis clone
+		go acceptConnections(listener, store)
+	}
 
 	// Graceful shutdown setup
 	stopChan := make(chan os.Signal, 1)
 	signal.Notify(stopChan, syscall.SIGINT, syscall.SIGTERM)
 
-	// Start accepting connections for Redis clone
-	go acceptConnections(listener, store)
+	// Block until we receive a shutdown signal or a SHUTDOWN command
+	mode := storage.ShutdownDefault
+	select {
+	case sig := <-stopChan:
+		log.Printf("Received %v, shutting down server...", sig)
+	case mode = <-store.ShutdownRequests():
+		log.Println("SHUTDOWN requested, shutting down server...")
+	}
+	shutdown(store, listener, servers, cancel, mode)
+}
+
+// shutdown stops the server: the listeners stop accepting, in-flight HTTP requests and
+// commands get until shutdown-timeout to finish, then the store saves if asked to, closes
+// the AOF and disconnects every client.
+func shutdown(store *storage.Tealis, listener net.Listener, servers []*http.Server, stopBackground context.CancelFunc, mode int) {
+	ctx, cancel := context.WithTimeout(context.Background(), store.Config().ShutdownTimeout)
+	defer cancel()
 
-	// Block until we receive a shutdown signal
-	<-stopChan
-	log.Println("Shutting down server...")
+	// Periodic snapshots and expiry must not run while the store is closing
+	stopBackground()
+	if listener != nil {
+		listener.Close()
+	}
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Printf("Error shutting down %s: %v", srv.Addr, err)
+			}
+		}(srv)
+	}
+	wg.Wait()
+
+	if err := store.Shutdown(ctx, mode); err != nil {
+		log.Printf("Shutdown finished with errors: %v", err)
+		return
+	}
+	log.Println("Server stopped.")
+}
+
+// listenAddr returns the address a listener binds to for a port.
+func listenAddr(cfg config.Config, port int) string {
+	return net.JoinHostPort(cfg.Bind, strconv.Itoa(port))
+}
+
+// serveHTTP starts one of the HTTP listeners. It stops when the server is shut down.
+func serveHTTP(name, addr string, handler http.Handler) *http.Server {
+	srv := &http.Server{Addr: addr, Handler: handler}
+	go func() {
+		log.Printf("%s is running on %s...", name, addr)
+		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+	return srv
 }
 
 var upgrader = websocket.Upgrader{
@@ -83,17 +177,23 @@ func websocketHandler(store *storage.Tealis, w http.ResponseWriter, r *http.Requ
 		return
 	}
 	defer conn.Close()
+	if store.MaxClientsReached() {
+		conn.WriteMessage(websocket.TextMessage, []byte("-ERR max number of clients reached\r\n"))
+		return
+	}
 
-	// Get the client ID (address of the WebSocket connection)
-	clientID := conn.RemoteAddr().String()
-
-	// Add the WebSocket client to ClientConnections map
-	store.Mu.Lock()
-	store.ClientConnections[clientID] = conn
-	store.Mu.Unlock()
+	// Every message and push for this client goes through its session
+	clientAddr := conn.RemoteAddr().String()
+	session := store.NewSession(storage.TransportWebSocket, clientAddr, wsWriter{conn})
 
 	// Handle incoming WebSocket messages
 	for {
+		// Idle clients are closed after the configured timeout; subscribers wait for messages
+		if timeout := store.Config().Timeout; timeout > 0 && session.SubscriptionCount() == 0 {
+			conn.SetReadDeadline(time.Now().Add(timeout))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
 		// Read message from client
 		_, message, err := conn.ReadMessage()
 		if err != nil {
@@ -103,50 +203,73 @@ func websocketHandler(store *storage.Tealis, w http.ResponseWriter, r *http.Requ
 
 		// Log the received command
 		command := string(message)
-		log.Printf("Received WebSocket command from %s: %s", clientID, command)
+		logging.Debugf("Received WebSocket command from %s: %s", clientAddr, command)
 
 		// Process the command and get the response
 		parts := protocol.ParseCommand(command)
-		response := storage.ProcessCommand(parts, store, clientID)
+		response := storage.ProcessCommand(parts, store, session)
 
-		if err := conn.WriteMessage(websocket.TextMessage, []byte(response)); err != nil {
+		if err := session.WriteReply(response); err != nil {
 			log.Printf("WebSocket write error: %v", err)
 			break
 		}
+		if session.Closing() {
+			break
+		}
 	}
 
 	// Clean up on client disconnect
-	store.Mu.Lock()
-	delete(store.ClientConnections, clientID)
-	store.Mu.Unlock()
+	store.CloseSession(session)
 }
 
-func serveFrontend() {
-	// Create a file server to serve static files from the "public" directory
-	fileServer := http.FileServer(http.Dir("./public"))
+// wsWriter sends every write as a single WebSocket text message.
+type wsWriter struct {
+	conn *websocket.Conn
+}
+
+func (w wsWriter) Write(p []byte) (int, error) {
+	if err := w.conn.WriteMessage(websocket.TextMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w wsWriter) Close() error {
+	return w.conn.Close()
+}
+
+func frontendHandler(dir string) http.Handler {
+	// Create a file server to serve static files from the frontend directory
+	fileServer := http.FileServer(http.Dir(dir))
 
 	// Add logging for incoming requests and serve the files
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("Serving request: %s", r.URL.Path)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logging.Debugf("Serving request: %s", r.URL.Path)
 		fileServer.ServeHTTP(w, r)
 	})
-
-	log.Println("Frontend server is running on port 8000...")
-	log.Fatal(http.ListenAndServe(":8000", nil))
 }
 
 func acceptConnections(listener net.Listener, store *storage.Tealis) {
 	// Continuously accept new client connections
 	for {
 		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return // The server is shutting down
+		}
 		if err != nil {
 			log.Printf("Error accepting connection: %v", err)
 			continue
 		}
 
+		if store.MaxClientsReached() {
+			conn.Write([]byte("-ERR max number of clients reached\r\n"))
+			conn.Close()
+			continue
+		}
+
 		// Log new client connection
 		clientAddr := conn.RemoteAddr().String()
-		log.Printf("New client connected: %s", clientAddr)
+		logging.Verbosef("New client connected: %s", clientAddr)
 
 		// Handle each connection in a separate goroutine
 		go handleConnectionWithRead(conn, store, clientAddr)
@@ -154,89 +277,47 @@ func acceptConnections(listener net.Listener, store *storage.Tealis) {
 }
 
 func handleConnectionWithRead(conn net.Conn, store *storage.Tealis, clientAddr string) {
-	// Create a buffer to read data from the connection
-	buf := make([]byte, 1024) // buffer to hold data from client
-	var input []byte          // the full command input from the client
-
-	clientID := clientAddr // For simplicity, use the client's address as the ID
-	store.Mu.Lock()
-	store.ClientConnections[clientID] = conn
-	store.Mu.Unlock()
+	// Replies and pub/sub messages share the connection, so both are written through the session
+	session := store.NewSession(storage.TransportTCP, clientAddr, conn)
 	defer func() {
-		log.Printf("Client %s disconnected.", clientAddr)
-		store.Mu.Lock()
-		delete(store.ClientConnections, clientID)
-		store.Mu.Unlock()
+		logging.Verbosef("Client %s disconnected.", clientAddr)
+		store.CloseSession(session)
 		conn.Close()
 	}()
 
-	// Display the prompt for the user
-	conn.Write([]byte("> "))
-	for {
-		// Read data from the connection
-		n, err := conn.Read(buf)
-		if err != nil {
-			// Handle EOF or any read error
-			if err.Error() == "EOF" {
-				log.Printf("Client %s closed the connection.", clientAddr)
-				return
-			}
-			log.Printf("Error reading input from client %s: %v", clientAddr, err)
-			continue
-		}
-		// Handle backspace (ASCII value 8)
-		if buf[0] == 8 { // Backspace ASCII value
-			if len(input) > 0 {
-				// Remove the last character from input
-				//input = input[:len(input)-0]
-				//Optionally, send backspace to the client to delete the last character on their screen
-				conn.Write([]byte(" \b \b"))
-
-			}
-		}
-		// Append the read data to the input buffer
-		input = append(input, buf[:n]...)
-
-		// Check if we have reached the end of the command (i.e., newline character)
-		if strings.Contains(string(input), "\n") {
-			// Trim any extra spaces or newline characters from the input
-			line := strings.TrimSpace(string(cleanBytes(input)))
-
-			// Log the received command from the client
-			log.Printf("Received command from %s: %s", clientAddr, line)
-
-			// Parse the command and process it
-			parts := protocol.ParseCommand(line)
-
-			if len(parts) > 0 {
-				// Process the command and get the response
-				response := storage.ProcessCommand(parts, store, clientID)
-
-				// Send the response back to the client
-				conn.Write([]byte(response + "\r\n"))
-				if strings.ToUpper(parts[0]) == "QUIT" {
-					log.Printf("Client %s sent QUIT. Closing connection.", clientAddr)
-					return // Break out of the loop to close the connection
-				}
-			}
-			// Clear the input buffer after processing the command
-			input = nil
-		}
+	err := store.Serve(idleReader{conn, store, session}, session)
+	var netErr net.Error
+	var protoErr *protocol.ProtocolError
+	switch {
+	case err == nil:
+	case errors.Is(err, io.EOF):
+		logging.Verbosef("Client %s closed the connection.", clientAddr)
+	case errors.Is(err, net.ErrClosed):
+		logging.Verbosef("Connection to client %s was closed.", clientAddr)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		logging.Verbosef("Closing idle client %s.", clientAddr)
+	case errors.As(err, &protoErr):
+		log.Printf("Protocol error from client %s: %v", clientAddr, err)
+	default:
+		log.Printf("Error on the connection to client %s: %v", clientAddr, err)
 	}
 }
 
-func cleanBytes(data []byte) []byte {
-	var result []byte
-	for _, b := range data {
-		if b == '\b' { // Check for backspace character
-			if len(result) > 0 {
-				result = result[:len(result)-1] // Remove the last byte if present
-			}
-		} else {
-			result = append(result, b) // Append the current byte
-		}
+// idleReader reads from a client connection, closing idle clients after the configured
+// timeout; subscribers wait for messages however long it takes.
+type idleReader struct {
+	conn    net.Conn
+	store   *storage.Tealis
+	session *storage.Session
+}
+
+func (r idleReader) Read(p []byte) (int, error) {
+	if timeout := r.store.Config().Timeout; timeout > 0 && r.session.SubscriptionCount() == 0 {
+		r.conn.SetReadDeadline(time.Now().Add(timeout))
+	} else {
+		r.conn.SetReadDeadline(time.Time{})
 	}
-	return result
+	return r.conn.Read(p)
 }
 
 // HTTP handler for processing raw Redis commands
@@ -268,13 +349,20 @@ func handleCommand(store *storage.Tealis) http.HandlerFunc {
 			return
 		}
 
-		// Process the command using ProcessCommand
-		clientID := "HTTP_CLIENT" // Use a generic client ID for HTTP requests
-		response := storage.ProcessCommand(parts, store, clientID)
+		// Each request runs in its own short-lived session; HTTP clients cannot receive pushes
+		session := store.NewSession(storage.TransportHTTP, r.RemoteAddr, nil)
+		defer store.CloseSession(session)
+		// Credentials come with every request, as there is no connection to AUTH on
+		if user, pass, ok := r.BasicAuth(); ok && !store.Authenticate(session, user, pass) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="tealis"`)
+			http.Error(w, "invalid username-password pair or user is disabled", http.StatusUnauthorized)
+			return
+		}
+		response := storage.ProcessCommand(parts, store, session)
 
 		// Send the response back to the client
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		w.WriteHeader(http.StatusOK)
-		fmt.Fprintln(w, response)
+		w.Write(protocol.Encode(response, session.ProtocolVersion()))
 	}
 }
@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"tealis/internal/protocol"
+	"tealis/internal/storage"
+	"testing"
+)
+
+func TestACLCommandAndKeyPermissions(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, false)
+	admin := r.NewSession(storage.TransportTCP, "admin", nil)
+	session := r.NewSession(storage.TransportTCP, "reader", nil)
+
+	if reply := storage.ProcessCommand([]string{"ACL", "SETUSER", "reader", "on", ">secret", "~cache:*", "+@read"}, r, admin); reply != protocol.OK {
+		t.Fatalf("Expected ACL SETUSER to succeed, got %v", reply)
+	}
+	if reply := storage.ProcessCommand([]string{"ACL", "SETUSER", "broken", "+nosuchcommand"}, r, admin); !protocol.IsError(reply) {
+		t.Errorf("Expected an error for an unknown command rule, got %v", reply)
+	}
+
+	if reply := storage.ProcessCommand([]string{"AUTH", "reader", "wrong"}, r, session); !strings.HasPrefix(string(reply.(protocol.Error)), "WRONGPASS") {
+		t.Errorf("Expected WRONGPASS for a bad password, got %v", reply)
+	}
+	if reply := storage.ProcessCommand([]string{"AUTH", "reader", "secret"}, r, session); reply != protocol.OK {
+		t.Fatalf("Expected AUTH to succeed, got %v", reply)
+	}
+	if reply := storage.ProcessCommand([]string{"ACL", "WHOAMI"}, r, session); !protocol.IsError(reply) {
+		t.Errorf("Expected ACL to be denied to a read-only user, got %v", reply)
+	}
+
+	if reply := storage.ProcessCommand([]string{"GET", "cache:1"}, r, session); reply != (protocol.Null{}) {
+		t.Errorf("Expected GET on an allowed key to run, got %v", reply)
+	}
+	reply := storage.ProcessCommand([]string{"SET", "cache:1", "v"}, r, session)
+	if e, ok := reply.(protocol.Error); !ok || !strings.Contains(string(e), "'set' command") {
+		t.Errorf("Expected NOPERM for SET, got %v", reply)
+	}
+	reply = storage.ProcessCommand([]string{"GET", "secret:1"}, r, session)
+	if e, ok := reply.(protocol.Error); !ok || !strings.HasPrefix(string(e), "NOPERM No permissions to access a key") {
+		t.Errorf("Expected NOPERM for a key outside ~cache:*, got %v", reply)
+	}
+}
+
+func TestACLChannelPatterns(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, false)
+	admin := r.NewSession(storage.TransportTCP, "admin", nil)
+	session := r.NewSession(storage.TransportTCP, "listener", nil)
+	storage.ProcessCommand([]string{"ACL", "SETUSER", "listener", "on", ">pw", "&news.?", "+@pubsub"}, r, admin)
+	if reply := storage.ProcessCommand([]string{"AUTH", "listener", "pw"}, r, session); reply != protocol.OK {
+		t.Fatalf("Expected AUTH to succeed, got %v", reply)
+	}
+
+	for _, parts := range [][]string{{"SUBSCRIBE", "news.a"}, {"PSUBSCRIBE", "news.?"}} {
+		if reply := storage.ProcessCommand(parts, r, session); protocol.IsError(reply) {
+			t.Errorf("Expected %v to be allowed, got %v", parts, reply)
+		}
+	}
+	// A pattern must be granted as it is, not because it matches a granted one
+	for _, parts := range [][]string{{"SUBSCRIBE", "news.ab"}, {"PSUBSCRIBE", "news.*"}, {"PSUBSCRIBE", "news.a"}} {
+		reply := storage.ProcessCommand(parts, r, session)
+		if e, ok := reply.(protocol.Error); !ok || !strings.HasPrefix(string(e), "NOPERM No permissions to access a channel") {
+			t.Errorf("Expected NOPERM for %v, got %v", parts, reply)
+		}
+	}
+}
+
+func TestACLDangerousCommands(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, true)
+	admin := r.NewSession(storage.TransportTCP, "admin", nil)
+	session := r.NewSession(storage.TransportTCP, "app", nil)
+	run := func(s *storage.Session, parts ...string) protocol.Reply {
+		return storage.ProcessCommand(parts, r, s)
+	}
+	run(admin, "SET", "other", "v")
+	run(admin, "ACL", "SETUSER", "app", "on", "nopass", "~app:*", "+@write", "+@read", "+@keyspace")
+	run(admin, "ACL", "SETUSER", "ops", "on", "nopass", "+@write", "+@dangerous")
+	run(session, "AUTH", "app", "")
+
+	// Key patterns cannot limit commands that drop or replace whole databases, so @write and
+	// @keyspace do not grant them
+	if reply := run(session, "SET", "app:1", "v"); reply != protocol.OK {
+		t.Errorf("Expected SET on an allowed key to run, got %v", reply)
+	}
+	for _, parts := range [][]string{{"FLUSHDB"}, {"FLUSHALL"}, {"SWAPDB", "0", "1"}, {"RESTORE"}} {
+		reply := run(session, parts...)
+		if e, ok := reply.(protocol.Error); !ok || !strings.HasPrefix(string(e), "NOPERM") {
+			t.Errorf("Expected NOPERM for %v, got %v", parts, reply)
+		}
+	}
+	if !r.Exists("other") {
+		t.Fatalf("Expected the keys of other users to survive")
+	}
+
+	// @dangerous grants them, and they are still logged and replayed
+	run(session, "AUTH", "ops", "")
+	if reply := run(session, "FLUSHDB"); reply != protocol.OK {
+		t.Errorf("Expected FLUSHDB to run for a user with @dangerous, got %v", reply)
+	}
+	r.AofFile.Close()
+	r2 := storage.NewTealis(dir, dir, true)
+	if err := r2.Load(); err != nil {
+		t.Fatalf("Expected the AOF to load, got %v", err)
+	}
+	if r2.Exists("other") || r2.Exists("app:1") {
+		t.Errorf("Expected FLUSHDB to be replayed")
+	}
+	r2.AofFile.Close()
+}
+
+func TestACLDefaultUserPassword(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, false)
+	admin := r.NewSession(storage.TransportTCP, "admin", nil)
+	storage.ProcessCommand([]string{"ACL", "SETUSER", "default", "resetpass", ">hunter2"}, r, admin)
+
+	session := r.NewSession(storage.TransportTCP, "client", nil)
+	reply := storage.ProcessCommand([]string{"GET", "k"}, r, session)
+	if e, ok := reply.(protocol.Error); !ok || !strings.HasPrefix(string(e), "NOAUTH") {
+		t.Fatalf("Expected NOAUTH before authenticating, got %v", reply)
+	}
+	if reply := storage.ProcessCommand([]string{"HELLO", "3"}, r, session); !protocol.IsError(reply) {
+		t.Errorf("Expected HELLO without AUTH to be refused, got %v", reply)
+	}
+	if reply := storage.ProcessCommand([]string{"HELLO", "3", "AUTH", "default", "hunter2"}, r, session); protocol.IsError(reply) {
+		t.Fatalf("Expected HELLO AUTH to authenticate, got %v", reply)
+	}
+	if reply := storage.ProcessCommand([]string{"ACL", "WHOAMI"}, r, session); reply != protocol.BulkString("default") {
+		t.Errorf("Expected WHOAMI to be default, got %v", reply)
+	}
+	if reply := storage.ProcessCommand([]string{"ACL", "DELUSER", "default"}, r, session); !protocol.IsError(reply) {
+		t.Errorf("Expected the default user not to be removable, got %v", reply)
+	}
+}
+
+func TestACLSaveAndLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "users.acl")
+	r := storage.NewTealis(dir, dir, false)
+	if err := r.LoadACLFile(path); err != nil {
+		t.Fatalf("Expected a missing ACL file to be ignored, got %v", err)
+	}
+	session := r.NewSession(storage.TransportTCP, "admin", nil)
+
+	storage.ProcessCommand([]string{"ACL", "SETUSER", "alice", "on", ">pw", "~app:*", "&news", "+@all", "-del", "-client|kill"}, r, session)
+	if reply := storage.ProcessCommand([]string{"ACL", "SAVE"}, r, session); reply != protocol.OK {
+		t.Fatalf("Expected ACL SAVE to succeed, got %v", reply)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || !strings.Contains(string(data), "user alice on #") {
+		t.Fatalf("Expected alice in the ACL file, got %q (%v)", data, err)
+	}
+
+	reloaded := storage.NewTealis(dir, dir, false)
+	if err := reloaded.LoadACLFile(path); err != nil {
+		t.Fatalf("Expected the saved ACL file to load, got %v", err)
+	}
+	client := reloaded.NewSession(storage.TransportTCP, "alice", nil)
+	if reply := storage.ProcessCommand([]string{"AUTH", "alice", "pw"}, reloaded, client); reply != protocol.OK {
+		t.Fatalf("Expected alice to authenticate after reload, got %v", reply)
+	}
+	if reply := storage.ProcessCommand([]string{"CLIENT", "KILL", "ID", "1"}, reloaded, client); !protocol.IsError(reply) {
+		t.Errorf("Expected CLIENT KILL to stay denied after reload, got %v", reply)
+	}
+	if reply := storage.ProcessCommand([]string{"CLIENT", "ID"}, reloaded, client); protocol.IsError(reply) {
+		t.Errorf("Expected other CLIENT subcommands to stay allowed, got %v", reply)
+	}
+
+	user := storage.ProcessCommand([]string{"ACL", "GETUSER", "alice"}, reloaded, client)
+	if _, ok := user.(protocol.Map); !ok {
+		t.Fatalf("Expected ACL GETUSER to return a map, got %v", user)
+	}
+}
@@ -1,10 +1,13 @@
 package storage
 
 import (
-	"bufio"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"tealis/internal/config"
+	"tealis/internal/protocol"
 	"tealis/internal/storage"
 	"testing"
 	"time"
@@ -60,30 +63,500 @@ func TestAOF(t *testing.T) {
 	}
 
 	// Append a command to the AOF file
-	command := "SET key value"
-	r.AppendToAOF(command)
+	r.AppendToAOF("SET", "key", "two words")
+	command := "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$9\r\ntwo words\r\n"
 
 	// Open the AOF file and check if the command was written
-	file, err := os.Open(aofFilePath + "/aof.txt")
+	data, err := os.ReadFile(aofFilePath + "/aof.txt")
 	if err != nil {
 		t.Fatalf("Failed to open AOF file: %v", err)
 	}
-	fmt.Printf("this file %v", file)
+	if !strings.HasSuffix(string(data), command) {
+		t.Errorf("Expected command %q at the end of the AOF file, got %q", command, data)
+	}
+}
+
+func TestAOFReplayAfterSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, true)
+	session := r.NewSession(storage.TransportTCP, "aof_client", nil)
+
+	storage.ProcessCommand([]string{"INCR", "counter"}, r, session)
+	storage.ProcessCommand([]string{"RPUSH", "queue", "a", "b"}, r, session)
+	if err := r.SaveSnapshot(); err != nil {
+		t.Fatalf("Failed to save snapshot: %v", err)
+	}
+	storage.ProcessCommand([]string{"INCR", "counter"}, r, session)
+	storage.ProcessCommand([]string{"GET", "counter"}, r, session)
+	storage.ProcessCommand([]string{"SET", "late", "v"}, r, session)
+	r.AofFile.Close()
+
+	r2 := storage.NewTealis(dir, dir, true)
+	if err := r2.Load(); err != nil {
+		t.Fatalf("Expected the data to load, got %v", err)
+	}
+	// Only the commands written after the snapshot are replayed on top of it
+	if v, _, _ := r2.Get("counter"); v != "2" {
+		t.Errorf("Expected counter 2, got %q", v)
+	}
+	if v, _, _ := r2.Get("late"); v != "v" {
+		t.Errorf("Expected the write after the snapshot to be replayed, got %q", v)
+	}
+	// Replaying does not log the commands a second time
+	before, _ := os.ReadFile(dir + "/aof.txt")
+	r3 := storage.NewTealis(dir, dir, true)
+	r3.Load()
+	after, _ := os.ReadFile(dir + "/aof.txt")
+	if len(before) != len(after) {
+		t.Errorf("Expected loading to leave the AOF unchanged, %d bytes became %d", len(before), len(after))
+	}
+}
+
+func TestAOFTruncatedTail(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, true)
+	session := r.NewSession(storage.TransportTCP, "aof_client", nil)
+	storage.ProcessCommand([]string{"SET", "kept", "v"}, r, session)
+	r.AofFile.Close()
+
+	path := dir + "/aof.txt"
+	complete, _ := os.ReadFile(path)
+	if err := os.WriteFile(path, append(complete, "*3\r\n$3\r\nSET\r\n$4\r\nlost"...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Default()
+	cfg.Dir, cfg.AppendDir, cfg.AOFLoadTruncated = dir, dir, false
+	if err := storage.NewTealisFromConfig(cfg).Load(); err == nil {
+		t.Fatalf("Expected a truncated AOF to be refused")
+	}
+
+	cfg.AOFLoadTruncated = true
+	repaired := storage.NewTealisFromConfig(cfg)
+	if err := repaired.Load(); err != nil {
+		t.Fatalf("Expected a truncated AOF to be repaired, got %v", err)
+	}
+	if v, _, _ := repaired.Get("kept"); v != "v" {
+		t.Errorf("Expected the complete commands to be loaded, got %q", v)
+	}
+	if data, _ := os.ReadFile(path); len(data) != len(complete) {
+		t.Errorf("Expected the partial command to be truncated, file has %d bytes instead of %d", len(data), len(complete))
+	}
+}
+
+func TestAOFLogsWritesAsRESP(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, true)
+	session := r.NewSession(storage.TransportTCP, "aof_client", nil)
+
+	storage.ProcessCommand([]string{"SET", "greeting", "hello world"}, r, session)
+	storage.ProcessCommand([]string{"GET", "greeting"}, r, session)
+	storage.ProcessCommand([]string{"INCR", "greeting"}, r, session) // fails, not logged
+	storage.ProcessCommand([]string{"SET", "session", "abc", "EX", "100"}, r, session)
+	storage.ProcessCommand([]string{"MULTI"}, r, session)
+	storage.ProcessCommand([]string{"RPUSH", "queue", "a"}, r, session)
+	storage.ProcessCommand([]string{"LLEN", "queue"}, r, session)
+	storage.ProcessCommand([]string{"EXEC"}, r, session)
+	r.AofFile.Close()
+
+	data, err := os.ReadFile(dir + "/aof.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logged []string
+	for pos := 0; pos < len(data); {
+		parts, size, err := protocol.ParseRequest(data[pos:])
+		if err != nil {
+			t.Fatalf("Expected a valid RESP AOF, got %v at offset %d", err, pos)
+		}
+		logged = append(logged, strings.Join(parts, "|"))
+		pos += size
+	}
+	expiry, _ := r.Expiries["session"]
+	expected := []string{
+		"SET|greeting|hello world",
+		"SET|session|abc",
+		"PEXPIREAT|session|" + strconv.FormatInt(expiry.UnixMilli(), 10),
+		"MULTI",
+		"RPUSH|queue|a",
+		"EXEC",
+	}
+	if strings.Join(logged, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Unexpected AOF entries:\n%s\nexpected:\n%s", strings.Join(logged, "\n"), strings.Join(expected, "\n"))
+	}
+
+	r2 := storage.NewTealis(dir, dir, true)
+	if err := r2.Load(); err != nil {
+		t.Fatalf("Expected the AOF to load, got %v", err)
+	}
+	if v, _, _ := r2.Get("greeting"); v != "hello world" {
+		t.Errorf("Expected arguments to round-trip exactly, got %q", v)
+	}
+	if !r2.Expiries["session"].Equal(time.UnixMilli(expiry.UnixMilli())) {
+		t.Errorf("Expected the absolute expiry to be restored, got %v", r2.Expiries["session"])
+	}
+}
+
+func TestAOFLogsConcurrentWritesInOrder(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, true)
+
+	// Writes from many clients to one key are replayed in the order they ran
+	var wg sync.WaitGroup
+	for c := 0; c < 8; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			session := r.NewSession(storage.TransportTCP, fmt.Sprintf("client_%d", c), nil)
+			for i := 0; i < 200; i++ {
+				storage.ProcessCommand([]string{"APPEND", "log", strconv.Itoa(c)}, r, session)
+				storage.ProcessCommand([]string{"SET", "last", strconv.Itoa(c)}, r, session)
+			}
+		}(c)
+	}
+	wg.Wait()
+	r.AofFile.Close()
+
+	r2 := storage.NewTealis(dir, dir, true)
+	if err := r2.Load(); err != nil {
+		t.Fatalf("Expected the AOF to load, got %v", err)
+	}
+	for _, key := range []string{"log", "last"} {
+		want, _, _ := r.Get(key)
+		if got, _, _ := r2.Get(key); got != want {
+			t.Errorf("Expected %s to replay as %q, got %q", key, want, got)
+		}
+	}
+}
+
+func TestAOFKeepsGeneratedStreamIDs(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, true)
+	session := r.NewSession(storage.TransportTCP, "aof_client", nil)
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		reply := storage.ProcessCommand([]string{"XADD", "events", "*", "n", strconv.Itoa(i)}, r, session)
+		ids = append(ids, string(reply.(protocol.BulkString)))
+	}
+	r.AofFile.Close()
+	time.Sleep(time.Millisecond)
+
+	// Replaying the AOF restores the IDs the entries were given, not new ones
+	r2 := storage.NewTealis(dir, dir, true)
+	if err := r2.Load(); err != nil {
+		t.Fatalf("Expected the AOF to load, got %v", err)
+	}
+	entries, _ := r2.XRange("events", "0", "9999999999999999999-0")
+	if len(entries) != len(ids) {
+		t.Fatalf("Expected %d entries after loading, got %v", len(ids), entries)
+	}
+	for i, entry := range entries {
+		if entry.ID != ids[i] || entry.Fields["n"] != strconv.Itoa(i) {
+			t.Errorf("Expected entry %s with n=%d, got %v", ids[i], i, entry)
+		}
+	}
+}
+
+func TestAOFSkipsWritesThatChangeNothing(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, true)
+	session := r.NewSession(storage.TransportTCP, "aof_client", nil)
+	watcher := r.NewSession(storage.TransportTCP, "watch_client", nil)
+	run := func(s *storage.Session, parts ...string) protocol.Reply {
+		return storage.ProcessCommand(parts, r, s)
+	}
+
+	run(session, "SET", "kept", "v")
+	run(session, "SADD", "set", "a")
+	run(session, "RPUSH", "list", "a")
+	run(session, "LPOP", "list")
+	logged, _ := os.ReadFile(dir + "/aof.txt")
+	run(watcher, "WATCH", "missing", "list", "set", "kept")
+	run(watcher, "MULTI")
+	run(watcher, "SET", "watched", "1")
+
+	// Writes that find nothing to change are neither logged nor counted, and leave WATCHed
+	// keys alone
+	for _, parts := range [][]string{
+		{"DEL", "missing"},
+		{"LPOP", "list"},
+		{"SREM", "set", "absent"},
+		{"PERSIST", "kept"},
+		{"EXPIRE", "missing", "100"},
+		{"SET", "kept", "other", "NX"},
+		{"GETEX", "kept"},
+	} {
+		run(session, parts...)
+	}
+	if data, _ := os.ReadFile(dir + "/aof.txt"); string(data) != string(logged) {
+		t.Errorf("Expected no AOF entries for writes that changed nothing, got %q", data[len(logged):])
+	}
+	info := string(run(session, "INFO", "persistence").(protocol.BulkString))
+	if !strings.Contains(info, "rdb_changes_since_last_save:4\r\n") {
+		t.Errorf("Expected only the four changes to be counted, got %q", info)
+	}
+	if reply, ok := run(watcher, "EXEC").(protocol.Array); !ok || len(reply) != 1 {
+		t.Errorf("Expected the transaction to run, got %v", reply)
+	}
+}
+
+func TestAOFDropsUnfinishedTransaction(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, true)
+	r.AppendToAOF("SET", "before", "1")
+	r.AppendToAOF("MULTI")
+	r.AppendToAOF("SET", "inside", "1")
+	r.AofFile.Close()
+	complete, _ := os.ReadFile(dir + "/aof.txt")
+
+	r2 := storage.NewTealis(dir, dir, true)
+	if err := r2.Load(); err != nil {
+		t.Fatalf("Expected the AOF to be repaired, got %v", err)
+	}
+	if _, ok, _ := r2.Get("inside"); ok {
+		t.Errorf("Expected a transaction without EXEC not to be applied")
+	}
+	if v, _, _ := r2.Get("before"); v != "1" {
+		t.Errorf("Expected the commands before the transaction to be applied, got %q", v)
+	}
+	data, _ := os.ReadFile(dir + "/aof.txt")
+	if !strings.HasSuffix(string(complete), "SET\r\n$6\r\ninside\r\n$1\r\n1\r\n") || strings.Contains(string(data), "MULTI") {
+		t.Errorf("Expected the unfinished transaction to be truncated, got %q", data)
+	}
+}
+
+func TestAOFRewriteRecreatesEveryType(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, true)
+	session := r.NewSession(storage.TransportTCP, "rewrite_client", nil)
+	run := func(parts ...string) protocol.Reply {
+		return storage.ProcessCommand(parts, r, session)
+	}
+
+	writes := [][]string{
+		{"SET", "string", "hello world"},
+		{"SET", "expiring", "soon"},
+		{"EX", "expiring", "100"},
+		{"RPUSH", "list", "a", "b", "c"},
+		{"SADD", "set", "x", "y"},
+		{"HSET", "hash", "field", "value"},
+		{"JSON.SET", "doc", ".", `{"a":{"b":1}}`},
+		{"ZADD", "zset", "1.5", "member"},
+		{"GEOADD", "geo", "13.361389", "38.115556", "Palermo", "15.087269", "37.502669", "Catania"},
+		{"XADD", "stream", "1-0", "field", "value"},
+		{"XGROUP", "CREATE", "stream", "group"},
+		{"XREADGROUP", "stream", "group", "alice", "0"},
+		{"XGROUP", "CREATECONSUMER", "stream", "group", "idle"},
+		{"PFADD", "hll", "a", "b", "c"},
+		{"TS.CREATE", "ts", "avg"},
+		{"TS.ADD", "ts", "100", "1.5"},
+		{"SETBIT", "bitmap", "9", "1"},
+		{"SETBIT", "bitmap", "23", "0"},
+		{"VECTOR.SET", "vector", "0.1", "0.2"},
+	}
+	for _, parts := range writes {
+		if reply := run(parts...); protocol.IsError(reply) {
+			t.Fatalf("%v failed: %v", parts, reply)
+		}
+	}
+	// The snapshot predates the rewrite, so the rewritten AOF must be loaded on its own
+	run("SAVE")
+	run("RPUSH", "list", "d")
+
+	// Writes made while the rewrite runs end up in the new file
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		writer := r.NewSession(storage.TransportTCP, "writer", nil)
+		for i := 0; i < 200; i++ {
+			storage.ProcessCommand([]string{"INCR", "counter"}, r, writer)
+		}
+	}()
+	if err := r.RewriteAOF(); err != nil {
+		t.Fatalf("Expected the rewrite to succeed, got %v", err)
+	}
+	<-done
+	run("RPUSH", "list", "e")
+	r.AofFile.Close()
+	data, _ := os.ReadFile(dir + "/aof.txt")
+	if strings.Contains(string(data), "SETBIT") || strings.Count(string(data), "BITRESTORE") != 1 {
+		t.Errorf("Expected the bitmap to be rewritten as one BITRESTORE, got %q", data)
+	}
+
+	r2 := storage.NewTealis(dir, dir, true)
+	if err := r2.Load(); err != nil {
+		t.Fatalf("Expected the rewritten AOF to load, got %v", err)
+	}
+	loaded := r2.NewSession(storage.TransportTCP, "loaded_client", nil)
+	reads := [][]string{
+		{"GET", "string"},
+		{"GET", "expiring"},
+		{"LRANGE", "list", "0", "10"},
+		{"SISMEMBER", "set", "y"},
+		{"HGET", "hash", "field"},
+		{"JSON.GET", "doc", "."},
+		{"ZSCORE", "zset", "member"},
+		{"GEODIST", "geo", "Palermo", "Catania"},
+		{"XLEN", "stream"},
+		{"XACK", "stream", "group", "1-0"},
+		{"XGROUP", "CREATECONSUMER", "stream", "group", "idle"}, // 0 once it exists
+		{"PFCOUNT", "hll"},
+		{"TS.GET", "ts"},
+		{"GETBIT", "bitmap", "9"},
+		{"BITCOUNT", "bitmap"},
+		{"VECTOR.GET", "vector"},
+		{"GET", "counter"},
+	}
+	for _, parts := range reads {
+		want := protocol.Encode(run(parts...), protocol.RESP2)
+		got := protocol.Encode(storage.ProcessCommand(parts, r2, loaded), protocol.RESP2)
+		if string(got) != string(want) {
+			t.Errorf("%v after the rewrite: expected %q, got %q", parts, want, got)
+		}
+	}
+	if got := protocol.Encode(storage.ProcessCommand([]string{"GET", "counter"}, r2, loaded), protocol.RESP2); string(got) != "$3\r\n200\r\n" {
+		t.Errorf("Expected every write made during the rewrite to be kept, got %q", got)
+	}
+	if ttl := r2.TTL("expiring"); ttl < 98 || ttl > 100 {
+		t.Errorf("Expected the expiry to be kept, got a TTL of %d", ttl)
+	}
+}
 
-	scanner := bufio.NewScanner(file)
-	var found bool
-	for scanner.Scan() {
-		if strings.TrimSpace(scanner.Text()) == command {
-			found = true
+func TestBGRewriteAOF(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, true)
+	session := r.NewSession(storage.TransportTCP, "rewrite_client", nil)
+	for i := 0; i < 50; i++ {
+		storage.ProcessCommand([]string{"SET", "key", strconv.Itoa(i)}, r, session)
+	}
+
+	reply := storage.ProcessCommand([]string{"BGREWRITEAOF"}, r, session)
+	if reply != protocol.SimpleString("Background append only file rewriting started") {
+		t.Fatalf("Expected the rewrite to start, got %v", reply)
+	}
+	var data []byte
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		data, _ = os.ReadFile(dir + "/aof.txt")
+		if strings.HasPrefix(string(data), "*2\r\n$7\r\nAOFBASE\r\n") {
 			break
 		}
 	}
+	if strings.Count(string(data), "SET") != 1 || !strings.Contains(string(data), "$2\r\n49\r\n") {
+		t.Fatalf("Expected the AOF to hold only the last SET, got %q", data)
+	}
+
+	// Writes go to the new file, not to the one it replaced
+	storage.ProcessCommand([]string{"SET", "after", "rewrite"}, r, session)
+	data, _ = os.ReadFile(dir + "/aof.txt")
+	if !strings.Contains(string(data), "after") {
+		t.Errorf("Expected writes after the rewrite in the AOF, got %q", data)
+	}
+}
+
+func TestBGRewriteAOFKeepsWritesMadeMeanwhile(t *testing.T) {
+	for _, preamble := range []string{"no", "yes"} {
+		dir := t.TempDir()
+		r := storage.NewTealis(dir, dir, true)
+		session := r.NewSession(storage.TransportTCP, "rewrite_client", nil)
+		run := func(parts ...string) protocol.Reply {
+			return storage.ProcessCommand(parts, r, session)
+		}
+		run("CONFIG", "SET", "aof-use-snapshot-preamble", preamble)
+		for i := 0; i < 2000; i++ {
+			run("RPUSH", fmt.Sprintf("list:%d", i), "a", "b")
+		}
+
+		// Commands keep running while the rewrite encodes the data; the lists they change
+		// are written as they were when it started, followed by the changes
+		if reply := run("BGREWRITEAOF"); protocol.IsError(reply) {
+			t.Fatalf("Expected the rewrite to start, got %v", reply)
+		}
+		for i := 0; ; i++ {
+			info := string(run("INFO", "persistence").(protocol.BulkString))
+			if i >= 2000 && strings.Contains(info, "aof_rewrite_in_progress:0") {
+				break
+			}
+			if i < 2000 {
+				run("RPUSH", fmt.Sprintf("list:%d", 1999-i), "c")
+				run("DEL", fmt.Sprintf("list:%d", i/2))
+			} else {
+				time.Sleep(time.Millisecond)
+			}
+		}
+
+		r2 := storage.NewTealis(dir, dir, true)
+		if err := r2.Load(); err != nil {
+			t.Fatalf("Expected the rewritten AOF to load, got %v", err)
+		}
+		loaded := r2.NewSession(storage.TransportTCP, "loaded_client", nil)
+		for i := 0; i < 2000; i++ {
+			parts := []string{"LRANGE", fmt.Sprintf("list:%d", i), "0", "-1"}
+			want := fmt.Sprint(run(parts...))
+			if got := fmt.Sprint(storage.ProcessCommand(parts, r2, loaded)); got != want {
+				t.Fatalf("With preamble %s, expected %v to be %s after loading, got %s", preamble, parts, want, got)
+			}
+		}
+		r.AofFile.Close()
+		r2.AofFile.Close()
+	}
+}
+
+func TestAOFSnapshotPreamble(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, true)
+	session := r.NewSession(storage.TransportTCP, "preamble_client", nil)
+	run := func(parts ...string) protocol.Reply {
+		return storage.ProcessCommand(parts, r, session)
+	}
+	if reply := run("CONFIG", "SET", "aof-use-snapshot-preamble", "yes"); reply != protocol.OK {
+		t.Fatalf("Expected the preamble to be enabled, got %v", reply)
+	}
+	run("RPUSH", "list", "a", "b")
+	run("HSET", "hash", "field", "before")
+	run("SET", "expiring", "soon")
+	run("EX", "expiring", "100")
+	run("SAVE")
 
-	if err := scanner.Err(); err != nil {
-		t.Errorf("Error reading AOF file: %v", err)
+	if err := r.RewriteAOF(); err != nil {
+		t.Fatalf("Expected the rewrite to succeed, got %v", err)
 	}
-	defer file.Close()
-	if !found {
-		t.Errorf("Expected command '%s' not found in AOF file", command)
+	run("RPUSH", "list", "c")
+	run("HSET", "hash", "field", "after")
+	data, _ := os.ReadFile(dir + "/aof.txt")
+	if !strings.HasPrefix(string(data), "TEALISDB") || !strings.HasSuffix(string(data), "$5\r\nafter\r\n") {
+		t.Fatalf("Expected a snapshot preamble followed by RESP commands, got %q", data)
 	}
+
+	// The snapshot predates the rewrite: the AOF is loaded alone, preamble then tail
+	load := func() (*storage.Tealis, *storage.Session) {
+		r2 := storage.NewTealis(dir, dir, true)
+		if err := r2.Load(); err != nil {
+			t.Fatalf("Expected the AOF to load, got %v", err)
+		}
+		return r2, r2.NewSession(storage.TransportTCP, "loaded_client", nil)
+	}
+	check := func(r2 *storage.Tealis, loaded *storage.Session) {
+		t.Helper()
+		for _, parts := range [][]string{{"LRANGE", "list", "0", "-1"}, {"HGET", "hash", "field"}, {"GET", "counter"}} {
+			want := protocol.Encode(run(parts...), protocol.RESP2)
+			got := protocol.Encode(storage.ProcessCommand(parts, r2, loaded), protocol.RESP2)
+			if string(got) != string(want) {
+				t.Errorf("%v after loading: expected %q, got %q", parts, want, got)
+			}
+		}
+		if ttl := r2.TTL("expiring"); ttl < 98 || ttl > 100 {
+			t.Errorf("Expected the expiry to be kept, got a TTL of %d", ttl)
+		}
+	}
+	r2, loaded := load()
+	check(r2, loaded)
+	r2.AofFile.Close()
+
+	// A snapshot taken after the rewrite is loaded with only the commands after it
+	run("SAVE")
+	run("INCR", "counter")
+	r3, loaded := load()
+	check(r3, loaded)
+	r3.AofFile.Close()
 }
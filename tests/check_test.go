@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"tealis/internal/storage"
+	"testing"
+)
+
+func TestInspectSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, false)
+	session := r.NewSession(storage.TransportTCP, "check_client", nil)
+	for _, parts := range [][]string{
+		{"SET", "a", "1"},
+		{"SET", "b", "2"},
+		{"EX", "b", "100"},
+		{"RPUSH", "list", "x", "y"},
+		{"HSET", "hash", "field", "value"},
+	} {
+		storage.ProcessCommand(parts, r, session)
+	}
+	if err := r.SaveSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := os.ReadFile(filepath.Join(dir, "dump.tdb"))
+	info, err := storage.InspectSnapshot(before)
+	if err != nil {
+		t.Fatalf("Expected the snapshot to validate, got %v", err)
+	}
+	types := map[string]string{}
+	for _, key := range info.Keys {
+		types[key.Name] = key.Type
+		if key.Size <= 0 {
+			t.Errorf("Expected %s to take some bytes, got %d", key.Name, key.Size)
+		}
+	}
+	want := map[string]string{"a": "string", "b": "string", "list": "list", "hash": "hash"}
+	if len(types) != len(want) {
+		t.Fatalf("Expected keys %v, got %v", want, types)
+	}
+	for name, typ := range want {
+		if types[name] != typ {
+			t.Errorf("Expected %s to be a %s, got %q", name, typ, types[name])
+		}
+	}
+	if info.Keys[1].Name != "b" || info.Keys[1].Expiry.IsZero() {
+		t.Errorf("Expected b to expire, got %+v", info.Keys[1])
+	}
+
+	// Equal values have equal digests; changed ones do not
+	storage.ProcessCommand([]string{"SET", "a", "changed"}, r, session)
+	r.SaveSnapshot()
+	after, _ := os.ReadFile(filepath.Join(dir, "dump.tdb"))
+	changed, _ := storage.InspectSnapshot(after)
+	for i, key := range changed.Keys {
+		if same := key.Digest == info.Keys[i].Digest; same != (key.Name != "a") {
+			t.Errorf("Unexpected digest comparison for %s: same=%v", key.Name, same)
+		}
+	}
+
+	// A cut-off snapshot is reported at the record it breaks off in
+	cut := len(before) - 12
+	_, err = storage.InspectSnapshot(before[:cut])
+	var corrupt *storage.CorruptError
+	if !errors.As(err, &corrupt) || corrupt.Offset <= 0 || corrupt.Offset > int64(cut) {
+		t.Errorf("Expected a corruption before offset %d, got %v", cut, err)
+	}
+}
+
+func TestCheckAOF(t *testing.T) {
+	valid := "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n" +
+		"*1\r\n$5\r\nMULTI\r\n*3\r\n$3\r\nSET\r\n$1\r\nb\r\n$1\r\n2\r\n*1\r\n$4\r\nEXEC\r\n"
+	info, err := storage.CheckAOF([]byte(valid))
+	if err != nil || info.Truncated() || info.Commands != 2 {
+		t.Fatalf("Expected a valid AOF with two commands, got %+v, %v", info, err)
+	}
+
+	// An unfinished transaction or command at the end can be truncated away
+	partial := valid + "*1\r\n$5\r\nMULTI\r\n*3\r\n$3\r\nSET\r\n$1\r\nc\r\n$1\r\n3\r\n*3\r\n$3\r\nSE"
+	info, err = storage.CheckAOF([]byte(partial))
+	if err != nil || !info.Truncated() || info.ValidSize != int64(len(valid)) {
+		t.Fatalf("Expected the AOF to be valid up to %d, got %+v, %v", len(valid), info, err)
+	}
+
+	corruptAOF := valid + "*2\r\n$7\r\nNOTACMD\r\n$1\r\nx\r\n" + valid
+	_, err = storage.CheckAOF([]byte(corruptAOF))
+	var corrupt *storage.CorruptError
+	if !errors.As(err, &corrupt) || corrupt.Offset != int64(len(valid)) {
+		t.Errorf("Expected a corruption at offset %d, got %v", len(valid), err)
+	}
+}
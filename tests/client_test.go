@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"strings"
+	"tealis/internal/protocol"
+	"tealis/internal/storage"
+	"testing"
+	"time"
+)
+
+// closeRecorder is a client connection that remembers being closed.
+type closeRecorder struct {
+	closed bool
+}
+
+func (c *closeRecorder) Write(p []byte) (int, error) { return len(p), nil }
+func (c *closeRecorder) Close() error                { c.closed = true; return nil }
+
+func TestClientNameAndInfo(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, false)
+	session := r.NewSession(storage.TransportWebSocket, "10.0.0.1:5000", nil)
+
+	if reply := storage.ProcessCommand([]string{"CLIENT", "ID"}, r, session); reply != protocol.Integer(session.ID) {
+		t.Errorf("Expected CLIENT ID %d, got %v", session.ID, reply)
+	}
+	if reply := storage.ProcessCommand([]string{"CLIENT", "GETNAME"}, r, session); reply != (protocol.Null{}) {
+		t.Errorf("Expected no name yet, got %v", reply)
+	}
+	if reply := storage.ProcessCommand([]string{"CLIENT", "SETNAME", "bad name"}, r, session); !protocol.IsError(reply) {
+		t.Errorf("Expected names with spaces to be rejected, got %v", reply)
+	}
+	storage.ProcessCommand([]string{"CLIENT", "SETNAME", "worker-1"}, r, session)
+	if reply := storage.ProcessCommand([]string{"CLIENT", "GETNAME"}, r, session); reply != protocol.BulkString("worker-1") {
+		t.Errorf("Expected name worker-1, got %v", reply)
+	}
+
+	storage.ProcessCommand([]string{"SUBSCRIBE", "news"}, r, session)
+	info := string(storage.ProcessCommand([]string{"CLIENT", "INFO"}, r, session).(protocol.BulkString))
+	for _, field := range []string{"name=worker-1", "transport=ws", "addr=10.0.0.1:5000", "db=0", "sub=1", "cmd=client|info", "flags=P"} {
+		if !strings.Contains(info, field) {
+			t.Errorf("Expected CLIENT INFO to contain %q, got %q", field, info)
+		}
+	}
+}
+
+func TestClientListAndKill(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, false)
+	admin := r.NewSession(storage.TransportTCP, "127.0.0.1:1000", nil)
+	conn := &closeRecorder{}
+	flooder := r.NewSession(storage.TransportTCP, "127.0.0.1:2000", conn)
+	defer r.CloseSession(flooder)
+
+	storage.ProcessCommand([]string{"SET", "k", "v"}, r, flooder)
+	list := string(storage.ProcessCommand([]string{"CLIENT", "LIST"}, r, admin).(protocol.BulkString))
+	if strings.Count(list, "\n") != 2 || !strings.Contains(list, "addr=127.0.0.1:2000") || !strings.Contains(list, "cmd=set") {
+		t.Fatalf("Unexpected CLIENT LIST output: %q", list)
+	}
+
+	if reply := storage.ProcessCommand([]string{"CLIENT", "KILL", "ID", "999999"}, r, admin); reply != protocol.Integer(0) {
+		t.Errorf("Expected no client killed for an unknown ID, got %v", reply)
+	}
+	if reply := storage.ProcessCommand([]string{"CLIENT", "KILL", "USER", "default"}, r, admin); reply != protocol.Integer(1) {
+		t.Fatalf("Expected one client killed by user (SKIPME yes), got %v", reply)
+	}
+	if !conn.closed || !flooder.Closing() {
+		t.Errorf("Expected the killed client's connection to be closed")
+	}
+	if admin.Closing() {
+		t.Errorf("Expected the caller to be skipped")
+	}
+	if reply := storage.ProcessCommand([]string{"CLIENT", "KILL", "10.9.9.9:1"}, r, admin); !protocol.IsError(reply) {
+		t.Errorf("Expected an error for an unknown address, got %v", reply)
+	}
+}
+
+func TestClientPauseWrites(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, false)
+	session := r.NewSession(storage.TransportTCP, "pause_client", nil)
+
+	storage.ProcessCommand([]string{"CLIENT", "PAUSE", "10000", "WRITE"}, r, session)
+
+	// Reads keep working during a write pause
+	done := make(chan struct{})
+	go func() {
+		storage.ProcessCommand([]string{"GET", "paused"}, r, session)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected reads to run during CLIENT PAUSE WRITE")
+	}
+
+	written := make(chan struct{})
+	go func() {
+		storage.ProcessCommand([]string{"SET", "paused", "v"}, r, session)
+		close(written)
+	}()
+	select {
+	case <-written:
+		t.Fatal("Expected writes to wait during CLIENT PAUSE WRITE")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	storage.ProcessCommand([]string{"CLIENT", "UNPAUSE"}, r, session)
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Fatal("Expected writes to resume after CLIENT UNPAUSE")
+	}
+}
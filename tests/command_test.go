@@ -0,0 +1,253 @@
+package storage
+
+import (
+	"reflect"
+	"strings"
+	"tealis/internal/protocol"
+	"tealis/internal/storage"
+	"testing"
+)
+
+func TestCommandTableFlagsAndKeys(t *testing.T) {
+	set, ok := storage.LookupCommand("set")
+	if !ok {
+		t.Fatal("Expected SET to be registered")
+	}
+	if !set.Has(storage.FlagWrite) || set.Has(storage.FlagReadonly) {
+		t.Errorf("Expected SET to be a write command, got flags %b", set.Flags)
+	}
+	if get, _ := storage.LookupCommand("GET"); !get.Has(storage.FlagReadonly) {
+		t.Errorf("Expected GET to be readonly")
+	}
+	if pub, ok := storage.LookupCommand("pub"); !ok || pub.Name != "publish" {
+		t.Errorf("Expected PUB to resolve to PUBLISH, got %v", pub)
+	}
+
+	bitop, _ := storage.LookupCommand("BITOP")
+	keys := bitop.Keys([]string{"BITOP", "AND", "dest", "a", "b"})
+	if !reflect.DeepEqual(keys, []string{"dest", "a", "b"}) {
+		t.Errorf("Unexpected BITOP keys: %v", keys)
+	}
+}
+
+func TestArityIsCheckedBeforeDispatch(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, false)
+	session := r.NewSession(storage.TransportTCP, "arity_client", nil)
+
+	cases := [][]string{
+		{"GET"},
+		{"GET", "a", "b"},
+		{"PFADD"},
+		{"BITFIELD", "bf", "SET", "u8"},
+		{"SET", "k"},
+	}
+	for _, parts := range cases {
+		if reply := storage.ProcessCommand(parts, r, session); !protocol.IsError(reply) {
+			t.Errorf("Expected an arity error for %v, got %v", parts, reply)
+		}
+	}
+
+	// BITFIELD GET needs no value, SET and INCRBY do
+	if reply := storage.ProcessCommand([]string{"BITFIELD", "bf", "SET", "u8", "0"}, r, session); !protocol.IsError(reply) {
+		t.Errorf("Expected BITFIELD SET without a value to fail, got %v", reply)
+	}
+	if reply := storage.ProcessCommand([]string{"BITFIELD", "bf", "SET", "i8", "0", "7"}, r, session); reply != protocol.OK {
+		t.Errorf("Expected OK from BITFIELD SET, got %v", reply)
+	}
+	if reply := storage.ProcessCommand([]string{"BITFIELD", "bf", "GET", "i8", "0"}, r, session); reply != protocol.Integer(7) {
+		t.Errorf("Expected 7 from BITFIELD GET, got %v", reply)
+	}
+	if reply := storage.ProcessCommand([]string{"PFADD", "hll"}, r, session); protocol.IsError(reply) {
+		t.Errorf("Expected PFADD with only a key to succeed, got %v", reply)
+	}
+}
+
+func TestCommandIntrospection(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, false)
+	session := r.NewSession(storage.TransportTCP, "command_client", nil)
+
+	count, ok := storage.ProcessCommand([]string{"COMMAND", "COUNT"}, r, session).(protocol.Integer)
+	if !ok || count == 0 {
+		t.Fatalf("Expected a positive COMMAND COUNT, got %v", count)
+	}
+	all := storage.ProcessCommand([]string{"COMMAND"}, r, session).(protocol.Array)
+	if len(all) != int(count) {
+		t.Errorf("Expected COMMAND to list %d commands, got %d", count, len(all))
+	}
+
+	info := storage.ProcessCommand([]string{"COMMAND", "INFO", "get", "nosuchcommand"}, r, session).(protocol.Array)
+	if len(info) != 2 {
+		t.Fatalf("Expected two COMMAND INFO entries, got %d", len(info))
+	}
+	get := info[0].(protocol.Array)
+	if get[0] != protocol.BulkString("get") || get[1] != protocol.Integer(2) || get[3] != protocol.Integer(1) {
+		t.Errorf("Unexpected COMMAND INFO entry for GET: %v", get)
+	}
+	if !reflect.DeepEqual(get[2], protocol.Set{protocol.SimpleString("readonly")}) {
+		t.Errorf("Unexpected GET flags: %v", get[2])
+	}
+	if _, ok := info[1].(protocol.NullArray); !ok {
+		t.Errorf("Expected a null entry for an unknown command, got %v", info[1])
+	}
+
+	docs := storage.ProcessCommand([]string{"COMMAND", "DOCS", "zadd"}, r, session).(protocol.Map)
+	if len(docs) != 1 || docs[0].Key != protocol.BulkString("zadd") {
+		t.Fatalf("Unexpected COMMAND DOCS reply: %v", docs)
+	}
+
+	keys := storage.ProcessCommand([]string{"COMMAND", "GETKEYS", "PFMERGE", "dest", "a", "b"}, r, session)
+	if !reflect.DeepEqual(keys, protocol.StringArray([]string{"dest", "a", "b"})) {
+		t.Errorf("Unexpected COMMAND GETKEYS reply: %v", keys)
+	}
+}
+
+func TestInvalidInputRepliesWithErrors(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, false)
+	session := r.NewSession(storage.TransportTCP, "invalid_input_client", nil)
+	run := func(parts ...string) protocol.Reply {
+		return storage.ProcessCommand(parts, r, session)
+	}
+	run("SET", "string", "v")
+	run("GEOADD", "geo", "13.361389", "38.115556", "Palermo")
+	run("SETBIT", "bits", "1", "1")
+
+	// Each of these used to crash the server
+	for _, parts := range [][]string{
+		{"GEOADD", "string", "13.361389", "38.115556", "Palermo"},
+		{"GEODIST", "string", "a", "b"},
+		{"GEORADIUS", "string", "15", "37", "200", "km"},
+		{"ZADD", "string", "1", "a"},
+		{"ZRANGE", "string", "0", "-1"},
+		{"ZRANGEBYSCORE", "string", "0", "1"},
+		{"ZSCORE", "string", "a"},
+		{"ZRANK", "string", "a"},
+		{"ZREM", "string", "a"},
+		{"LLEN", "string"},
+		{"BITOP", "AND", "dest", "bits", "string"},
+	} {
+		reply := run(parts...)
+		if err, ok := reply.(protocol.Error); !ok || !strings.HasPrefix(string(err), "WRONGTYPE") {
+			t.Errorf("Expected %v to fail with WRONGTYPE, got %v", parts, reply)
+		}
+	}
+
+	for _, c := range []struct {
+		parts []string
+		err   string
+	}{
+		{[]string{"SETRANGE", "string", "-1", "x"}, "ERR offset is out of range"},
+		{[]string{"BITFIELD", "bits", "SET", "i8", "-16", "1"}, "ERR bit offset is not an integer or out of range"},
+		{[]string{"BITFIELD", "bits", "INCRBY", "i8", "-1", "1"}, "ERR bit offset is not an integer or out of range"},
+		{[]string{"BITFIELD", "bits", "GET", "u16", "-8"}, "ERR bit offset is not an integer or out of range"},
+		{[]string{"BITFIELD", "bits", "SET", "i8", "4294967296", "1"}, "ERR bit offset is not an integer or out of range"},
+	} {
+		if reply := run(c.parts...); reply != protocol.Error(c.err) {
+			t.Errorf("Expected %v to fail with %q, got %v", c.parts, c.err, reply)
+		}
+	}
+	if reply := run("GET", "string"); reply != protocol.BulkString("v") {
+		t.Errorf("Expected a rejected SETRANGE to leave the value, got %v", reply)
+	}
+	if reply := run("BITCOUNT", "bits"); reply != protocol.Integer(1) {
+		t.Errorf("Expected rejected BITFIELD writes to leave the bitmap, got %v", reply)
+	}
+
+	if reply := run("GEODIST", "geo", "Palermo", "Nowhere"); reply != (protocol.Null{}) {
+		t.Errorf("Expected GEODIST of a missing member to be nil, got %v", reply)
+	}
+	if reply := run("GEODIST", "missing", "a", "b"); reply != (protocol.Null{}) {
+		t.Errorf("Expected GEODIST of a missing key to be nil, got %v", reply)
+	}
+
+	// Missing source keys count as empty strings, and sources are left as they were
+	if reply := run("BITOP", "OR", "dest", "missing", "bits"); reply != protocol.Integer(1) {
+		t.Errorf("Expected BITOP with a missing source to succeed, got %v", reply)
+	}
+	if reply := run("BITOP", "AND", "dest", "bits", "missing"); reply != protocol.Integer(1) {
+		t.Errorf("Expected BITOP AND with a missing source to succeed, got %v", reply)
+	}
+	if reply := run("GETBIT", "bits", "1"); reply != protocol.Integer(1) {
+		t.Errorf("Expected BITOP not to change its sources, got %v", reply)
+	}
+	if reply := run("BITOP", "AND", "dest", "missing"); reply != protocol.Integer(0) || r.Exists("dest") {
+		t.Errorf("Expected BITOP of only missing sources to delete the destination, got %v", reply)
+	}
+}
+
+func TestWrongTypeRepliesForEveryFamily(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, false)
+	session := r.NewSession(storage.TransportTCP, "wrongtype_client", nil)
+	run := func(parts ...string) protocol.Reply {
+		return storage.ProcessCommand(parts, r, session)
+	}
+	run("SET", "string", "v")
+	run("RPUSH", "list", "a")
+	run("SADD", "set", "a")
+	run("HSET", "hash", "f", "v")
+
+	for _, parts := range [][]string{
+		// Strings
+		{"GET", "list"},
+		{"STRLEN", "list"},
+		{"APPEND", "list", "x"},
+		{"INCR", "list"},
+		{"INCRBY", "list", "2"},
+		{"GETRANGE", "list", "0", "-1"},
+		{"SETRANGE", "list", "0", "x"},
+		// Lists
+		{"LPUSH", "string", "a"},
+		{"RPUSH", "set", "a"},
+		{"LPOP", "string"},
+		{"RPOP", "hash"},
+		{"LRANGE", "set", "0", "-1"},
+		// Sets
+		{"SADD", "string", "a"},
+		{"SREM", "hash", "a"},
+		{"SISMEMBER", "list", "a"},
+		{"SMEMBERS", "hash"},
+		// Hashes
+		{"HSET", "string", "f", "v"},
+		{"HMSET", "list", "f", "v"},
+		{"HGET", "set", "f"},
+		{"HGETALL", "list"},
+		{"HDEL", "set", "f"},
+		{"HEXISTS", "list", "f"},
+		// Streams
+		{"XADD", "hash", "*", "f", "v"},
+		{"XLEN", "hash"},
+		{"XRANGE", "hash", "0", "9"},
+		{"XREAD", "hash", "0"},
+		{"XGROUP", "CREATE", "hash", "group"},
+		{"XREADGROUP", "hash", "group", "consumer", "0"},
+		{"XACK", "hash", "group", "1-0"},
+		{"XCLAIM", "hash", "group", "consumer", "0", "1-0"},
+		// Bitmaps
+		{"SETBIT", "hash", "1", "1"},
+		{"GETBIT", "hash", "1"},
+		{"BITCOUNT", "list"},
+		{"BITFIELD", "list", "GET", "i8", "0"},
+		{"BITFIELD", "list", "SET", "i8", "0", "1"},
+		// JSON documents and time series
+		{"JSON.GET", "list", "."},
+		{"JSON.SET", "set", ".", `{"a":1}`},
+		{"TS.ADD", "list", "1", "1"},
+		{"TS.GET", "set"},
+	} {
+		reply := run(parts...)
+		if err, ok := reply.(protocol.Error); !ok || !strings.HasPrefix(string(err), "WRONGTYPE") {
+			t.Errorf("Expected %v to fail with WRONGTYPE, got %v", parts, reply)
+		}
+	}
+
+	// Failed writes leave the key as it was
+	if reply := run("LRANGE", "list", "0", "-1"); !reflect.DeepEqual(reply, protocol.StringArray([]string{"a"})) {
+		t.Errorf("Expected the list to be unchanged, got %v", reply)
+	}
+	if reply := run("GET", "string"); reply != protocol.BulkString("v") {
+		t.Errorf("Expected the string to be unchanged, got %v", reply)
+	}
+}
@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"tealis/internal/config"
+	"tealis/internal/protocol"
+	"tealis/internal/storage"
+	"testing"
+)
+
+func TestConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tealis.conf")
+	content := "# instance b\nport 6380\nws-port 9080\ndir \"/var/lib/tealis b\"\nappendonly no\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{"TEALIS_WS_PORT": "9180", "TEALIS_MAXCLIENTS": "50"}
+	getenv := func(name string) string { return env[name] }
+
+	cfg, err := config.FromArgs([]string{"-maxclients", "20", path}, getenv, io.Discard)
+	if err != nil {
+		t.Fatalf("Expected the config to load, got %v", err)
+	}
+	if cfg.Port != 6380 || cfg.Dir != "/var/lib/tealis b" || cfg.AppendOnly {
+		t.Errorf("Expected settings from the file, got port=%d dir=%q appendonly=%v", cfg.Port, cfg.Dir, cfg.AppendOnly)
+	}
+	if cfg.WSPort != 9180 {
+		t.Errorf("Expected the environment to override the file, got ws-port=%d", cfg.WSPort)
+	}
+	if cfg.MaxClients != 20 {
+		t.Errorf("Expected flags to override the environment, got maxclients=%d", cfg.MaxClients)
+	}
+	if save, _ := cfg.Get("save"); cfg.HTTPPort != 8081 || save != "3600 1 300 100 60 10000" {
+		t.Errorf("Expected defaults for unset settings, got http-port=%d save=%q", cfg.HTTPPort, save)
+	}
+
+	if _, err := config.FromArgs([]string{"-port", "http"}, getenv, io.Discard); err == nil {
+		t.Errorf("Expected an invalid port to be rejected")
+	}
+}
+
+func TestConfigRewriteKeepsComments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tealis.conf")
+	if err := os.WriteFile(path, []byte("# main instance\nport 6380\nport 6381\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Set("timeout", "30")
+	cfg.Set("port", "6390")
+	if err := cfg.Rewrite(); err != nil {
+		t.Fatalf("Expected the rewrite to succeed, got %v", err)
+	}
+	data, _ := os.ReadFile(path)
+	if string(data) != "# main instance\nport 6390\ntimeout 30\n" {
+		t.Errorf("Unexpected rewritten config: %q", data)
+	}
+}
+
+func TestConfigSaveLinesAddUp(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tealis.conf")
+	if err := os.WriteFile(path, []byte("save 900 1\nsave 300 10\nport 6380\nsave 60 10000\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if save, _ := cfg.Get("save"); save != "900 1 300 10 60 10000" {
+		t.Errorf("Expected every save line to add a rule, got %q", save)
+	}
+	if err := cfg.Rewrite(); err != nil {
+		t.Fatalf("Expected the rewrite to succeed, got %v", err)
+	}
+	data, _ := os.ReadFile(path)
+	if string(data) != "save 900 1\nsave 300 10\nsave 60 10000\nport 6380\n" {
+		t.Errorf("Expected one save line per rule, got %q", data)
+	}
+
+	if err := os.WriteFile(path, []byte("save 900 1\nsave \"\"\nsave 60 10000\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err = config.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if save, _ := cfg.Get("save"); save != "60 10000" {
+		t.Errorf("Expected save \"\" to clear the earlier rules, got %q", save)
+	}
+	cfg.Set("save", "")
+	if err := cfg.Rewrite(); err != nil {
+		t.Fatalf("Expected the rewrite to succeed, got %v", err)
+	}
+	data, _ = os.ReadFile(path)
+	if string(data) != "save \"\"\n" {
+		t.Errorf("Expected disabled save rules to be written as save \"\", got %q", data)
+	}
+}
+
+func TestConfigGetSet(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, false)
+	session := r.NewSession(storage.TransportTCP, "config_client", nil)
+
+	reply := storage.ProcessCommand([]string{"CONFIG", "GET", "*port"}, r, session)
+	entries, ok := reply.(protocol.Map)
+	if !ok || len(entries) != 4 {
+		t.Fatalf("Expected the four port settings, got %v", reply)
+	}
+
+	if reply := storage.ProcessCommand([]string{"CONFIG", "SET", "port", "7000"}, r, session); !protocol.IsError(reply) {
+		t.Errorf("Expected port to be immutable, got %v", reply)
+	}
+	// An invalid pair leaves the valid ones unapplied
+	if reply := storage.ProcessCommand([]string{"CONFIG", "SET", "timeout", "10", "loglevel", "loud"}, r, session); !protocol.IsError(reply) {
+		t.Errorf("Expected an invalid loglevel to be rejected, got %v", reply)
+	}
+	if r.Config().Timeout != 0 {
+		t.Errorf("Expected CONFIG SET to be atomic, timeout is %v", r.Config().Timeout)
+	}
+	if reply := storage.ProcessCommand([]string{"CONFIG", "SET", "timeout", "10", "maxclients", "1"}, r, session); reply != protocol.OK {
+		t.Fatalf("Expected CONFIG SET to succeed, got %v", reply)
+	}
+	reply = storage.ProcessCommand([]string{"CONFIG", "GET", "timeout"}, r, session)
+	if entries, ok := reply.(protocol.Map); !ok || len(entries) != 1 || entries[0].Value != protocol.BulkString("10") {
+		t.Errorf("Expected timeout 10, got %v", reply)
+	}
+	if !r.MaxClientsReached() {
+		t.Errorf("Expected maxclients 1 to be reached by the connected session")
+	}
+
+	reply = storage.ProcessCommand([]string{"CONFIG", "REWRITE"}, r, session)
+	if e, ok := reply.(protocol.Error); !ok || !strings.Contains(string(e), "without a config file") {
+		t.Errorf("Expected CONFIG REWRITE to need a config file, got %v", reply)
+	}
+}
@@ -0,0 +1,217 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"tealis/internal/protocol"
+	"tealis/internal/storage"
+	"testing"
+)
+
+func TestSelectIsolatesDatabases(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, false)
+	first := r.NewSession(storage.TransportTCP, "first", nil)
+	second := r.NewSession(storage.TransportTCP, "second", nil)
+
+	storage.ProcessCommand([]string{"SET", "k", "zero"}, r, first)
+	if reply := storage.ProcessCommand([]string{"SELECT", "1"}, r, second); reply != protocol.OK {
+		t.Fatalf("Expected SELECT 1 to succeed, got %v", reply)
+	}
+	if second.DB() != 1 {
+		t.Errorf("Expected the session to be in database 1, got %d", second.DB())
+	}
+	if reply := storage.ProcessCommand([]string{"GET", "k"}, r, second); reply != (protocol.Null{}) {
+		t.Errorf("Expected database 1 not to see the key of database 0, got %v", reply)
+	}
+	storage.ProcessCommand([]string{"SET", "k", "one"}, r, second)
+	storage.ProcessCommand([]string{"SET", "other", "one"}, r, second)
+	if reply := storage.ProcessCommand([]string{"GET", "k"}, r, first); reply != protocol.BulkString("zero") {
+		t.Errorf("Expected database 0 to keep its own value, got %v", reply)
+	}
+	if reply := storage.ProcessCommand([]string{"DBSIZE"}, r, first); reply != protocol.Integer(1) {
+		t.Errorf("Expected DBSIZE 1 in database 0, got %v", reply)
+	}
+	if reply := storage.ProcessCommand([]string{"DBSIZE"}, r, second); reply != protocol.Integer(2) {
+		t.Errorf("Expected DBSIZE 2 in database 1, got %v", reply)
+	}
+
+	for _, index := range []string{"16", "-1", "x"} {
+		if reply := storage.ProcessCommand([]string{"SELECT", index}, r, first); !protocol.IsError(reply) {
+			t.Errorf("Expected SELECT %s to fail, got %v", index, reply)
+		}
+	}
+	if first.DB() != 0 {
+		t.Errorf("Expected a failed SELECT to keep the database, got %d", first.DB())
+	}
+
+	// A key watched in database 1 is not the key of the same name in database 0
+	storage.ProcessCommand([]string{"WATCH", "k"}, r, second)
+	storage.ProcessCommand([]string{"SET", "k", "changed"}, r, first)
+	storage.ProcessCommand([]string{"MULTI"}, r, second)
+	storage.ProcessCommand([]string{"SET", "k", "from-exec"}, r, second)
+	if reply := storage.ProcessCommand([]string{"EXEC"}, r, second); reply == (protocol.NullArray{}) {
+		t.Errorf("Expected a write to another database not to abort the transaction")
+	}
+
+	// SELECT inside a transaction applies to the commands queued after it
+	storage.ProcessCommand([]string{"MULTI"}, r, first)
+	storage.ProcessCommand([]string{"SELECT", "2"}, r, first)
+	storage.ProcessCommand([]string{"SET", "k", "two"}, r, first)
+	storage.ProcessCommand([]string{"EXEC"}, r, first)
+	if first.DB() != 2 {
+		t.Errorf("Expected SELECT inside EXEC to change the database, got %d", first.DB())
+	}
+	if reply := storage.ProcessCommand([]string{"GET", "k"}, r, first); reply != protocol.BulkString("two") {
+		t.Errorf("Expected the queued SET to write database 2, got %v", reply)
+	}
+}
+
+func TestMoveSwapDBAndFlush(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, false)
+	session := r.NewSession(storage.TransportTCP, "move_client", nil)
+	run := func(parts ...string) protocol.Reply {
+		return storage.ProcessCommand(parts, r, session)
+	}
+
+	run("SET", "k", "v", "EX", "100")
+	run("SET", "taken", "zero")
+	if reply := run("MOVE", "k", "0"); !protocol.IsError(reply) {
+		t.Errorf("Expected MOVE to the same database to fail, got %v", reply)
+	}
+	if reply := run("MOVE", "k", "99"); !protocol.IsError(reply) {
+		t.Errorf("Expected MOVE to a database out of range to fail, got %v", reply)
+	}
+	if reply := run("MOVE", "k", "1"); reply != protocol.Integer(1) {
+		t.Fatalf("Expected MOVE to move the key, got %v", reply)
+	}
+	if reply := run("MOVE", "missing", "1"); reply != protocol.Integer(0) {
+		t.Errorf("Expected MOVE of a missing key to reply 0, got %v", reply)
+	}
+	if r.Exists("k") {
+		t.Errorf("Expected the key to leave database 0")
+	}
+	run("SELECT", "1")
+	if reply := run("GET", "k"); reply != protocol.BulkString("v") {
+		t.Errorf("Expected the key in database 1, got %v", reply)
+	}
+	if reply := run("TTL", "k"); reply != protocol.Integer(100) {
+		t.Errorf("Expected the key to keep its expiry, got %v", reply)
+	}
+	run("SET", "taken", "one")
+	if reply := run("MOVE", "taken", "0"); reply != protocol.Integer(0) {
+		t.Errorf("Expected MOVE onto an existing key to reply 0, got %v", reply)
+	}
+
+	// Database 1 holds k and taken, database 0 only taken
+	if reply := run("SWAPDB", "0", "1"); reply != protocol.OK {
+		t.Fatalf("Expected SWAPDB to succeed, got %v", reply)
+	}
+	if reply := run("GET", "taken"); reply != protocol.BulkString("zero") {
+		t.Errorf("Expected the selected database to show the swapped keys, got %v", reply)
+	}
+	if v, _, _ := r.Get("k"); v != "v" {
+		t.Errorf("Expected database 0 to hold the keys of database 1, got %q", v)
+	}
+	if reply := run("SWAPDB", "0", "16"); !protocol.IsError(reply) {
+		t.Errorf("Expected SWAPDB with a database out of range to fail, got %v", reply)
+	}
+
+	if reply := run("FLUSHDB", "NOW"); !protocol.IsError(reply) {
+		t.Errorf("Expected FLUSHDB with an unknown mode to fail, got %v", reply)
+	}
+	if reply := run("FLUSHDB", "ASYNC"); reply != protocol.OK {
+		t.Fatalf("Expected FLUSHDB ASYNC to succeed, got %v", reply)
+	}
+	if reply := run("DBSIZE"); reply != protocol.Integer(0) {
+		t.Errorf("Expected FLUSHDB to empty the database, got %v", reply)
+	}
+	if !r.Exists("taken") {
+		t.Errorf("Expected FLUSHDB to leave the other databases alone")
+	}
+	run("SET", "again", "1")
+	if reply := run("FLUSHALL"); reply != protocol.OK {
+		t.Fatalf("Expected FLUSHALL to succeed, got %v", reply)
+	}
+	if r.Exists("taken") || run("DBSIZE") != protocol.Integer(0) {
+		t.Errorf("Expected FLUSHALL to empty every database")
+	}
+}
+
+func TestDatabasesPersist(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, true)
+	session := r.NewSession(storage.TransportTCP, "persist_client", nil)
+	run := func(parts ...string) protocol.Reply {
+		return storage.ProcessCommand(parts, r, session)
+	}
+	run("SET", "k", "zero")
+	run("SELECT", "3")
+	run("SET", "k", "three")
+	run("RPUSH", "list", "a", "b")
+	run("MULTI")
+	run("SELECT", "5")
+	run("SET", "k", "five")
+	run("EXEC")
+
+	// get reads a key of a database of a store loaded from the files
+	get := func(loaded *storage.Tealis, db, key string) protocol.Reply {
+		s := loaded.NewSession(storage.TransportTCP, "loaded_client", nil)
+		storage.ProcessCommand([]string{"SELECT", db}, loaded, s)
+		return storage.ProcessCommand([]string{"GET", key}, loaded, s)
+	}
+	check := func(step string, extra bool) {
+		t.Helper()
+		loaded := storage.NewTealis(dir, dir, true)
+		if err := loaded.Load(); err != nil {
+			t.Fatalf("%s: expected the data to load, got %v", step, err)
+		}
+		defer loaded.AofFile.Close()
+		for db, want := range map[string]string{"0": "zero", "3": "three", "5": "five"} {
+			if reply := get(loaded, db, "k"); reply != protocol.BulkString(want) {
+				t.Errorf("%s: expected k of database %s to be %q, got %v", step, db, want, reply)
+			}
+		}
+		if extra {
+			if reply := get(loaded, "5", "late"); reply != protocol.BulkString("v") {
+				t.Errorf("%s: expected the write after the snapshot in database 5, got %v", step, reply)
+			}
+		}
+	}
+	check("AOF", false)
+
+	if err := r.SaveSnapshot(); err != nil {
+		t.Fatalf("Failed to save snapshot: %v", err)
+	}
+	// Replaying the AOF from where the snapshot was taken starts in database 0, not in the
+	// database the AOF selected last
+	run("SET", "late", "v")
+	check("snapshot", true)
+	data, _ := os.ReadFile(filepath.Join(dir, "dump.tdb"))
+	info, err := storage.InspectSnapshot(data)
+	if err != nil {
+		t.Fatalf("Expected the snapshot to validate, got %v", err)
+	}
+	var dbs []int
+	for _, key := range info.Keys {
+		dbs = append(dbs, key.DB)
+	}
+	if fmt.Sprint(dbs) != "[0 3 3 5]" {
+		t.Errorf("Expected the snapshot keys in databases [0 3 3 5], got %v", dbs)
+	}
+
+	if err := r.RewriteAOF(); err != nil {
+		t.Fatalf("Expected the rewrite to succeed, got %v", err)
+	}
+	check("rewrite", true)
+
+	if reply := run("CONFIG", "SET", "aof-use-snapshot-preamble", "yes"); reply != protocol.OK {
+		t.Fatalf("Expected the preamble to be enabled, got %v", reply)
+	}
+	if err := r.RewriteAOF(); err != nil {
+		t.Fatalf("Expected the rewrite to succeed, got %v", err)
+	}
+	check("preamble", true)
+}
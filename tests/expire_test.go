@@ -0,0 +1,336 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"tealis/internal/protocol"
+	"tealis/internal/storage"
+	"testing"
+	"time"
+)
+
+func TestExpireOptions(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, false)
+	session := r.NewSession(storage.TransportTCP, "expire_client", nil)
+	run := func(parts ...string) protocol.Reply {
+		return storage.ProcessCommand(parts, r, session)
+	}
+
+	if reply := run("EXPIRE", "missing", "100"); reply != protocol.Integer(0) {
+		t.Errorf("Expected EXPIRE of a missing key to reply 0, got %v", reply)
+	}
+	if reply := run("EX", "missing", "100"); reply != protocol.Integer(0) || r.TTL("missing") != -2 {
+		t.Errorf("Expected EX not to create an expiry for a missing key, got %v", reply)
+	}
+
+	run("SET", "k", "v")
+	steps := []struct {
+		parts []string
+		reply protocol.Integer
+		ttl   int64
+	}{
+		{[]string{"EXPIRE", "k", "100", "XX"}, 0, -1},
+		{[]string{"EXPIRE", "k", "100", "GT"}, 0, -1},
+		{[]string{"EXPIRE", "k", "100", "NX"}, 1, 100},
+		{[]string{"EXPIRE", "k", "200", "NX"}, 0, 100},
+		{[]string{"EXPIRE", "k", "50", "GT"}, 0, 100},
+		{[]string{"EXPIRE", "k", "200", "GT"}, 1, 200},
+		{[]string{"PEXPIRE", "k", "300000", "LT"}, 0, 200},
+		{[]string{"PEXPIRE", "k", "150000", "XX", "LT"}, 1, 150},
+	}
+	for _, step := range steps {
+		if reply := run(step.parts...); reply != step.reply {
+			t.Errorf("%v: expected %v, got %v", step.parts, step.reply, reply)
+		}
+		if ttl := r.TTL("k"); ttl != step.ttl {
+			t.Errorf("%v: expected a TTL of %d, got %d", step.parts, step.ttl, ttl)
+		}
+	}
+
+	if reply := run("EXPIRE", "k", "100", "NX", "GT"); !protocol.IsError(reply) {
+		t.Errorf("Expected NX and GT to be rejected together, got %v", reply)
+	}
+	if reply := run("EXPIRE", "k", "100", "GT", "LT"); !protocol.IsError(reply) {
+		t.Errorf("Expected GT and LT to be rejected together, got %v", reply)
+	}
+
+	at := time.Now().Add(time.Hour).Unix()
+	run("EXPIREAT", "k", strconv.FormatInt(at, 10))
+	if reply := run("EXPIRETIME", "k"); reply != protocol.Integer(at) {
+		t.Errorf("Expected EXPIRETIME %d, got %v", at, reply)
+	}
+	if reply := run("PEXPIRETIME", "k"); reply != protocol.Integer(at*1000) {
+		t.Errorf("Expected PEXPIRETIME %d, got %v", at*1000, reply)
+	}
+	if ttl := run("PTTL", "k").(protocol.Integer); ttl <= 3590000 || ttl > 3600000 {
+		t.Errorf("Expected a PTTL of about an hour, got %d", ttl)
+	}
+	run("SET", "persistent", "v")
+	if reply := run("EXPIRETIME", "persistent"); reply != protocol.Integer(-1) {
+		t.Errorf("Expected EXPIRETIME -1 without an expiry, got %v", reply)
+	}
+	if reply := run("PEXPIRETIME", "missing"); reply != protocol.Integer(-2) {
+		t.Errorf("Expected PEXPIRETIME -2 for a missing key, got %v", reply)
+	}
+
+	// An expiry in the past deletes the key
+	if reply := run("EXPIRE", "k", "-1"); reply != protocol.Integer(1) || r.Exists("k") {
+		t.Errorf("Expected a past expiry to delete the key, got %v", reply)
+	}
+}
+
+func TestSetOptions(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, false)
+	session := r.NewSession(storage.TransportTCP, "set_client", nil)
+	run := func(parts ...string) protocol.Reply {
+		return storage.ProcessCommand(parts, r, session)
+	}
+
+	if reply := run("SET", "k", "a", "XX"); reply != (protocol.Null{}) || r.Exists("k") {
+		t.Errorf("Expected SET XX of a missing key to do nothing, got %v", reply)
+	}
+	if reply := run("SET", "k", "a", "NX", "PX", "100000"); reply != protocol.OK {
+		t.Errorf("Expected SET NX of a missing key to reply OK, got %v", reply)
+	}
+	if reply := run("SET", "k", "b", "NX"); reply != (protocol.Null{}) {
+		t.Errorf("Expected SET NX of an existing key to do nothing, got %v", reply)
+	}
+	if reply := run("SET", "k", "b", "KEEPTTL", "GET"); reply != protocol.BulkString("a") {
+		t.Errorf("Expected SET GET to return the old value, got %v", reply)
+	}
+	if ttl := r.TTL("k"); ttl != 100 {
+		t.Errorf("Expected KEEPTTL to keep the expiry, got a TTL of %d", ttl)
+	}
+	run("SET", "k", "c")
+	if ttl := r.TTL("k"); ttl != -1 {
+		t.Errorf("Expected a plain SET to clear the expiry, got a TTL of %d", ttl)
+	}
+
+	at := time.Now().Add(time.Hour).Unix()
+	run("SET", "k", "d", "EXAT", strconv.FormatInt(at, 10))
+	if reply := run("EXPIRETIME", "k"); reply != protocol.Integer(at) {
+		t.Errorf("Expected SET EXAT to set the expiry, got %v", reply)
+	}
+
+	for _, parts := range [][]string{
+		{"SET", "k", "v", "EX", "0"},
+		{"SET", "k", "v", "EX", "10", "PX", "10"},
+		{"SET", "k", "v", "EX", "10", "KEEPTTL"},
+		{"SET", "k", "v", "NX", "XX"},
+		{"SET", "k", "v", "EX"},
+		{"SET", "k", "v", "FOO"},
+	} {
+		if reply := run(parts...); !protocol.IsError(reply) {
+			t.Errorf("%v: expected an error, got %v", parts, reply)
+		}
+	}
+
+	run("RPUSH", "list", "a")
+	if reply := run("SET", "list", "v", "GET"); !protocol.IsError(reply) {
+		t.Errorf("Expected SET GET of a list to fail, got %v", reply)
+	}
+	if reply := run("LLEN", "list"); reply != protocol.Integer(1) {
+		t.Errorf("Expected the failed SET GET to leave the list alone, got %v", reply)
+	}
+}
+
+func TestGetEx(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, false)
+	session := r.NewSession(storage.TransportTCP, "getex_client", nil)
+	run := func(parts ...string) protocol.Reply {
+		return storage.ProcessCommand(parts, r, session)
+	}
+
+	if reply := run("GETEX", "missing", "EX", "10"); reply != (protocol.Null{}) {
+		t.Errorf("Expected GETEX of a missing key to reply null, got %v", reply)
+	}
+	run("SET", "k", "v")
+	if reply := run("GETEX", "k", "EX", "100"); reply != protocol.BulkString("v") || r.TTL("k") != 100 {
+		t.Errorf("Expected GETEX EX to return the value and set the expiry, got %v and TTL %d", reply, r.TTL("k"))
+	}
+	if reply := run("GETEX", "k"); reply != protocol.BulkString("v") || r.TTL("k") != 100 {
+		t.Errorf("Expected a plain GETEX to keep the expiry, got %v and TTL %d", reply, r.TTL("k"))
+	}
+	if run("GETEX", "k", "PERSIST"); r.TTL("k") != -1 {
+		t.Errorf("Expected GETEX PERSIST to remove the expiry, got TTL %d", r.TTL("k"))
+	}
+	if reply := run("GETEX", "k", "EX", "-5"); !protocol.IsError(reply) {
+		t.Errorf("Expected a negative GETEX expiry to fail, got %v", reply)
+	}
+	run("RPUSH", "list", "a")
+	if reply := run("GETEX", "list"); !protocol.IsError(reply) {
+		t.Errorf("Expected GETEX of a list to fail, got %v", reply)
+	}
+}
+
+func TestAOFLogsExpiryOutcomes(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, true)
+	session := r.NewSession(storage.TransportTCP, "aof_client", nil)
+	run := func(parts ...string) {
+		storage.ProcessCommand(parts, r, session)
+	}
+
+	run("SET", "a", "1", "EX", "100")
+	run("SET", "a", "2", "KEEPTTL")
+	run("SET", "b", "1")
+	run("PEXPIRE", "b", "200000")
+	run("SET", "c", "1")
+	run("EXPIRE", "c", "-1")
+	run("SET", "d", "1", "NX", "PXAT", "1")
+	run("SET", "e", "1")
+	run("GETEX", "e", "PX", "300000")
+	r.AofFile.Close()
+
+	data, err := os.ReadFile(dir + "/aof.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logged []string
+	for pos := 0; pos < len(data); {
+		parts, size, err := protocol.ParseRequest(data[pos:])
+		if err != nil {
+			t.Fatalf("Expected a valid RESP AOF, got %v at offset %d", err, pos)
+		}
+		logged = append(logged, strings.Join(parts, "|"))
+		pos += size
+	}
+	for _, entry := range []string{"SET|a|2", "DEL|c", "DEL|d"} {
+		if !strings.Contains(strings.Join(logged, "\n"), entry) {
+			t.Errorf("Expected %s to be logged, got:\n%s", entry, strings.Join(logged, "\n"))
+		}
+	}
+
+	r2 := storage.NewTealis(dir, dir, true)
+	if err := r2.Load(); err != nil {
+		t.Fatalf("Expected the AOF to load, got %v", err)
+	}
+	for _, key := range []string{"a", "b", "e"} {
+		if !r2.Expiries[key].Equal(time.UnixMilli(r.Expiries[key].UnixMilli())) {
+			t.Errorf("Expected the expiry of %s to be restored, got %v instead of %v", key, r2.Expiries[key], r.Expiries[key])
+		}
+	}
+	for _, key := range []string{"c", "d"} {
+		if r2.Exists(key) {
+			t.Errorf("Expected %s to stay deleted", key)
+		}
+	}
+	if v, _, _ := r2.Get("a"); v != "2" {
+		t.Errorf("Expected a to be 2, got %q", v)
+	}
+}
+
+func TestAOFReplaysExpiredKeysUntilLoaded(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, true)
+	session := r.NewSession(storage.TransportTCP, "aof_client", nil)
+
+	storage.ProcessCommand([]string{"SET", "k", "v", "PX", "300"}, r, session)
+	storage.ProcessCommand([]string{"APPEND", "k", "x"}, r, session)
+	storage.ProcessCommand([]string{"SET", "other", "v", "PX", "300"}, r, session)
+	storage.ProcessCommand([]string{"PERSIST", "other"}, r, session)
+	r.AofFile.Close()
+	time.Sleep(350 * time.Millisecond)
+
+	// The expiry passed before the restart, but the commands after it ran while the key was
+	// alive: replaying them must not recreate it without its expiry
+	r2 := storage.NewTealis(dir, dir, true)
+	if err := r2.Load(); err != nil {
+		t.Fatalf("Expected the AOF to load, got %v", err)
+	}
+	if v, ok, _ := r2.Get("k"); ok {
+		t.Errorf("Expected k to have expired, got %q", v)
+	}
+	if v, _, _ := r2.Get("other"); v != "v" || r2.TTL("other") != -1 {
+		t.Errorf("Expected the persisted key to survive without an expiry, got %q with a TTL of %d", v, r2.TTL("other"))
+	}
+}
+
+func TestLazyExpiry(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, true)
+	session := r.NewSession(storage.TransportTCP, "lazy_client", nil)
+	run := func(parts ...string) protocol.Reply {
+		return storage.ProcessCommand(parts, r, session)
+	}
+
+	run("SET", "str", "v", "PX", "20")
+	run("RPUSH", "list", "a", "b")
+	run("HSET", "hash", "f", "v")
+	run("ZADD", "zset", "1", "m")
+	run("PEXPIRE", "list", "20")
+	run("PEXPIRE", "hash", "20")
+	run("PEXPIRE", "zset", "20")
+	time.Sleep(40 * time.Millisecond)
+
+	// No active expiry runs: every accessor must hide the expired keys itself
+	if _, ok, _ := r.Get("str"); ok {
+		t.Error("Expected Get to miss an expired key")
+	}
+	if values, _ := r.LRANGE("list", 0, -1); len(values) != 0 {
+		t.Errorf("Expected LRANGE of an expired list to be empty, got %v", values)
+	}
+	if _, ok, _ := r.HGET("hash", "f"); ok {
+		t.Error("Expected HGET to miss an expired hash")
+	}
+	if members, _ := r.ZRange("zset", 0, -1); len(members) != 0 {
+		t.Errorf("Expected ZRANGE of an expired sorted set to be empty, got %v", members)
+	}
+	if r.Exists("list") || len(r.Keys("*")) != 0 {
+		t.Errorf("Expected expired keys not to be listed, got %v", r.Keys("*"))
+	}
+
+	// A write to an expired key starts from nothing, without the old expiry
+	if reply := run("RPUSH", "list", "c"); reply != protocol.Integer(1) {
+		t.Errorf("Expected RPUSH to create a new list, got %v", reply)
+	}
+	if ttl := r.TTL("list"); ttl != -1 {
+		t.Errorf("Expected the new list not to inherit the expiry, got a TTL of %d", ttl)
+	}
+	r.AofFile.Close()
+
+	r2 := storage.NewTealis(dir, dir, true)
+	if err := r2.Load(); err != nil {
+		t.Fatalf("Expected the AOF to load, got %v", err)
+	}
+	if values, _ := r2.LRANGE("list", 0, -1); len(values) != 1 || values[0] != "c" {
+		t.Errorf("Expected the replayed list to hold only c, got %v", values)
+	}
+}
+
+func TestActiveExpiry(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, false)
+	for i := 0; i < 500; i++ {
+		r.Set("expiring"+strconv.Itoa(i), "v", 10*time.Millisecond)
+	}
+	r.Set("kept", "v", time.Hour)
+	r.Set("persistent", "v", 0)
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r.StartCleanup(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.Mu.RLock()
+		left := len(r.Store)
+		r.Mu.RUnlock()
+		if left == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected active expiry to delete the expired keys, %d keys left", left)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !r.Exists("kept") || !r.Exists("persistent") {
+		t.Error("Expected active expiry to keep keys that did not expire")
+	}
+}
@@ -41,7 +41,7 @@ func TestGeoCommands(t *testing.T) {
 		r.GEOAdd("geoKey", 13.361389, 38.115556, "Palermo")
 		r.GEOAdd("geoKey", 15.087269, 37.502669, "Catania")
 
-		dist := r.GEODist("geoKey", "Palermo", "Catania")
+		dist, _, _ := r.GEODist("geoKey", "Palermo", "Catania")
 		expectedDist := 202.9598 // Example distance in km
 		if !closeEnough(dist, expectedDist, 0.0001) {
 			t.Errorf("Expected distance %.4f, got %.4f", expectedDist, dist)
@@ -54,7 +54,7 @@ func TestGeoCommands(t *testing.T) {
 		r.GEOAdd("geoKey", 15.087269, 37.502669, "Catania")
 		r.GEOAdd("geoKey", 40.0, 38.0, "AnotherCity")
 
-		results := r.GEOSearch("geoKey", 13.361389, 38.115556, 300)
+		results, _ := r.GEOSearch("geoKey", 13.361389, 38.115556, 300)
 		expectedResults := []string{"Palermo", "Catania"}
 		sort.Strings(results)
 		sort.Strings(expectedResults)
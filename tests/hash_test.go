@@ -18,19 +18,19 @@ func TestHSET(t *testing.T) {
 	r := storage.NewTealis(aofFilePath, snapshotPath, false)
 
 	// Test adding a new field
-	result := r.HSET("myhash", "field1", "value1")
+	result, _ := r.HSET("myhash", "field1", "value1")
 	if result != 1 {
 		t.Errorf("Expected 1, got %d", result)
 	}
 
 	// Test updating an existing field
-	result = r.HSET("myhash", "field1", "value2")
+	result, _ = r.HSET("myhash", "field1", "value2")
 	if result != 0 {
 		t.Errorf("Expected 0, got %d", result)
 	}
 
 	// Test adding another new field
-	result = r.HSET("myhash", "field2", "value3")
+	result, _ = r.HSET("myhash", "field2", "value3")
 	if result != 1 {
 		t.Errorf("Expected 1, got %d", result)
 	}
@@ -49,13 +49,13 @@ func TestHGET(t *testing.T) {
 	r.HSET("myhash", "field1", "value1")
 
 	// Test retrieving an existing field
-	value, exists := r.HGET("myhash", "field1")
+	value, exists, _ := r.HGET("myhash", "field1")
 	if !exists || value != "value1" {
 		t.Errorf("Expected 'value1', got '%v'", value)
 	}
 
 	// Test retrieving a non-existing field
-	_, exists = r.HGET("myhash", "field2")
+	_, exists, _ = r.HGET("myhash", "field2")
 	if exists {
 		t.Errorf("Expected field to not exist")
 	}
@@ -78,12 +78,12 @@ func TestHMSET(t *testing.T) {
 	})
 
 	// Verify the fields were set
-	value, exists := r.HGET("myhash", "field1")
+	value, exists, _ := r.HGET("myhash", "field1")
 	if !exists || value != "value1" {
 		t.Errorf("Expected 'value1', got '%v'", value)
 	}
 
-	value, exists = r.HGET("myhash", "field2")
+	value, exists, _ = r.HGET("myhash", "field2")
 	if !exists || value != "value2" {
 		t.Errorf("Expected 'value2', got '%v'", value)
 	}
@@ -106,7 +106,7 @@ func TestHGETALL(t *testing.T) {
 	})
 
 	// Retrieve all fields
-	allFields := r.HGETALL("myhash")
+	allFields, _ := r.HGETALL("myhash")
 	expected := map[string]interface{}{
 		"field1": "value1",
 		"field2": "value2",
@@ -139,19 +139,19 @@ func TestHDEL(t *testing.T) {
 	r.HSET("myhash", "field2", "value2")
 
 	// Delete an existing field
-	result := r.HDEL("myhash", "field1")
+	result, _ := r.HDEL("myhash", "field1")
 	if result != 1 {
 		t.Errorf("Expected 1, got %d", result)
 	}
 
 	// Verify the field was deleted
-	_, exists := r.HGET("myhash", "field1")
+	_, exists, _ := r.HGET("myhash", "field1")
 	if exists {
 		t.Errorf("Expected field1 to be deleted")
 	}
 
 	// Attempt to delete a non-existing field
-	result = r.HDEL("myhash", "field3")
+	result, _ = r.HDEL("myhash", "field3")
 	if result != 0 {
 		t.Errorf("Expected 0, got %d", result)
 	}
@@ -171,13 +171,13 @@ func TestHEXISTS(t *testing.T) {
 	r.HSET("myhash", "field1", "value1")
 
 	// Check existence of an existing field
-	exists := r.HEXISTS("myhash", "field1")
+	exists, _ := r.HEXISTS("myhash", "field1")
 	if !exists {
 		t.Errorf("Expected field1 to exist")
 	}
 
 	// Check existence of a non-existing field
-	exists = r.HEXISTS("myhash", "field2")
+	exists, _ = r.HEXISTS("myhash", "field2")
 	if exists {
 		t.Errorf("Expected field2 to not exist")
 	}
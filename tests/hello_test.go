@@ -0,0 +1,41 @@
+package storage
+
+import (
+	"tealis/internal/protocol"
+	"tealis/internal/storage"
+	"testing"
+)
+
+func TestHelloNegotiatesRESP3(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, false)
+	session := r.NewSession(storage.TransportTCP, "resp3_client", nil)
+
+	if v := session.ProtocolVersion(); v != protocol.RESP2 {
+		t.Fatalf("Expected RESP2 by default, got %d", v)
+	}
+
+	reply := storage.ProcessCommand([]string{"HELLO", "3"}, r, session)
+	if _, ok := reply.(protocol.Map); !ok {
+		t.Fatalf("Expected HELLO to reply with a map, got %T", reply)
+	}
+	if v := session.ProtocolVersion(); v != protocol.RESP3 {
+		t.Fatalf("Expected RESP3 after HELLO 3, got %d", v)
+	}
+
+	storage.ProcessCommand([]string{"HSET", "h", "f", "v"}, r, session)
+	hash := storage.ProcessCommand([]string{"HGETALL", "h"}, r, session)
+	if encoded := string(protocol.Encode(hash, session.ProtocolVersion())); encoded != "%1\r\n$1\r\nf\r\n$1\r\nv\r\n" {
+		t.Errorf("Expected a RESP3 map, got %q", encoded)
+	}
+
+	storage.ProcessCommand([]string{"ZADD", "z", "1.5", "m"}, r, session)
+	score := storage.ProcessCommand([]string{"ZSCORE", "z", "m"}, r, session)
+	if encoded := string(protocol.Encode(score, session.ProtocolVersion())); encoded != ",1.5\r\n" {
+		t.Errorf("Expected a RESP3 double, got %q", encoded)
+	}
+
+	if reply := storage.ProcessCommand([]string{"HELLO", "4"}, r, session); !protocol.IsError(reply) {
+		t.Errorf("Expected NOPROTO error for an unsupported version, got %v", reply)
+	}
+}
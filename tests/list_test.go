@@ -20,13 +20,13 @@ func TestRedisCloneListOperations(t *testing.T) {
 	// Test RPUSH
 	t.Run("RPUSH", func(t *testing.T) {
 		// Add items to the list
-		length := r.RPUSH("mylist", "a", "b", "c")
+		length, _ := r.RPUSH("mylist", "a", "b", "c")
 		if length != 3 {
 			t.Errorf("Expected list length 3, but got %d", length)
 		}
 
 		// Verify the list content
-		list := r.LRANGE("mylist", 0, -1)
+		list, _ := r.LRANGE("mylist", 0, -1)
 		expectedList := []string{"a", "b", "c"}
 		if !equal(list, expectedList) {
 			t.Errorf("Expected list %v, but got %v", expectedList, list)
@@ -36,13 +36,13 @@ func TestRedisCloneListOperations(t *testing.T) {
 	// Test LPUSH
 	t.Run("LPUSH", func(t *testing.T) {
 		// Add items to the front of the list
-		length := r.LPUSH("mylist", "x", "y")
+		length, _ := r.LPUSH("mylist", "x", "y")
 		if length != 5 {
 			t.Errorf("Expected list length 5, but got %d", length)
 		}
 
 		// Verify the list content
-		list := r.LRANGE("mylist", 0, -1)
+		list, _ := r.LRANGE("mylist", 0, -1)
 		expectedList := []string{"x", "y", "a", "b", "c"}
 		if !equal(list, expectedList) {
 			t.Errorf("Expected list %v, but got %v", expectedList, list)
@@ -51,7 +51,7 @@ func TestRedisCloneListOperations(t *testing.T) {
 
 	// Test LPOP
 	t.Run("LPOP", func(t *testing.T) {
-		value, exists := r.LPOP("mylist")
+		value, exists, _ := r.LPOP("mylist")
 		if !exists {
 			t.Error("Expected LPOP to return true, but got false")
 		}
@@ -60,7 +60,7 @@ func TestRedisCloneListOperations(t *testing.T) {
 		}
 
 		// Verify the list content after LPOP
-		list := r.LRANGE("mylist", 0, -1)
+		list, _ := r.LRANGE("mylist", 0, -1)
 		expectedList := []string{"y", "a", "b", "c"}
 		if !equal(list, expectedList) {
 			t.Errorf("Expected list %v, but got %v", expectedList, list)
@@ -69,7 +69,7 @@ func TestRedisCloneListOperations(t *testing.T) {
 
 	// Test RPOP
 	t.Run("RPOP", func(t *testing.T) {
-		value, exists := r.RPOP("mylist")
+		value, exists, _ := r.RPOP("mylist")
 		if !exists {
 			t.Error("Expected RPOP to return true, but got false")
 		}
@@ -78,7 +78,7 @@ func TestRedisCloneListOperations(t *testing.T) {
 		}
 
 		// Verify the list content after RPOP
-		list := r.LRANGE("mylist", 0, -1)
+		list, _ := r.LRANGE("mylist", 0, -1)
 		expectedList := []string{"y", "a", "b"}
 		if !equal(list, expectedList) {
 			t.Errorf("Expected list %v, but got %v", expectedList, list)
@@ -88,7 +88,7 @@ func TestRedisCloneListOperations(t *testing.T) {
 	// Test LRANGE
 	t.Run("LRANGE", func(t *testing.T) {
 		// Retrieve a range of elements
-		list := r.LRANGE("mylist", 0, 1)
+		list, _ := r.LRANGE("mylist", 0, 1)
 		expectedList := []string{"y", "a"}
 		if !equal(list, expectedList) {
 			t.Errorf("Expected list %v, but got %v", expectedList, list)
@@ -1,6 +1,8 @@
 package storage
 
 import (
+	"strings"
+	"tealis/internal/protocol"
 	"tealis/internal/storage"
 	"testing"
 )
@@ -13,22 +15,30 @@ func TestMultiExecAndDiscard(t *testing.T) {
 	// Initialize a Tealis instance
 	r := storage.NewTealis(aofFilePath, snapshotPath, false)
 
-	clientID := "test_client"
+	session := r.NewSession(storage.TransportTCP, "test_client", nil)
+	other := r.NewSession(storage.TransportTCP, "other_client", nil)
 	// Begin a transaction
-	r.MULTI(clientID)
+	r.MULTI(session)
 
 	// Queue commands within the transaction
-	r.Transactions[clientID] = append(r.Transactions[clientID], "SET key1 value1")
-	r.Transactions[clientID] = append(r.Transactions[clientID], "SET key2 value2")
-	r.Transactions[clientID] = append(r.Transactions[clientID], "DEL key3")
+	for _, parts := range [][]string{{"SET", "key1", "value1"}, {"SET", "key2", "value2"}, {"DEL", "key3"}} {
+		if reply := storage.ProcessCommand(parts, r, session); reply != protocol.SimpleString("QUEUED") {
+			t.Fatalf("Expected %v to be queued, got %v", parts, reply)
+		}
+	}
+
+	// Another client's commands are not queued by this client's MULTI
+	if reply := storage.ProcessCommand([]string{"SET", "other", "value"}, r, other); reply != protocol.OK {
+		t.Errorf("Expected other client's SET to run immediately, got %v", reply)
+	}
 
 	// Execute the transaction
-	response := r.EXEC(clientID)
+	response := r.EXEC(session)
 
 	// Validate responses from EXEC
-	expectedResponse := "+OK\r\n+OK\r\n:0\r\n" // Expected Redis responses
-	if response != expectedResponse {
-		t.Errorf("EXEC response mismatch. Expected: %q, Got: %q", expectedResponse, response)
+	expectedResponse := "*3\r\n+OK\r\n+OK\r\n:0\r\n" // Expected Redis responses
+	if encoded := string(protocol.EncodeRESP2(response)); encoded != expectedResponse {
+		t.Errorf("EXEC response mismatch. Expected: %q, Got: %q", expectedResponse, encoded)
 	}
 
 	// Ensure commands were applied to the database
@@ -43,14 +53,14 @@ func TestMultiExecAndDiscard(t *testing.T) {
 	}
 
 	// Start another transaction
-	r.MULTI(clientID)
+	r.MULTI(session)
 
 	// Queue commands
-	r.Transactions[clientID] = append(r.Transactions[clientID], "SET key4 value4")
-	r.Transactions[clientID] = append(r.Transactions[clientID], "SET key5 value5")
+	storage.ProcessCommand([]string{"SET", "key4", "value4"}, r, session)
+	storage.ProcessCommand([]string{"SET", "key5", "value5"}, r, session)
 
 	// Discard the transaction
-	r.DISCARD(clientID)
+	r.DISCARD(session)
 
 	// Verify that no commands were executed
 	if _, exists := r.Store["key4"]; exists {
@@ -61,7 +71,87 @@ func TestMultiExecAndDiscard(t *testing.T) {
 	}
 
 	// Ensure no transaction remains for the client
-	if _, exists := r.Transactions[clientID]; exists {
-		t.Errorf("Expected no active transaction for client %s after DISCARD", clientID)
+	if session.InMulti() {
+		t.Errorf("Expected no active transaction for client %d after DISCARD", session.ID)
+	}
+}
+
+func TestExecAbortsAfterQueueErrors(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, false)
+	session := r.NewSession(storage.TransportTCP, "abort_client", nil)
+
+	storage.ProcessCommand([]string{"MULTI"}, r, session)
+	storage.ProcessCommand([]string{"SET", "abort_key", "value"}, r, session)
+	if reply := storage.ProcessCommand([]string{"GET"}, r, session); !protocol.IsError(reply) {
+		t.Fatalf("Expected an arity error while queueing, got %v", reply)
+	}
+	if reply := storage.ProcessCommand([]string{"NOSUCHCOMMAND"}, r, session); !protocol.IsError(reply) {
+		t.Fatalf("Expected an unknown command error while queueing, got %v", reply)
+	}
+
+	reply := storage.ProcessCommand([]string{"EXEC"}, r, session)
+	if err, ok := reply.(protocol.Error); !ok || !strings.HasPrefix(string(err), "EXECABORT") {
+		t.Fatalf("Expected EXECABORT, got %v", reply)
+	}
+	if _, exists := r.Store["abort_key"]; exists {
+		t.Errorf("Expected no queued command to run after EXECABORT")
+	}
+	if session.InMulti() {
+		t.Errorf("Expected the transaction to be over after EXECABORT")
+	}
+}
+
+func TestExecKeepsArgumentsWithSpaces(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, false)
+	session := r.NewSession(storage.TransportTCP, "spaces_client", nil)
+
+	storage.ProcessCommand([]string{"MULTI"}, r, session)
+	storage.ProcessCommand([]string{"SET", "greeting", "hello world"}, r, session)
+	storage.ProcessCommand([]string{"EXEC"}, r, session)
+
+	if v, _ := r.Store["greeting"].(string); v != "hello world" {
+		t.Errorf("Expected 'hello world', got %q", v)
+	}
+}
+
+func TestWatchAbortsOnConcurrentWrite(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, false)
+	session := r.NewSession(storage.TransportTCP, "watch_client", nil)
+	other := r.NewSession(storage.TransportTCP, "writer_client", nil)
+
+	storage.ProcessCommand([]string{"SET", "balance", "10"}, r, session)
+	storage.ProcessCommand([]string{"WATCH", "balance"}, r, session)
+	storage.ProcessCommand([]string{"MULTI"}, r, session)
+	storage.ProcessCommand([]string{"INCRBY", "balance", "5"}, r, session)
+
+	// Another client changes the watched key before EXEC
+	storage.ProcessCommand([]string{"SET", "balance", "100"}, r, other)
+
+	if reply := storage.ProcessCommand([]string{"EXEC"}, r, session); reply != (protocol.NullArray{}) {
+		t.Fatalf("Expected a null array when a watched key changed, got %v", reply)
+	}
+	if v, _ := r.Store["balance"].(string); v != "100" {
+		t.Errorf("Expected the aborted transaction not to run, got balance %q", v)
+	}
+
+	// EXEC unwatches, so the next transaction goes through
+	storage.ProcessCommand([]string{"WATCH", "balance"}, r, session)
+	storage.ProcessCommand([]string{"GET", "balance"}, r, other) // reads do not invalidate
+	storage.ProcessCommand([]string{"MULTI"}, r, session)
+	storage.ProcessCommand([]string{"INCRBY", "balance", "5"}, r, session)
+	reply := storage.ProcessCommand([]string{"EXEC"}, r, session)
+	if encoded := string(protocol.EncodeRESP2(reply)); encoded != "*1\r\n:105\r\n" {
+		t.Errorf("Expected the transaction to run, got %q", encoded)
+	}
+
+	if reply := storage.ProcessCommand([]string{"MULTI"}, r, session); reply != protocol.OK {
+		t.Fatalf("Expected OK from MULTI, got %v", reply)
+	}
+	if reply := storage.ProcessCommand([]string{"WATCH", "balance"}, r, session); !protocol.IsError(reply) {
+		t.Errorf("Expected WATCH inside MULTI to fail, got %v", reply)
 	}
+	storage.ProcessCommand([]string{"DISCARD"}, r, session)
 }
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"errors"
+	"reflect"
+	"tealis/internal/protocol"
+	"testing"
+)
+
+func TestParseRequestMultiBulk(t *testing.T) {
+	// Values may contain spaces, quotes, newlines and arbitrary bytes
+	input := []byte("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$9\r\na \"b\"\r\n\x00c\r\n")
+	args, n, err := protocol.ParseRequest(input)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if n != len(input) {
+		t.Errorf("Expected %d bytes consumed, got %d", len(input), n)
+	}
+	expected := []string{"SET", "key", "a \"b\"\r\n\x00c"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("Expected %q, got %q", expected, args)
+	}
+}
+
+func TestParseRequestIncomplete(t *testing.T) {
+	full := []byte("*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n")
+	for i := 1; i < len(full); i++ {
+		if _, _, err := protocol.ParseRequest(full[:i]); !errors.Is(err, protocol.ErrIncomplete) {
+			t.Fatalf("Expected ErrIncomplete for %q, got %v", full[:i], err)
+		}
+	}
+	if _, _, err := protocol.ParseRequest([]byte("GET key")); !errors.Is(err, protocol.ErrIncomplete) {
+		t.Errorf("Expected ErrIncomplete for an unterminated inline command, got %v", err)
+	}
+}
+
+func TestParseRequestInline(t *testing.T) {
+	args, n, err := protocol.ParseRequest([]byte("SET mykey \"sample value\"\r\nGET mykey\r\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if n != len("SET mykey \"sample value\"\r\n") {
+		t.Errorf("Expected only the first line to be consumed, got %d bytes", n)
+	}
+	expected := []string{"SET", "mykey", "sample value"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("Expected %q, got %q", expected, args)
+	}
+}
+
+func TestParseRequestProtocolError(t *testing.T) {
+	var protoErr *protocol.ProtocolError
+	if _, _, err := protocol.ParseRequest([]byte("*2\r\n+GET\r\n")); !errors.As(err, &protoErr) {
+		t.Errorf("Expected a protocol error, got %v", err)
+	}
+	if _, _, err := protocol.ParseRequest([]byte("*x\r\n")); !errors.As(err, &protoErr) {
+		t.Errorf("Expected a protocol error, got %v", err)
+	}
+}
+
+func TestEncodeRESP2(t *testing.T) {
+	cases := []struct {
+		reply    protocol.Reply
+		expected string
+	}{
+		{protocol.OK, "+OK\r\n"},
+		{protocol.Errorf("syntax error"), "-ERR syntax error\r\n"},
+		{protocol.Integer(-3), ":-3\r\n"},
+		{protocol.BulkString("a\r\nb"), "$4\r\na\r\nb\r\n"},
+		{protocol.Null{}, "$-1\r\n"},
+		{protocol.NullArray{}, "*-1\r\n"},
+		{protocol.Double(1.5), "$3\r\n1.5\r\n"},
+		{protocol.StringArray([]string{"x", "y"}), "*2\r\n$1\r\nx\r\n$1\r\ny\r\n"},
+		{protocol.Map{{Key: protocol.BulkString("f"), Value: protocol.Integer(1)}}, "*2\r\n$1\r\nf\r\n:1\r\n"},
+		{protocol.Push{protocol.BulkString("message")}, "*1\r\n$7\r\nmessage\r\n"},
+	}
+	for _, c := range cases {
+		if encoded := string(protocol.EncodeRESP2(c.reply)); encoded != c.expected {
+			t.Errorf("Expected %q, got %q", c.expected, encoded)
+		}
+	}
+}
+
+func TestEncodeRESP3(t *testing.T) {
+	cases := []struct {
+		reply    protocol.Reply
+		expected string
+	}{
+		{protocol.Null{}, "_\r\n"},
+		{protocol.Double(2.5), ",2.5\r\n"},
+		{protocol.StringSet([]string{"a"}), "~1\r\n$1\r\na\r\n"},
+		{protocol.Map{{Key: protocol.BulkString("f"), Value: protocol.BulkString("v")}}, "%1\r\n$1\r\nf\r\n$1\r\nv\r\n"},
+		{protocol.Push{protocol.BulkString("message")}, ">1\r\n$7\r\nmessage\r\n"},
+		{protocol.Array{protocol.Integer(1), protocol.Double(-1)}, "*2\r\n:1\r\n,-1\r\n"},
+	}
+	for _, c := range cases {
+		if encoded := string(protocol.EncodeRESP3(c.reply)); encoded != c.expected {
+			t.Errorf("Expected %q, got %q", c.expected, encoded)
+		}
+	}
+}
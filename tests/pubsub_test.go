@@ -2,11 +2,26 @@ package storage_test
 
 import (
 	"os"
+	"tealis/internal/protocol"
 	"tealis/internal/storage"
 	"testing"
 	"time"
 )
 
+// chanWriter collects everything written to a session so tests can inspect pushes.
+type chanWriter chan string
+
+func (w chanWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+func messageFrame(channel, message string) string {
+	return string(protocol.EncodeRESP2(protocol.Push{
+		protocol.BulkString("message"), protocol.BulkString(channel), protocol.BulkString(message),
+	}))
+}
+
 func TestPubSub(t *testing.T) {
 	// Setup
 	aofFilePath := "./snapshot"
@@ -21,47 +36,43 @@ func TestPubSub(t *testing.T) {
 	channel := "test-channel"
 
 	// Simulate a client connection for testing
-	clientID := "client1"
-	r.AddMockClientConnection(clientID) // Mock connection for the test
+	outbox := make(chanWriter, 10)
+	session := r.NewSession(storage.TransportTCP, "client1", outbox)
+	defer r.CloseSession(session)
 
 	// Test Subscribe
-	subscribeResp := r.Subscribe(clientID, channel)
-	if subscribeResp != "+SUBSCRIBED to test-channel" {
-		t.Errorf("Subscribe failed: expected '+SUBSCRIBED to test-channel', got '%s'", subscribeResp)
+	subscribeResp := r.Subscribe(session, channel)
+	if subscribeResp != 1 {
+		t.Errorf("Subscribe failed: expected 1 subscription, got %d", subscribeResp)
 	}
 
 	// Test Publish
 	message := "Hello, Pub/Sub!"
 	publishResp := r.Publish(channel, message)
-	if publishResp != ":1" {
-		t.Errorf("Publish failed: expected ':1', got '%s'", publishResp)
+	if publishResp != 1 {
+		t.Errorf("Publish failed: expected 1, got %d", publishResp)
 	}
 
 	// Test Message Delivery
-	conn := r.GetMockClientConnection(clientID)
-	if conn == nil {
-		t.Fatal("Failed to retrieve mock client connection")
-	}
-
 	select {
-	case msg := <-conn.Outbox:
-		if msg != message {
-			t.Errorf("Expected message '%s', got '%s'", message, msg)
+	case msg := <-outbox:
+		if expected := messageFrame(channel, message); msg != expected {
+			t.Errorf("Expected message %q, got %q", expected, msg)
 		}
 	case <-time.After(time.Second):
 		t.Fatal("Message delivery timed out")
 	}
 
 	// Test Unsubscribe
-	unsubscribeResp := r.Unsubscribe(clientID, channel)
-	if unsubscribeResp != "+UNSUBSCRIBED from test-channel" {
-		t.Errorf("Unsubscribe failed: expected '+UNSUBSCRIBED from test-channel', got '%s'", unsubscribeResp)
+	unsubscribeResp := r.Unsubscribe(session, channel)
+	if unsubscribeResp != 0 {
+		t.Errorf("Unsubscribe failed: expected 0 remaining subscriptions, got %d", unsubscribeResp)
 	}
 
 	// Test Publish after Unsubscribe
 	publishResp = r.Publish(channel, message)
-	if publishResp != ":0" {
-		t.Errorf("Publish after unsubscribe failed: expected ':0', got '%s'", publishResp)
+	if publishResp != 0 {
+		t.Errorf("Publish after unsubscribe failed: expected 0, got %d", publishResp)
 	}
 }
 
@@ -73,34 +84,200 @@ func TestMultipleSubscribers(t *testing.T) {
 	store := storage.NewTealis(aofFilePath, "./snapshot", false)
 	channel := "test-channel"
 
-	// Add multiple mock clients
-	clientIDs := []string{"client1", "client2", "client3"}
-	for _, clientID := range clientIDs {
-		store.AddMockClientConnection(clientID)
-		store.Subscribe(clientID, channel)
+	// Add multiple clients
+	outboxes := make(map[uint64]chanWriter)
+	for _, addr := range []string{"client1", "client2", "client3"} {
+		outbox := make(chanWriter, 10)
+		session := store.NewSession(storage.TransportWebSocket, addr, outbox)
+		defer store.CloseSession(session)
+		store.Subscribe(session, channel)
+		outboxes[session.ID] = outbox
 	}
 
 	// Publish a message
 	message := "Hello, all subscribers!"
 	publishResp := store.Publish(channel, message)
-	if publishResp != ":3" {
-		t.Errorf("Publish failed: expected ':3', got '%s'", publishResp)
+	if publishResp != 3 {
+		t.Errorf("Publish failed: expected 3, got %d", publishResp)
 	}
 
 	// Verify message delivery for each client
-	for _, clientID := range clientIDs {
-		conn := store.GetMockClientConnection(clientID)
-		if conn == nil {
-			t.Fatalf("Failed to retrieve mock client connection for %s", clientID)
+	for id, outbox := range outboxes {
+		select {
+		case msg := <-outbox:
+			if expected := messageFrame(channel, message); msg != expected {
+				t.Errorf("Expected message %q, got %q for client %d", expected, msg, id)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Message delivery timed out for client %d", id)
+		}
+	}
+}
+
+func TestCloseSessionDropsSubscriptions(t *testing.T) {
+	dir := t.TempDir()
+	store := storage.NewTealis(dir, dir, false)
+	first := store.NewSession(storage.TransportTCP, "client1", make(chanWriter, 10))
+	second := store.NewSession(storage.TransportHTTP, "client2", nil)
+	if first.ID == second.ID {
+		t.Fatalf("Expected unique session IDs, got %d twice", first.ID)
+	}
+
+	store.Subscribe(first, "news")
+	store.CloseSession(first)
+	if n := store.Publish("news", "hello"); n != 0 {
+		t.Errorf("Expected no receivers after the subscriber disconnected, got %d", n)
+	}
+	if _, ok := store.Session(first.ID); ok {
+		t.Errorf("Expected closed session %d to be forgotten", first.ID)
+	}
+}
+
+func TestKeyspaceNotifications(t *testing.T) {
+	dir := t.TempDir()
+	store := storage.NewTealis(dir, dir, false)
+	if err := store.SetConfig("notify-keyspace-events", "KEA"); err != nil {
+		t.Fatal(err)
+	}
+	cfg := store.Config()
+	if value, _ := cfg.Get("notify-keyspace-events"); value != "AKE" {
+		t.Errorf("Expected notify-keyspace-events to read AKE, got %q", value)
+	}
+	client := store.NewSession(storage.TransportTCP, "client", nil)
+	outbox := make(chanWriter, 100)
+	listener := store.NewSession(storage.TransportTCP, "listener", outbox)
+	defer store.CloseSession(listener)
+	for _, channel := range []string{"__keyspace@0__:queue", "__keyevent@0__:del", "__keyevent@0__:expire", "__keyevent@0__:expired", "__keyevent@0__:hset", "__keyevent@0__:set"} {
+		store.Subscribe(listener, channel)
+	}
+
+	run := func(parts ...string) {
+		if reply := storage.ProcessCommand(parts, store, client); protocol.IsError(reply) {
+			t.Fatalf("%v failed: %v", parts, reply)
+		}
+	}
+	run("RPUSH", "queue", "a")
+	run("LPOP", "queue")
+	run("LPOP", "queue") // empty, changes nothing
+	run("HSET", "user", "name", "x")
+	run("SET", "user", "v", "NX") // not set
+	run("DEL", "missing")         // nothing deleted
+	run("DEL", "user")
+	run("SET", "session", "abc", "PX", "20")
+	time.Sleep(40 * time.Millisecond)
+	run("GET", "session") // finds it expired
+
+	expected := []string{
+		messageFrame("__keyspace@0__:queue", "rpush"),
+		messageFrame("__keyspace@0__:queue", "lpop"),
+		messageFrame("__keyevent@0__:hset", "user"),
+		messageFrame("__keyevent@0__:del", "user"),
+		messageFrame("__keyevent@0__:set", "session"),
+		messageFrame("__keyevent@0__:expire", "session"),
+		messageFrame("__keyevent@0__:expired", "session"),
+	}
+	for _, want := range expected {
+		select {
+		case msg := <-outbox:
+			if msg != want {
+				t.Errorf("Expected notification %q, got %q", want, msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected notification %q, got none", want)
 		}
+	}
+	select {
+	case msg := <-outbox:
+		t.Errorf("Expected no more notifications, got %q", msg)
+	default:
+	}
+
+	if err := store.SetConfig("notify-keyspace-events", "Kq"); err == nil {
+		t.Error("Expected an unknown event class to be rejected")
+	}
+}
 
+func TestKeyspaceNotificationsNameTheDatabase(t *testing.T) {
+	dir := t.TempDir()
+	store := storage.NewTealis(dir, dir, false)
+	if err := store.SetConfig("notify-keyspace-events", "Kg$"); err != nil {
+		t.Fatal(err)
+	}
+	client := store.NewSession(storage.TransportTCP, "client", nil)
+	outbox := make(chanWriter, 10)
+	listener := store.NewSession(storage.TransportTCP, "listener", outbox)
+	defer store.CloseSession(listener)
+	store.Subscribe(listener, "__keyspace@2__:k")
+	store.Subscribe(listener, "__keyspace@4__:k")
+
+	for _, parts := range [][]string{{"SET", "k", "v"}, {"SELECT", "2"}, {"SET", "k", "v"}, {"MOVE", "k", "4"}} {
+		storage.ProcessCommand(parts, store, client)
+	}
+	for _, want := range []string{
+		messageFrame("__keyspace@2__:k", "set"),
+		messageFrame("__keyspace@2__:k", "move_from"),
+		messageFrame("__keyspace@4__:k", "move_to"),
+	} {
 		select {
-		case msg := <-conn.Outbox:
-			if msg != message {
-				t.Errorf("Expected message '%s', got '%s' for %s", message, msg, clientID)
+		case msg := <-outbox:
+			if msg != want {
+				t.Errorf("Expected notification %q, got %q", want, msg)
 			}
 		case <-time.After(time.Second):
-			t.Fatalf("Message delivery timed out for %s", clientID)
+			t.Fatalf("Expected notification %q, got none", want)
 		}
 	}
 }
+
+func TestPatternSubscribe(t *testing.T) {
+	dir := t.TempDir()
+	store := storage.NewTealis(dir, dir, false)
+	outbox := make(chanWriter, 10)
+	session := store.NewSession(storage.TransportTCP, "client", outbox)
+	defer store.CloseSession(session)
+
+	reply := storage.ProcessCommand([]string{"PSUBSCRIBE", "news.[ab]*"}, store, session)
+	expected := protocol.Push{protocol.BulkString("psubscribe"), protocol.BulkString("news.[ab]*"), protocol.Integer(1)}
+	if string(protocol.EncodeRESP2(reply)) != string(protocol.EncodeRESP2(expected)) {
+		t.Errorf("Expected %v, got %v", expected, reply)
+	}
+	if n := store.Subscribe(session, "news.art"); n != 2 {
+		t.Errorf("Expected channels and patterns to be counted together, got %d", n)
+	}
+
+	// A channel matching both the pattern and a subscription is delivered once for each
+	if n := store.Publish("news.art", "hi"); n != 2 {
+		t.Errorf("Expected 2 receivers, got %d", n)
+	}
+	if n := store.Publish("news.cars", "hi"); n != 0 {
+		t.Errorf("Expected a channel outside the pattern to have no receivers, got %d", n)
+	}
+	pmessage := string(protocol.EncodeRESP2(protocol.Push{
+		protocol.BulkString("pmessage"), protocol.BulkString("news.[ab]*"), protocol.BulkString("news.art"), protocol.BulkString("hi"),
+	}))
+	received := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-outbox:
+			received[msg] = true
+		case <-time.After(time.Second):
+			t.Fatal("Message delivery timed out")
+		}
+	}
+	if !received[pmessage] || !received[messageFrame("news.art", "hi")] {
+		t.Errorf("Expected a message and a pmessage, got %v", received)
+	}
+
+	if n := store.PUnsubscribe(session, "news.[ab]*"); n != 1 {
+		t.Errorf("Expected 1 remaining subscription, got %d", n)
+	}
+	if n := store.Publish("news.bikes", "hi"); n != 0 {
+		t.Errorf("Expected no receivers after PUNSUBSCRIBE, got %d", n)
+	}
+
+	store.PSubscribe(session, "*")
+	store.CloseSession(session)
+	if n := store.Publish("anything", "hi"); n != 0 {
+		t.Errorf("Expected closing the session to drop its patterns, got %d receivers", n)
+	}
+}
@@ -0,0 +1,295 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"tealis/internal/protocol"
+	"tealis/internal/storage"
+	"testing"
+	"time"
+)
+
+// scanAll runs a SCAN-like command from cursor 0 until the cursor comes back to 0 and returns
+// every name replied, calling between after each call.
+func scanAll(t *testing.T, run func(parts ...string) protocol.Reply, command []string, options []string, between func()) []string {
+	t.Helper()
+	var names []string
+	cursor := "0"
+	for calls := 0; ; calls++ {
+		if calls > 10000 {
+			t.Fatalf("Expected %v to finish", command)
+		}
+		parts := append(append(append([]string{}, command...), cursor), options...)
+		reply, ok := run(parts...).(protocol.Array)
+		if !ok || len(reply) != 2 {
+			t.Fatalf("Unexpected %v reply: %v", parts, reply)
+		}
+		for _, name := range reply[1].(protocol.Array) {
+			names = append(names, string(name.(protocol.BulkString)))
+		}
+		cursor = string(reply[0].(protocol.BulkString))
+		if cursor == "0" {
+			return names
+		}
+		if between != nil {
+			between()
+		}
+	}
+}
+
+func TestGlobMatching(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, false)
+	for _, key := range []string{"hello", "hallo", "hxllo", "hllo", "heeeello", "h*llo", "a/b", "[x]", "h-llo"} {
+		r.Set(key, "v", 0)
+	}
+	for pattern, want := range map[string]string{
+		"h?llo":       "hallo h-llo h*llo hello hxllo",
+		"h*llo":       "h*llo h-llo hallo heeeello hello hllo hxllo",
+		"h[ae]llo":    "hallo hello",
+		"h[^e]llo":    "h*llo h-llo hallo hxllo",
+		"h[a-b]llo":   "hallo",
+		"h[b-a]llo":   "hallo",
+		"h[a-]llo":    "h-llo hallo",
+		`h\*llo`:      "h*llo",
+		`\[x\]`:       "[x]",
+		"a*":          "a/b",
+		"*/*":         "a/b",
+		"[[]x]":       "[x]",
+		"h[e":         "",
+		"hello\\":     "",
+		"hello*****":  "hello",
+		"*l*l*o":      "h*llo h-llo hallo heeeello hello hllo hxllo",
+		"[^a-z]*":     "[x]",
+		"*[\\-]*":     "h-llo",
+		"nothing":     "",
+		"h[!e]llo":    "hello",
+		"he*e*llo":    "heeeello",
+		"??":          "",
+		"???":         "a/b [x]",
+		"h?????llo":   "",
+		"*":           "[x] a/b h*llo h-llo hallo heeeello hello hllo hxllo",
+		"[a-z][a-z]*": "hallo heeeello hello hllo hxllo",
+	} {
+		keys := r.Keys(pattern)
+		sort.Strings(keys)
+		wantKeys := strings.Fields(want)
+		sort.Strings(wantKeys)
+		if strings.Join(keys, " ") != strings.Join(wantKeys, " ") {
+			t.Errorf("Expected KEYS %s to match %v, got %v", pattern, wantKeys, keys)
+		}
+	}
+}
+
+func TestScanKeyspace(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, false)
+	session := r.NewSession(storage.TransportTCP, "scan_client", nil)
+	run := func(parts ...string) protocol.Reply {
+		return storage.ProcessCommand(parts, r, session)
+	}
+
+	for i := 0; i < 100; i++ {
+		run("SET", fmt.Sprintf("key:%d", i), "v")
+	}
+	run("RPUSH", "list", "a")
+	run("SADD", "set", "a")
+	run("SET", "gone", "v", "PX", "1")
+	run("SELECT", "1")
+	run("SET", "other", "v")
+	run("SELECT", "0")
+	time.Sleep(5 * time.Millisecond)
+
+	// Keys added while the scan runs may or may not be returned, but every key present for
+	// the whole scan is returned exactly once
+	added := 0
+	names := scanAll(t, run, []string{"SCAN"}, []string{"COUNT", "7"}, func() {
+		run("SET", fmt.Sprintf("new:%d", added), "v")
+		added++
+	})
+	seen := make(map[string]int)
+	for _, name := range names {
+		seen[name]++
+	}
+	for i := 0; i < 100; i++ {
+		if key := fmt.Sprintf("key:%d", i); seen[key] != 1 {
+			t.Errorf("Expected %s to be returned once, got %d times", key, seen[key])
+		}
+	}
+	if seen["list"] != 1 || seen["set"] != 1 {
+		t.Errorf("Expected every key to be returned, got %v", names)
+	}
+	if seen["gone"] != 0 || seen["other"] != 0 {
+		t.Errorf("Expected expired keys and keys of other databases to be skipped, got %v", names)
+	}
+	for name, n := range seen {
+		if n != 1 {
+			t.Errorf("Expected %s to be returned once, got %d times", name, n)
+		}
+	}
+
+	names = scanAll(t, run, []string{"SCAN"}, []string{"MATCH", "key:1?", "COUNT", "1000"}, nil)
+	if len(names) != 10 {
+		t.Errorf("Expected MATCH to return the 10 matching keys, got %v", names)
+	}
+	names = scanAll(t, run, []string{"SCAN"}, []string{"TYPE", "LIST"}, nil)
+	if fmt.Sprint(names) != "[list]" {
+		t.Errorf("Expected TYPE to return only the list, got %v", names)
+	}
+
+	// Without COUNT a call returns at most 10 keys
+	reply := run("SCAN", "0").(protocol.Array)
+	if len(reply[1].(protocol.Array)) != 10 || reply[0] == protocol.BulkString("0") {
+		t.Errorf("Expected a first page of 10 keys, got %v", reply)
+	}
+
+	for _, parts := range [][]string{
+		{"SCAN", "x"},
+		{"SCAN", "-1"},
+		{"SCAN", "0", "COUNT", "0"},
+		{"SCAN", "0", "COUNT"},
+		{"SCAN", "0", "NOVALUES"},
+		{"SCAN", "0", "BOGUS", "1"},
+	} {
+		if reply := run(parts...); !protocol.IsError(reply) {
+			t.Errorf("Expected %v to fail, got %v", parts, reply)
+		}
+	}
+}
+
+func TestScanCollections(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, false)
+	session := r.NewSession(storage.TransportTCP, "collection_scan_client", nil)
+	run := func(parts ...string) protocol.Reply {
+		return storage.ProcessCommand(parts, r, session)
+	}
+
+	for i := 0; i < 30; i++ {
+		run("HSET", "hash", fmt.Sprintf("f%d", i), fmt.Sprintf("v%d", i))
+		run("SADD", "set", fmt.Sprintf("m%d", i))
+		run("ZADD", "zset", fmt.Sprint(i), fmt.Sprintf("z%d", i))
+	}
+
+	pairs := scanAll(t, run, []string{"HSCAN", "hash"}, []string{"COUNT", "4"}, nil)
+	if len(pairs) != 60 {
+		t.Fatalf("Expected HSCAN to return 30 fields and values, got %v", pairs)
+	}
+	for i := 0; i < len(pairs); i += 2 {
+		if "v"+strings.TrimPrefix(pairs[i], "f") != pairs[i+1] {
+			t.Errorf("Expected the value of %s, got %s", pairs[i], pairs[i+1])
+		}
+	}
+	fields := scanAll(t, run, []string{"HSCAN", "hash"}, []string{"MATCH", "f1*", "NOVALUES"}, nil)
+	sort.Strings(fields)
+	if fmt.Sprint(fields) != "[f1 f10 f11 f12 f13 f14 f15 f16 f17 f18 f19]" {
+		t.Errorf("Expected HSCAN NOVALUES to return the matching fields, got %v", fields)
+	}
+
+	members := scanAll(t, run, []string{"SSCAN", "set"}, []string{"COUNT", "3"}, nil)
+	seen := make(map[string]bool)
+	for _, member := range members {
+		seen[member] = true
+	}
+	if len(members) != 30 || len(seen) != 30 {
+		t.Errorf("Expected SSCAN to return every member once, got %v", members)
+	}
+
+	scores := scanAll(t, run, []string{"ZSCAN", "zset"}, []string{"MATCH", "z2?"}, nil)
+	if len(scores) != 20 {
+		t.Fatalf("Expected ZSCAN to return 10 members and scores, got %v", scores)
+	}
+	for i := 0; i < len(scores); i += 2 {
+		if strings.TrimPrefix(scores[i], "z") != scores[i+1] {
+			t.Errorf("Expected the score of %s, got %s", scores[i], scores[i+1])
+		}
+	}
+
+	if reply := run("SSCAN", "missing", "0"); fmt.Sprint(reply) != fmt.Sprint(protocol.Array{protocol.BulkString("0"), protocol.Array{}}) {
+		t.Errorf("Expected an empty scan of a missing key, got %v", reply)
+	}
+	for _, parts := range [][]string{
+		{"HSCAN", "set", "0"},
+		{"SSCAN", "hash", "0"},
+		{"ZSCAN", "hash", "0"},
+		{"SSCAN", "set", "0", "NOVALUES"},
+		{"ZSCAN", "zset", "0", "TYPE", "zset"},
+		{"HSCAN", "hash", "nope"},
+	} {
+		if reply := run(parts...); !protocol.IsError(reply) {
+			t.Errorf("Expected %v to fail, got %v", parts, reply)
+		}
+	}
+}
+
+func TestScanFollowsWrites(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, false)
+	session := r.NewSession(storage.TransportTCP, "scan_writes_client", nil)
+	run := func(parts ...string) protocol.Reply {
+		return storage.ProcessCommand(parts, r, session)
+	}
+	// scanned runs a scan to the end and returns the names it returned, sorted
+	scanned := func(command ...string) string {
+		names := scanAll(t, run, command, []string{"COUNT", "3"}, nil)
+		sort.Strings(names)
+		return strings.Join(names, " ")
+	}
+
+	for i := 0; i < 20; i++ {
+		run("SET", fmt.Sprintf("key:%02d", i), "v")
+	}
+	run("SADD", "set", "a", "b", "c")
+	run("HSET", "hash", "f1", "1")
+	run("HSET", "hash", "f2", "2")
+	run("ZADD", "zset", "1", "one")
+	run("ZADD", "zset", "2", "two")
+	scanned("SCAN")
+	scanned("SSCAN", "set")
+	scanned("HSCAN", "hash")
+	scanned("ZSCAN", "zset")
+
+	// Once indexed, keys and members added and removed in equal numbers are still followed
+	for i := 0; i < 20; i += 2 {
+		run("DEL", fmt.Sprintf("key:%02d", i))
+		run("SET", fmt.Sprintf("new:%02d", i), "v")
+	}
+	run("DEL", "set")
+	run("SADD", "set", "x", "y", "z")
+	run("HDEL", "hash", "f1")
+	run("HSET", "hash", "f3", "3")
+	run("ZREM", "zset", "one")
+	run("ZADD", "zset", "3", "three")
+	run("ZADD", "zset", "4", "two")
+
+	keys := r.Keys("*")
+	sort.Strings(keys)
+	if got := scanned("SCAN"); got != strings.Join(keys, " ") {
+		t.Errorf("Expected SCAN to return %v, got %s", keys, got)
+	}
+	if got := scanned("SSCAN", "set"); got != "x y z" {
+		t.Errorf("Expected SSCAN to return the members of the new set, got %s", got)
+	}
+	if got := scanned("HSCAN", "hash"); got != "2 3 f2 f3" {
+		t.Errorf("Expected HSCAN to return f2 and f3, got %s", got)
+	}
+	if got := scanned("ZSCAN", "zset"); got != "3 4 three two" {
+		t.Errorf("Expected ZSCAN to return three and two with their new scores, got %s", got)
+	}
+
+	// Moving, swapping and flushing databases carry or drop their indexes with their keys
+	run("MOVE", "new:00", "1")
+	if got := scanned("SCAN"); strings.Contains(got, "new:00") {
+		t.Errorf("Expected the moved key not to be scanned, got %s", got)
+	}
+	run("SWAPDB", "0", "1")
+	if got := scanned("SCAN"); got != "new:00" {
+		t.Errorf("Expected SCAN to return the keys of the swapped database, got %s", got)
+	}
+	run("FLUSHDB")
+	run("SET", "after", "v")
+	if got := scanned("SCAN"); got != "after" {
+		t.Errorf("Expected SCAN to return only the key set after FLUSHDB, got %s", got)
+	}
+}
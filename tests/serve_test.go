@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"tealis/internal/protocol"
+	"tealis/internal/storage"
+	"testing"
+)
+
+// chunkReader hands out one chunk per read, as a connection receiving them in separate
+// packets would, then io.EOF.
+type chunkReader struct {
+	chunks []string
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.chunks[0])
+	if n < len(r.chunks[0]) {
+		r.chunks[0] = r.chunks[0][n:]
+	} else {
+		r.chunks = r.chunks[1:]
+	}
+	return n, nil
+}
+
+// outputRecorder collects everything written to a session.
+type outputRecorder struct {
+	mu  sync.Mutex
+	out strings.Builder
+}
+
+func (w *outputRecorder) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.out.Write(p)
+}
+
+func (w *outputRecorder) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.out.String()
+}
+
+// serve runs a client that sends chunks and returns what it was sent back and the error
+// Serve returned.
+func serve(t *testing.T, r *storage.Tealis, chunks ...string) (string, error) {
+	t.Helper()
+	out := &outputRecorder{}
+	session := r.NewSession(storage.TransportTCP, "serve_client", out)
+	defer r.CloseSession(session)
+	err := r.Serve(&chunkReader{chunks: chunks}, session)
+	return out.String(), err
+}
+
+// respRequest encodes a request the way RESP clients send it.
+func respRequest(parts ...string) string {
+	return string(protocol.EncodeRESP2(protocol.StringArray(parts)))
+}
+
+func TestServePipelinedRequests(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, false)
+
+	// Several requests in one write are answered in order
+	out, err := serve(t, r, respRequest("SET", "k", "v")+respRequest("GET", "k")+respRequest("INCR", "n")+respRequest("INCR", "n"))
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("Expected Serve to return the end of the input, got %v", err)
+	}
+	if want := "+OK\r\n$1\r\nv\r\n:1\r\n:2\r\n"; out != want {
+		t.Errorf("Expected replies %q, got %q", want, out)
+	}
+
+	// A request split across reads waits for the rest, in its header or within a bulk
+	set := respRequest("SET", "split", "a value with spaces")
+	out, _ = serve(t, r, set[:3], set[3:20], set[20:]+respRequest("GET", "split")[:10], respRequest("GET", "split")[10:])
+	if want := "+OK\r\n$19\r\na value with spaces\r\n"; out != want {
+		t.Errorf("Expected replies %q, got %q", want, out)
+	}
+
+	// Replies stop at QUIT even when more requests follow it
+	out, err = serve(t, r, respRequest("EXISTS", "k")+respRequest("QUIT")+respRequest("SET", "after", "quit"))
+	if err != nil || out != ":1\r\n+OK\r\n" {
+		t.Errorf("Expected EXISTS and QUIT replies and no error, got %q, %v", out, err)
+	}
+	if r.Exists("after") {
+		t.Errorf("Expected the request after QUIT not to run")
+	}
+
+	out, err = serve(t, r, "*1\r\n$x\r\n")
+	var protoErr *protocol.ProtocolError
+	if !errors.As(err, &protoErr) || !strings.HasPrefix(out, "-ERR Protocol error") {
+		t.Errorf("Expected a protocol error to be reported and returned, got %q, %v", out, err)
+	}
+}
+
+func TestServeInlineRequests(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, false)
+
+	// Inline commands are prompted for, after their replies and after an empty line, but
+	// not before the client sends anything
+	out, _ := serve(t, r, "\r\n", "SET k \"two words\"\r\nGET k\r\n", "GET ", "k\r\n")
+	if want := "> +OK\r\n$9\r\ntwo words\r\n> $9\r\ntwo words\r\n> "; out != want {
+		t.Errorf("Expected replies %q, got %q", want, out)
+	}
+
+	// A backspace typed in character mode erases a character of the line and of the screen
+	out, _ = serve(t, r, "G", "E", "T", "T", "\b", " k\r\n")
+	if want := " \b \b$9\r\ntwo words\r\n> "; out != want {
+		t.Errorf("Expected replies %q, got %q", want, out)
+	}
+
+	// Once a client sends a RESP frame it is not prompted any more
+	out, _ = serve(t, r, "EXISTS k\r\n", respRequest("EXISTS", "k")+"EXISTS k\r\n")
+	if want := ":1\r\n> :1\r\n:1\r\n"; out != want {
+		t.Errorf("Expected replies %q, got %q", want, out)
+	}
+}
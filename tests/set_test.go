@@ -20,13 +20,13 @@ func TestRedisCloneSetOperations(t *testing.T) {
 
 	// Test SADD
 	t.Run("SADD", func(t *testing.T) {
-		length := r.SADD("myset", "a", "b", "c", "d")
+		length, _ := r.SADD("myset", "a", "b", "c", "d")
 		if length != 4 {
 			t.Errorf("Expected set length 4, but got %d", length)
 		}
 
 		// Verify the set content
-		members := r.SMEMBERS("myset")
+		members, _ := r.SMEMBERS("myset")
 		expectedMembers := []string{"a", "b", "c", "d"}
 		sort.Strings(expectedMembers)
 		sort.Strings(members)
@@ -37,13 +37,13 @@ func TestRedisCloneSetOperations(t *testing.T) {
 
 	// Test SREM
 	t.Run("SREM", func(t *testing.T) {
-		removedCount := r.SREM("myset", "a", "b")
+		removedCount, _ := r.SREM("myset", "a", "b")
 		if removedCount != 2 {
 			t.Errorf("Expected to remove 2 members, but removed %d", removedCount)
 		}
 
 		// Verify the set content after removal
-		members := r.SMEMBERS("myset")
+		members, _ := r.SMEMBERS("myset")
 		expectedMembers := []string{"c", "d"}
 		sort.Strings(members)
 		sort.Strings(expectedMembers)
@@ -54,12 +54,12 @@ func TestRedisCloneSetOperations(t *testing.T) {
 
 	// Test SISMEMBER
 	t.Run("SISMEMBER", func(t *testing.T) {
-		exists := r.SISMEMBER("myset", "c")
+		exists, _ := r.SISMEMBER("myset", "c")
 		if !exists {
 			t.Error("Expected member 'c' to exist in the set, but it does not")
 		}
 
-		exists = r.SISMEMBER("myset", "a")
+		exists, _ = r.SISMEMBER("myset", "a")
 		if exists {
 			t.Error("Expected member 'a' to not exist in the set, but it does")
 		}
@@ -71,7 +71,7 @@ func TestRedisCloneSetOperations(t *testing.T) {
 		r.SADD("myset2", "e", "f", "g")
 		r.SADD("myset3", "h", "i")
 
-		union := r.SUNION("myset", "myset2", "myset3")
+		union, _ := r.SUNION("myset", "myset2", "myset3")
 		expectedUnion := []string{"d", "e", "f", "g", "h", "i", "c"}
 		sort.Strings(union)
 		sort.Strings(expectedUnion)
@@ -85,7 +85,7 @@ func TestRedisCloneSetOperations(t *testing.T) {
 		// Add some common members to test intersection
 		r.SADD("myset2", "c", "d", "h")
 
-		intersection := r.SINTER("myset", "myset2")
+		intersection, _ := r.SINTER("myset", "myset2")
 		expectedIntersection := []string{"c", "d"}
 		sort.Strings(expectedIntersection)
 		sort.Strings(intersection)
@@ -99,7 +99,7 @@ func TestRedisCloneSetOperations(t *testing.T) {
 		// Add some different members to test difference
 		r.SADD("myset2", "e", "f", "g")
 
-		difference := r.SDIFF("myset", "myset2")
+		difference, _ := r.SDIFF("myset", "myset2")
 		var expectedDifference []string
 		if !equal(difference, expectedDifference) {
 			t.Errorf("Expected difference %v, but got %v", expectedDifference, difference)
@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"tealis/internal/protocol"
+	"tealis/internal/storage"
+	"testing"
+	"time"
+)
+
+func TestShutdownSavesAndClosesEverything(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, true)
+	conn := &closeRecorder{}
+	session := r.NewSession(storage.TransportTCP, "127.0.0.1:3000", conn)
+
+	storage.ProcessCommand([]string{"SET", "greeting", "hello"}, r, session)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := r.Shutdown(ctx, storage.ShutdownSave); err != nil {
+		t.Fatalf("Expected a clean shutdown, got %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "dump.tdb")); err != nil {
+		t.Errorf("Expected a final snapshot, got %v", err)
+	}
+	if r.AofFile != nil {
+		t.Errorf("Expected the AOF to be closed")
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "aof.txt"))
+	if !strings.Contains(string(data), "greeting") {
+		t.Errorf("Expected the write to be in the AOF, got %q", data)
+	}
+	if !conn.closed || !session.Closing() {
+		t.Errorf("Expected clients to be disconnected")
+	}
+	reply := storage.ProcessCommand([]string{"GET", "greeting"}, r, session)
+	if e, ok := reply.(protocol.Error); !ok || !strings.Contains(string(e), "shutting down") {
+		t.Errorf("Expected commands to be refused after shutdown, got %v", reply)
+	}
+}
+
+func TestShutdownSkipsTheSnapshotWhileACommandRuns(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, true)
+	session := r.NewSession(storage.TransportTCP, "writer", nil)
+
+	// Holding the store lock keeps the SET running, after it joined the running commands
+	r.Mu.Lock()
+	done := make(chan protocol.Reply)
+	go func() {
+		done <- storage.ProcessCommand([]string{"SET", "k", "v"}, r, session)
+	}()
+	for !strings.Contains(session.Info(), "cmd=set") {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := r.Shutdown(ctx, storage.ShutdownSave); err == nil {
+		t.Errorf("Expected shutdown to report the command it did not wait for")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dump.tdb")); !os.IsNotExist(err) {
+		t.Errorf("Expected no final snapshot while a command runs, got %v", err)
+	}
+	if r.AofFile != nil {
+		t.Errorf("Expected the AOF to be closed")
+	}
+	r.Mu.Unlock()
+	<-done
+}
+
+func TestShutdownCommand(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, false)
+	session := r.NewSession(storage.TransportTCP, "shutdown_client", nil)
+
+	if reply := storage.ProcessCommand([]string{"SHUTDOWN", "LATER"}, r, session); !protocol.IsError(reply) {
+		t.Errorf("Expected a syntax error, got %v", reply)
+	}
+	if reply := storage.ProcessCommand([]string{"SHUTDOWN", "NOSAVE"}, r, session); reply != protocol.OK {
+		t.Fatalf("Expected SHUTDOWN to be accepted, got %v", reply)
+	}
+	select {
+	case mode := <-r.ShutdownRequests():
+		if mode != storage.ShutdownNoSave {
+			t.Errorf("Expected a NOSAVE shutdown, got mode %d", mode)
+		}
+	default:
+		t.Fatal("Expected SHUTDOWN to request a shutdown")
+	}
+}
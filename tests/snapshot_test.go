@@ -0,0 +1,315 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"tealis/internal/protocol"
+	"tealis/internal/storage"
+	"testing"
+	"time"
+)
+
+func TestSnapshotKeepsEveryType(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, false)
+	session := r.NewSession(storage.TransportTCP, "snapshot_client", nil)
+	writes := [][]string{
+		{"SET", "string", "hello world"},
+		{"SET", "expiring", "soon"},
+		{"EX", "expiring", "100"},
+		{"RPUSH", "list", "a", "b", "c"},
+		{"SADD", "set", "x", "y"},
+		{"HSET", "hash", "field", "value"},
+		{"JSON.SET", "doc", ".", `{"a":{"b":1}}`},
+		{"ZADD", "zset", "1.5", "member"},
+		{"ZADD", "zset", "-2", "first"},
+		{"GEOADD", "geo", "13.361389", "38.115556", "Palermo", "15.087269", "37.502669", "Catania"},
+		{"XADD", "stream", "1-0", "field", "value"},
+		{"XGROUP", "CREATE", "stream", "group"},
+		{"XREADGROUP", "stream", "group", "alice", "0"},
+		{"PFADD", "hll", "a", "b", "c"},
+		{"TS.CREATE", "ts", "max"},
+		{"TS.ADD", "ts", "100", "1.5"},
+		{"SETBIT", "bitmap", "9", "1"},
+		{"VECTOR.SET", "vector", "0.1", "0.2"},
+	}
+	for _, parts := range writes {
+		if reply := storage.ProcessCommand(parts, r, session); protocol.IsError(reply) {
+			t.Fatalf("%v failed: %v", parts, reply)
+		}
+	}
+	if err := r.SaveSnapshot(); err != nil {
+		t.Fatalf("Expected the snapshot to save, got %v", err)
+	}
+
+	r2 := storage.NewTealis(dir, dir, false)
+	if err := r2.LoadSnapshot(); err != nil {
+		t.Fatalf("Expected the snapshot to load, got %v", err)
+	}
+	loaded := r2.NewSession(storage.TransportTCP, "loaded_client", nil)
+	reads := [][]string{
+		{"GET", "string"},
+		{"GET", "expiring"},
+		{"LRANGE", "list", "0", "10"},
+		{"SISMEMBER", "set", "y"},
+		{"HGET", "hash", "field"},
+		{"JSON.GET", "doc", "."},
+		{"ZRANGE", "zset", "0", "10"},
+		{"ZSCORE", "zset", "member"},
+		{"GEODIST", "geo", "Palermo", "Catania"},
+		{"XRANGE", "stream", "0", "9"},
+		{"XACK", "stream", "group", "1-0"},
+		{"PFCOUNT", "hll"},
+		{"TS.GET", "ts"},
+		{"GETBIT", "bitmap", "9"},
+		{"VECTOR.GET", "vector"},
+	}
+	for _, parts := range reads {
+		want := protocol.Encode(storage.ProcessCommand(parts, r, session), protocol.RESP2)
+		got := protocol.Encode(storage.ProcessCommand(parts, r2, loaded), protocol.RESP2)
+		if string(got) != string(want) {
+			t.Errorf("%v after loading: expected %q, got %q", parts, want, got)
+		}
+	}
+	if !r2.Expiries["expiring"].Equal(r.Expiries["expiring"].Truncate(time.Millisecond)) {
+		t.Errorf("Expected the expiry to be kept, got %v", r2.Expiries["expiring"])
+	}
+}
+
+func TestSnapshotRejectsCorruptFiles(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, false)
+	r.Set("key", "value", 0)
+	if err := r.SaveSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "dump.tdb")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "TEALISDB") {
+		t.Errorf("Expected the snapshot to start with its magic, got %q", data[:8])
+	}
+
+	flipped := append([]byte(nil), data...)
+	flipped[len(flipped)/2] ^= 0xff
+	corruptions := map[string][]byte{
+		"flipped byte":   flipped,
+		"truncated":      data[:len(data)-3],
+		"not a snapshot": []byte(`{"store":{}}`),
+	}
+	for name, corrupt := range corruptions {
+		if err := os.WriteFile(path, corrupt, 0644); err != nil {
+			t.Fatal(err)
+		}
+		r2 := storage.NewTealis(dir, dir, false)
+		r2.Set("untouched", "yes", 0)
+		if err := r2.LoadSnapshot(); err == nil {
+			t.Errorf("%s: expected the snapshot to be rejected", name)
+		}
+		if _, ok, _ := r2.Get("untouched"); !ok {
+			t.Errorf("%s: expected a rejected snapshot to leave the data alone", name)
+		}
+	}
+}
+
+// waitForSave waits until no background save is running.
+func waitForSave(t *testing.T, r *storage.Tealis, session *storage.Session) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		info := storage.ProcessCommand([]string{"INFO", "persistence"}, r, session)
+		if strings.Contains(string(info.(protocol.BulkString)), "rdb_bgsave_in_progress:0") {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Timed out waiting for the background save")
+}
+
+func TestBGSaveWritesPointInTimeView(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, false)
+	session := r.NewSession(storage.TransportTCP, "bgsave_client", nil)
+	for i := 0; i < 2000; i++ {
+		key := "key" + strconv.Itoa(i)
+		storage.ProcessCommand([]string{"RPUSH", key, "before"}, r, session)
+		storage.ProcessCommand([]string{"HSET", "hash" + strconv.Itoa(i), "field", "before"}, r, session)
+	}
+
+	if reply := storage.ProcessCommand([]string{"BGSAVE"}, r, session); reply != protocol.SimpleString("Background saving started") {
+		t.Fatalf("Expected the background save to start, got %v", reply)
+	}
+	// Everything written once BGSAVE replied comes after the view the save writes
+	for i := 0; i < 2000; i++ {
+		key := "key" + strconv.Itoa(i)
+		storage.ProcessCommand([]string{"RPUSH", key, "after"}, r, session)
+		storage.ProcessCommand([]string{"HSET", "hash" + strconv.Itoa(i), "field", "after"}, r, session)
+	}
+	storage.ProcessCommand([]string{"SET", "new", "after"}, r, session)
+	waitForSave(t, r, session)
+
+	r2 := storage.NewTealis(dir, dir, false)
+	if err := r2.LoadSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := r2.NewSession(storage.TransportTCP, "loaded_client", nil)
+	for i := 0; i < 2000; i++ {
+		key := "key" + strconv.Itoa(i)
+		if reply := storage.ProcessCommand([]string{"LLEN", key}, r2, loaded); reply != protocol.Integer(1) {
+			t.Fatalf("Expected %s to be saved as it was when BGSAVE ran, got length %v", key, reply)
+		}
+		if reply := storage.ProcessCommand([]string{"HGET", "hash" + strconv.Itoa(i), "field"}, r2, loaded); reply != protocol.BulkString("before") {
+			t.Fatalf("Expected hash%d to be saved as it was when BGSAVE ran, got %v", i, reply)
+		}
+	}
+	if _, ok, _ := r2.Get("new"); ok {
+		t.Error("Expected a key written after BGSAVE not to be saved")
+	}
+}
+
+func TestBGSaveScheduleAndLastSave(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, false)
+	session := r.NewSession(storage.TransportTCP, "bgsave_client", nil)
+	for i := 0; i < 20000; i++ {
+		r.Set("key"+strconv.Itoa(i), "value", 0)
+	}
+	before := storage.ProcessCommand([]string{"LASTSAVE"}, r, session).(protocol.Integer)
+
+	if reply := storage.ProcessCommand([]string{"BGSAVE"}, r, session); reply != protocol.SimpleString("Background saving started") {
+		t.Fatalf("Expected the background save to start, got %v", reply)
+	}
+	// The save may already be over, in which case SCHEDULE starts a new one right away
+	switch reply := storage.ProcessCommand([]string{"BGSAVE", "SCHEDULE"}, r, session); reply {
+	case protocol.SimpleString("Background saving scheduled"), protocol.SimpleString("Background saving started"):
+	default:
+		t.Fatalf("Expected BGSAVE SCHEDULE to schedule a save, got %v", reply)
+	}
+	if reply := storage.ProcessCommand([]string{"BGSAVE", "NOW"}, r, session); !protocol.IsError(reply) {
+		t.Errorf("Expected a syntax error, got %v", reply)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		info := string(storage.ProcessCommand([]string{"INFO", "persistence"}, r, session).(protocol.BulkString))
+		if strings.Contains(info, "rdb_bgsave_in_progress:0") && strings.Contains(info, "rdb_bgsave_scheduled:0") {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	info := string(storage.ProcessCommand([]string{"INFO"}, r, session).(protocol.BulkString))
+	for _, field := range []string{"# Persistence", "rdb_bgsave_in_progress:0", "rdb_bgsave_scheduled:0", "rdb_last_bgsave_status:ok"} {
+		if !strings.Contains(info, field) {
+			t.Errorf("Expected INFO to report %q, got %q", field, info)
+		}
+	}
+	if after := storage.ProcessCommand([]string{"LASTSAVE"}, r, session).(protocol.Integer); after < before {
+		t.Errorf("Expected LASTSAVE to move forward, got %d then %d", before, after)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dump.tdb")); err != nil {
+		t.Errorf("Expected the snapshot to be written, got %v", err)
+	}
+}
+
+func TestSaveRulesCountChanges(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, false)
+	session := r.NewSession(storage.TransportTCP, "save_client", nil)
+	if reply := storage.ProcessCommand([]string{"CONFIG", "SET", "save", "1 3"}, r, session); reply != protocol.OK {
+		t.Fatalf("Expected the save rule to be set, got %v", reply)
+	}
+	if reply := storage.ProcessCommand([]string{"CONFIG", "SET", "save", "1"}, r, session); !protocol.IsError(reply) {
+		t.Errorf("Expected a rule without a change count to be rejected, got %v", reply)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r.StartSnapshotScheduler(ctx)
+
+	storage.ProcessCommand([]string{"SET", "a", "1"}, r, session)
+	storage.ProcessCommand([]string{"SET", "b", "2"}, r, session)
+	storage.ProcessCommand([]string{"GET", "a"}, r, session)
+	info := string(storage.ProcessCommand([]string{"INFO", "persistence"}, r, session).(protocol.BulkString))
+	if !strings.Contains(info, "rdb_changes_since_last_save:2") {
+		t.Errorf("Expected two unsaved changes, got %q", info)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	path := filepath.Join(dir, "dump.tdb")
+	if _, err := os.Stat(path); err == nil {
+		t.Fatal("Expected no save before the rule's change count is reached")
+	}
+
+	storage.ProcessCommand([]string{"SET", "c", "3"}, r, session)
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	waitForSave(t, r, session)
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Expected the rule to save the snapshot, got %v", err)
+	}
+	info = string(storage.ProcessCommand([]string{"INFO", "persistence"}, r, session).(protocol.BulkString))
+	for _, field := range []string{"rdb_changes_since_last_save:0", "rdb_last_bgsave_status:ok", "rdb_last_bgsave_time_sec:0"} {
+		if !strings.Contains(info, field) {
+			t.Errorf("Expected INFO to report %q, got %q", field, info)
+		}
+	}
+}
+
+func TestRestoreSnapshotGenerations(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, true)
+	session := r.NewSession(storage.TransportTCP, "restore_client", nil)
+	storage.ProcessCommand([]string{"CONFIG", "SET", "snapshot-retention", "2"}, r, session)
+	for _, value := range []string{"first", "second", "third"} {
+		storage.ProcessCommand([]string{"SET", "key", value}, r, session)
+		if reply := storage.ProcessCommand([]string{"SAVE"}, r, session); reply != protocol.OK {
+			t.Fatalf("Expected SAVE to succeed, got %v", reply)
+		}
+		// Generations are named after the time they were saved
+		time.Sleep(2 * time.Millisecond)
+	}
+	storage.ProcessCommand([]string{"SET", "key", "unsaved"}, r, session)
+
+	list, ok := storage.ProcessCommand([]string{"RESTORE", "LIST"}, r, session).(protocol.Array)
+	if !ok || len(list) != 2 {
+		t.Fatalf("Expected the two newest generations to be kept, got %v", list)
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "temp-") {
+			t.Errorf("Expected no temporary file to be left behind, found %s", entry.Name())
+		}
+	}
+
+	// The older generation kept holds the second value
+	older := string(list[1].(protocol.BulkString))
+	if reply := storage.ProcessCommand([]string{"RESTORE", older}, r, session); reply != protocol.OK {
+		t.Fatalf("Expected RESTORE %s to succeed, got %v", older, reply)
+	}
+	if reply := storage.ProcessCommand([]string{"GET", "key"}, r, session); reply != protocol.BulkString("second") {
+		t.Errorf("Expected the restored generation's value, got %v", reply)
+	}
+	for _, name := range []string{"dump-nope.tdb", "../" + older, "users.acl"} {
+		if reply := storage.ProcessCommand([]string{"RESTORE", name}, r, session); !protocol.IsError(reply) {
+			t.Errorf("Expected RESTORE %s to fail, got %v", name, reply)
+		}
+	}
+
+	// The restored data is what the server comes back with
+	r.Shutdown(context.Background(), storage.ShutdownNoSave)
+	r2 := storage.NewTealis(dir, dir, true)
+	if err := r2.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if value, _, _ := r2.Get("key"); value != "second" {
+		t.Errorf("Expected the restored value after a restart, got %v", value)
+	}
+}
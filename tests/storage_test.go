@@ -25,12 +25,12 @@ func TestSetGet(t *testing.T) {
 
 	// Test setting a key-value pair
 	r.Set("key1", "value1", 0)
-	value, exists := r.Get("key1")
+	value, exists, _ := r.Get("key1")
 	assert.True(t, exists, "Expected key to exist")
 	assert.Equal(t, "value1", value, "Expected value to be 'value1'")
 
 	// Test getting a non-existing key
-	_, exists = r.Get("nonexistent")
+	_, exists, _ = r.Get("nonexistent")
 	assert.False(t, exists, "Expected key to not exist")
 
 }
@@ -55,13 +55,13 @@ func TestSetWithTTL(t *testing.T) {
 
 	// Set key with TTL of 2 seconds
 	r.Set("key2", "value2", 2*time.Second)
-	value, exists := r.Get("key2")
+	value, exists, _ := r.Get("key2")
 	assert.True(t, exists, "Expected key to exist")
 	assert.Equal(t, "value2", value, "Expected value to be 'value2'")
 
 	// Wait for the TTL to expire
 	time.Sleep(3 * time.Second)
-	_, exists = r.Get("key2")
+	_, exists, _ = r.Get("key2")
 	assert.False(t, exists, "Expected key to expire")
 }
 
@@ -120,15 +120,15 @@ func TestAppend(t *testing.T) {
 
 	// Test appending to a key
 	r.Set("key5", "hello", 0)
-	newLength := r.Append("key5", " world")
+	newLength, _ := r.Append("key5", " world")
 	assert.Equal(t, 11, newLength, "Expected new length to be 11")
-	value, _ := r.Get("key5")
+	value, _, _ := r.Get("key5")
 	assert.Equal(t, "hello world", value, "Expected value to be 'hello world'")
 
 	// Append to a non-existing key
-	newLength = r.Append("key6", "new")
+	newLength, _ = r.Append("key6", "new")
 	assert.Equal(t, 3, newLength, "Expected new length to be 3")
-	value, _ = r.Get("key6")
+	value, _, _ = r.Get("key6")
 	assert.Equal(t, "new", value, "Expected value to be 'new'")
 }
 
@@ -145,11 +145,11 @@ func TestStrLen(t *testing.T) {
 
 	// Test string length
 	r.Set("key7", "some value", 0)
-	length := r.StrLen("key7")
+	length, _ := r.StrLen("key7")
 	assert.Equal(t, 10, length, "Expected length to be 10")
 
 	// Test length of non-existing key
-	length = r.StrLen("nonexistent")
+	length, _ = r.StrLen("nonexistent")
 	assert.Equal(t, 0, length, "Expected length to be 0")
 }
 
@@ -218,15 +218,15 @@ func TestGetRange(t *testing.T) {
 	r.Set("key13", "Hello World", 0)
 
 	// Test GETRANGE
-	result := r.GetRange("key13", 0, 4)
+	result, _ := r.GetRange("key13", 0, 4)
 	assert.Equal(t, "Hello", result, "Expected range to be 'Hello'")
 
 	// Test GETRANGE with negative indices
-	result = r.GetRange("key13", -5, -1)
+	result, _ = r.GetRange("key13", -5, -1)
 	assert.Equal(t, "World", result, "Expected range to be 'World'")
 
 	// Test GETRANGE with out-of-bounds indices
-	result = r.GetRange("key13", 10, 15)
+	result, _ = r.GetRange("key13", 10, 15)
 	assert.Equal(t, "d", result, "Expected empty result")
 }
 
@@ -244,27 +244,27 @@ func TestSetRange(t *testing.T) {
 	// Test 1: Basic SETRANGE functionality
 	r.Set("key1", "Hello", 0)
 	// Set the range at index 6 with the value "Go"
-	resultLen := r.SetRange("key1", 6, "Go") // Expected: "Hello Go"
+	resultLen, _ := r.SetRange("key1", 6, "Go") // Expected: "Hello Go"
 	assert.Equal(t, 8, resultLen, "Expected length after SETRANGE to be 8")
-	value, exists := r.Get("key1")
+	value, exists, _ := r.Get("key1")
 	assert.True(t, exists, "Expected key to exist")
 	assert.Equal(t, "Hello Go", value, "Expected value to be 'Hello Go'")
 
 	// Test 2: Padding with null bytes (when offset is beyond current length)
 	r.Set("key2", "Hello     Redis", 0)
 	// Set range at a large offset, padding with null bytes
-	resultLen = r.SetRange("key2", 10, "Redis") // Expected: "Hello\x00\x00\x00Redis"
+	resultLen, _ = r.SetRange("key2", 10, "Redis") // Expected: "Hello\x00\x00\x00Redis"
 	assert.Equal(t, 15, resultLen, "Expected length after SETRANGE to be 16")
-	value, exists = r.Get("key2")
+	value, exists, _ = r.Get("key2")
 	assert.True(t, exists, "Expected key to exist")
 	assert.Equal(t, "Hello     Redis", value, "Expected value to be 'Hello     Redis'")
 
 	// Test 3: Overwriting part of the string
 	r.Set("key3", "Hello World", 0)
 	// Set range at index 6 to overwrite part of the string with "Gorld"
-	resultLen = r.SetRange("key3", 6, "Gorld") // Expected: "Hello Gorld"
+	resultLen, _ = r.SetRange("key3", 6, "Gorld") // Expected: "Hello Gorld"
 	assert.Equal(t, 11, resultLen, "Expected length after SETRANGE to be 12")
-	value, exists = r.Get("key3")
+	value, exists, _ = r.Get("key3")
 	assert.True(t, exists, "Expected key to exist")
 	assert.Equal(t, "Hello Gorld", value, "Expected value to be 'Hello Gorld'")
 }
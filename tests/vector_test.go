@@ -1,7 +1,6 @@
 package storage
 
 import (
-	"encoding/json"
 	"os"
 	"strings"
 	"tealis/internal/storage"
@@ -21,17 +20,12 @@ func TestVectorSetAndGet(t *testing.T) {
 
 	// Test VectorSet
 	vector := []float64{1.0, 2.0, 3.0}
-	response := r.VectorSet("vec1", vector)
-	if response != "+OK\r\n" {
-		t.Errorf("Expected +OK\\r\\n, got %s", response)
-	}
+	r.VectorSet("vec1", vector)
 
 	// Test VectorGet - existing vector
-	response = r.VectorGet("vec1")
-	var retrievedVector []float64
-	err := json.Unmarshal([]byte(strings.Trim(response[4:], "\r\n")), &retrievedVector)
+	retrievedVector, err := r.VectorGet("vec1")
 	if err != nil {
-		t.Errorf("Failed to unmarshal response: %v", err)
+		t.Errorf("Failed to get vector: %v", err)
 	}
 	if len(retrievedVector) != len(vector) {
 		t.Errorf("Expected vector length %d, got %d", len(vector), len(retrievedVector))
@@ -43,16 +37,16 @@ func TestVectorSetAndGet(t *testing.T) {
 	}
 
 	// Test VectorGet - non-existing key
-	response = r.VectorGet("nonexistent")
-	if response != "-ERR Key not found\r\n" {
-		t.Errorf("Expected -ERR Key not found\\r\\n, got %s", response)
+	_, err = r.VectorGet("nonexistent")
+	if err == nil || err.Error() != "Key not found" {
+		t.Errorf("Expected 'Key not found' error, got %v", err)
 	}
 
 	// Test VectorGet - key is not a vector
 	r.Store["notavector"] = "string"
-	response = r.VectorGet("notavector")
-	if response != "-ERR Key is not a vector\r\n" {
-		t.Errorf("Expected -ERR Key is not a vector\\r\\n, got %s", response)
+	_, err = r.VectorGet("notavector")
+	if err == nil || err.Error() != "Key is not a vector" {
+		t.Errorf("Expected 'Key is not a vector' error, got %v", err)
 	}
 }
 
@@ -75,7 +69,7 @@ func TestVectorSearch(t *testing.T) {
 
 	// Search with query vector
 	query := []float64{1.0, 1.0, 1.0}
-	response := r.VectorSearch(query, 2)
+	response := vectorKeys(r.VectorSearch(query, 2))
 
 	expectedKeys := []string{"vec1"} // Closest two vectors
 	for _, key := range expectedKeys {
@@ -85,7 +79,7 @@ func TestVectorSearch(t *testing.T) {
 	}
 
 	// Test with k greater than available vectors
-	response = r.VectorSearch(query, 10)
+	response = vectorKeys(r.VectorSearch(query, 10))
 	expectedKeys = []string{"vec3", "vec1", "vec2", "vec4"}
 	for _, key := range expectedKeys {
 		if !strings.Contains(response, key) {
@@ -95,12 +89,21 @@ func TestVectorSearch(t *testing.T) {
 
 	// Test with incompatible dimensions
 	invalidQuery := []float64{1.0}
-	response = r.VectorSearch(invalidQuery, 2)
+	response = vectorKeys(r.VectorSearch(invalidQuery, 2))
 	if !strings.Contains(response, "vec1") {
 		t.Errorf("Expected fallback result with key vec4 for invalid query dimensions, got %s", response)
 	}
 }
 
+// vectorKeys joins the keys of search results so they can be checked with strings.Contains.
+func vectorKeys(matches []storage.VectorMatch) string {
+	keys := make([]string, len(matches))
+	for i, match := range matches {
+		keys[i] = match.Key
+	}
+	return strings.Join(keys, " ")
+}
+
 func TestCosineSimilarity(t *testing.T) {
 	a := []float64{1.0, 2.0, 3.0}
 	b := []float64{1.0, 2.0, 3.0}
@@ -22,25 +22,25 @@ func TestRedisCloneSortedSet(t *testing.T) {
 	r.ZAdd("myzset", 2.0, "two")
 	r.ZAdd("myzset", 3.0, "three")
 	expectedZRange := []string{"one", "two", "three"}
-	zrange := r.ZRange("myzset", 0, 2)
+	zrange, _ := r.ZRange("myzset", 0, 2)
 	if !reflect.DeepEqual(zrange, expectedZRange) {
 		t.Fatalf("ZRange failed, expected %v, got %v", expectedZRange, zrange)
 	}
 
 	// Test ZRANK
-	zrank := r.ZRank("myzset", "two")
+	zrank, _ := r.ZRank("myzset", "two")
 	expectedRank := 1
 	if zrank != expectedRank {
 		t.Fatalf("ZRank failed, expected %d, got %d", expectedRank, zrank)
 	}
 
 	// Test ZREM
-	removed := r.ZRem("myzset", "two")
+	removed, _ := r.ZRem("myzset", "two")
 	if !removed {
 		t.Fatalf("ZRem failed, expected %v, got %v", true, removed)
 	}
 	expectedZRangeAfterRem := []string{"one", "three"}
-	zrangeAfterRem := r.ZRange("myzset", 0, 2)
+	zrangeAfterRem, _ := r.ZRange("myzset", 0, 2)
 	if !reflect.DeepEqual(zrangeAfterRem, expectedZRangeAfterRem) {
 		t.Fatalf("ZRange after ZRem failed, expected %v, got %v", expectedZRangeAfterRem, zrangeAfterRem)
 	}
@@ -48,24 +48,64 @@ func TestRedisCloneSortedSet(t *testing.T) {
 	// Test ZRANGEBYSCORE
 	r.ZAdd("myzset", 2.5, "two-and-half")
 	expectedRangeByScore := []string{"one", "two-and-half", "three"}
-	zrangeByScore := r.ZRangeByScore("myzset", 1.0, 3.0)
+	zrangeByScore, _ := r.ZRangeByScore("myzset", 1.0, 3.0)
 	if !reflect.DeepEqual(zrangeByScore, expectedRangeByScore) {
 		t.Fatalf("ZRangeByScore failed, expected %v, got %v", expectedRangeByScore, zrangeByScore)
 	}
 
 	// Test Non-existent Key
-	zrangeNonExistent := r.ZRange("nonexistent", 0, 2)
+	zrangeNonExistent, _ := r.ZRange("nonexistent", 0, 2)
 	if zrangeNonExistent != nil {
 		t.Fatalf("ZRange on nonexistent key failed, expected nil, got %v", zrangeNonExistent)
 	}
 
-	zrankNonExistent := r.ZRank("nonexistent", "key")
+	zrankNonExistent, _ := r.ZRank("nonexistent", "key")
 	if zrankNonExistent != -1 {
 		t.Fatalf("ZRank on nonexistent key failed, expected -1, got %d", zrankNonExistent)
 	}
 
-	removedNonExistent := r.ZRem("nonexistent", "key")
+	removedNonExistent, _ := r.ZRem("nonexistent", "key")
 	if removedNonExistent {
 		t.Fatalf("ZRem on nonexistent key failed, expected false, got %v", removedNonExistent)
 	}
 }
+
+func TestZAddMovesRescoredMember(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, false)
+
+	r.ZAdd("zset", 1, "a")
+	r.ZAdd("zset", 2, "b")
+	r.ZAdd("zset", 3, "c")
+	r.ZAdd("zset", 4, "a")
+
+	expected := []string{"b", "c", "a"}
+	if members, _ := r.ZRange("zset", 0, 10); !reflect.DeepEqual(members, expected) {
+		t.Fatalf("Expected ZRange %v after re-scoring a, got %v", expected, members)
+	}
+	if removed, _ := r.ZRem("zset", "a"); !removed {
+		t.Fatalf("Expected ZRem to find the re-scored member")
+	}
+	if members, _ := r.ZRange("zset", 0, 10); !reflect.DeepEqual(members, []string{"b", "c"}) {
+		t.Fatalf("Expected ZRange [b c] after ZRem, got %v", members)
+	}
+}
+
+func TestZRankFollowsScores(t *testing.T) {
+	dir := t.TempDir()
+	r := storage.NewTealis(dir, dir, false)
+
+	// Members whose names sort in the opposite order to their scores
+	members := []string{"e", "d", "c", "b", "a"}
+	for i, member := range members {
+		r.ZAdd("zset", float64(i), member)
+	}
+	for i, member := range members {
+		if rank, _ := r.ZRank("zset", member); rank != i {
+			t.Errorf("Expected ZRank of %s to be %d, got %d", member, i, rank)
+		}
+	}
+	if rank, _ := r.ZRank("zset", "missing"); rank != -1 {
+		t.Errorf("Expected ZRank of a missing member to be -1, got %d", rank)
+	}
+}